@@ -0,0 +1,50 @@
+package client
+
+import (
+    "context"
+
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/metadata"
+)
+
+// APIKeyInterceptor 为服务账号附加 API key 的客户端拦截器，无需用户名和密码
+type APIKeyInterceptor struct {
+    apiKey string
+}
+
+// NewAPIKeyInterceptor 创建新的 API key 客户端拦截器
+func NewAPIKeyInterceptor(apiKey string) *APIKeyInterceptor {
+    return &APIKeyInterceptor{apiKey}
+}
+
+// Unary 一元客户端 API key 拦截器
+func (interceptor *APIKeyInterceptor) Unary() grpc.UnaryClientInterceptor {
+    return func(
+        ctx context.Context,
+        method string,
+        req, reply interface{},
+        cc *grpc.ClientConn,
+        invoker grpc.UnaryInvoker,
+        opts ...grpc.CallOption,
+    ) error {
+        return invoker(interceptor.attachAPIKey(ctx), method, req, reply, cc, opts...)
+    }
+}
+
+// Stream 流式客户端 API key 拦截器
+func (interceptor *APIKeyInterceptor) Stream() grpc.StreamClientInterceptor {
+    return func(
+        ctx context.Context,
+        desc *grpc.StreamDesc,
+        cc *grpc.ClientConn,
+        method string,
+        streamer grpc.Streamer,
+        opts ...grpc.CallOption,
+    ) (grpc.ClientStream, error) {
+        return streamer(interceptor.attachAPIKey(ctx), desc, cc, method, opts...)
+    }
+}
+
+func (interceptor *APIKeyInterceptor) attachAPIKey(ctx context.Context) context.Context {
+    return metadata.AppendToOutgoingContext(ctx, "x-api-key", interceptor.apiKey)
+}
@@ -2,6 +2,7 @@ package client
 
 import (
     "context"
+    "fmt"
     "time"
 
     "github.com/xiusl/pcbook/pb"
@@ -13,12 +14,19 @@ type AuthClient struct {
     server   pb.AuthServiceClient
     username string
     password string
+    // totpCode 账号开启两步验证时用于获取验证码
+    totpCode func() (string, error)
 }
 
 // NewAuthClient 创建一个新的授权客户端
 func NewAuthClient(cc *grpc.ClientConn, username, password string) *AuthClient {
+    return NewAuthClientWithTOTP(cc, username, password, nil)
+}
+
+// NewAuthClientWithTOTP 创建一个支持两步验证的授权客户端，totpCode 在需要验证码时调用
+func NewAuthClientWithTOTP(cc *grpc.ClientConn, username, password string, totpCode func() (string, error)) *AuthClient {
     server := pb.NewAuthServiceClient(cc)
-    return &AuthClient{server, username, password}
+    return &AuthClient{server, username, password, totpCode}
 }
 
 // Login 用户登录并返回令牌 Token
@@ -35,5 +43,25 @@ func (client *AuthClient) Login() (string, error) {
     if err != nil {
         return "", err
     }
+    if !res.GetMfaRequired() {
+        return res.GetAccessToken(), nil
+    }
+
+    if client.totpCode == nil {
+        return "", fmt.Errorf("two-factor authentication is required for %s", client.username)
+    }
+    code, err := client.totpCode()
+    if err != nil {
+        return "", fmt.Errorf("cannot get totp code: %w", err)
+    }
+
+    verifyReq := &pb.VerifyLoginRequest{
+        MfaChallenge: res.GetMfaChallenge(),
+        Factor:       &pb.VerifyLoginRequest_TotpCode{TotpCode: code},
+    }
+    res, err = client.server.VerifyLogin(ctx, verifyReq)
+    if err != nil {
+        return "", err
+    }
     return res.GetAccessToken(), nil
 }
@@ -2,39 +2,80 @@ package client
 
 import (
     "context"
-    "log"
+    "math/rand"
+    "sync"
     "time"
 
+    "github.com/dgrijalva/jwt-go"
+    "github.com/xiusl/pcbook/logging"
     "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
     "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
 )
 
-// AuthInterceptor 客户端授权拦截器
+const (
+    // defaultRefreshInterval 令牌中没有 exp 时的刷新间隔
+    defaultRefreshInterval = 30 * time.Second
+    // expiryMargin 令牌距离过期不足这个时间时，发起调用前先同步刷新
+    expiryMargin = 5 * time.Second
+    // refreshRetryDelay 后台刷新失败后的重试间隔
+    refreshRetryDelay = time.Second
+)
+
+// clientLog 客户端的日志
+var clientLog = logging.New("client")
+
+// AuthInterceptor 客户端授权拦截器，根据令牌的过期时间在后台刷新令牌
 type AuthInterceptor struct {
     authClient  *AuthClient
-    authMethods map[string]bool
+    authMethods func(method string) bool
+
+    mutex       sync.Mutex
     accessToken string
+    expiresAt   time.Time
+    // inflight 正在进行的刷新，并发的调用方共享同一次刷新的结果
+    inflight *refreshCall
+
+    cancel context.CancelFunc
+    done   chan struct{}
+}
+
+type refreshCall struct {
+    done  chan struct{}
+    token string
+    err   error
 }
 
-// NewAuthInterceptor 创建新的客户端授权拦截器
+// NewAuthInterceptor 登录并创建新的客户端授权拦截器，authMethods 判断方法是否需要附加令牌
+// ctx 取消或者调用 Close 后停止后台刷新
 func NewAuthInterceptor(
+    ctx context.Context,
     authClient *AuthClient,
-    authMethods map[string]bool,
-    refreshDuration time.Duration,
+    authMethods func(method string) bool,
 ) (*AuthInterceptor, error) {
     interceptor := &AuthInterceptor{
         authClient:  authClient,
         authMethods: authMethods,
+        done:        make(chan struct{}),
     }
 
-    err := interceptor.scheduleRefreshToken(refreshDuration)
-    if err != nil {
+    if _, err := interceptor.refreshToken(""); err != nil {
         return nil, err
     }
+
+    ctx, interceptor.cancel = context.WithCancel(ctx)
+    go interceptor.refreshLoop(ctx)
     return interceptor, nil
 }
 
-// Unary 一元客户端授权拦截器
+// Close 停止后台刷新，等待后台协程退出
+func (interceptor *AuthInterceptor) Close() {
+    interceptor.cancel()
+    <-interceptor.done
+}
+
+// Unary 一元客户端授权拦截器，令牌失效时刷新后重试一次
 func (interceptor *AuthInterceptor) Unary() grpc.UnaryClientInterceptor {
     return func(
         ctx context.Context,
@@ -44,16 +85,31 @@ func (interceptor *AuthInterceptor) Unary() grpc.UnaryClientInterceptor {
         invoker grpc.UnaryInvoker,
         opts ...grpc.CallOption,
     ) error {
-        log.Printf("---> unary interceptor: %v", method)
+        if !interceptor.authMethods(method) {
+            return invoker(ctx, method, req, reply, cc, opts...)
+        }
+
+        token, err := interceptor.token()
+        if err != nil {
+            return err
+        }
+
+        err = invoker(attachToken(ctx, token), method, req, reply, cc, opts...)
+        if status.Code(err) != codes.Unauthenticated {
+            return err
+        }
 
-        if interceptor.authMethods[method] {
-            return invoker(interceptor.attachToken(ctx), method, req, reply, cc, opts...)
+        token, refreshErr := interceptor.refreshToken(token)
+        if refreshErr != nil {
+            clientLog.Warn(ctx, "cannot refresh token", "method", method, "error", refreshErr)
+            return err
         }
-        return invoker(ctx, method, req, reply, cc, opts...)
+        return invoker(attachToken(ctx, token), method, req, reply, cc, opts...)
     }
 }
 
-// Stream 一元客户端授权拦截器
+// Stream 流式客户端授权拦截器
+// 已经发送的消息无法重放，所以流式调用不会重试，令牌失效时只刷新令牌供后续调用使用
 func (interceptor *AuthInterceptor) Stream() grpc.StreamClientInterceptor {
     return func(
         ctx context.Context,
@@ -63,46 +119,150 @@ func (interceptor *AuthInterceptor) Stream() grpc.StreamClientInterceptor {
         streamer grpc.Streamer,
         opts ...grpc.CallOption,
     ) (grpc.ClientStream, error) {
-        log.Printf("---> stream interceptor: %v", method)
-        if interceptor.authMethods[method] {
-            return streamer(interceptor.attachToken(ctx), desc, cc, method, opts...)
+        if !interceptor.authMethods(method) {
+            return streamer(ctx, desc, cc, method, opts...)
+        }
+
+        token, err := interceptor.token()
+        if err != nil {
+            return nil, err
+        }
+
+        stream, err := streamer(attachToken(ctx, token), desc, cc, method, opts...)
+        if err != nil {
+            interceptor.refreshIfUnauthenticated(token, err)
+            return nil, err
         }
-        return streamer(ctx, desc, cc, method, opts...)
+        return &authClientStream{stream, interceptor, token}, nil
     }
 }
 
-func (interceptor *AuthInterceptor) attachToken(ctx context.Context) context.Context {
-    return metadata.AppendToOutgoingContext(ctx, "authorization", interceptor.accessToken)
+// authClientStream 在流返回 Unauthenticated 时刷新令牌
+type authClientStream struct {
+    grpc.ClientStream
+    interceptor *AuthInterceptor
+    token       string
 }
 
-func (interceptor *AuthInterceptor) scheduleRefreshToken(duration time.Duration) error {
-    err := interceptor.refreshToken()
+func (stream *authClientStream) RecvMsg(m interface{}) error {
+    err := stream.ClientStream.RecvMsg(m)
     if err != nil {
-        return err
+        stream.interceptor.refreshIfUnauthenticated(stream.token, err)
+    }
+    return err
+}
+
+func attachToken(ctx context.Context, token string) context.Context {
+    return metadata.AppendToOutgoingContext(ctx, "authorization", token)
+}
+
+func (interceptor *AuthInterceptor) refreshIfUnauthenticated(token string, err error) {
+    if status.Code(err) != codes.Unauthenticated {
+        return
+    }
+    if _, err := interceptor.refreshToken(token); err != nil {
+        clientLog.Warn(context.Background(), "cannot refresh token", "error", err)
     }
-    // 开启后台协程，定时刷新 Token
-    go func() {
-        wait := duration
-        for {
-            time.Sleep(wait)
-            err := interceptor.refreshToken()
-            if err != nil {
-                wait = time.Second
-            } else {
-                wait = duration
-            }
+}
+
+// token 返回当前令牌，令牌即将过期时先同步刷新
+func (interceptor *AuthInterceptor) token() (string, error) {
+    interceptor.mutex.Lock()
+    token := interceptor.accessToken
+    expiring := !interceptor.expiresAt.IsZero() && time.Until(interceptor.expiresAt) < expiryMargin
+    interceptor.mutex.Unlock()
+
+    if !expiring {
+        return token, nil
+    }
+    return interceptor.refreshToken(token)
+}
+
+// refreshToken 重新登录替换 stale 令牌
+// 令牌已经被其他调用方替换时直接返回新令牌，并发的刷新只会登录一次
+func (interceptor *AuthInterceptor) refreshToken(stale string) (string, error) {
+    interceptor.mutex.Lock()
+    if interceptor.accessToken != stale {
+        token := interceptor.accessToken
+        interceptor.mutex.Unlock()
+        return token, nil
+    }
+    if call := interceptor.inflight; call != nil {
+        interceptor.mutex.Unlock()
+        <-call.done
+        return call.token, call.err
+    }
+    call := &refreshCall{done: make(chan struct{})}
+    interceptor.inflight = call
+    interceptor.mutex.Unlock()
+
+    call.token, call.err = interceptor.authClient.Login()
+
+    interceptor.mutex.Lock()
+    if call.err == nil {
+        interceptor.accessToken = call.token
+        interceptor.expiresAt = tokenExpiry(call.token)
+        clientLog.Debug(context.Background(), "access token refreshed", "expires_at", interceptor.expiresAt)
+    }
+    interceptor.inflight = nil
+    interceptor.mutex.Unlock()
+
+    close(call.done)
+    return call.token, call.err
+}
+
+// refreshLoop 在令牌过期之前刷新令牌，直到 ctx 取消
+func (interceptor *AuthInterceptor) refreshLoop(ctx context.Context) {
+    defer close(interceptor.done)
+
+    random := rand.New(rand.NewSource(time.Now().UnixNano()))
+    var wait time.Duration
+    failed := false
+    for {
+        interceptor.mutex.Lock()
+        token := interceptor.accessToken
+        expiresAt := interceptor.expiresAt
+        interceptor.mutex.Unlock()
+
+        if failed {
+            wait = refreshRetryDelay
+        } else {
+            wait = refreshDelay(time.Until(expiresAt), expiresAt.IsZero(), random)
+        }
+
+        timer := time.NewTimer(wait)
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return
+        case <-timer.C:
+        }
+
+        _, err := interceptor.refreshToken(token)
+        failed = err != nil
+        if failed {
+            clientLog.Warn(ctx, "cannot refresh token", "error", err)
         }
-    }()
+    }
+}
 
-    return nil
+// refreshDelay 在令牌剩余有效期的 70%~80% 时刷新，随机抖动避免大量客户端同时刷新
+func refreshDelay(remaining time.Duration, noExpiry bool, random *rand.Rand) time.Duration {
+    if noExpiry {
+        return defaultRefreshInterval
+    }
+    if remaining <= expiryMargin {
+        return refreshRetryDelay
+    }
+    jitter := time.Duration(random.Int63n(int64(remaining/10) + 1))
+    return remaining*7/10 + jitter
 }
 
-func (interceptor *AuthInterceptor) refreshToken() error {
-    accessToken, err := interceptor.authClient.Login()
-    if err != nil {
-        return err
+// tokenExpiry 读取令牌中的 exp，客户端没有密钥，不验证签名
+func tokenExpiry(token string) time.Time {
+    claims := &jwt.StandardClaims{}
+    if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil || claims.ExpiresAt == 0 {
+        return time.Time{}
     }
-    log.Printf("Token Refreshed: %v\n", accessToken)
-    interceptor.accessToken = accessToken
-    return nil
+    return time.Unix(claims.ExpiresAt, 0)
 }
@@ -10,9 +10,11 @@ import (
     "path/filepath"
     "time"
 
+    "github.com/google/uuid"
     "github.com/xiusl/pcbook/pb"
     "google.golang.org/grpc"
     "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/metadata"
     "google.golang.org/grpc/status"
 )
 
@@ -27,16 +29,31 @@ func NewLaptopClient(cc *grpc.ClientConn) *LaptopClient {
     return &LaptopClient{server}
 }
 
+const (
+    // createLaptopAttempts 创建便携电脑超时或者服务暂时不可用时最多尝试的次数
+    createLaptopAttempts = 3
+    // createLaptopBackoff 每次重试之前多等待的时间
+    createLaptopBackoff = 500 * time.Millisecond
+)
+
 // CreateLaptop 创建一个便携电脑
+// 每次重试使用同一个幂等键，第一次请求已经保存时服务端返回第一次的结果，不会创建重复的便携电脑
 func (clien *LaptopClient) CreateLaptop(laptop *pb.Laptop) {
     req := &pb.CreateLaptopRequest{
         Laptop: laptop,
     }
+    idempotencyKey := uuid.New().String()
 
-    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-    defer cancel()
-
-    res, err := clien.server.CreateLaptop(ctx, req)
+    var res *pb.CreateLaptopResponse
+    var err error
+    for attempt := 1; attempt <= createLaptopAttempts; attempt++ {
+        res, err = clien.createLaptop(req, idempotencyKey)
+        if !retryable(err) || attempt == createLaptopAttempts {
+            break
+        }
+        log.Printf("create laptop attempt %d failed, retrying: %v", attempt, err)
+        time.Sleep(time.Duration(attempt) * createLaptopBackoff)
+    }
     if err != nil {
         st, ok := status.FromError(err)
         if ok && st.Code() == codes.AlreadyExists {
@@ -50,6 +67,42 @@ func (clien *LaptopClient) CreateLaptop(laptop *pb.Laptop) {
     log.Printf("created laptop success, id: %v", res.Id)
 }
 
+func (clien *LaptopClient) createLaptop(req *pb.CreateLaptopRequest, idempotencyKey string) (*pb.CreateLaptopResponse, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    ctx = metadata.AppendToOutgoingContext(ctx, "idempotency-key", idempotencyKey)
+    return clien.server.CreateLaptop(ctx, req)
+}
+
+// retryable 判断请求是否可以用同一个幂等键重试，Aborted 表示第一次请求还在处理中
+func retryable(err error) bool {
+    switch status.Code(err) {
+    case codes.DeadlineExceeded, codes.Unavailable, codes.Aborted:
+        return true
+    default:
+        return false
+    }
+}
+
+// UpdateLaptop 更新一个便携电脑
+func (client *LaptopClient) UpdateLaptop(laptop *pb.Laptop) error {
+    req := &pb.UpdateLaptopRequest{
+        Laptop: laptop,
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    res, err := client.server.UpdateLaptop(ctx, req)
+    if err != nil {
+        return fmt.Errorf("cannot update laptop: %w", err)
+    }
+
+    log.Printf("updated laptop success, id: %v", res.Id)
+    return nil
+}
+
 // SearchLaptop 搜索指定的便携电脑
 func (client *LaptopClient) SearchLaptop(filter *pb.Filter) {
     log.Printf("search filter: %v", filter)
@@ -86,6 +139,119 @@ func (client *LaptopClient) SearchLaptop(filter *pb.Filter) {
     }
 }
 
+// watchRetryDelay 订阅断开后重新连接之前等待的时间
+const watchRetryDelay = time.Second
+
+// WatchLaptops 从 startRevision 开始订阅便携电脑的变更事件，直到 ctx 结束或者 handle 返回错误
+// 连接断开或者服务端退出时从最后收到的版本号继续订阅；返回 OutOfRange 错误时事件已经被清理，
+// 需要重新搜索便携电脑后传入 0 从最新的事件开始订阅
+func (client *LaptopClient) WatchLaptops(ctx context.Context, filter *pb.Filter, startRevision uint64, handle func(event *pb.LaptopEvent) error) error {
+    next := startRevision
+    for {
+        err := client.watchLaptops(ctx, filter, next, func(event *pb.LaptopEvent) error {
+            next = event.GetRevision() + 1
+            return handle(event)
+        })
+        if status.Code(err) != codes.Unavailable {
+            return err
+        }
+        log.Printf("watch is interrupted, resuming from revision %d: %v", next, err)
+
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(watchRetryDelay):
+        }
+    }
+}
+
+func (client *LaptopClient) watchLaptops(ctx context.Context, filter *pb.Filter, startRevision uint64, handle func(event *pb.LaptopEvent) error) error {
+    req := &pb.WatchLaptopsRequest{
+        Filter:        filter,
+        StartRevision: startRevision,
+    }
+    stream, err := client.server.WatchLaptops(ctx, req)
+    if err != nil {
+        return err
+    }
+
+    for {
+        res, err := stream.Recv()
+        if err != nil {
+            return err
+        }
+        if err := handle(res.GetEvent()); err != nil {
+            return err
+        }
+    }
+}
+
+// importBatchSize 导入时每条消息包含的便携电脑数，不能超过服务端的上限
+const importBatchSize = 100
+
+// ImportLaptops 分批导入便携电脑，返回每个便携电脑的结果和汇总，dryRun 为 true 时只检查不保存
+// 整个导入只有一个请求，调用方通过 ctx 控制总的超时时间
+func (client *LaptopClient) ImportLaptops(ctx context.Context, laptops []*pb.Laptop, dryRun bool) (*pb.ImportLaptopsResponse, error) {
+    stream, err := client.server.ImportLaptops(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("cannot import laptops: %w", err)
+    }
+
+    req := &pb.ImportLaptopsRequest{
+        Data: &pb.ImportLaptopsRequest_Options{Options: &pb.ImportOptions{DryRun: dryRun}},
+    }
+    if err := stream.Send(req); err != nil {
+        return nil, fmt.Errorf("cannot send import options: %v - %v", err, stream.RecvMsg(nil))
+    }
+
+    for start := 0; start < len(laptops); start += importBatchSize {
+        end := start + importBatchSize
+        if end > len(laptops) {
+            end = len(laptops)
+        }
+        req := &pb.ImportLaptopsRequest{
+            Data: &pb.ImportLaptopsRequest_Batch{Batch: &pb.LaptopBatch{Laptops: laptops[start:end]}},
+        }
+        if err := stream.Send(req); err != nil {
+            return nil, fmt.Errorf("cannot send laptop batch: %v - %v", err, stream.RecvMsg(nil))
+        }
+    }
+
+    res, err := stream.CloseAndRecv()
+    if err != nil {
+        return nil, fmt.Errorf("cannot receive import response: %w", err)
+    }
+
+    summary := res.GetSummary()
+    log.Printf("imported %d laptops (dry run: %v): %d created, %d duplicate, %d invalid",
+        summary.GetTotal(), res.GetDryRun(), summary.GetCreated(), summary.GetDuplicate(), summary.GetInvalid())
+    return res, nil
+}
+
+// ExportLaptops 导出符合条件的便携电脑以及它们的评分和图片信息，filter 为空时导出所有的便携电脑
+func (client *LaptopClient) ExportLaptops(ctx context.Context, filter *pb.Filter, handle func(res *pb.ExportLaptopsResponse) error) error {
+    req := &pb.ExportLaptopsRequest{
+        Filter: filter,
+    }
+    stream, err := client.server.ExportLaptops(ctx, req)
+    if err != nil {
+        return fmt.Errorf("cannot export laptops: %w", err)
+    }
+
+    for {
+        res, err := stream.Recv()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return fmt.Errorf("cannot receive exported laptop: %w", err)
+        }
+        if err := handle(res); err != nil {
+            return err
+        }
+    }
+}
+
 // UploadImage 为指定的便携电脑上传图片
 func (clien *LaptopClient) UploadImage(laptopID, imagePath string) {
     // 打开文件
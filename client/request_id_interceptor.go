@@ -0,0 +1,59 @@
+package client
+
+import (
+    "context"
+
+    "github.com/xiusl/pcbook/logging"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/metadata"
+)
+
+// RequestIDInterceptor 客户端请求 ID 拦截器，为每个调用附加 x-request-id 元数据，服务端的日志会带上同一个 ID
+// 上下文中已经有请求 ID 时沿用，否则为每个调用生成新的 ID
+type RequestIDInterceptor struct{}
+
+// NewRequestIDInterceptor 新建一个客户端请求 ID 拦截器
+func NewRequestIDInterceptor() *RequestIDInterceptor {
+    return &RequestIDInterceptor{}
+}
+
+// Unary 一元客户端请求 ID 拦截器
+func (interceptor *RequestIDInterceptor) Unary() grpc.UnaryClientInterceptor {
+    return func(
+        ctx context.Context,
+        method string,
+        req, reply interface{},
+        cc *grpc.ClientConn,
+        invoker grpc.UnaryInvoker,
+        opts ...grpc.CallOption,
+    ) error {
+        return invoker(attachRequestID(ctx), method, req, reply, cc, opts...)
+    }
+}
+
+// Stream 流式客户端请求 ID 拦截器
+func (interceptor *RequestIDInterceptor) Stream() grpc.StreamClientInterceptor {
+    return func(
+        ctx context.Context,
+        desc *grpc.StreamDesc,
+        cc *grpc.ClientConn,
+        method string,
+        streamer grpc.Streamer,
+        opts ...grpc.CallOption,
+    ) (grpc.ClientStream, error) {
+        return streamer(attachRequestID(ctx), desc, cc, method, opts...)
+    }
+}
+
+func attachRequestID(ctx context.Context) context.Context {
+    if md, ok := metadata.FromOutgoingContext(ctx); ok && len(md.Get(logging.RequestIDKey)) > 0 {
+        return ctx
+    }
+
+    id := logging.RequestIDFromContext(ctx)
+    if id == "" {
+        id = logging.NewRequestID()
+        ctx = logging.ContextWithRequestID(ctx, id)
+    }
+    return metadata.AppendToOutgoingContext(ctx, logging.RequestIDKey, id)
+}
@@ -0,0 +1,161 @@
+package client
+
+import (
+    "context"
+    "io"
+    "strings"
+
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/attribute"
+    otelcodes "go.opentelemetry.io/otel/codes"
+    "go.opentelemetry.io/otel/propagation"
+    "go.opentelemetry.io/otel/trace"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+)
+
+// tracerName 客户端创建 span 使用的 tracer 名称
+const tracerName = "github.com/xiusl/pcbook/client"
+
+// TracingInterceptor 客户端链路追踪拦截器，为每个调用创建客户端 span，并通过 traceparent 元数据传递给服务端
+type TracingInterceptor struct {
+    propagator propagation.TextMapPropagator
+}
+
+// NewTracingInterceptor 新建一个客户端链路追踪拦截器，需要放在其他拦截器之前
+func NewTracingInterceptor() *TracingInterceptor {
+    return &TracingInterceptor{propagation.TraceContext{}}
+}
+
+// Unary 一元客户端链路追踪拦截器
+func (interceptor *TracingInterceptor) Unary() grpc.UnaryClientInterceptor {
+    return func(
+        ctx context.Context,
+        method string,
+        req, reply interface{},
+        cc *grpc.ClientConn,
+        invoker grpc.UnaryInvoker,
+        opts ...grpc.CallOption,
+    ) error {
+        ctx, span := interceptor.startSpan(ctx, method)
+        err := invoker(ctx, method, req, reply, cc, opts...)
+        endSpan(span, err)
+        return err
+    }
+}
+
+// Stream 流式客户端链路追踪拦截器，span 在流结束时结束
+func (interceptor *TracingInterceptor) Stream() grpc.StreamClientInterceptor {
+    return func(
+        ctx context.Context,
+        desc *grpc.StreamDesc,
+        cc *grpc.ClientConn,
+        method string,
+        streamer grpc.Streamer,
+        opts ...grpc.CallOption,
+    ) (grpc.ClientStream, error) {
+        ctx, span := interceptor.startSpan(ctx, method)
+        stream, err := streamer(ctx, desc, cc, method, opts...)
+        if err != nil {
+            endSpan(span, err)
+            return nil, err
+        }
+        return &tracingClientStream{ClientStream: stream, desc: desc, span: span}, nil
+    }
+}
+
+func (interceptor *TracingInterceptor) startSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+    service, name := "unknown", strings.TrimPrefix(method, "/")
+    if i := strings.LastIndex(name, "/"); i >= 0 {
+        service, name = name[:i], name[i+1:]
+    }
+
+    ctx, span := otel.Tracer(tracerName).Start(
+        ctx,
+        method,
+        trace.WithSpanKind(trace.SpanKindClient),
+        trace.WithAttributes(
+            attribute.String("rpc.system", "grpc"),
+            attribute.String("rpc.service", service),
+            attribute.String("rpc.method", name),
+        ),
+    )
+
+    md, ok := metadata.FromOutgoingContext(ctx)
+    if ok {
+        md = md.Copy()
+    } else {
+        md = metadata.MD{}
+    }
+    interceptor.propagator.Inject(ctx, metadataCarrier(md))
+    return metadata.NewOutgoingContext(ctx, md), span
+}
+
+func endSpan(span trace.Span, err error) {
+    span.SetAttributes(attribute.String("rpc.grpc.status_code", status.Code(err).String()))
+    if err != nil {
+        span.SetStatus(otelcodes.Error, status.Convert(err).Message())
+    }
+    span.End()
+}
+
+// tracingClientStream 在流结束或者出错时结束 span
+type tracingClientStream struct {
+    grpc.ClientStream
+    desc *grpc.StreamDesc
+    span trace.Span
+    done bool
+}
+
+func (stream *tracingClientStream) SendMsg(m interface{}) error {
+    err := stream.ClientStream.SendMsg(m)
+    if err != nil && err != io.EOF {
+        stream.finish(err)
+    }
+    return err
+}
+
+func (stream *tracingClientStream) RecvMsg(m interface{}) error {
+    err := stream.ClientStream.RecvMsg(m)
+    if err == io.EOF {
+        stream.finish(nil)
+    } else if err != nil {
+        stream.finish(err)
+    } else if !stream.desc.ServerStreams {
+        // 客户端流只有一个响应，收到后流就结束了
+        stream.finish(nil)
+    }
+    return err
+}
+
+func (stream *tracingClientStream) finish(err error) {
+    if stream.done {
+        return
+    }
+    stream.done = true
+    endSpan(stream.span, err)
+}
+
+// metadataCarrier 让 gRPC 元数据可以写入 trace context
+type metadataCarrier metadata.MD
+
+func (carrier metadataCarrier) Get(key string) string {
+    values := metadata.MD(carrier).Get(key)
+    if len(values) == 0 {
+        return ""
+    }
+    return values[0]
+}
+
+func (carrier metadataCarrier) Set(key string, value string) {
+    metadata.MD(carrier).Set(key, value)
+}
+
+func (carrier metadataCarrier) Keys() []string {
+    keys := make([]string, 0, len(carrier))
+    for key := range carrier {
+        keys = append(keys, key)
+    }
+    return keys
+}
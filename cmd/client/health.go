@@ -0,0 +1,54 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "log"
+    "time"
+
+    "google.golang.org/grpc"
+    healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// runHealthCheck 执行 health 子命令，服务不是 SERVING 时返回非零的退出码
+func runHealthCheck(args []string) int {
+    flags := flag.NewFlagSet("health", flag.ExitOnError)
+    addr := flags.String("addr", "", "the server address")
+    enableTLS := flags.Bool("tls", false, "enable SSL/TLS")
+    serviceName := flags.String("service", "", "service to check, for example xiusl.pcbook.LaptopServices (empty checks the whole server)")
+    timeout := flags.Duration("timeout", 5*time.Second, "timeout of the health check")
+    flags.Parse(args)
+
+    transportOption := grpc.WithInsecure()
+    if *enableTLS {
+        tlsCredentials, err := loadTLSCredentials()
+        if err != nil {
+            log.Printf("cannot load  TLS credentials: %v", err)
+            return 2
+        }
+        transportOption = grpc.WithTransportCredentials(tlsCredentials)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+    defer cancel()
+
+    conn, err := grpc.DialContext(ctx, *addr, transportOption, grpc.WithBlock())
+    if err != nil {
+        log.Printf("cannot dial server: %v", err)
+        return 1
+    }
+    defer conn.Close()
+
+    res, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: *serviceName})
+    if err != nil {
+        log.Printf("health check failed: %v", err)
+        return 1
+    }
+
+    fmt.Println(res.GetStatus())
+    if res.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+        return 1
+    }
+    return 0
+}
@@ -1,18 +1,21 @@
 package main
 
 import (
+    "context"
     "crypto/tls"
     "crypto/x509"
     "flag"
     "fmt"
     "io/ioutil"
     "log"
+    "os"
     "strings"
-    "time"
 
     "github.com/xiusl/pcbook/client"
+    "github.com/xiusl/pcbook/logging"
     "github.com/xiusl/pcbook/pb"
     "github.com/xiusl/pcbook/sample"
+    "github.com/xiusl/pcbook/service"
     "google.golang.org/grpc"
     "google.golang.org/grpc/credentials"
 )
@@ -75,18 +78,15 @@ func testRatingLaptop(laptopClient *client.LaptopClient) {
 }
 
 const (
-    username        = "admin"
-    password        = "abc"
-    refreshDuration = 30 * time.Second
+    username = "admin"
+    password = "Book-Keeper-42"
 )
 
-func authMethods() map[string]bool {
-    const latopServicePath = "/xiusl.pcbook.LaptopServices/"
-    return map[string]bool{
-        latopServicePath + "CreateLaptop": true,
-        latopServicePath + "UploadImage":  true,
-        latopServicePath + "RateLaptop":   true,
-    }
+func promptTOTPCode() (string, error) {
+    fmt.Println("totp code:")
+    var code string
+    _, err := fmt.Scan(&code)
+    return code, err
 }
 
 func loadTLSCredentials() (credentials.TransportCredentials, error) {
@@ -112,11 +112,39 @@ func loadTLSCredentials() (credentials.TransportCredentials, error) {
 }
 
 func main() {
+    if len(os.Args) > 1 && os.Args[1] == "health" {
+        os.Exit(runHealthCheck(os.Args[2:]))
+    }
+
     addr := flag.String("addr", "", "the server address")
     enableTLS := flag.Bool("tls", false, "enable SSL/TLS")
+    policyFile := flag.String("policy", "config/policy.yaml", "access policy file (yaml/json)")
+    certAuth := flag.Bool("cert-auth", false, "authenticate with the TLS client certificate instead of login")
+    apiKey := flag.String("api-key", "", "authenticate with a service account api key instead of login")
+    totp := flag.Bool("totp", false, "prompt for a totp code when two-factor authentication is enabled")
+    traceFile := flag.String("trace-file", "", "write client spans to this file (JSON lines)")
+    logLevel := flag.String("log-level", "info", "log level (debug/info/warn/error)")
+    logFormat := flag.String("log-format", "text", "log format (text/json)")
     flag.Parse()
+
+    if err := logging.Configure(os.Stderr, logging.Config{Level: *logLevel, Format: *logFormat}); err != nil {
+        log.Fatalf("cannot set up logging: %v", err)
+    }
+    log.SetFlags(0)
+    log.SetOutput(logging.New("client").Writer(logging.LevelInfo))
+
+    shutdownTracing, err := setupTracing(*traceFile)
+    if err != nil {
+        log.Fatalf("cannot set up tracing: %v", err)
+    }
+    defer shutdownTracing()
     log.Printf("dial server: %s", *addr)
 
+    policy, err := service.LoadAccessPolicy(*policyFile)
+    if err != nil {
+        log.Fatalf("cannot load access policy: %v", err)
+    }
+
     transportOption := grpc.WithInsecure()
     if *enableTLS {
         tlsCredentials, err := loadTLSCredentials()
@@ -126,28 +154,66 @@ func main() {
         transportOption = grpc.WithTransportCredentials(tlsCredentials)
     }
 
-    conn, err := grpc.Dial(*addr, transportOption)
-    if err != nil {
-        log.Fatalf("cannot dial server: %v", err)
-    }
-
-    authClient := client.NewAuthClient(conn, username, password)
-    interceptor, err := client.NewAuthInterceptor(authClient, authMethods(), refreshDuration)
-    if err != nil {
-        log.Fatalf("cannot create auth interceptor: %v", err)
-    }
-
-    conn1, err := grpc.Dial(
+    // 链路追踪拦截器在最外层，同一个调用的重试属于同一个客户端 span，并且使用同一个请求 ID
+    tracing := client.NewTracingInterceptor()
+    requestID := client.NewRequestIDInterceptor()
+    conn, err := grpc.Dial(
         *addr,
         transportOption,
-        grpc.WithUnaryInterceptor(interceptor.Unary()),
-        grpc.WithStreamInterceptor(interceptor.Stream()),
+        grpc.WithChainUnaryInterceptor(tracing.Unary(), requestID.Unary()),
+        grpc.WithChainStreamInterceptor(tracing.Stream(), requestID.Stream()),
     )
     if err != nil {
-        log.Fatalf("cannot dial server2: %v", err)
+        log.Fatalf("cannot dial server: %v", err)
     }
 
-    laptopClient := client.NewLaptopClient(conn1)
+    var laptopClient *client.LaptopClient
+    if *certAuth {
+        // 服务端根据客户端证书识别身份，无需登录
+        if !*enableTLS {
+            log.Fatal("cert auth requires TLS")
+        }
+        laptopClient = client.NewLaptopClient(conn)
+    } else if *apiKey != "" {
+        // 服务账号使用 API key，无需用户名和密码
+        interceptor := client.NewAPIKeyInterceptor(*apiKey)
+        conn1, err := grpc.Dial(
+            *addr,
+            transportOption,
+            grpc.WithChainUnaryInterceptor(tracing.Unary(), requestID.Unary(), interceptor.Unary()),
+            grpc.WithChainStreamInterceptor(tracing.Stream(), requestID.Stream(), interceptor.Stream()),
+        )
+        if err != nil {
+            log.Fatalf("cannot dial server2: %v", err)
+        }
+        laptopClient = client.NewLaptopClient(conn1)
+    } else {
+        var totpCode func() (string, error)
+        if *totp {
+            totpCode = promptTOTPCode
+        }
+        authClient := client.NewAuthClientWithTOTP(conn, username, password, totpCode)
+        authMethods := func(method string) bool {
+            return !policy.IsPublic(method)
+        }
+        interceptor, err := client.NewAuthInterceptor(context.Background(), authClient, authMethods)
+        if err != nil {
+            log.Fatalf("cannot create auth interceptor: %v", err)
+        }
+        defer interceptor.Close()
+
+        conn1, err := grpc.Dial(
+            *addr,
+            transportOption,
+            grpc.WithChainUnaryInterceptor(tracing.Unary(), requestID.Unary(), interceptor.Unary()),
+            grpc.WithChainStreamInterceptor(tracing.Stream(), requestID.Stream(), interceptor.Stream()),
+        )
+        if err != nil {
+            log.Fatalf("cannot dial server2: %v", err)
+        }
+
+        laptopClient = client.NewLaptopClient(conn1)
+    }
 
     testRatingLaptop(laptopClient)
 }
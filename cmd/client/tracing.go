@@ -0,0 +1,37 @@
+package main
+
+import (
+    "context"
+    "log"
+
+    "github.com/xiusl/pcbook/service"
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/sdk/resource"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// setupTracing 把客户端 span 写入 filename，返回退出时写出剩余 span 的函数
+// filename 为空时不记录 span，也不会向服务端传递 traceparent
+func setupTracing(filename string) (func(), error) {
+    if filename == "" {
+        return func() {}, nil
+    }
+
+    exporter, err := service.NewFileSpanExporter(filename)
+    if err != nil {
+        return nil, err
+    }
+
+    provider := sdktrace.NewTracerProvider(
+        sdktrace.WithSyncer(exporter),
+        sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "pcbook-client"))),
+    )
+    otel.SetTracerProvider(provider)
+
+    return func() {
+        if err := provider.Shutdown(context.Background()); err != nil {
+            log.Printf("cannot flush traces: %v", err)
+        }
+    }, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+    "context"
+    "net"
+    "net/http"
+
+    "github.com/xiusl/pcbook/service"
+)
+
+// startAdminServer 在单独的端口上提供 /metrics，不经过认证，只应该监听内网地址
+func startAdminServer(address string) (*http.Server, error) {
+    listener, err := net.Listen("tcp", address)
+    if err != nil {
+        return nil, err
+    }
+
+    mux := http.NewServeMux()
+    mux.Handle("/metrics", service.MetricsHandler())
+    server := &http.Server{Handler: mux}
+
+    go func() {
+        serverLog.Info(context.Background(), "start admin server", "address", listener.Addr().String())
+        if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+            serverLog.Error(context.Background(), "admin server stopped", "error", err)
+        }
+    }()
+    return server, nil
+}
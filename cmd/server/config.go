@@ -0,0 +1,533 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "reflect"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/xiusl/pcbook/logging"
+    "github.com/xiusl/pcbook/service"
+    "gopkg.in/yaml.v3"
+)
+
+// envPrefix 环境变量前缀，例如 server.port 对应 PCBOOK_SERVER_PORT
+const envPrefix = "PCBOOK_"
+
+// redacted 打印配置时替换密钥的占位符
+const redacted = "REDACTED"
+
+// Config 服务端配置
+// 优先级从低到高：默认值、配置文件、PCBOOK_* 环境变量、命令行参数
+type Config struct {
+    Server      ServerConfig              `yaml:"server"`
+    TLS         TLSConfig                 `yaml:"tls"`
+    Auth        AuthConfig                `yaml:"auth"`
+    Stores      StoresConfig              `yaml:"stores"`
+    Limits      LimitsConfig              `yaml:"limits"`
+    Audit       AuditConfig               `yaml:"audit"`
+    Logging     LoggingConfig             `yaml:"logging"`
+    Admin       AdminConfig               `yaml:"admin"`
+    Tracing     TracingConfig             `yaml:"tracing"`
+    Idempotency service.IdempotencyConfig `yaml:"idempotency"`
+    Alerts      service.AlertConfig       `yaml:"alerts"`
+    Webhooks    service.WebhookConfig     `yaml:"webhooks"`
+}
+
+// ServerConfig 监听地址和服务类型
+type ServerConfig struct {
+    // Type grpc、rest 或者 combined，combined 在同一个端口上同时提供 gRPC 和 REST 服务
+    Type string `yaml:"type"`
+    Host string `yaml:"host"`
+    Port int    `yaml:"port"`
+    // Endpoint REST 网关转发请求的 gRPC 服务地址
+    Endpoint string `yaml:"endpoint"`
+    // ShutdownTimeout 收到退出信号后等待进行中的请求完成的最长时间，超时后强制关闭连接
+    ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+    // HealthCheckInterval 执行健康检查的间隔
+    HealthCheckInterval time.Duration `yaml:"health_check_interval"`
+}
+
+// TLSConfig 证书配置，gRPC 服务端会验证客户端证书
+type TLSConfig struct {
+    Enabled      bool   `yaml:"enabled"`
+    CertFile     string `yaml:"cert_file"`
+    KeyFile      string `yaml:"key_file"`
+    ClientCAFile string `yaml:"client_ca_file"`
+}
+
+// AuthConfig 认证和授权配置
+type AuthConfig struct {
+    // SecretKey 签发访问令牌的密钥
+    SecretKey            string                 `yaml:"secret_key"`
+    TokenDuration        time.Duration          `yaml:"token_duration"`
+    PolicyFile           string                 `yaml:"policy_file"`
+    PolicyReloadInterval time.Duration          `yaml:"policy_reload_interval"`
+    CertIdentitiesFile   string                 `yaml:"cert_identities_file"`
+    OIDCConfigFile       string                 `yaml:"oidc_config_file"`
+    PasswordPolicy       service.PasswordPolicy `yaml:"password_policy"`
+    // PasswordHashing 新密码的哈希参数和同时进行的哈希计算数量
+    PasswordHashing service.PasswordHashConfig `yaml:"password_hashing"`
+    SeedUsers       []SeedUser                 `yaml:"seed_users"`
+}
+
+// SeedUser 启动时创建的用户
+type SeedUser struct {
+    Username string `yaml:"username"`
+    Password string `yaml:"password"`
+    Role     string `yaml:"role"`
+    Vendor   string `yaml:"vendor,omitempty"`
+}
+
+// StoresConfig 数据存储配置
+type StoresConfig struct {
+    ImageDir string `yaml:"image_dir"`
+    // EventHistory 在内存中保留的便携电脑变更事件数，订阅方断开后只能从保留的事件继续接收
+    EventHistory int `yaml:"event_history"`
+}
+
+// LimitsConfig 请求限制
+type LimitsConfig struct {
+    // MaxImageSize 上传图片的大小上限，单位为字节
+    MaxImageSize int                        `yaml:"max_image_size"`
+    Login        service.LoginLimiterConfig `yaml:"login"`
+    // Rate 按调用方和方法限制请求频率和并发流数量
+    Rate service.RateLimitConfig `yaml:"rate"`
+}
+
+// AuditConfig 审计日志配置
+type AuditConfig struct {
+    File       string `yaml:"file"`
+    MaxSizeMB  int64  `yaml:"max_size_mb"`
+    MaxBackups int    `yaml:"max_backups"`
+}
+
+// LoggingConfig 日志配置
+type LoggingConfig struct {
+    // Output stderr、stdout 或者日志文件路径
+    Output string `yaml:"output"`
+    // Level 默认的级别，debug、info、warn 或者 error
+    Level string `yaml:"level"`
+    // Format json 或者 text
+    Format string `yaml:"format"`
+    // Components 单独设置级别的组件，例如 laptop: debug
+    Components map[string]string `yaml:"components"`
+}
+
+// AdminConfig 管理端口配置
+type AdminConfig struct {
+    // Address 提供 /metrics 的监听地址，为空时不启动
+    Address string `yaml:"address"`
+}
+
+// TracingConfig 链路追踪配置
+type TracingConfig struct {
+    // File 以 JSON 行格式写入 span 的文件，为空时不记录
+    File string `yaml:"file"`
+    // SampleRatio 没有上游 trace 的请求被采样的比例，上游已经采样的请求总是采样
+    SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// DefaultConfig 默认配置，访问令牌的密钥没有默认值，必须配置
+func DefaultConfig() *Config {
+    return &Config{
+        Server: ServerConfig{
+            Type:                "grpc",
+            Host:                "0.0.0.0",
+            Port:                8080,
+            ShutdownTimeout:     30 * time.Second,
+            HealthCheckInterval: 10 * time.Second,
+        },
+        TLS: TLSConfig{
+            CertFile:     "cert/server-cert.pem",
+            KeyFile:      "cert/server-key.pem",
+            ClientCAFile: "cert/ca-cert.pem",
+        },
+        Auth: AuthConfig{
+            TokenDuration:        10 * time.Minute,
+            PolicyFile:           "config/policy.yaml",
+            PolicyReloadInterval: 5 * time.Second,
+            PasswordPolicy:       service.DefaultPasswordPolicy(),
+            PasswordHashing:      service.DefaultPasswordHashConfig(),
+        },
+        Stores: StoresConfig{
+            ImageDir:     "img",
+            EventHistory: service.DefaultEventHistory,
+        },
+        Limits: LimitsConfig{
+            MaxImageSize: service.DefaultMaxImageSize,
+            Login:        service.DefaultLoginLimiterConfig(),
+            Rate:         service.DefaultRateLimitConfig(),
+        },
+        Audit: AuditConfig{
+            File:       "audit.jsonl",
+            MaxSizeMB:  100,
+            MaxBackups: 10,
+        },
+        Logging: LoggingConfig{
+            Output: "stderr",
+            Level:  "info",
+            Format: "text",
+        },
+        Tracing: TracingConfig{
+            SampleRatio: 1,
+        },
+        Idempotency: service.DefaultIdempotencyConfig(),
+        Alerts:      service.DefaultAlertConfig(),
+        Webhooks:    service.DefaultWebhookConfig(),
+    }
+}
+
+// configFlags 命令行参数与配置项的对应关系
+var configFlags = []struct {
+    name  string
+    path  string
+    usage string
+}{
+    {"type", "server.type", "type of server (grpc/rest/combined)"},
+    {"port", "server.port", "server port"},
+    {"endpoint", "server.endpoint", "gRPC endpoint"},
+    {"shutdown-timeout", "server.shutdown_timeout", "time to wait for in-flight requests before forcing the server to stop"},
+    {"tls", "tls.enabled", "enable SSL/TLS"},
+    {"policy", "auth.policy_file", "access policy file (yaml/json)"},
+    {"cert-identities", "auth.cert_identities_file", "client certificate identity mapping file (requires TLS)"},
+    {"oidc-config", "auth.oidc_config_file", "OIDC provider config file for accepting SSO tokens"},
+    {"password-min-length", "auth.password_policy.min_length", "minimum password length"},
+    {"password-min-classes", "auth.password_policy.min_character_classes", "minimum number of character classes (lower, upper, digit, symbol) in a password"},
+    {"audit-log", "audit.file", "audit log file (JSON lines)"},
+    {"audit-max-size", "audit.max_size_mb", "rotate the audit log after it reaches this size in megabytes"},
+    {"audit-max-backups", "audit.max_backups", "number of rotated audit log files to keep, 0 keeps all"},
+    {"log-level", "logging.level", "default log level (debug/info/warn/error)"},
+    {"log-format", "logging.format", "log format (text/json)"},
+    {"admin-addr", "admin.address", "address of the admin listener serving /metrics, empty disables it"},
+    {"trace-file", "tracing.file", "write finished spans to this file (JSON lines), empty disables tracing"},
+    {"trace-sample-ratio", "tracing.sample_ratio", "fraction of new traces to sample, between 0 and 1"},
+}
+
+// LoadConfig 解析命令行参数并加载配置，返回配置和是否需要打印配置后退出
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (*Config, bool, error) {
+    flags := flag.NewFlagSet("server", flag.ContinueOnError)
+    configFile := flags.String("config", "", "config file (yaml), can also be set with "+envPrefix+"CONFIG")
+    printConfig := flags.Bool("print-config", false, "print the effective config with secrets redacted and exit")
+
+    values := make(map[string]*string)
+    for _, f := range configFlags {
+        value := new(string)
+        values[f.name] = value
+        if isBoolPath(f.path) {
+            flags.Var(boolFlag{value}, f.name, f.usage+" (overrides "+f.path+")")
+        } else {
+            flags.StringVar(value, f.name, "", f.usage+" (overrides "+f.path+")")
+        }
+    }
+    if err := flags.Parse(args); err != nil {
+        return nil, false, err
+    }
+    if flags.NArg() > 0 {
+        return nil, false, fmt.Errorf("unexpected arguments: %v", flags.Args())
+    }
+
+    config := DefaultConfig()
+
+    filename := *configFile
+    if filename == "" {
+        filename, _ = lookupEnv(envPrefix + "CONFIG")
+    }
+    if filename != "" {
+        if err := config.loadFile(filename); err != nil {
+            return nil, false, err
+        }
+    }
+
+    if err := config.applyEnv(lookupEnv); err != nil {
+        return nil, false, err
+    }
+
+    var flagErr error
+    flags.Visit(func(f *flag.Flag) {
+        value, ok := values[f.Name]
+        if !ok || flagErr != nil {
+            return
+        }
+        for _, configFlag := range configFlags {
+            if configFlag.name == f.Name {
+                if err := config.set(configFlag.path, *value); err != nil {
+                    flagErr = fmt.Errorf("-%s: %w", f.Name, err)
+                }
+            }
+        }
+    })
+    if flagErr != nil {
+        return nil, false, flagErr
+    }
+    return config, *printConfig, nil
+}
+
+func (config *Config) loadFile(filename string) error {
+    data, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return fmt.Errorf("cannot read config file: %w", err)
+    }
+
+    // 拒绝未知的配置项，避免拼写错误被静默忽略
+    decoder := yaml.NewDecoder(bytes.NewReader(data))
+    decoder.KnownFields(true)
+    if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+        return fmt.Errorf("cannot parse config file %s: %w", filename, err)
+    }
+    return nil
+}
+
+// applyEnv 使用 PCBOOK_* 环境变量覆盖配置，列表类型的配置项只能在配置文件中设置
+func (config *Config) applyEnv(lookupEnv func(string) (string, bool)) error {
+    for _, path := range configPaths(reflect.TypeOf(*config), "") {
+        name := envPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+        value, ok := lookupEnv(name)
+        if !ok {
+            continue
+        }
+        if err := config.set(path, value); err != nil {
+            return fmt.Errorf("%s: %w", name, err)
+        }
+    }
+    return nil
+}
+
+// set 按照 yaml 路径设置配置项，例如 server.port
+func (config *Config) set(path string, value string) error {
+    field, ok := fieldByPath(reflect.ValueOf(config).Elem(), path)
+    if !ok {
+        return fmt.Errorf("unknown config %s", path)
+    }
+
+    if field.Type() == reflect.TypeOf(time.Duration(0)) {
+        d, err := time.ParseDuration(value)
+        if err != nil {
+            return fmt.Errorf("invalid duration %q", value)
+        }
+        field.SetInt(int64(d))
+        return nil
+    }
+
+    switch field.Kind() {
+    case reflect.String:
+        field.SetString(value)
+    case reflect.Bool:
+        b, err := strconv.ParseBool(value)
+        if err != nil {
+            return fmt.Errorf("invalid bool %q", value)
+        }
+        field.SetBool(b)
+    case reflect.Int, reflect.Int64:
+        n, err := strconv.ParseInt(value, 10, 64)
+        if err != nil {
+            return fmt.Errorf("invalid integer %q", value)
+        }
+        field.SetInt(n)
+    case reflect.Float64:
+        f, err := strconv.ParseFloat(value, 64)
+        if err != nil {
+            return fmt.Errorf("invalid number %q", value)
+        }
+        field.SetFloat(f)
+    default:
+        return fmt.Errorf("%s cannot be set from a string", path)
+    }
+    return nil
+}
+
+// Validate 检查配置，返回所有的错误
+func (config *Config) Validate() error {
+    var errs []string
+    check := func(ok bool, format string, args ...interface{}) {
+        if !ok {
+            errs = append(errs, fmt.Sprintf(format, args...))
+        }
+    }
+    fileExists := func(filename string) bool {
+        _, err := os.Stat(filename)
+        return err == nil
+    }
+
+    check(config.ServesGRPC() || config.Server.Type == "rest", "server.type must be grpc, rest or combined, got %q", config.Server.Type)
+    check(config.Server.Port > 0 && config.Server.Port < 65536, "server.port must be between 1 and 65535, got %d", config.Server.Port)
+    check(config.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+    check(!config.ServesGRPC() || config.Server.HealthCheckInterval > 0, "server.health_check_interval must be positive")
+    if config.Server.Type == "rest" {
+        check(config.Server.Endpoint != "", "server.endpoint is required for the rest server")
+    }
+
+    if config.TLS.Enabled {
+        check(fileExists(config.TLS.CertFile), "tls.cert_file %q does not exist", config.TLS.CertFile)
+        check(fileExists(config.TLS.KeyFile), "tls.key_file %q does not exist", config.TLS.KeyFile)
+        if config.ServesGRPC() {
+            check(fileExists(config.TLS.ClientCAFile), "tls.client_ca_file %q does not exist", config.TLS.ClientCAFile)
+        }
+    }
+
+    auth := config.Auth
+    check(len(auth.SecretKey) >= 16, "auth.secret_key must be at least 16 characters (set it in the config file or %sAUTH_SECRET_KEY)", envPrefix)
+    check(auth.TokenDuration > 0, "auth.token_duration must be positive")
+    if config.ServesGRPC() {
+        check(fileExists(auth.PolicyFile), "auth.policy_file %q does not exist", auth.PolicyFile)
+        check(auth.PolicyReloadInterval > 0, "auth.policy_reload_interval must be positive")
+        check(auth.CertIdentitiesFile == "" || config.TLS.Enabled, "auth.cert_identities_file requires tls.enabled")
+        check(auth.CertIdentitiesFile == "" || fileExists(auth.CertIdentitiesFile), "auth.cert_identities_file %q does not exist", auth.CertIdentitiesFile)
+        check(auth.OIDCConfigFile == "" || fileExists(auth.OIDCConfigFile), "auth.oidc_config_file %q does not exist", auth.OIDCConfigFile)
+    }
+    check(auth.PasswordPolicy.MinLength >= 1, "auth.password_policy.min_length must be at least 1")
+    check(auth.PasswordPolicy.MaxLength == 0 || auth.PasswordPolicy.MaxLength >= auth.PasswordPolicy.MinLength,
+        "auth.password_policy.max_length must not be less than min_length")
+    check(auth.PasswordPolicy.MinCharacterClasses >= 0 && auth.PasswordPolicy.MinCharacterClasses <= 4,
+        "auth.password_policy.min_character_classes must be between 0 and 4")
+    if err := auth.PasswordHashing.Validate(); err != nil {
+        check(false, "auth.password_hashing: %v", err)
+    }
+    for i, user := range auth.SeedUsers {
+        check(user.Username != "" && user.Role != "", "auth.seed_users[%d] must have a username and a role", i)
+    }
+
+    check(config.Stores.ImageDir != "", "stores.image_dir is required")
+    check(config.Stores.EventHistory > 0, "stores.event_history must be positive")
+
+    check(config.Limits.MaxImageSize > 0, "limits.max_image_size must be positive")
+    login := config.Limits.Login
+    check(login.MaxUserFailures > 0 && login.MaxPeerFailures > 0, "limits.login max failures must be positive")
+    check(login.BaseDelay > 0 && login.MaxDelay >= login.BaseDelay, "limits.login.max_delay must not be less than base_delay")
+    check(login.LockoutDuration > 0, "limits.login.lockout_duration must be positive")
+    if err := config.Limits.Rate.Validate(); err != nil {
+        check(false, "limits.rate: %v", err)
+    }
+
+    if config.ServesGRPC() {
+        check(config.Audit.File != "", "audit.file is required")
+        check(config.Audit.MaxSizeMB >= 0, "audit.max_size_mb must not be negative")
+        check(config.Audit.MaxBackups >= 0, "audit.max_backups must not be negative")
+        if err := config.Idempotency.Validate(); err != nil {
+            check(false, "idempotency: %v", err)
+        }
+        if err := config.Alerts.Validate(); err != nil {
+            check(false, "alerts: %v", err)
+        }
+        if err := config.Webhooks.Validate(); err != nil {
+            check(false, "webhooks: %v", err)
+        }
+    }
+
+    check(config.Logging.Output != "", "logging.output is required")
+    if _, err := logging.ParseLevel(config.Logging.Level); err != nil {
+        check(false, "logging.level: %v", err)
+    }
+    for component, level := range config.Logging.Components {
+        if _, err := logging.ParseLevel(level); err != nil {
+            check(false, "logging.components.%s: %v", component, err)
+        }
+    }
+    check(config.Logging.Format == "text" || config.Logging.Format == "json", "logging.format must be text or json")
+    check(config.Tracing.SampleRatio >= 0 && config.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+
+    if len(errs) > 0 {
+        return errors.New("invalid config:\n  " + strings.Join(errs, "\n  "))
+    }
+    return nil
+}
+
+// Redacted 返回隐藏了密钥和密码的配置副本
+func (config *Config) Redacted() *Config {
+    copied := *config
+    if copied.Auth.SecretKey != "" {
+        copied.Auth.SecretKey = redacted
+    }
+    copied.Auth.SeedUsers = make([]SeedUser, len(config.Auth.SeedUsers))
+    for i, user := range config.Auth.SeedUsers {
+        user.Password = redacted
+        copied.Auth.SeedUsers[i] = user
+    }
+    return &copied
+}
+
+// ServesGRPC 是否在本进程内提供 gRPC 服务
+func (config *Config) ServesGRPC() bool {
+    return config.Server.Type == "grpc" || config.Server.Type == "combined"
+}
+
+// Address 服务监听的地址
+func (config *Config) Address() string {
+    return fmt.Sprintf("%s:%d", config.Server.Host, config.Server.Port)
+}
+
+// configPaths 返回所有可以用字符串设置的配置项路径
+func configPaths(t reflect.Type, prefix string) []string {
+    var paths []string
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+        if name == "" || name == "-" {
+            continue
+        }
+        path := prefix + name
+
+        switch {
+        case field.Type == reflect.TypeOf(time.Duration(0)):
+            paths = append(paths, path)
+        case field.Type.Kind() == reflect.Struct:
+            paths = append(paths, configPaths(field.Type, path+".")...)
+        case field.Type.Kind() != reflect.Slice && field.Type.Kind() != reflect.Map:
+            paths = append(paths, path)
+        }
+    }
+    return paths
+}
+
+func fieldByPath(v reflect.Value, path string) (reflect.Value, bool) {
+    for _, name := range strings.Split(path, ".") {
+        if v.Kind() != reflect.Struct {
+            return reflect.Value{}, false
+        }
+        found := false
+        for i := 0; i < v.NumField(); i++ {
+            if strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0] == name {
+                v = v.Field(i)
+                found = true
+                break
+            }
+        }
+        if !found {
+            return reflect.Value{}, false
+        }
+    }
+    return v, true
+}
+
+func isBoolPath(path string) bool {
+    field, ok := fieldByPath(reflect.ValueOf(DefaultConfig()).Elem(), path)
+    return ok && field.Kind() == reflect.Bool
+}
+
+// boolFlag 布尔类型的参数，支持 -tls 和 -tls=false 两种写法
+type boolFlag struct {
+    value *string
+}
+
+func (f boolFlag) String() string {
+    if f.value == nil {
+        return ""
+    }
+    return *f.value
+}
+
+func (f boolFlag) Set(value string) error {
+    *f.value = value
+    return nil
+}
+
+func (f boolFlag) IsBoolFlag() bool {
+    return true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/service"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+    dir, err := ioutil.TempDir("", "config")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    filename := filepath.Join(dir, "server.yaml")
+    content := []byte("server:\n  port: 9000\nauth:\n  secret_key: file-secret-key-1234\n  token_duration: 1m\n")
+    require.NoError(t, ioutil.WriteFile(filename, content, 0600))
+
+    env := map[string]string{
+        "PCBOOK_CONFIG":              filename,
+        "PCBOOK_SERVER_PORT":         "9001",
+        "PCBOOK_AUTH_TOKEN_DURATION": "2m",
+    }
+    lookupEnv := func(key string) (string, bool) {
+        value, ok := env[key]
+        return value, ok
+    }
+
+    // 默认值 < 配置文件 < 环境变量 < 命令行参数
+    config, printConfig, err := LoadConfig([]string{"-port", "9002", "-print-config"}, lookupEnv)
+    require.NoError(t, err)
+    require.True(t, printConfig)
+    require.Equal(t, 9002, config.Server.Port)
+    require.Equal(t, 2*time.Minute, config.Auth.TokenDuration)
+    require.Equal(t, "file-secret-key-1234", config.Auth.SecretKey)
+    require.Equal(t, "grpc", config.Server.Type)
+    config.Auth.PolicyFile = "../../config/policy.yaml"
+    require.NoError(t, config.Validate())
+
+    redacted := config.Redacted()
+    require.Equal(t, "REDACTED", redacted.Auth.SecretKey)
+    require.Equal(t, "file-secret-key-1234", config.Auth.SecretKey)
+
+    env["PCBOOK_SERVER_PORT"] = "not-a-port"
+    _, _, err = LoadConfig(nil, lookupEnv)
+    require.Error(t, err)
+
+    _, _, err = LoadConfig([]string{"-config", filepath.Join(dir, "missing.yaml")}, lookupEnv)
+    require.Error(t, err)
+}
+
+func TestConfigValidate(t *testing.T) {
+    config := DefaultConfig()
+    config.Server.Type = "soap"
+    config.Server.Port = 0
+    config.Limits.Rate.Methods = append(config.Limits.Rate.Methods, service.MethodRateLimit{
+        Method:    "SearchLaptop",
+        RateLimit: service.RateLimit{Rate: 1},
+    })
+
+    err := config.Validate()
+    require.Error(t, err)
+    require.Contains(t, err.Error(), "server.type")
+    require.Contains(t, err.Error(), "server.port")
+    require.Contains(t, err.Error(), "auth.secret_key")
+    require.Contains(t, err.Error(), "limits.rate")
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "strings"
+
+    "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+    "github.com/xiusl/pcbook/client"
+    "github.com/xiusl/pcbook/logging"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/service"
+    "golang.org/x/net/http2"
+    "golang.org/x/net/http2/h2c"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/credentials"
+    healthpb "google.golang.org/grpc/health/grpc_health_v1"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/peer"
+    "google.golang.org/grpc/test/bufconn"
+)
+
+// streamingRoutes 进程内网关不支持的流式方法，这些请求通过内存中的 gRPC 连接转发
+var streamingRoutes = map[string]bool{
+    "/v1/laptop/search":       true,
+    "/v1/laptop/upload_image": true,
+    "/v1/laptop/reate":        true,
+    "/v1/laptop/watch":        true,
+    "/v1/laptop/import":       true,
+    "/v1/laptop/export":       true,
+    "/v1/alert/subscribe":     true,
+}
+
+// newGatewayMux 新建 REST 网关，除了默认的请求头以外还转发 API Key、请求 ID 和幂等键
+// 响应头 X-Request-Id 返回服务端使用的请求 ID，Idempotent-Replayed 表示响应是重放的结果
+func newGatewayMux(opts ...runtime.ServeMuxOption) *runtime.ServeMux {
+    return runtime.NewServeMux(append([]runtime.ServeMuxOption{
+        runtime.WithIncomingHeaderMatcher(func(key string) (string, bool) {
+            switch {
+            case strings.EqualFold(key, runtime.MetadataHeaderPrefix+service.GatewayPeerHeader):
+                // 调用方令牌只能由网关设置
+                return "", false
+            case strings.EqualFold(key, "X-Api-Key"):
+                return "x-api-key", true
+            case strings.EqualFold(key, "X-Request-Id"):
+                return logging.RequestIDKey, true
+            case strings.EqualFold(key, "Idempotency-Key"):
+                return service.IdempotencyKeyHeader, true
+            }
+            return runtime.DefaultHeaderMatcher(key)
+        }),
+        runtime.WithOutgoingHeaderMatcher(func(key string) (string, bool) {
+            switch key {
+            case logging.RequestIDKey:
+                return "X-Request-Id", true
+            case service.IdempotentReplayedHeader:
+                return "Idempotent-Replayed", true
+            }
+            return runtime.MetadataHeaderPrefix + key, true
+        }),
+    }, opts...)...)
+}
+
+// runCombinedServer 在同一个端口上提供 gRPC 和 REST 服务
+// HTTP/2 的 gRPC 请求交给 gRPC 服务端，其余请求交给 REST 网关，两者共用一份 TLS 配置
+func runCombinedServer(
+    ctx context.Context,
+    authServer pb.AuthServiceServer,
+    laptopServer pb.LaptopServicesServer,
+    apiKeyServer pb.APIKeyServiceServer,
+    auditServer pb.AuditServiceServer,
+    alertServer pb.AlertServiceServer,
+    webhookServer pb.WebhookServiceServer,
+    healthMonitor *service.HealthMonitor,
+    interceptor *service.AuthInterceptor,
+    rateLimit *service.RateLimitInterceptor,
+    idempotency *service.IdempotencyInterceptor,
+    policy *service.AccessPolicy,
+    config *Config,
+    listener net.Listener,
+) error {
+    // TLS 由 HTTP 服务端处理，gRPC 服务端不需要再配置证书
+    // 经过内存连接转发的流式请求由 gatewayPeers 还原 HTTP 调用方的地址和证书，用于限流、认证和审计
+    // REST 网关的一元请求和 gRPC 服务端使用同一份拦截器
+    gatewayPeers := service.NewGatewayPeers()
+    unary, stream := serverInterceptors(interceptor, rateLimit, idempotency)
+    grpcServer := newGRPCServer(
+        authServer, laptopServer, apiKeyServer, auditServer, alertServer, webhookServer, healthMonitor, unary, stream,
+        grpc.ChainUnaryInterceptor(gatewayPeers.Unary()),
+        grpc.ChainStreamInterceptor(gatewayPeers.Stream()),
+    )
+    if err := watchPolicy(grpcServer, policy, config); err != nil {
+        return err
+    }
+    defer policy.Close()
+    healthMonitor.Start(config.Server.HealthCheckInterval)
+    defer healthMonitor.Close()
+
+    gatewayCtx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    mux := newGatewayMux()
+    gatewayServer := service.NewGatewayServer(chainUnaryInterceptors(unary...), authServer, laptopServer, apiKeyServer, auditServer, alertServer, webhookServer)
+    if err := gatewayServer.RegisterHandlers(gatewayCtx, mux); err != nil {
+        return err
+    }
+
+    // 流式方法经过内存中的连接调用同一个 gRPC 服务端，同样会执行拦截器
+    inProcess := bufconn.Listen(1 << 20)
+    go grpcServer.Serve(inProcess)
+    defer grpcServer.Stop()
+
+    tracing := client.NewTracingInterceptor()
+    conn, err := grpc.DialContext(
+        gatewayCtx,
+        "in-process",
+        grpc.WithInsecure(),
+        grpc.WithUnaryInterceptor(tracing.Unary()),
+        grpc.WithStreamInterceptor(tracing.Stream()),
+        grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+            return inProcess.Dial()
+        }),
+    )
+    if err != nil {
+        return fmt.Errorf("cannot dial in-process gRPC server: %w", err)
+    }
+    defer conn.Close()
+
+    if err := registerHealthHandlers(mux, healthpb.NewHealthClient(conn), healthMonitor.Services()); err != nil {
+        return err
+    }
+
+    streamMux := newGatewayMux(runtime.WithMetadata(func(ctx context.Context, r *http.Request) metadata.MD {
+        token, err := gatewayPeers.Register(r.Context(), requestPeer(r))
+        if err != nil {
+            serverLog.Error(ctx, "cannot register gateway peer", "error", err)
+            return nil
+        }
+        return metadata.Pairs(service.GatewayPeerHeader, token)
+    }))
+    if err := pb.RegisterLaptopServicesHandler(gatewayCtx, streamMux, conn); err != nil {
+        return err
+    }
+    if err := pb.RegisterAlertServiceHandler(gatewayCtx, streamMux, conn); err != nil {
+        return err
+    }
+
+    restHandler := service.TracingHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if streamingRoutes[r.URL.Path] {
+            streamMux.ServeHTTP(w, r)
+            return
+        }
+        mux.ServeHTTP(w, withPeer(r))
+    }))
+    handler := &inflightHandler{handler: grpcHandlerFunc(grpcServer, restHandler)}
+
+    server := &http.Server{Handler: handler}
+    if config.TLS.Enabled {
+        tlsConfig, err := loadTLSConfig(config.TLS)
+        if err != nil {
+            return fmt.Errorf("cannot load  TLS credentials: %v", err)
+        }
+        server.TLSConfig = tlsConfig
+    } else {
+        // 没有 TLS 时使用 h2c 支持明文的 HTTP/2
+        server.Handler = h2c.NewHandler(handler, &http2.Server{})
+    }
+
+    serverLog.Info(ctx, "start combined gRPC and REST server", "address", listener.Addr().String(), "tls", config.TLS.Enabled)
+    return serveUntilShutdown(ctx, config.Server.ShutdownTimeout, func() error {
+        if config.TLS.Enabled {
+            return server.ServeTLS(listener, "", "")
+        }
+        return server.Serve(listener)
+    }, func(ctx context.Context) {
+        healthMonitor.Shutdown()
+        shutdownHTTP(ctx, server)
+        // ServeHTTP 处理的 gRPC 请求不支持 GracefulStop，等待请求数归零后再关闭
+        if !handler.wait(ctx) {
+            serverLog.Warn(ctx, "shutdown deadline exceeded, closing remaining gRPC streams")
+        }
+        grpcServer.Stop()
+    })
+}
+
+// registerHealthHandlers 在 REST 网关上注册 /healthz 和 /readyz
+// /healthz 只表示进程在运行，/readyz 在整个服务端和所有服务都是 SERVING 时返回 200，否则返回 503
+func registerHealthHandlers(mux *runtime.ServeMux, healthClient healthpb.HealthClient, services []string) error {
+    err := mux.HandlePath(http.MethodGet, "/healthz", func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+        writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+    })
+    if err != nil {
+        return err
+    }
+
+    return mux.HandlePath(http.MethodGet, "/readyz", func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+        ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+        defer cancel()
+
+        ready := true
+        statuses := make(map[string]string, len(services))
+        for _, name := range append([]string{""}, services...) {
+            res, err := healthClient.Check(ctx, &healthpb.HealthCheckRequest{Service: name})
+            status := res.GetStatus().String()
+            if err != nil {
+                status = healthpb.HealthCheckResponse_UNKNOWN.String()
+            }
+            if name != "" {
+                statuses[name] = status
+            }
+            ready = ready && status == healthpb.HealthCheckResponse_SERVING.String()
+        }
+
+        code := http.StatusOK
+        if !ready {
+            code = http.StatusServiceUnavailable
+        }
+        writeJSON(w, code, map[string]interface{}{"ready": ready, "services": statuses})
+    })
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    json.NewEncoder(w).Encode(body)
+}
+
+// chainUnaryInterceptors 按顺序组合多个一元拦截器，第一个拦截器在最外层
+func chainUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+    return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+        for i := len(interceptors) - 1; i >= 0; i-- {
+            interceptor, next := interceptors[i], handler
+            handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+                return interceptor(ctx, req, info, next)
+            }
+        }
+        return handler(ctx, req)
+    }
+}
+
+// grpcHandlerFunc 按照协议和内容类型把请求分发给 gRPC 服务端或者 REST 网关
+func grpcHandlerFunc(grpcServer *grpc.Server, otherHandler http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+            grpcServer.ServeHTTP(w, r)
+            return
+        }
+        otherHandler.ServeHTTP(w, r)
+    })
+}
+
+// withPeer 把 HTTP 调用方的地址和证书放入上下文，与 gRPC 调用一样可以按证书认证和记录来源
+func withPeer(r *http.Request) *http.Request {
+    return r.WithContext(peer.NewContext(r.Context(), requestPeer(r)))
+}
+
+// requestPeer HTTP 调用方的地址和证书
+func requestPeer(r *http.Request) *peer.Peer {
+    pr := &peer.Peer{Addr: remoteAddr(r.RemoteAddr)}
+    if r.TLS != nil {
+        pr.AuthInfo = credentials.TLSInfo{
+            State:          *r.TLS,
+            CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity},
+        }
+    }
+    return pr
+}
+
+// remoteAddr HTTP 请求中的调用方地址
+type remoteAddr string
+
+func (addr remoteAddr) Network() string {
+    return "tcp"
+}
+
+func (addr remoteAddr) String() string {
+    return string(addr)
+}
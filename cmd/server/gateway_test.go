@@ -0,0 +1,98 @@
+package main
+
+import (
+    "context"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/service"
+)
+
+func TestCombinedServerStreamingPeers(t *testing.T) {
+    dir := t.TempDir()
+    searchLaptop := "/xiusl.pcbook.LaptopServices/SearchLaptop"
+
+    config := DefaultConfig()
+    config.Server.Type = "combined"
+    config.Auth.PolicyFile = "../../config/policy.yaml"
+    config.Limits.Rate.Methods = []service.MethodRateLimit{
+        {Method: searchLaptop, RateLimit: service.RateLimit{Rate: 0.001, Burst: 1}},
+    }
+
+    policy, err := service.LoadAccessPolicy(config.Auth.PolicyFile)
+    require.NoError(t, err)
+    auditStore, err := service.NewFileAuditStore(filepath.Join(dir, "audit.jsonl"), 0, 0)
+    require.NoError(t, err)
+    defer auditStore.Close()
+
+    jwtManager := service.NewJWTManager("secret", time.Minute)
+    authServer := service.NewAuthServer(service.NewInMemoryUserStore(), jwtManager, nil, auditStore, service.DefaultPasswordPolicy())
+    laptopStore := service.NewInMemoryLaptopStore()
+    laptopServer := service.NewLaptopServer(laptopStore, service.NewDiskImageStore(dir), service.NewInMemoryRatingStore())
+    apiKeyStore := service.NewInMemoryAPIKeyStore()
+    apiKeyServer := service.NewAPIKeyServer(apiKeyStore, policy)
+    auditServer := service.NewAuditServer(auditStore)
+    alertStore := service.NewInMemoryAlertStore()
+    alertServer := service.NewAlertServer(alertStore, service.NewAlertEvaluator(alertStore, laptopStore, config.Alerts), config.Alerts)
+    webhookStore := service.NewInMemoryWebhookStore()
+    deadLetterStore := service.NewInMemoryDeadLetterStore(config.Webhooks.MaxDeadLetters)
+    webhookDispatcher := service.NewWebhookDispatcher(webhookStore, deadLetterStore, laptopStore, config.Webhooks)
+    webhookServer := service.NewWebhookServer(webhookStore, deadLetterStore, webhookDispatcher)
+    healthMonitor := service.NewHealthMonitor(time.Second)
+
+    interceptor := service.NewAuthInterceptor(policy, auditStore, jwtManager, service.NewAPIKeyAuthenticator(apiKeyStore))
+    rateLimit := service.NewRateLimitInterceptor(service.NewInMemoryRateLimiter(), config.Limits.Rate)
+    idempotency, err := service.NewIdempotencyInterceptor(service.NewInMemoryIdempotencyStore(), config.Idempotency)
+    require.NoError(t, err)
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    require.NoError(t, err)
+    url := "http://" + listener.Addr().String()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    served := make(chan error, 1)
+    go func() {
+        served <- runCombinedServer(ctx, authServer, laptopServer, apiKeyServer, auditServer, alertServer, webhookServer, healthMonitor, interceptor, rateLimit, idempotency, policy, config, listener)
+    }()
+    defer func() {
+        cancel()
+        require.NoError(t, <-served)
+    }()
+
+    // 两个 REST 调用方使用不同的来源地址
+    restClient := func(ip string) *http.Client {
+        dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+        return &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+    }
+    post := func(client *http.Client, path string) string {
+        res, err := client.Post(url+path, "application/json", strings.NewReader(`{}`))
+        require.NoError(t, err)
+        defer res.Body.Close()
+        body, err := ioutil.ReadAll(res.Body)
+        require.NoError(t, err)
+        return string(body)
+    }
+    client1 := restClient("127.0.0.1")
+    client2 := restClient("127.0.0.2")
+
+    // 匿名的流式请求按各自的来源 IP 限流
+    require.NotContains(t, post(client1, "/v1/laptop/search"), "rate limit exceeded")
+    require.Contains(t, post(client1, "/v1/laptop/search"), "rate limit exceeded")
+    require.NotContains(t, post(client2, "/v1/laptop/search"), "rate limit exceeded")
+
+    // 审计记录的是 HTTP 调用方的地址
+    require.Contains(t, post(client2, "/v1/laptop/export"), "authorization credentials are not provided")
+    events, err := auditStore.Query(service.AuditFilter{Limit: 1})
+    require.NoError(t, err)
+    require.Len(t, events, 1)
+    require.Equal(t, service.AuditAccessDenied, events[0].Type)
+    host, _, err := net.SplitHostPort(events[0].PeerAddress)
+    require.NoError(t, err)
+    require.Equal(t, "127.0.0.2", host)
+}
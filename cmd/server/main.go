@@ -4,60 +4,68 @@ import (
     "context"
     "crypto/tls"
     "crypto/x509"
+    "errors"
     "flag"
     "fmt"
+    "io"
     "io/ioutil"
     "log"
     "net"
     "net/http"
+    "os"
+    "os/signal"
+    "syscall"
     "time"
 
-    "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+    "github.com/xiusl/pcbook/client"
+    "github.com/xiusl/pcbook/logging"
     "github.com/xiusl/pcbook/pb"
     "github.com/xiusl/pcbook/service"
     "google.golang.org/grpc"
     "google.golang.org/grpc/credentials"
+    healthpb "google.golang.org/grpc/health/grpc_health_v1"
     "google.golang.org/grpc/reflection"
+    "gopkg.in/yaml.v3"
 )
 
 const (
-    secretKey     = "njkandsiaud"
-    tokenDuration = 10 * time.Minute
-)
+    authServiceName   = "xiusl.pcbook.AuthService"
+    laptopServiceName = "xiusl.pcbook.LaptopServices"
 
-const (
-    serverCertFile   = "cert/server-cert.pem"
-    serverKeyFile    = "cert/server-key.pem"
-    clientCACertFile = "cert/ca-cert.pem"
+    // healthCheckTimeout 每项健康检查的超时时间
+    healthCheckTimeout = 5 * time.Second
 )
 
-func seedUser(userStroe service.UserStore) error {
-    err := createUser(userStroe, "admin", "abc", "admin")
-    if err != nil {
-        return err
+// serverLog 服务端启动和退出的日志
+var serverLog = logging.New("server")
+
+// healthCheckedServices 有健康检查的服务
+var healthCheckedServices = []string{authServiceName, laptopServiceName}
+
+func seedUser(userStroe service.UserStore, passwordPolicy service.PasswordPolicy, seedUsers []SeedUser) error {
+    for _, seed := range seedUsers {
+        err := createUser(userStroe, passwordPolicy, seed.Username, seed.Password, seed.Role, seed.Vendor)
+        if err != nil {
+            return err
+        }
     }
-    return createUser(userStroe, "user1", "abc", "user")
+    return nil
 }
 
-func createUser(userStroe service.UserStore, username, password, role string) error {
+func createUser(userStroe service.UserStore, passwordPolicy service.PasswordPolicy, username, password, role, vendor string) error {
+    if err := passwordPolicy.Validate(username, password); err != nil {
+        return fmt.Errorf("password of %s is too weak: %w", username, err)
+    }
     user, err := service.NewUser(username, password, role)
     if err != nil {
         return err
     }
+    user.Vendor = vendor
     return userStroe.Save(user)
 }
 
-func accessibleRoles() map[string][]string {
-    const latopServicePath = "/xiusl.pcbook.LaptopServices/"
-    return map[string][]string{
-        latopServicePath + "CreateLaptop": {"admin"},
-        latopServicePath + "UploadImage":  {"admin"},
-        latopServicePath + "RateLaptop":   {"admin", "user"},
-    }
-}
-
-func loadTLSCredentials() (credentials.TransportCredentials, error) {
-    pemClientCA, err := ioutil.ReadFile(clientCACertFile)
+func loadTLSConfig(tlsConfig TLSConfig) (*tls.Config, error) {
+    pemClientCA, err := ioutil.ReadFile(tlsConfig.ClientCAFile)
     if err != nil {
         return nil, err
     }
@@ -66,7 +74,7 @@ func loadTLSCredentials() (credentials.TransportCredentials, error) {
         return nil, fmt.Errorf("cannot load the client ca file")
     }
 
-    serverCert, err := tls.LoadX509KeyPair(serverCertFile, serverKeyFile)
+    serverCert, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
     if err != nil {
         return nil, err
     }
@@ -76,105 +84,441 @@ func loadTLSCredentials() (credentials.TransportCredentials, error) {
         ClientAuth:   tls.RequireAndVerifyClientCert,
         ClientCAs:    certPool,
     }
-    return credentials.NewTLS(config), nil
+    return config, nil
+}
+
+// serverInterceptors 按执行顺序返回服务端的一元拦截器和流拦截器，第一个拦截器在最外层
+// gRPC 服务端和 REST 网关共用同一份列表，新增拦截器只需要加在这里
+func serverInterceptors(
+    interceptor *service.AuthInterceptor,
+    rateLimit *service.RateLimitInterceptor,
+    idempotency *service.IdempotencyInterceptor,
+) ([]grpc.UnaryServerInterceptor, []grpc.StreamServerInterceptor) {
+    tracing := service.NewTracingInterceptor()
+    requestID := service.NewRequestIDInterceptor()
+    metrics := service.NewMetricsInterceptor()
+    recovery := service.NewRecoveryInterceptor()
+    validation := service.NewValidationInterceptor()
+    unary := []grpc.UnaryServerInterceptor{
+        tracing.Unary(),
+        requestID.Unary(),
+        metrics.Unary(),
+        recovery.Unary(),
+        interceptor.Unary(),
+        rateLimit.Unary(),
+        validation.Unary(),
+        idempotency.Unary(),
+    }
+    stream := []grpc.StreamServerInterceptor{
+        tracing.Stream(),
+        requestID.Stream(),
+        metrics.Stream(),
+        recovery.Stream(),
+        interceptor.Stream(),
+        rateLimit.Stream(),
+        validation.Stream(),
+        idempotency.Stream(),
+    }
+    return unary, stream
+}
+
+// newGRPCServer 新建 gRPC 服务端并注册所有服务，unary 和 stream 由 serverInterceptors 返回
+func newGRPCServer(
+    authServer pb.AuthServiceServer,
+    laptopServer pb.LaptopServicesServer,
+    apiKeyServer pb.APIKeyServiceServer,
+    auditServer pb.AuditServiceServer,
+    alertServer pb.AlertServiceServer,
+    webhookServer pb.WebhookServiceServer,
+    healthMonitor *service.HealthMonitor,
+    unary []grpc.UnaryServerInterceptor,
+    stream []grpc.StreamServerInterceptor,
+    serverOptions ...grpc.ServerOption,
+) *grpc.Server {
+    serverOptions = append(
+        serverOptions,
+        grpc.ChainUnaryInterceptor(unary...),
+        grpc.ChainStreamInterceptor(stream...),
+    )
+
+    grpcServer := grpc.NewServer(serverOptions...)
+    pb.RegisterAuthServiceServer(grpcServer, authServer)
+    pb.RegisterLaptopServicesServer(grpcServer, laptopServer)
+    pb.RegisterAPIKeyServiceServer(grpcServer, apiKeyServer)
+    pb.RegisterAuditServiceServer(grpcServer, auditServer)
+    pb.RegisterAlertServiceServer(grpcServer, alertServer)
+    pb.RegisterWebhookServiceServer(grpcServer, webhookServer)
+    healthpb.RegisterHealthServer(grpcServer, healthMonitor)
+    reflection.Register(grpcServer)
+    return grpcServer
+}
+
+// watchPolicy 检查访问控制策略覆盖了所有的方法，并定时重新加载策略
+func watchPolicy(grpcServer *grpc.Server, policy *service.AccessPolicy, config *Config) error {
+    services := grpcServer.GetServiceInfo()
+    if err := policy.Validate(services); err != nil {
+        return fmt.Errorf("invalid access policy: %v", err)
+    }
+    policy.Watch(config.Auth.PolicyReloadInterval, services)
+    return nil
 }
 
 func runGRPCServer(
+    ctx context.Context,
     authServer pb.AuthServiceServer,
     laptopServer pb.LaptopServicesServer,
-    jwtManager *service.JWTManager,
-    enableTLS bool,
+    apiKeyServer pb.APIKeyServiceServer,
+    auditServer pb.AuditServiceServer,
+    alertServer pb.AlertServiceServer,
+    webhookServer pb.WebhookServiceServer,
+    healthMonitor *service.HealthMonitor,
+    interceptor *service.AuthInterceptor,
+    rateLimit *service.RateLimitInterceptor,
+    idempotency *service.IdempotencyInterceptor,
+    policy *service.AccessPolicy,
+    config *Config,
     listener net.Listener,
 ) error {
-    interceptor := service.NewAuthInterceptor(jwtManager, accessibleRoles())
-    serverOptioon := []grpc.ServerOption{
-        grpc.UnaryInterceptor(interceptor.Unary()),
-        grpc.StreamInterceptor(interceptor.Stream()),
-    }
-
-    if enableTLS {
-        tlsCredentials, err := loadTLSCredentials()
+    var serverOptioon []grpc.ServerOption
+    if config.TLS.Enabled {
+        tlsConfig, err := loadTLSConfig(config.TLS)
         if err != nil {
             return fmt.Errorf("cannot load  TLS credentials: %v", err)
         }
-        serverOptioon = append(serverOptioon, grpc.Creds(tlsCredentials))
+        serverOptioon = append(serverOptioon, grpc.Creds(credentials.NewTLS(tlsConfig)))
     }
 
-    grpcServer := grpc.NewServer(serverOptioon...)
-    pb.RegisterAuthServiceServer(grpcServer, authServer)
-    pb.RegisterLaptopServicesServer(grpcServer, laptopServer)
-    reflection.Register(grpcServer)
+    unary, stream := serverInterceptors(interceptor, rateLimit, idempotency)
+    grpcServer := newGRPCServer(authServer, laptopServer, apiKeyServer, auditServer, alertServer, webhookServer, healthMonitor, unary, stream, serverOptioon...)
+    if err := watchPolicy(grpcServer, policy, config); err != nil {
+        return err
+    }
+    defer policy.Close()
+    healthMonitor.Start(config.Server.HealthCheckInterval)
+    defer healthMonitor.Close()
 
-    log.Printf("Start GRPC server at %s, TLS = %t", listener.Addr().String(), enableTLS)
-    return grpcServer.Serve(listener)
+    serverLog.Info(ctx, "start gRPC server", "address", listener.Addr().String(), "tls", config.TLS.Enabled)
+    return serveUntilShutdown(ctx, config.Server.ShutdownTimeout, func() error {
+        return grpcServer.Serve(listener)
+    }, func(ctx context.Context) {
+        // 先通知负载均衡不再转发新的请求，再等待进行中的流结束
+        healthMonitor.Shutdown()
+        gracefulStopGRPC(ctx, grpcServer)
+    })
 }
 
 func runRESTServer(
-    authServer pb.AuthServiceServer,
-    laptopServer pb.LaptopServicesServer,
-    jwtManager *service.JWTManager,
-    enableTLS bool,
+    ctx context.Context,
+    config *Config,
     listener net.Listener,
-    grpcEndpoints string,
 ) error {
-    mux := runtime.NewServeMux()
-    dialOptions := []grpc.DialOption{grpc.WithInsecure()}
+    mux := newGatewayMux()
+    tracing := client.NewTracingInterceptor()
+    dialOptions := []grpc.DialOption{
+        grpc.WithInsecure(),
+        grpc.WithUnaryInterceptor(tracing.Unary()),
+        grpc.WithStreamInterceptor(tracing.Stream()),
+    }
+    grpcEndpoints := config.Server.Endpoint
 
-    ctx, cancel := context.WithCancel(context.Background())
+    dialCtx, cancel := context.WithCancel(context.Background())
     defer cancel()
 
-    err := pb.RegisterAuthServiceHandlerFromEndpoint(ctx, mux, grpcEndpoints, dialOptions)
+    err := pb.RegisterAuthServiceHandlerFromEndpoint(dialCtx, mux, grpcEndpoints, dialOptions)
     if err != nil {
         return err
     }
 
-    err = pb.RegisterLaptopServicesHandlerFromEndpoint(ctx, mux, grpcEndpoints, dialOptions)
+    err = pb.RegisterLaptopServicesHandlerFromEndpoint(dialCtx, mux, grpcEndpoints, dialOptions)
+    if err != nil {
+        return err
+    }
+
+    err = pb.RegisterAPIKeyServiceHandlerFromEndpoint(dialCtx, mux, grpcEndpoints, dialOptions)
+    if err != nil {
+        return err
+    }
+
+    err = pb.RegisterAuditServiceHandlerFromEndpoint(dialCtx, mux, grpcEndpoints, dialOptions)
+    if err != nil {
+        return err
+    }
+
+    err = pb.RegisterAlertServiceHandlerFromEndpoint(dialCtx, mux, grpcEndpoints, dialOptions)
+    if err != nil {
+        return err
+    }
+
+    err = pb.RegisterWebhookServiceHandlerFromEndpoint(dialCtx, mux, grpcEndpoints, dialOptions)
+    if err != nil {
+        return err
+    }
+
+    // /readyz 反映 gRPC 服务端的健康状态
+    conn, err := grpc.DialContext(dialCtx, grpcEndpoints, dialOptions...)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    err = registerHealthHandlers(mux, healthpb.NewHealthClient(conn), healthCheckedServices)
     if err != nil {
         return err
     }
 
-    log.Printf("Start REST server at %s, TLS = %t", listener.Addr().String(), enableTLS)
+    serverLog.Info(ctx, "start REST server", "address", listener.Addr().String(), "tls", config.TLS.Enabled)
+
+    server := &http.Server{Handler: service.TracingHandler(mux)}
+    return serveUntilShutdown(ctx, config.Server.ShutdownTimeout, func() error {
+        if config.TLS.Enabled {
+            return server.ServeTLS(listener, config.TLS.CertFile, config.TLS.KeyFile)
+        }
+        return server.Serve(listener)
+    }, func(ctx context.Context) {
+        shutdownHTTP(ctx, server)
+    })
+}
 
-    if enableTLS {
-        return http.ServeTLS(listener, mux, serverCertFile, serverKeyFile)
+// setupLogging 设置日志输出，返回需要在退出时关闭的文件
+// 标准库 log 的输出也会转为 server 组件的 error 日志，只有启动失败时使用
+func setupLogging(config LoggingConfig) (io.Closer, error) {
+    var writer io.Writer
+    var file *os.File
+    switch config.Output {
+    case "stderr":
+        writer = os.Stderr
+    case "stdout":
+        writer = os.Stdout
+    default:
+        var err error
+        file, err = os.OpenFile(config.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+        if err != nil {
+            return nil, fmt.Errorf("cannot open log file: %w", err)
+        }
+        writer = file
     }
 
-    return http.Serve(listener, mux)
+    err := logging.Configure(writer, logging.Config{
+        Level:      config.Level,
+        Format:     config.Format,
+        Components: config.Components,
+    })
+    if err != nil {
+        if file != nil {
+            file.Close()
+        }
+        return nil, err
+    }
+
+    log.SetFlags(0)
+    log.SetOutput(serverLog.Writer(logging.LevelError))
+    if file == nil {
+        return nil, nil
+    }
+    return file, nil
 }
 
 func main() {
-    port := flag.String("port", "", "server port")
-    enableTLS := flag.Bool("tls", false, "enable SSL/TLS")
-    serverType := flag.String("type", "grpc", "type of server (grpc/rest)")
-    endPoint := flag.String("endpoint", "", "gRPC endpoint")
-    flag.Parse()
+    config, printConfig, err := LoadConfig(os.Args[1:], os.LookupEnv)
+    if err != nil {
+        if errors.Is(err, flag.ErrHelp) {
+            return
+        }
+        log.Fatalf("cannot load config: %v", err)
+    }
+
+    if printConfig {
+        out, err := yaml.Marshal(config.Redacted())
+        if err != nil {
+            log.Fatalf("cannot print config: %v", err)
+        }
+        fmt.Print(string(out))
+        if err := config.Validate(); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+        return
+    }
+
+    if err := config.Validate(); err != nil {
+        log.Fatal(err)
+    }
+
+    logFile, err := setupLogging(config.Logging)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if logFile != nil {
+        defer logFile.Close()
+    }
+
+    shutdownTracing, err := setupTracing(config.Tracing)
+    if err != nil {
+        log.Fatalf("cannot set up tracing: %v", err)
+    }
+    defer shutdownTracing()
+
+    // 收到 SIGINT/SIGTERM 后停止接收新的请求，等待进行中的请求完成后退出
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
 
+    if err := service.ConfigurePasswordHashing(config.Auth.PasswordHashing); err != nil {
+        log.Fatalf("cannot configure password hashing: %v", err)
+    }
+    passwordPolicy := config.Auth.PasswordPolicy
     userStore := service.NewInMemoryUserStore()
-    if err := seedUser(userStore); err != nil {
-        log.Fatal("cannot create seed users: %w", err)
+    if err := seedUser(userStore, passwordPolicy, config.Auth.SeedUsers); err != nil {
+        log.Fatalf("cannot create seed users: %v", err)
+    }
+    jwtManager := service.NewJWTManager(config.Auth.SecretKey, config.Auth.TokenDuration)
+
+    // REST 网关只转发请求，审计由 gRPC 服务端记录
+    var auditStore service.AuditStore
+    var fileAuditStore *service.FileAuditStore
+    if config.ServesGRPC() {
+        fileAuditStore, err = service.NewFileAuditStore(config.Audit.File, config.Audit.MaxSizeMB<<20, config.Audit.MaxBackups)
+        if err != nil {
+            log.Fatalf("cannot open audit log: %v", err)
+        }
+        auditStore = fileAuditStore
     }
-    jwtManager := service.NewJWTManager(secretKey, tokenDuration)
 
-    authServer := service.NewAuthServer(userStore, jwtManager)
+    loginLimiter := service.NewLoginLimiter(config.Limits.Login)
+    authServer := service.NewAuthServer(userStore, jwtManager, loginLimiter, auditStore, passwordPolicy)
 
-    laptopStore := service.NewInMemoryLaptopStore()
-    imageStore := service.NewDiskImageStore("img")
+    if err := os.MkdirAll(config.Stores.ImageDir, 0755); err != nil {
+        log.Fatalf("cannot create image folder: %v", err)
+    }
+    laptopStore := service.NewInMemoryLaptopStoreWithHistory(config.Stores.EventHistory)
+    imageStore := service.NewDiskImageStore(config.Stores.ImageDir)
     ratingStore := service.NewInMemoryRatingStore()
-    laptopServer := service.NewLaptopServer(laptopStore, imageStore, ratingStore)
+    laptopServer := service.NewLaptopServerWithImageLimit(laptopStore, imageStore, ratingStore, config.Limits.MaxImageSize)
+    // 订阅不会自己结束，收到退出信号后先结束订阅，订阅方可以在其他实例上从最后的版本号继续接收
+    go func() {
+        <-ctx.Done()
+        laptopStore.CloseWatches()
+    }()
 
-    address := fmt.Sprintf("0.0.0.0:%s", *port)
-    listener, err := net.Listen("tcp", address)
+    if config.Admin.Address != "" {
+        adminServer, err := startAdminServer(config.Admin.Address)
+        if err != nil {
+            log.Fatalf("cannot start admin server: %v", err)
+        }
+        defer adminServer.Close()
+    }
+
+    listener, err := net.Listen("tcp", config.Address())
     if err != nil {
         log.Fatalf("cannot start server: %v", err)
     }
 
-    if *serverType == "grpc" {
-        err = runGRPCServer(authServer, laptopServer, jwtManager, *enableTLS, listener)
+    // webhooksStopped 在 webhook 发送器把没有送达的事件保存到死信队列后关闭
+    var webhooksStopped chan struct{}
+    var fileDeadLetterStore *service.FileDeadLetterStore
+    if config.ServesGRPC() {
+        var policy *service.AccessPolicy
+        policy, err = service.LoadAccessPolicy(config.Auth.PolicyFile)
+        if err != nil {
+            log.Fatalf("cannot load access policy: %v", err)
+        }
+        apiKeyStore := service.NewInMemoryAPIKeyStore()
+        apiKeyServer := service.NewAPIKeyServer(apiKeyStore, policy)
+
+        authenticators := []service.Authenticator{jwtManager, service.NewAPIKeyAuthenticator(apiKeyStore)}
+        authChecks := []service.HealthCheck{service.UserStoreCheck(userStore), service.SigningKeyCheck(jwtManager)}
+        if config.Auth.OIDCConfigFile != "" {
+            var oidcConfig *service.OIDCConfig
+            oidcConfig, err = service.LoadOIDCConfig(config.Auth.OIDCConfigFile)
+            if err != nil {
+                log.Fatalf("cannot load oidc config: %v", err)
+            }
+            var oidcAuthenticator *service.OIDCAuthenticator
+            oidcAuthenticator, err = service.NewOIDCAuthenticator(*oidcConfig, nil)
+            if err != nil {
+                log.Fatalf("cannot create oidc authenticator: %v", err)
+            }
+            // SSO 令牌与 JWTManager 的令牌使用同一个 authorization 元数据，需要先按 issuer 识别
+            authenticators = append([]service.Authenticator{oidcAuthenticator}, authenticators...)
+            authChecks = append(authChecks, service.OIDCKeysCheck(oidcAuthenticator))
+        }
+        if config.Auth.CertIdentitiesFile != "" {
+            var mapper *service.CertIdentityMapper
+            mapper, err = service.LoadCertIdentityMapper(config.Auth.CertIdentitiesFile)
+            if err != nil {
+                log.Fatalf("cannot load client certificate identities: %v", err)
+            }
+            authenticators = append(authenticators, mapper)
+        }
+        auditServer := service.NewAuditServer(auditStore)
+        alertStore := service.NewInMemoryAlertStore()
+        alertEvaluator := service.NewAlertEvaluator(alertStore, laptopStore, config.Alerts)
+        alertServer := service.NewAlertServer(alertStore, alertEvaluator, config.Alerts)
+        go func() {
+            // 便携电脑存储在退出时结束订阅，检查器随之结束
+            if err := alertEvaluator.Run(ctx); err != nil && !errors.Is(err, service.ErrWatchClosed) && ctx.Err() == nil {
+                serverLog.Error(ctx, "alert evaluator stopped", "error", err)
+            }
+        }()
+        webhookStore := service.NewInMemoryWebhookStore()
+        var deadLetterStore service.DeadLetterStore = service.NewInMemoryDeadLetterStore(config.Webhooks.MaxDeadLetters)
+        if config.Webhooks.DeadLetterFile != "" {
+            fileDeadLetterStore, err = service.NewFileDeadLetterStore(config.Webhooks.DeadLetterFile, config.Webhooks.MaxDeadLetters)
+            if err != nil {
+                log.Fatalf("cannot open dead letter file: %v", err)
+            }
+            deadLetterStore = fileDeadLetterStore
+        }
+        webhookDispatcher := service.NewWebhookDispatcher(webhookStore, deadLetterStore, laptopStore, config.Webhooks)
+        webhookServer := service.NewWebhookServer(webhookStore, deadLetterStore, webhookDispatcher)
+        webhooksStopped = make(chan struct{})
+        go func() {
+            defer close(webhooksStopped)
+            if err := webhookDispatcher.Run(ctx); err != nil && !errors.Is(err, service.ErrWatchClosed) && ctx.Err() == nil {
+                serverLog.Error(ctx, "webhook dispatcher stopped", "error", err)
+            }
+        }()
+        interceptor := service.NewAuthInterceptor(policy, auditStore, authenticators...)
+        rateLimit := service.NewRateLimitInterceptor(service.NewInMemoryRateLimiter(), config.Limits.Rate)
+        var idempotency *service.IdempotencyInterceptor
+        idempotency, err = service.NewIdempotencyInterceptor(service.NewInMemoryIdempotencyStore(), config.Idempotency)
+        if err != nil {
+            log.Fatalf("cannot create idempotency interceptor: %v", err)
+        }
+
+        healthMonitor := service.NewHealthMonitor(healthCheckTimeout)
+        healthMonitor.Register(authServiceName, authChecks...)
+        healthMonitor.Register(
+            laptopServiceName,
+            service.LaptopStoreCheck(laptopStore),
+            service.ImageFolderCheck(config.Stores.ImageDir),
+        )
+
+        if config.Server.Type == "combined" {
+            err = runCombinedServer(ctx, authServer, laptopServer, apiKeyServer, auditServer, alertServer, webhookServer, healthMonitor, interceptor, rateLimit, idempotency, policy, config, listener)
+        } else {
+            err = runGRPCServer(ctx, authServer, laptopServer, apiKeyServer, auditServer, alertServer, webhookServer, healthMonitor, interceptor, rateLimit, idempotency, policy, config, listener)
+        }
     } else {
-        err = runRESTServer(authServer, laptopServer, jwtManager, *enableTLS, listener, *endPoint)
+        err = runRESTServer(ctx, config, listener)
+    }
+
+    // 所有请求结束后再把存储写入磁盘
+    if webhooksStopped != nil {
+        stop()
+        <-webhooksStopped
+    }
+    if fileDeadLetterStore != nil {
+        if closeErr := fileDeadLetterStore.Close(); closeErr != nil {
+            serverLog.Error(ctx, "cannot flush dead letters", "error", closeErr)
+        }
+    }
+    if fileAuditStore != nil {
+        if closeErr := fileAuditStore.Close(); closeErr != nil {
+            serverLog.Error(ctx, "cannot flush audit log", "error", closeErr)
+        }
     }
 
     if err != nil {
+        shutdownTracing()
         log.Fatalf("cannot run start server: %v", err)
     }
 }
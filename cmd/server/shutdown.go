@@ -0,0 +1,96 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "sync/atomic"
+    "time"
+
+    "google.golang.org/grpc"
+)
+
+// serveUntilShutdown 运行服务直到服务出错或者 ctx 结束（收到退出信号）
+// ctx 结束后调用 shutdown 停止服务，shutdown 的上下文在 timeout 后超时，之后需要强制关闭
+func serveUntilShutdown(
+    ctx context.Context,
+    timeout time.Duration,
+    serve func() error,
+    shutdown func(ctx context.Context),
+) error {
+    errc := make(chan error, 1)
+    go func() {
+        errc <- serve()
+    }()
+
+    select {
+    case err := <-errc:
+        return err
+    case <-ctx.Done():
+    }
+
+    serverLog.Info(ctx, "shutting down, waiting for in-flight requests", "timeout", timeout)
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    shutdown(shutdownCtx)
+
+    // 正常停止后 Serve 返回 nil 或者 http.ErrServerClosed
+    if err := <-errc; err != nil && !errors.Is(err, http.ErrServerClosed) {
+        return err
+    }
+    serverLog.Info(ctx, "server stopped")
+    return nil
+}
+
+// gracefulStopGRPC 停止接收新的连接和请求，等待进行中的 RPC 完成，ctx 结束后强制关闭
+func gracefulStopGRPC(ctx context.Context, grpcServer *grpc.Server) {
+    done := make(chan struct{})
+    go func() {
+        grpcServer.GracefulStop()
+        close(done)
+    }()
+
+    select {
+    case <-done:
+    case <-ctx.Done():
+        serverLog.Warn(ctx, "shutdown deadline exceeded, closing remaining gRPC connections")
+        grpcServer.Stop()
+        <-done
+    }
+}
+
+// shutdownHTTP 关闭 HTTP 服务的监听和空闲连接，等待进行中的请求完成，ctx 结束后强制关闭
+func shutdownHTTP(ctx context.Context, server *http.Server) {
+    if err := server.Shutdown(ctx); err != nil {
+        serverLog.Warn(ctx, "shutdown deadline exceeded, closing remaining HTTP connections", "error", err)
+        server.Close()
+    }
+}
+
+// inflightHandler 记录进行中的请求数
+// h2c 和 grpc.Server.ServeHTTP 处理的请求不受 http.Server.Shutdown 管理，需要单独等待
+type inflightHandler struct {
+    handler http.Handler
+    active  int64
+}
+
+func (h *inflightHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    atomic.AddInt64(&h.active, 1)
+    defer atomic.AddInt64(&h.active, -1)
+    h.handler.ServeHTTP(w, r)
+}
+
+// wait 等待所有进行中的请求完成，ctx 结束时返回 false
+func (h *inflightHandler) wait(ctx context.Context) bool {
+    ticker := time.NewTicker(50 * time.Millisecond)
+    defer ticker.Stop()
+
+    for atomic.LoadInt64(&h.active) > 0 {
+        select {
+        case <-ticker.C:
+        case <-ctx.Done():
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+    "context"
+    "net"
+    "net/http"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+)
+
+func TestServeUntilShutdownDrainsRequests(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    require.NoError(t, err)
+
+    started := make(chan struct{})
+    handler := &inflightHandler{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        close(started)
+        time.Sleep(200 * time.Millisecond)
+        w.WriteHeader(http.StatusOK)
+    })}
+    server := &http.Server{Handler: handler}
+
+    ctx, cancel := context.WithCancel(context.Background())
+    served := make(chan error, 1)
+    go func() {
+        served <- serveUntilShutdown(ctx, time.Second, func() error {
+            return server.Serve(listener)
+        }, func(ctx context.Context) {
+            shutdownHTTP(ctx, server)
+            require.True(t, handler.wait(ctx))
+        })
+    }()
+
+    responded := make(chan int, 1)
+    go func() {
+        res, err := http.Get("http://" + listener.Addr().String())
+        if err != nil {
+            responded <- 0
+            return
+        }
+        res.Body.Close()
+        responded <- res.StatusCode
+    }()
+
+    // 收到退出信号时进行中的请求可以正常完成
+    <-started
+    cancel()
+    require.Equal(t, http.StatusOK, <-responded)
+    require.NoError(t, <-served)
+
+    _, err = http.Get("http://" + listener.Addr().String())
+    require.Error(t, err)
+}
+
+func TestInflightHandlerWaitTimeout(t *testing.T) {
+    handler := &inflightHandler{handler: http.NotFoundHandler()}
+    handler.active = 1
+
+    ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+    defer cancel()
+    require.False(t, handler.wait(ctx))
+
+    handler.active = 0
+    require.True(t, handler.wait(context.Background()))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+    "context"
+    "time"
+
+    "github.com/xiusl/pcbook/service"
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/sdk/resource"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// tracingFlushTimeout 退出时写出剩余 span 的最长时间
+const tracingFlushTimeout = 5 * time.Second
+
+// setupTracing 按照配置设置全局的 TracerProvider，返回退出时写出剩余 span 的函数
+// 没有配置 tracing.file 时不记录 span，但仍然在 gRPC 和 REST 之间传递 traceparent
+func setupTracing(config TracingConfig) (func(), error) {
+    if config.File == "" {
+        return func() {}, nil
+    }
+
+    exporter, err := service.NewFileSpanExporter(config.File)
+    if err != nil {
+        return nil, err
+    }
+
+    provider := sdktrace.NewTracerProvider(
+        sdktrace.WithBatcher(exporter),
+        sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+        sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "pcbook"))),
+    )
+    otel.SetTracerProvider(provider)
+    serverLog.Info(context.Background(), "writing traces", "file", config.File, "sample_ratio", config.SampleRatio)
+
+    return func() {
+        ctx, cancel := context.WithTimeout(context.Background(), tracingFlushTimeout)
+        defer cancel()
+        if err := provider.Shutdown(ctx); err != nil {
+            serverLog.Error(ctx, "cannot flush traces", "error", err)
+        }
+    }, nil
+}
@@ -0,0 +1,317 @@
+package logging
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "go.opentelemetry.io/otel/trace"
+)
+
+// Level 日志级别
+type Level int32
+
+// 日志级别，低于组件级别的日志不会输出
+const (
+    LevelDebug Level = iota
+    LevelInfo
+    LevelWarn
+    LevelError
+)
+
+// String 级别的名称
+func (level Level) String() string {
+    switch level {
+    case LevelDebug:
+        return "debug"
+    case LevelInfo:
+        return "info"
+    case LevelWarn:
+        return "warn"
+    case LevelError:
+        return "error"
+    default:
+        return "level(" + strconv.Itoa(int(level)) + ")"
+    }
+}
+
+// ParseLevel 解析级别名称，不区分大小写
+func ParseLevel(name string) (Level, error) {
+    switch strings.ToLower(name) {
+    case "debug":
+        return LevelDebug, nil
+    case "info", "":
+        return LevelInfo, nil
+    case "warn", "warning":
+        return LevelWarn, nil
+    case "error":
+        return LevelError, nil
+    default:
+        return LevelInfo, fmt.Errorf("unknown log level %q", name)
+    }
+}
+
+// Config 日志配置
+type Config struct {
+    // Level 默认的级别，debug、info、warn 或者 error
+    Level string `yaml:"level"`
+    // Format json 或者 text
+    Format string `yaml:"format"`
+    // Components 单独设置级别的组件，例如 laptop: debug
+    Components map[string]string `yaml:"components"`
+}
+
+// output 所有组件共用的输出
+type output struct {
+    mutex  sync.Mutex
+    writer io.Writer
+    json   bool
+}
+
+var (
+    // mutex 保护 loggers 和级别配置
+    mutex           sync.Mutex
+    loggers         = make(map[string]*Logger)
+    defaultLevel    = LevelInfo
+    componentLevels = make(map[string]Level)
+
+    current atomic.Value
+)
+
+func init() {
+    current.Store(&output{writer: os.Stderr})
+}
+
+// Configure 设置所有组件的输出和级别，已经创建的 Logger 立即生效
+func Configure(writer io.Writer, config Config) error {
+    level, err := ParseLevel(config.Level)
+    if err != nil {
+        return err
+    }
+
+    levels := make(map[string]Level, len(config.Components))
+    for component, name := range config.Components {
+        levels[component], err = ParseLevel(name)
+        if err != nil {
+            return fmt.Errorf("component %s: %w", component, err)
+        }
+    }
+
+    var json bool
+    switch config.Format {
+    case "json":
+        json = true
+    case "text", "":
+    default:
+        return fmt.Errorf("unknown log format %q", config.Format)
+    }
+
+    mutex.Lock()
+    defer mutex.Unlock()
+
+    defaultLevel = level
+    componentLevels = levels
+    for _, logger := range loggers {
+        atomic.StoreInt32(&logger.level, int32(levelOf(logger.component)))
+    }
+    current.Store(&output{writer: writer, json: json})
+    return nil
+}
+
+// levelOf 组件的级别，调用方需要持有 mutex
+func levelOf(component string) Level {
+    if level, ok := componentLevels[component]; ok {
+        return level
+    }
+    return defaultLevel
+}
+
+// Logger 一个组件的日志，同一个组件共用一个 Logger
+type Logger struct {
+    component string
+    level     int32
+}
+
+// New 返回组件的 Logger，可以在包初始化时创建，之后调用 Configure 同样生效
+func New(component string) *Logger {
+    mutex.Lock()
+    defer mutex.Unlock()
+
+    if logger, ok := loggers[component]; ok {
+        return logger
+    }
+    logger := &Logger{component: component, level: int32(levelOf(component))}
+    loggers[component] = logger
+    return logger
+}
+
+// Enabled 是否输出 level 级别的日志
+// 参数需要额外计算的调试日志先检查 Enabled，关闭时不产生任何开销
+func (logger *Logger) Enabled(level Level) bool {
+    return int32(level) >= atomic.LoadInt32(&logger.level)
+}
+
+// Log 输出 level 级别的日志，fields 为交替的键和值
+func (logger *Logger) Log(ctx context.Context, level Level, msg string, fields ...interface{}) {
+    if logger.Enabled(level) {
+        logger.write(ctx, level, msg, fields)
+    }
+}
+
+// Debug 输出调试日志
+func (logger *Logger) Debug(ctx context.Context, msg string, fields ...interface{}) {
+    if logger.Enabled(LevelDebug) {
+        logger.write(ctx, LevelDebug, msg, fields)
+    }
+}
+
+// Info 输出普通日志
+func (logger *Logger) Info(ctx context.Context, msg string, fields ...interface{}) {
+    if logger.Enabled(LevelInfo) {
+        logger.write(ctx, LevelInfo, msg, fields)
+    }
+}
+
+// Warn 输出警告日志
+func (logger *Logger) Warn(ctx context.Context, msg string, fields ...interface{}) {
+    if logger.Enabled(LevelWarn) {
+        logger.write(ctx, LevelWarn, msg, fields)
+    }
+}
+
+// Error 输出错误日志
+func (logger *Logger) Error(ctx context.Context, msg string, fields ...interface{}) {
+    if logger.Enabled(LevelError) {
+        logger.write(ctx, LevelError, msg, fields)
+    }
+}
+
+// Writer 返回把每次写入作为一条 level 级别日志的 io.Writer，用于接管标准库 log 的输出
+func (logger *Logger) Writer(level Level) io.Writer {
+    return &lineWriter{logger, level}
+}
+
+type lineWriter struct {
+    logger *Logger
+    level  Level
+}
+
+func (writer *lineWriter) Write(p []byte) (int, error) {
+    if writer.logger.Enabled(writer.level) {
+        msg := strings.TrimRight(string(p), "\n")
+        writer.logger.write(context.Background(), writer.level, msg, nil)
+    }
+    return len(p), nil
+}
+
+// field 一个键值对
+type field struct {
+    key   string
+    value interface{}
+}
+
+func (logger *Logger) write(ctx context.Context, level Level, msg string, args []interface{}) {
+    fields := make([]field, 0, len(args)/2+2)
+    if ctx != nil {
+        if id := RequestIDFromContext(ctx); id != "" {
+            fields = append(fields, field{"request_id", id})
+        }
+        if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+            fields = append(fields, field{"trace_id", span.TraceID().String()})
+        }
+    }
+    for i := 0; i < len(args); i += 2 {
+        key, ok := args[i].(string)
+        if !ok {
+            key = fmt.Sprint(args[i])
+        }
+        if i+1 >= len(args) {
+            fields = append(fields, field{key, "!MISSING"})
+            break
+        }
+        value := args[i+1]
+        if isSecret(key) {
+            value = Redacted
+        }
+        fields = append(fields, field{key, value})
+    }
+
+    out := current.Load().(*output)
+    var buffer bytes.Buffer
+    now := time.Now().UTC()
+    if out.json {
+        buffer.WriteString(`{"time":"`)
+        buffer.WriteString(now.Format(time.RFC3339Nano))
+        buffer.WriteString(`","level":"`)
+        buffer.WriteString(level.String())
+        buffer.WriteString(`","component":`)
+        writeJSONValue(&buffer, logger.component)
+        buffer.WriteString(`,"msg":`)
+        writeJSONValue(&buffer, msg)
+        for _, f := range fields {
+            buffer.WriteByte(',')
+            writeJSONValue(&buffer, f.key)
+            buffer.WriteByte(':')
+            writeJSONValue(&buffer, jsonValue(f.value))
+        }
+        buffer.WriteString("}\n")
+    } else {
+        buffer.WriteString(now.Format("2006-01-02T15:04:05.000Z07:00"))
+        buffer.WriteByte(' ')
+        buffer.WriteString(strings.ToUpper(level.String()))
+        buffer.WriteByte(' ')
+        buffer.WriteString(logger.component)
+        buffer.WriteString(": ")
+        buffer.WriteString(msg)
+        for _, f := range fields {
+            buffer.WriteByte(' ')
+            buffer.WriteString(f.key)
+            buffer.WriteByte('=')
+            buffer.WriteString(textValue(f.value))
+        }
+        buffer.WriteByte('\n')
+    }
+
+    out.mutex.Lock()
+    out.writer.Write(buffer.Bytes())
+    out.mutex.Unlock()
+}
+
+// jsonValue 把值转换为可以直接编码为 JSON 的类型
+func jsonValue(value interface{}) interface{} {
+    switch v := value.(type) {
+    case nil, string, bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+        return v
+    case error:
+        return v.Error()
+    case fmt.Stringer:
+        return v.String()
+    default:
+        return fmt.Sprint(v)
+    }
+}
+
+func writeJSONValue(buffer *bytes.Buffer, value interface{}) {
+    data, err := json.Marshal(value)
+    if err != nil {
+        data, _ = json.Marshal(fmt.Sprint(value))
+    }
+    buffer.Write(data)
+}
+
+// textValue 文本格式的值，包含空格或者引号的字符串加上引号
+func textValue(value interface{}) string {
+    text := fmt.Sprint(jsonValue(value))
+    if text == "" || strings.ContainsAny(text, " \t\n\"=") {
+        return strconv.Quote(text)
+    }
+    return text
+}
@@ -0,0 +1,158 @@
+package logging_test
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "os"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/logging"
+)
+
+// configure 在测试期间把日志写入 buffer
+func configure(t *testing.T, config logging.Config) *bytes.Buffer {
+    var buffer bytes.Buffer
+    require.NoError(t, logging.Configure(&buffer, config))
+    t.Cleanup(func() {
+        logging.Configure(os.Stderr, logging.Config{})
+    })
+    return &buffer
+}
+
+// readLines 解析 JSON 格式的日志
+func readLines(t *testing.T, buffer *bytes.Buffer) []map[string]interface{} {
+    var lines []map[string]interface{}
+    scanner := bufio.NewScanner(buffer)
+    for scanner.Scan() {
+        line := make(map[string]interface{})
+        require.NoError(t, json.Unmarshal(scanner.Bytes(), &line), scanner.Text())
+        lines = append(lines, line)
+    }
+    return lines
+}
+
+func TestLoggerJSON(t *testing.T) {
+    buffer := configure(t, logging.Config{
+        Level:      "info",
+        Format:     "json",
+        Components: map[string]string{"test-verbose": "debug"},
+    })
+
+    logger := logging.New("test")
+    verbose := logging.New("test-verbose")
+    ctx := logging.ContextWithRequestID(context.Background(), "req-1")
+
+    logger.Debug(ctx, "hidden")
+    verbose.Debug(ctx, "shown", "count", 3)
+    logger.Info(ctx, "login",
+        "username", "alice",
+        "password", "Book-Keeper-42",
+        "access_token", "eyJhbGciOi",
+        "error", errors.New("boom"),
+        "duration", 1500*time.Millisecond,
+        "odd",
+    )
+
+    lines := readLines(t, buffer)
+    require.Len(t, lines, 2)
+
+    require.Equal(t, "debug", lines[0]["level"])
+    require.Equal(t, "test-verbose", lines[0]["component"])
+    require.Equal(t, "shown", lines[0]["msg"])
+    require.Equal(t, float64(3), lines[0]["count"])
+
+    line := lines[1]
+    require.Equal(t, "info", line["level"])
+    require.Equal(t, "test", line["component"])
+    require.Equal(t, "req-1", line["request_id"])
+    require.Equal(t, "alice", line["username"])
+    require.Equal(t, logging.Redacted, line["password"])
+    require.Equal(t, logging.Redacted, line["access_token"])
+    require.Equal(t, "boom", line["error"])
+    require.Equal(t, "1.5s", line["duration"])
+    require.Equal(t, "!MISSING", line["odd"])
+    require.NotContains(t, buffer.String(), "Book-Keeper-42")
+}
+
+func TestLoggerText(t *testing.T) {
+    buffer := configure(t, logging.Config{Level: "warn"})
+
+    logger := logging.New("test")
+    logger.Info(context.Background(), "hidden")
+    logger.Warn(context.Background(), "image too large", "size", 2048, "laptop_id", "a b")
+
+    out := strings.TrimSpace(buffer.String())
+    require.NotContains(t, out, "hidden")
+    require.Contains(t, out, " WARN test: image too large size=2048 laptop_id=\"a b\"")
+}
+
+func TestLoggerStandardLogWriter(t *testing.T) {
+    buffer := configure(t, logging.Config{Format: "json"})
+
+    writer := logging.New("test").Writer(logging.LevelError)
+    _, err := writer.Write([]byte("cannot start server\n"))
+    require.NoError(t, err)
+
+    lines := readLines(t, buffer)
+    require.Len(t, lines, 1)
+    require.Equal(t, "error", lines[0]["level"])
+    require.Equal(t, "cannot start server", lines[0]["msg"])
+}
+
+func TestLoggerDisabledDoesNotAllocate(t *testing.T) {
+    configure(t, logging.Config{Level: "info"})
+
+    logger := logging.New("test")
+    ctx := context.Background()
+    id := "4bf92f35-77b3-4da6-a3ce-929d0e0e4736"
+
+    allocs := testing.AllocsPerRun(100, func() {
+        logger.Debug(ctx, "wait to receive more data")
+        if logger.Enabled(logging.LevelDebug) {
+            logger.Debug(ctx, "check laptop", "laptop_id", id)
+        }
+    })
+    require.Equal(t, 0.0, allocs)
+}
+
+func TestConfigureInvalid(t *testing.T) {
+    testCases := []struct {
+        name   string
+        config logging.Config
+    }{
+        {"level", logging.Config{Level: "verbose"}},
+        {"format", logging.Config{Format: "xml"}},
+        {"component", logging.Config{Components: map[string]string{"laptop": "trace"}}},
+    }
+
+    for _, tc := range testCases {
+        tc := tc
+        t.Run(tc.name, func(t *testing.T) {
+            require.Error(t, logging.Configure(&bytes.Buffer{}, tc.config))
+        })
+    }
+}
+
+func TestValidRequestID(t *testing.T) {
+    testCases := []struct {
+        id    string
+        valid bool
+    }{
+        {"4bf92f35-77b3-4da6-a3ce-929d0e0e4736", true},
+        {"client:retry_1.2", true},
+        {"", false},
+        {"with space", false},
+        {"line\nbreak", false},
+        {strings.Repeat("a", 129), false},
+    }
+
+    for _, tc := range testCases {
+        require.Equal(t, tc.valid, logging.ValidRequestID(tc.id), tc.id)
+    }
+}
@@ -0,0 +1,29 @@
+package logging
+
+import "strings"
+
+// Redacted 替换密钥和密码的占位符
+const Redacted = "REDACTED"
+
+// secretKeys 字段名包含这些字符串时不输出字段的值
+var secretKeys = []string{
+    "password",
+    "token",
+    "secret",
+    "authorization",
+    "api_key",
+    "apikey",
+    "challenge",
+    "otp",
+}
+
+// isSecret 判断字段是否保存密钥、密码或者令牌
+func isSecret(key string) bool {
+    key = strings.ToLower(key)
+    for _, secret := range secretKeys {
+        if strings.Contains(key, secret) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,47 @@
+package logging
+
+import (
+    "context"
+
+    "github.com/google/uuid"
+)
+
+// RequestIDKey 传递请求 ID 的 gRPC 元数据，REST 网关对应 X-Request-Id 请求头
+const RequestIDKey = "x-request-id"
+
+// maxRequestIDLength 调用方传入的请求 ID 的最大长度
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// ContextWithRequestID 返回带有请求 ID 的上下文，之后这个上下文的日志都会带上请求 ID
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+    return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext 返回上下文中的请求 ID，没有时返回空字符串
+func RequestIDFromContext(ctx context.Context) string {
+    id, _ := ctx.Value(requestIDKey{}).(string)
+    return id
+}
+
+// NewRequestID 生成一个新的请求 ID
+func NewRequestID() string {
+    return uuid.New().String()
+}
+
+// ValidRequestID 调用方传入的请求 ID 只能包含字母、数字和 -_.:，避免伪造日志内容
+func ValidRequestID(id string) bool {
+    if id == "" || len(id) > maxRequestIDLength {
+        return false
+    }
+    for _, c := range id {
+        switch {
+        case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+        case c == '-' || c == '_' || c == '.' || c == ':':
+        default:
+            return false
+        }
+    }
+    return true
+}
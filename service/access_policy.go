@@ -0,0 +1,435 @@
+package service
+
+import (
+    "context"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/xiusl/pcbook/logging"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "gopkg.in/yaml.v3"
+)
+
+// policyLog 访问控制策略的日志
+var policyLog = logging.New("policy")
+
+// AccessPolicy 声明式的 RPC 访问控制策略
+// 规则按顺序匹配，第一条匹配的规则生效；没有规则匹配的方法一律拒绝
+type AccessPolicy struct {
+    mutex    sync.RWMutex
+    filename string
+    modTime  time.Time
+    compiled *compiledPolicy
+    done     chan struct{}
+}
+
+// policyFile 策略文件的结构，支持 YAML 和 JSON
+type policyFile struct {
+    Roles map[string]roleSpec `yaml:"roles"`
+    Rules []ruleSpec          `yaml:"rules"`
+}
+
+type roleSpec struct {
+    Inherits []string `yaml:"inherits"`
+    // RequireMFA 只通过单一因素登录（没有两步验证）的用户不能使用该角色
+    RequireMFA bool `yaml:"require_mfa"`
+}
+
+type ruleSpec struct {
+    Methods []string `yaml:"methods"`
+    // Public 无需认证即可访问
+    Public bool `yaml:"public"`
+    // Authenticated 任何通过认证的调用方都可以访问，不检查角色
+    Authenticated bool     `yaml:"authenticated"`
+    Roles         []string `yaml:"roles"`
+}
+
+type compiledPolicy struct {
+    rules []ruleSpec
+    // 角色 -> 该角色拥有的全部角色（包含继承来的）
+    effectiveRoles map[string]map[string]bool
+    // 需要两步验证的角色，包含继承了这些角色的角色
+    mfaRoles map[string]bool
+}
+
+// LoadAccessPolicy 从文件中加载访问控制策略
+func LoadAccessPolicy(filename string) (*AccessPolicy, error) {
+    info, err := os.Stat(filename)
+    if err != nil {
+        return nil, fmt.Errorf("cannot stat policy file: %w", err)
+    }
+
+    compiled, err := compilePolicyFile(filename)
+    if err != nil {
+        return nil, err
+    }
+
+    policy := &AccessPolicy{
+        filename: filename,
+        modTime:  info.ModTime(),
+        compiled: compiled,
+    }
+    return policy, nil
+}
+
+// ParseAccessPolicy 从 YAML/JSON 数据中解析访问控制策略
+func ParseAccessPolicy(data []byte) (*AccessPolicy, error) {
+    compiled, err := compilePolicy(data)
+    if err != nil {
+        return nil, err
+    }
+    return &AccessPolicy{compiled: compiled}, nil
+}
+
+// IsPublic 判断方法是否无需认证即可访问
+func (policy *AccessPolicy) IsPublic(method string) bool {
+    rule := policy.current().match(method)
+    return rule != nil && rule.Public
+}
+
+// Allow 判断角色是否可以访问指定方法，不考虑两步验证
+func (policy *AccessPolicy) Allow(method string, role string) bool {
+    compiled := policy.current()
+    rule := compiled.match(method)
+    return rule != nil && compiled.grants(rule, role)
+}
+
+// RequiresMFA 判断角色是否要求两步验证
+func (policy *AccessPolicy) RequiresMFA(role string) bool {
+    return policy.current().mfaRoles[role]
+}
+
+// Authorize 判断通过认证的调用方是否可以访问指定方法
+func (policy *AccessPolicy) Authorize(method string, principal *Principal) error {
+    return policy.Check(method).Authorize(principal)
+}
+
+// Check 取当前策略中匹配方法的规则，之后的判断都使用这一份策略，不受热加载影响
+func (policy *AccessPolicy) Check(method string) *AccessDecision {
+    compiled := policy.current()
+    return &AccessDecision{
+        compiled: compiled,
+        rule:     compiled.match(method),
+    }
+}
+
+// AccessDecision 同一份策略对一个方法的访问判断
+type AccessDecision struct {
+    compiled *compiledPolicy
+    rule     *ruleSpec
+}
+
+// Covered 判断方法是否被策略中的某条规则覆盖
+func (decision *AccessDecision) Covered() bool {
+    return decision.rule != nil
+}
+
+// Public 判断方法是否无需认证即可访问
+func (decision *AccessDecision) Public() bool {
+    return decision.rule != nil && decision.rule.Public
+}
+
+// Authorize 判断通过认证的调用方是否可以访问方法
+func (decision *AccessDecision) Authorize(principal *Principal) error {
+    compiled, rule := decision.compiled, decision.rule
+    if rule == nil {
+        return status.Errorf(codes.PermissionDenied, "no permission to access this RPC")
+    }
+    if rule.Public || rule.Authenticated {
+        return nil
+    }
+
+    mfaRequired := false
+    for _, role := range principal.Roles {
+        if !compiled.grants(rule, role) {
+            continue
+        }
+        if compiled.mfaRoles[role] && principal.SingleFactor() {
+            mfaRequired = true
+            continue
+        }
+        return nil
+    }
+
+    if mfaRequired {
+        return status.Errorf(codes.PermissionDenied, "two-factor authentication is required to access this RPC")
+    }
+    return status.Errorf(codes.PermissionDenied, "no permission to access this RPC")
+}
+
+// Admin 判断调用方是否可以使用管理员权限，和 Authorize 一样，单一因素登录时不能使用要求两步验证的角色
+func (decision *AccessDecision) Admin(principal *Principal) bool {
+    compiled := decision.compiled
+    for _, role := range principal.Roles {
+        if !compiled.effectiveRoles[role][RoleAdmin] {
+            continue
+        }
+        if compiled.mfaRoles[role] && principal.SingleFactor() {
+            continue
+        }
+        return true
+    }
+    return false
+}
+
+// HasRole 判断策略中是否定义了角色
+func (policy *AccessPolicy) HasRole(role string) bool {
+    _, ok := policy.current().effectiveRoles[role]
+    return ok
+}
+
+// Inherits 判断角色是否拥有 parent 的权限，角色总是拥有自己的权限
+func (policy *AccessPolicy) Inherits(role string, parent string) bool {
+    return policy.current().effectiveRoles[role][parent]
+}
+
+// Covers 判断方法是否被策略中的某条规则覆盖
+func (policy *AccessPolicy) Covers(method string) bool {
+    return policy.current().match(method) != nil
+}
+
+// Validate 使用已注册的 gRPC 服务校验策略，每个方法模式都必须匹配到至少一个方法
+func (policy *AccessPolicy) Validate(services map[string]grpc.ServiceInfo) error {
+    return policy.current().validate(services)
+}
+
+// Watch 定时检查策略文件，文件变化时重新加载，新策略无效时保留旧策略
+func (policy *AccessPolicy) Watch(interval time.Duration, services map[string]grpc.ServiceInfo) {
+    policy.mutex.Lock()
+    if policy.done != nil || policy.filename == "" {
+        policy.mutex.Unlock()
+        return
+    }
+    done := make(chan struct{})
+    policy.done = done
+    policy.mutex.Unlock()
+
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-done:
+                return
+            case <-ticker.C:
+                reloaded, err := policy.reload(services)
+                if err != nil {
+                    policyLog.Error(context.Background(), "cannot reload access policy", "file", policy.filename, "error", err)
+                } else if reloaded {
+                    policyLog.Info(context.Background(), "access policy reloaded", "file", policy.filename)
+                }
+            }
+        }
+    }()
+}
+
+// Close 停止策略文件的监听
+func (policy *AccessPolicy) Close() {
+    policy.mutex.Lock()
+    defer policy.mutex.Unlock()
+
+    if policy.done != nil {
+        close(policy.done)
+        policy.done = nil
+    }
+}
+
+func (policy *AccessPolicy) current() *compiledPolicy {
+    policy.mutex.RLock()
+    defer policy.mutex.RUnlock()
+    return policy.compiled
+}
+
+func (policy *AccessPolicy) reload(services map[string]grpc.ServiceInfo) (bool, error) {
+    info, err := os.Stat(policy.filename)
+    if err != nil {
+        return false, err
+    }
+
+    policy.mutex.RLock()
+    unchanged := info.ModTime().Equal(policy.modTime)
+    policy.mutex.RUnlock()
+    if unchanged {
+        return false, nil
+    }
+
+    compiled, err := compilePolicyFile(policy.filename)
+    if err == nil && services != nil {
+        err = compiled.validate(services)
+    }
+
+    policy.mutex.Lock()
+    defer policy.mutex.Unlock()
+    // 无论成功与否都记录修改时间，避免对同一个错误文件反复报错
+    policy.modTime = info.ModTime()
+    if err != nil {
+        return false, err
+    }
+    policy.compiled = compiled
+    return true, nil
+}
+
+func compilePolicyFile(filename string) (*compiledPolicy, error) {
+    data, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return nil, fmt.Errorf("cannot read policy file: %w", err)
+    }
+
+    compiled, err := compilePolicy(data)
+    if err != nil {
+        return nil, fmt.Errorf("invalid policy file %s: %w", filename, err)
+    }
+    return compiled, nil
+}
+
+func compilePolicy(data []byte) (*compiledPolicy, error) {
+    file := &policyFile{}
+    if err := yaml.Unmarshal(data, file); err != nil {
+        return nil, fmt.Errorf("cannot parse policy: %w", err)
+    }
+
+    for role, spec := range file.Roles {
+        for _, parent := range spec.Inherits {
+            if _, ok := file.Roles[parent]; !ok {
+                return nil, fmt.Errorf("role %q inherits unknown role %q", role, parent)
+            }
+        }
+    }
+
+    effectiveRoles := make(map[string]map[string]bool)
+    mfaRoles := make(map[string]bool)
+    for role := range file.Roles {
+        owned := make(map[string]bool)
+        if err := collectRoles(file.Roles, role, owned, nil); err != nil {
+            return nil, err
+        }
+        effectiveRoles[role] = owned
+
+        for parent := range owned {
+            if file.Roles[parent].RequireMFA {
+                mfaRoles[role] = true
+            }
+        }
+    }
+
+    for i, rule := range file.Rules {
+        if len(rule.Methods) == 0 {
+            return nil, fmt.Errorf("rule %d has no methods", i)
+        }
+        kinds := 0
+        for _, set := range []bool{rule.Public, rule.Authenticated, len(rule.Roles) > 0} {
+            if set {
+                kinds++
+            }
+        }
+        if kinds != 1 {
+            return nil, fmt.Errorf("rule %d must be exactly one of public, authenticated or a list of roles", i)
+        }
+        for _, method := range rule.Methods {
+            if !strings.HasPrefix(method, "/") {
+                return nil, fmt.Errorf("rule %d: method %q must start with '/'", i, method)
+            }
+            if _, err := path.Match(method, ""); err != nil {
+                return nil, fmt.Errorf("rule %d: bad method pattern %q: %w", i, method, err)
+            }
+        }
+        for _, role := range rule.Roles {
+            if _, ok := file.Roles[role]; !ok {
+                return nil, fmt.Errorf("rule %d references unknown role %q", i, role)
+            }
+        }
+    }
+
+    compiled := &compiledPolicy{
+        rules:          file.Rules,
+        effectiveRoles: effectiveRoles,
+        mfaRoles:       mfaRoles,
+    }
+    return compiled, nil
+}
+
+// collectRoles 收集角色以及它继承的所有角色，同时检查循环继承
+func collectRoles(roles map[string]roleSpec, role string, owned map[string]bool, visiting []string) error {
+    for _, name := range visiting {
+        if name == role {
+            return fmt.Errorf("role inheritance cycle: %s -> %s", strings.Join(visiting, " -> "), role)
+        }
+    }
+    if owned[role] {
+        return nil
+    }
+
+    owned[role] = true
+    for _, parent := range roles[role].Inherits {
+        if err := collectRoles(roles, parent, owned, append(visiting, role)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// grants 判断规则是否授权给角色（包含继承来的角色）
+func (compiled *compiledPolicy) grants(rule *ruleSpec, role string) bool {
+    if rule.Public || rule.Authenticated {
+        return true
+    }
+
+    owned := compiled.effectiveRoles[role]
+    for _, allowed := range rule.Roles {
+        if owned[allowed] {
+            return true
+        }
+    }
+    return false
+}
+
+func (compiled *compiledPolicy) match(method string) *ruleSpec {
+    for i := range compiled.rules {
+        for _, pattern := range compiled.rules[i].Methods {
+            if ok, _ := path.Match(pattern, method); ok {
+                return &compiled.rules[i]
+            }
+        }
+    }
+    return nil
+}
+
+func (compiled *compiledPolicy) validate(services map[string]grpc.ServiceInfo) error {
+    var registered []string
+    for name, info := range services {
+        for _, method := range info.Methods {
+            registered = append(registered, fmt.Sprintf("/%s/%s", name, method.Name))
+        }
+    }
+    sort.Strings(registered)
+
+    for i, rule := range compiled.rules {
+        for _, pattern := range rule.Methods {
+            matched := false
+            for _, method := range registered {
+                if ok, _ := path.Match(pattern, method); ok {
+                    matched = true
+                    break
+                }
+            }
+            if !matched {
+                return fmt.Errorf("rule %d: method pattern %q matches no registered method", i, pattern)
+            }
+        }
+    }
+
+    for _, method := range registered {
+        if compiled.match(method) == nil {
+            policyLog.Warn(context.Background(), "access policy does not cover the method, it will be denied", "method", method)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,158 @@
+package service_test
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/health"
+    healthpb "google.golang.org/grpc/health/grpc_health_v1"
+    "google.golang.org/grpc/reflection"
+)
+
+const testPolicy = `
+roles:
+  user: {}
+  admin:
+    inherits: [user]
+rules:
+  - methods: [/xiusl.pcbook.AuthService/Login]
+    public: true
+  - methods: [/xiusl.pcbook.LaptopServices/RateLaptop]
+    roles: [user]
+  - methods: ["/xiusl.pcbook.LaptopServices/*"]
+    roles: [admin]
+`
+
+func TestAccessPolicyEvaluate(t *testing.T) {
+    policy, err := service.ParseAccessPolicy([]byte(testPolicy))
+    require.NoError(t, err)
+
+    const laptopService = "/xiusl.pcbook.LaptopServices/"
+
+    require.True(t, policy.IsPublic("/xiusl.pcbook.AuthService/Login"))
+    require.False(t, policy.IsPublic(laptopService+"CreateLaptop"))
+
+    require.True(t, policy.Allow(laptopService+"RateLaptop", "user"))
+    require.True(t, policy.Allow(laptopService+"RateLaptop", "admin"))
+    require.False(t, policy.Allow(laptopService+"CreateLaptop", "user"))
+    require.True(t, policy.Allow(laptopService+"CreateLaptop", "admin"))
+    require.False(t, policy.Allow(laptopService+"CreateLaptop", "unknown"))
+
+    // 默认拒绝
+    require.False(t, policy.Covers("/xiusl.pcbook.Other/Method"))
+    require.False(t, policy.Allow("/xiusl.pcbook.Other/Method", "admin"))
+}
+
+func TestAccessPolicyInvalid(t *testing.T) {
+    testCases := []struct {
+        name   string
+        policy string
+    }{
+        {
+            name:   "unknown_parent_role",
+            policy: "roles: {admin: {inherits: [root]}}\nrules: []",
+        },
+        {
+            name:   "inheritance_cycle",
+            policy: "roles: {a: {inherits: [b]}, b: {inherits: [a]}}\nrules: []",
+        },
+        {
+            name:   "unknown_rule_role",
+            policy: "roles: {user: {}}\nrules: [{methods: [/a/b], roles: [admin]}]",
+        },
+        {
+            name:   "no_roles_not_public",
+            policy: "roles: {user: {}}\nrules: [{methods: [/a/b]}]",
+        },
+        {
+            name:   "bad_pattern",
+            policy: "roles: {user: {}}\nrules: [{methods: [\"/a/[\"], roles: [user]}]",
+        },
+    }
+
+    for _, tc := range testCases {
+        t.Run(tc.name, func(t *testing.T) {
+            _, err := service.ParseAccessPolicy([]byte(tc.policy))
+            require.Error(t, err)
+        })
+    }
+}
+
+func TestAccessPolicyValidate(t *testing.T) {
+    grpcServer := grpc.NewServer()
+    pb.RegisterAuthServiceServer(grpcServer, service.NewAuthServer(nil, nil, nil, nil, service.DefaultPasswordPolicy()))
+    pb.RegisterLaptopServicesServer(grpcServer, service.NewLaptopServer(nil, nil, nil))
+    pb.RegisterAPIKeyServiceServer(grpcServer, service.NewAPIKeyServer(nil, nil))
+    pb.RegisterAuditServiceServer(grpcServer, service.NewAuditServer(nil))
+    pb.RegisterAlertServiceServer(grpcServer, service.NewAlertServer(nil, nil, service.DefaultAlertConfig()))
+    pb.RegisterWebhookServiceServer(grpcServer, service.NewWebhookServer(nil, nil, nil))
+    services := grpcServer.GetServiceInfo()
+
+    policy, err := service.ParseAccessPolicy([]byte(testPolicy))
+    require.NoError(t, err)
+    require.NoError(t, policy.Validate(services))
+
+    shipped, err := service.LoadAccessPolicy("../config/policy.yaml")
+    require.NoError(t, err)
+    reflection.Register(grpcServer)
+    healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+    require.NoError(t, shipped.Validate(grpcServer.GetServiceInfo()))
+
+    typo, err := service.ParseAccessPolicy([]byte(
+        "roles: {admin: {}}\nrules: [{methods: [/xiusl.pcbook.LatopServices/CreateLaptop], roles: [admin]}]",
+    ))
+    require.NoError(t, err)
+    require.Error(t, typo.Validate(services))
+}
+
+func TestAccessPolicyReload(t *testing.T) {
+    dir, err := ioutil.TempDir("", "policy")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    filename := filepath.Join(dir, "policy.yaml")
+    require.NoError(t, ioutil.WriteFile(filename, []byte(testPolicy), 0644))
+
+    policy, err := service.LoadAccessPolicy(filename)
+    require.NoError(t, err)
+    require.False(t, policy.IsPublic("/xiusl.pcbook.LaptopServices/SearchLaptop"))
+    decision := policy.Check("/xiusl.pcbook.LaptopServices/SearchLaptop")
+
+    policy.Watch(10*time.Millisecond, nil)
+    defer policy.Close()
+
+    // 无效的策略不会替换当前策略
+    require.NoError(t, ioutil.WriteFile(filename, []byte("rules: [{methods: [/a/b]}]"), 0644))
+    require.NoError(t, os.Chtimes(filename, time.Now(), time.Now().Add(time.Second)))
+    time.Sleep(50 * time.Millisecond)
+    require.True(t, policy.Allow("/xiusl.pcbook.LaptopServices/CreateLaptop", "admin"))
+
+    reordered := `
+roles:
+  admin: {}
+rules:
+  - methods: [/xiusl.pcbook.LaptopServices/SearchLaptop]
+    public: true
+  - methods: ["/xiusl.pcbook.LaptopServices/*"]
+    roles: [admin]
+`
+    require.NoError(t, ioutil.WriteFile(filename, []byte(reordered), 0644))
+    require.NoError(t, os.Chtimes(filename, time.Now(), time.Now().Add(2*time.Second)))
+
+    require.Eventually(t, func() bool {
+        return policy.IsPublic("/xiusl.pcbook.LaptopServices/SearchLaptop")
+    }, time.Second, 10*time.Millisecond)
+
+    // 重新加载之前取得的判断仍然使用原来的策略
+    require.True(t, decision.Covered())
+    require.False(t, decision.Public())
+    require.Error(t, decision.Authorize(&service.Principal{Username: "bob", Roles: []string{"user"}}))
+    require.NoError(t, decision.Authorize(&service.Principal{Username: "alice", Roles: []string{"admin"}}))
+}
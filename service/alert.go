@@ -0,0 +1,315 @@
+package service
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/xiusl/pcbook/logging"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/serializer"
+    "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// alertLog 价格提醒相关的日志
+var alertLog = logging.New("alert")
+
+// alertSubscriberBuffer 每个订阅缓存的提醒数，订阅方处理太慢时丢弃新的提醒
+const alertSubscriberBuffer = 64
+
+// AlertConfig 价格提醒配置
+type AlertConfig struct {
+    // MaxPerUser 每个用户最多创建的提醒数
+    MaxPerUser int `yaml:"max_per_user"`
+    // WebhookTimeout 向 webhook 发送一个提醒的超时时间
+    WebhookTimeout time.Duration `yaml:"webhook_timeout"`
+    // WebhookWorkers 并发发送 webhook 的数量
+    WebhookWorkers int `yaml:"webhook_workers"`
+    // WebhookQueueSize 等待发送的 webhook 队列长度，队列满时丢弃新的提醒
+    WebhookQueueSize int `yaml:"webhook_queue_size"`
+    // AllowPrivateAddresses 允许发送到本机和内网地址，只用于测试
+    AllowPrivateAddresses bool `yaml:"-"`
+}
+
+// DefaultAlertConfig 默认的价格提醒配置
+func DefaultAlertConfig() AlertConfig {
+    return AlertConfig{
+        MaxPerUser:       20,
+        WebhookTimeout:   5 * time.Second,
+        WebhookWorkers:   4,
+        WebhookQueueSize: 256,
+    }
+}
+
+// Validate 检查价格提醒配置
+func (config AlertConfig) Validate() error {
+    if config.MaxPerUser < 1 {
+        return fmt.Errorf("max_per_user must be at least 1")
+    }
+    if config.WebhookTimeout <= 0 {
+        return fmt.Errorf("webhook_timeout must be positive")
+    }
+    if config.WebhookWorkers < 1 {
+        return fmt.Errorf("webhook_workers must be at least 1")
+    }
+    if config.WebhookQueueSize < 1 {
+        return fmt.Errorf("webhook_queue_size must be at least 1")
+    }
+    return nil
+}
+
+// AlertEvaluator 订阅便携电脑的创建和更新事件，检查每个提醒并推送给提醒的创建者
+// 同一个便携电脑对同一个提醒只在第一次符合条件和之后每次降价时提醒，价格不变的更新不会重复提醒
+type AlertEvaluator struct {
+    alertStore  AlertStore
+    laptopStore LaptopStore
+    webhook     *http.Client
+    // webhooks 等待发送的 webhook，由 Run 启动的固定数量的协程发送
+    webhooks       chan alertWebhook
+    webhookWorkers int
+
+    mutex sync.Mutex
+    // notified 每个提醒符合条件的便携电脑，以及最后一次看到的价格
+    notified map[string]map[string]float64
+    // subscribers 每个用户的订阅
+    subscribers map[string]map[chan *pb.AlertNotification]bool
+    closed      bool
+}
+
+// NewAlertEvaluator 新建一个价格提醒检查器，需要调用 Run 开始检查
+func NewAlertEvaluator(alertStore AlertStore, laptopStore LaptopStore, config AlertConfig) *AlertEvaluator {
+    return &AlertEvaluator{
+        alertStore:     alertStore,
+        laptopStore:    laptopStore,
+        webhook:        newWebhookClient(config.WebhookTimeout, config.AllowPrivateAddresses),
+        webhooks:       make(chan alertWebhook, config.WebhookQueueSize),
+        webhookWorkers: config.WebhookWorkers,
+        notified:       make(map[string]map[string]float64),
+        subscribers:    make(map[string]map[chan *pb.AlertNotification]bool),
+    }
+}
+
+// alertWebhook 一个等待发送到 webhook 的提醒
+type alertWebhook struct {
+    url          string
+    notification *pb.AlertNotification
+}
+
+// Run 检查之后发生的便携电脑事件，直到 ctx 结束或者便携电脑存储不再接受订阅，结束时关闭所有的订阅
+// 检查期间同时发送 webhook，结束时不再发送队列中剩余的提醒
+func (evaluator *AlertEvaluator) Run(ctx context.Context) error {
+    defer evaluator.close()
+
+    workerCtx, cancel := context.WithCancel(ctx)
+    var wg sync.WaitGroup
+    for i := 0; i < evaluator.webhookWorkers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            evaluator.sendWebhooks(workerCtx)
+        }()
+    }
+    defer func() {
+        cancel()
+        wg.Wait()
+    }()
+
+    var next uint64
+    for {
+        err := evaluator.laptopStore.Watch(ctx, nil, next, func(event *pb.LaptopEvent) error {
+            next = event.GetRevision() + 1
+            evaluator.Evaluate(ctx, event)
+            return nil
+        })
+        if !errors.Is(err, ErrCompacted) {
+            return err
+        }
+        // 检查本身不会阻塞，只有在事件非常多的时候才会落后，跳过落后的事件继续检查
+        alertLog.Error(ctx, "alert evaluator fell behind, skipping laptop events", "error", err)
+        next = 0
+    }
+}
+
+// Evaluate 用一个便携电脑事件检查所有的提醒，只处理创建和更新事件
+func (evaluator *AlertEvaluator) Evaluate(ctx context.Context, event *pb.LaptopEvent) {
+    if event.GetType() != pb.LaptopEvent_CREATED && event.GetType() != pb.LaptopEvent_UPDATED {
+        return
+    }
+    alerts, err := evaluator.alertStore.All()
+    if err != nil {
+        alertLog.Error(ctx, "cannot load alerts", "error", err)
+        return
+    }
+
+    evaluator.mutex.Lock()
+    defer evaluator.mutex.Unlock()
+
+    laptop := event.GetLaptop()
+    price := laptop.GetPriceUsd()
+    active := make(map[string]bool, len(alerts))
+    for _, alert := range alerts {
+        active[alert.GetId()] = true
+        notified := evaluator.notified[alert.GetId()]
+        if notified == nil {
+            notified = make(map[string]float64)
+            evaluator.notified[alert.GetId()] = notified
+        }
+
+        // 不再符合条件的便携电脑再次符合条件时重新提醒
+        if !alertMatches(alert, laptop) {
+            delete(notified, laptop.GetId())
+            continue
+        }
+        previous, seen := notified[laptop.GetId()]
+        notified[laptop.GetId()] = price
+
+        notification := &pb.AlertNotification{
+            Id:      uuid.New().String(),
+            AlertId: alert.GetId(),
+            Laptop:  laptop,
+            Time:    timestamppb.Now(),
+        }
+        switch {
+        case !seen:
+            notification.Reason = pb.AlertNotification_AVAILABLE
+        case price < previous:
+            notification.Reason = pb.AlertNotification_PRICE_DROP
+            notification.PreviousPriceUsd = previous
+        default:
+            continue
+        }
+        evaluator.deliver(ctx, alert, notification)
+    }
+
+    // 清理已经删除的提醒
+    for alertID := range evaluator.notified {
+        if !active[alertID] {
+            delete(evaluator.notified, alertID)
+        }
+    }
+}
+
+// Subscribe 订阅 owner 的提醒，返回的函数用于取消订阅，检查器结束时通道会被关闭
+func (evaluator *AlertEvaluator) Subscribe(owner string) (<-chan *pb.AlertNotification, func()) {
+    evaluator.mutex.Lock()
+    defer evaluator.mutex.Unlock()
+
+    ch := make(chan *pb.AlertNotification, alertSubscriberBuffer)
+    if evaluator.closed {
+        close(ch)
+        return ch, func() {}
+    }
+    if evaluator.subscribers[owner] == nil {
+        evaluator.subscribers[owner] = make(map[chan *pb.AlertNotification]bool)
+    }
+    evaluator.subscribers[owner][ch] = true
+
+    return ch, func() {
+        evaluator.mutex.Lock()
+        defer evaluator.mutex.Unlock()
+
+        if evaluator.subscribers[owner][ch] {
+            delete(evaluator.subscribers[owner], ch)
+            if len(evaluator.subscribers[owner]) == 0 {
+                delete(evaluator.subscribers, owner)
+            }
+        }
+    }
+}
+
+// deliver 把提醒推送给 owner 的所有订阅，并放入 webhook 的发送队列，调用方需要持有锁
+func (evaluator *AlertEvaluator) deliver(ctx context.Context, alert *pb.Alert, notification *pb.AlertNotification) {
+    alertLog.Info(ctx, "alert triggered", "alert_id", alert.GetId(), "owner", alert.GetOwner(),
+        "laptop_id", notification.GetLaptop().GetId(), "reason", notification.GetReason())
+
+    for ch := range evaluator.subscribers[alert.GetOwner()] {
+        select {
+        case ch <- notification:
+            alertDeliveries.WithLabelValues("stream", "delivered").Inc()
+        default:
+            alertDeliveries.WithLabelValues("stream", "dropped").Inc()
+            alertLog.Warn(ctx, "alert subscriber is too slow, dropping notification", "alert_id", alert.GetId())
+        }
+    }
+
+    if alert.GetWebhookUrl() != "" {
+        select {
+        case evaluator.webhooks <- alertWebhook{url: alert.GetWebhookUrl(), notification: notification}:
+        default:
+            alertDeliveries.WithLabelValues("webhook", "dropped").Inc()
+            alertLog.Warn(ctx, "alert webhook queue is full, dropping notification", "alert_id", alert.GetId())
+        }
+    }
+}
+
+// sendWebhooks 从队列中取出提醒并发送，直到 ctx 结束
+func (evaluator *AlertEvaluator) sendWebhooks(ctx context.Context) {
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case webhook := <-evaluator.webhooks:
+            evaluator.sendWebhook(ctx, webhook.url, webhook.notification)
+        }
+    }
+}
+
+// sendWebhook 把提醒以 JSON 格式 POST 到 webhook，只尝试一次，失败时记录日志
+func (evaluator *AlertEvaluator) sendWebhook(ctx context.Context, url string, notification *pb.AlertNotification) {
+    err := func() error {
+        body, err := serializer.ConvertProtobufToJSON(notification)
+        if err != nil {
+            return fmt.Errorf("cannot marshal notification: %w", err)
+        }
+        req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBufferString(body))
+        if err != nil {
+            return err
+        }
+        req.Header.Set("Content-Type", "application/json")
+        res, err := evaluator.webhook.Do(req)
+        if err != nil {
+            return err
+        }
+        res.Body.Close()
+        if res.StatusCode < 200 || res.StatusCode >= 300 {
+            return fmt.Errorf("unexpected status %s", res.Status)
+        }
+        return nil
+    }()
+    if err != nil {
+        alertDeliveries.WithLabelValues("webhook", "failed").Inc()
+        alertLog.Warn(ctx, "cannot send alert to webhook", "alert_id", notification.GetAlertId(), "error", err)
+        return
+    }
+    alertDeliveries.WithLabelValues("webhook", "delivered").Inc()
+}
+
+// close 关闭所有的订阅，之后的订阅会立即结束
+func (evaluator *AlertEvaluator) close() {
+    evaluator.mutex.Lock()
+    defer evaluator.mutex.Unlock()
+
+    evaluator.closed = true
+    for owner, subscribers := range evaluator.subscribers {
+        for ch := range subscribers {
+            close(ch)
+        }
+        delete(evaluator.subscribers, owner)
+    }
+}
+
+// alertMatches 判断便携电脑是否符合提醒的条件，价格条件使用提醒的目标价格
+func alertMatches(alert *pb.Alert, laptop *pb.Laptop) bool {
+    filter := &pb.Filter{
+        MaxPriceUsd: alert.GetTargetPriceUsd(),
+        MinCpuCores: alert.GetFilter().GetMinCpuCores(),
+        MinCpuGhz:   alert.GetFilter().GetMinCpuGhz(),
+        MinRam:      alert.GetFilter().GetMinRam(),
+    }
+    return isQualified(normalizeFilter(filter), laptop)
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+    "context"
+    "errors"
+
+    "github.com/google/uuid"
+    "github.com/xiusl/pcbook/pb"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// AlertServer 管理和订阅价格提醒的服务，提醒属于创建它的用户
+type AlertServer struct {
+    alertStore AlertStore
+    evaluator  *AlertEvaluator
+    config     AlertConfig
+}
+
+// NewAlertServer 创建一个价格提醒服务
+func NewAlertServer(alertStore AlertStore, evaluator *AlertEvaluator, config AlertConfig) *AlertServer {
+    return &AlertServer{
+        alertStore: alertStore,
+        evaluator:  evaluator,
+        config:     config,
+    }
+}
+
+// CreateAlert 为调用方创建一个价格提醒
+func (server *AlertServer) CreateAlert(ctx context.Context, req *pb.CreateAlertRequest) (*pb.CreateAlertResponse, error) {
+    owner, err := alertOwner(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    existing, err := server.alertStore.List(owner)
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot list alerts: %v", err)
+    }
+    if len(existing) >= server.config.MaxPerUser {
+        return nil, status.Errorf(codes.ResourceExhausted, "at most %d alerts are allowed per user", server.config.MaxPerUser)
+    }
+
+    alert := &pb.Alert{
+        Id:             uuid.New().String(),
+        Owner:          owner,
+        Name:           req.GetName(),
+        Filter:         req.GetFilter(),
+        TargetPriceUsd: req.GetTargetPriceUsd(),
+        WebhookUrl:     req.GetWebhookUrl(),
+        CreatedAt:      timestamppb.Now(),
+    }
+    if err := server.alertStore.Save(alert); err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot save alert: %v", err)
+    }
+    alertLog.Info(ctx, "alert created", "alert_id", alert.Id, "owner", owner)
+
+    res := &pb.CreateAlertResponse{Alert: alert}
+    return res, nil
+}
+
+// ListAlerts 列出调用方创建的所有提醒
+func (server *AlertServer) ListAlerts(ctx context.Context, req *pb.ListAlertsRequest) (*pb.ListAlertsResponse, error) {
+    owner, err := alertOwner(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    alerts, err := server.alertStore.List(owner)
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot list alerts: %v", err)
+    }
+    res := &pb.ListAlertsResponse{Alerts: alerts}
+    return res, nil
+}
+
+// DeleteAlert 删除调用方创建的提醒，其他用户的提醒按不存在处理
+func (server *AlertServer) DeleteAlert(ctx context.Context, req *pb.DeleteAlertRequest) (*pb.DeleteAlertResponse, error) {
+    owner, err := alertOwner(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    err = server.alertStore.Delete(owner, req.GetId())
+    if errors.Is(err, ErrNotFound) {
+        return nil, status.Errorf(codes.NotFound, "alert %s doesn't exist", req.GetId())
+    }
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot delete alert: %v", err)
+    }
+    alertLog.Info(ctx, "alert deleted", "alert_id", req.GetId(), "owner", owner)
+    return &pb.DeleteAlertResponse{}, nil
+}
+
+// SubscribeAlerts 推送调用方所有提醒的通知，直到调用方断开或者服务端退出
+// 只推送订阅期间触发的提醒，没有订阅时触发的提醒只会发送到提醒的 webhook
+func (server *AlertServer) SubscribeAlerts(req *pb.SubscribeAlertsRequest, stream pb.AlertService_SubscribeAlertsServer) error {
+    owner, err := alertOwner(stream.Context())
+    if err != nil {
+        return err
+    }
+
+    notifications, cancel := server.evaluator.Subscribe(owner)
+    defer cancel()
+    alertLog.Info(stream.Context(), "subscribe alerts", "owner", owner)
+
+    for {
+        select {
+        case <-stream.Context().Done():
+            return contextError(stream.Context())
+        case notification, ok := <-notifications:
+            if !ok {
+                return status.Error(codes.Unavailable, "server is shutting down, subscribe again on another server")
+            }
+            if err := stream.Send(&pb.SubscribeAlertsResponse{Notification: notification}); err != nil {
+                return status.Errorf(codes.Internal, "cannot send the notification: %v", err)
+            }
+        }
+    }
+}
+
+// alertOwner 返回提醒的所有者，提醒属于登录的用户，服务账号的 API key 不能使用提醒
+func alertOwner(ctx context.Context) (string, error) {
+    principal, ok := PrincipalFromContext(ctx)
+    if !ok || principal.Username == "" {
+        return "", status.Error(codes.Unauthenticated, "alerts require a signed in user")
+    }
+    if principal.APIKeyID != "" {
+        return "", status.Error(codes.PermissionDenied, "alerts belong to users and cannot be used with an api key")
+    }
+    return principal.Username, nil
+}
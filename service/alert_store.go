@@ -0,0 +1,96 @@
+package service
+
+import (
+    "sort"
+    "sync"
+
+    "github.com/xiusl/pcbook/pb"
+    "google.golang.org/protobuf/proto"
+)
+
+// AlertStore 存储价格提醒的接口
+type AlertStore interface {
+    Save(alert *pb.Alert) error
+    // Delete 删除 owner 创建的提醒，提醒不存在或者不属于 owner 时返回 ErrNotFound
+    Delete(owner string, id string) error
+    // List 按创建时间返回 owner 创建的所有提醒
+    List(owner string) ([]*pb.Alert, error)
+    // All 返回所有用户的提醒
+    All() ([]*pb.Alert, error)
+}
+
+// InMemoryAlertStore 在内存中存储价格提醒
+type InMemoryAlertStore struct {
+    mutex  sync.RWMutex
+    alerts map[string]*pb.Alert
+}
+
+// NewInMemoryAlertStore 新建一个价格提醒内存存储实例
+func NewInMemoryAlertStore() *InMemoryAlertStore {
+    return &InMemoryAlertStore{
+        alerts: make(map[string]*pb.Alert),
+    }
+}
+
+// Save 存储价格提醒到内存中
+func (store *InMemoryAlertStore) Save(alert *pb.Alert) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    if store.alerts[alert.GetId()] != nil {
+        return ErrAlreadyExists
+    }
+    store.alerts[alert.GetId()] = proto.Clone(alert).(*pb.Alert)
+    return nil
+}
+
+// Delete 删除 owner 创建的提醒
+func (store *InMemoryAlertStore) Delete(owner string, id string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    alert := store.alerts[id]
+    if alert == nil || alert.GetOwner() != owner {
+        return ErrNotFound
+    }
+    delete(store.alerts, id)
+    return nil
+}
+
+// List 按创建时间返回 owner 创建的所有提醒
+func (store *InMemoryAlertStore) List(owner string) ([]*pb.Alert, error) {
+    store.mutex.RLock()
+    defer store.mutex.RUnlock()
+
+    var alerts []*pb.Alert
+    for _, alert := range store.alerts {
+        if alert.GetOwner() == owner {
+            alerts = append(alerts, proto.Clone(alert).(*pb.Alert))
+        }
+    }
+    sortAlerts(alerts)
+    return alerts, nil
+}
+
+// All 按创建时间返回所有用户的提醒
+func (store *InMemoryAlertStore) All() ([]*pb.Alert, error) {
+    store.mutex.RLock()
+    defer store.mutex.RUnlock()
+
+    alerts := make([]*pb.Alert, 0, len(store.alerts))
+    for _, alert := range store.alerts {
+        alerts = append(alerts, proto.Clone(alert).(*pb.Alert))
+    }
+    sortAlerts(alerts)
+    return alerts, nil
+}
+
+func sortAlerts(alerts []*pb.Alert) {
+    sort.Slice(alerts, func(i, j int) bool {
+        a, b := alerts[i].GetCreatedAt().AsTime(), alerts[j].GetCreatedAt().AsTime()
+        if a.Equal(b) {
+            return alerts[i].GetId() < alerts[j].GetId()
+        }
+        return a.Before(b)
+    })
+}
@@ -0,0 +1,219 @@
+package service_test
+
+import (
+    "context"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/sample"
+    "github.com/xiusl/pcbook/serializer"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+// nextNotification 等待下一个提醒，超时返回 nil
+func nextNotification(notifications <-chan *pb.AlertNotification) *pb.AlertNotification {
+    select {
+    case notification := <-notifications:
+        return notification
+    case <-time.After(100 * time.Millisecond):
+        return nil
+    }
+}
+
+func TestAlertEvaluator(t *testing.T) {
+    alertStore := service.NewInMemoryAlertStore()
+    evaluator := service.NewAlertEvaluator(alertStore, service.NewInMemoryLaptopStore(), service.DefaultAlertConfig())
+
+    require.NoError(t, alertStore.Save(&pb.Alert{
+        Id:             "cheap",
+        Owner:          "alice",
+        Filter:         &pb.Filter{MinCpuCores: 2},
+        TargetPriceUsd: 1500,
+    }))
+    require.NoError(t, alertStore.Save(&pb.Alert{Id: "any", Owner: "bob"}))
+
+    alice, cancelAlice := evaluator.Subscribe("alice")
+    defer cancelAlice()
+    bob, cancelBob := evaluator.Subscribe("bob")
+    defer cancelBob()
+
+    laptop := sample.NewLaptop()
+    laptop.Cpu.NumberCores = 4
+    evaluate := func(eventType pb.LaptopEvent_Type, price float64) {
+        laptop.PriceUsd = price
+        evaluator.Evaluate(context.Background(), &pb.LaptopEvent{Type: eventType, Laptop: laptop})
+    }
+
+    // 高于目标价格时只提醒没有价格条件的提醒
+    evaluate(pb.LaptopEvent_CREATED, 2000)
+    require.Nil(t, nextNotification(alice))
+    notification := nextNotification(bob)
+    require.Equal(t, "any", notification.GetAlertId())
+    require.Equal(t, pb.AlertNotification_AVAILABLE, notification.GetReason())
+
+    // 降到目标价格以下
+    evaluate(pb.LaptopEvent_UPDATED, 1400)
+    notification = nextNotification(alice)
+    require.Equal(t, pb.AlertNotification_AVAILABLE, notification.GetReason())
+    require.Equal(t, laptop.Id, notification.GetLaptop().GetId())
+    notification = nextNotification(bob)
+    require.Equal(t, pb.AlertNotification_PRICE_DROP, notification.GetReason())
+    require.Equal(t, 2000.0, notification.GetPreviousPriceUsd())
+
+    // 价格不变的更新不会重复提醒
+    evaluate(pb.LaptopEvent_UPDATED, 1400)
+    require.Nil(t, nextNotification(alice))
+    require.Nil(t, nextNotification(bob))
+
+    // 涨价不提醒，之后再降价时提醒
+    evaluate(pb.LaptopEvent_UPDATED, 1450)
+    require.Nil(t, nextNotification(alice))
+    evaluate(pb.LaptopEvent_UPDATED, 1300)
+    notification = nextNotification(alice)
+    require.Equal(t, pb.AlertNotification_PRICE_DROP, notification.GetReason())
+    require.Equal(t, 1450.0, notification.GetPreviousPriceUsd())
+    require.NotNil(t, nextNotification(bob))
+
+    // 不再符合条件后再次符合条件时重新提醒
+    laptop.Cpu.NumberCores = 1
+    evaluate(pb.LaptopEvent_UPDATED, 1300)
+    require.Nil(t, nextNotification(alice))
+    laptop.Cpu.NumberCores = 4
+    evaluate(pb.LaptopEvent_UPDATED, 1300)
+    require.Equal(t, pb.AlertNotification_AVAILABLE, nextNotification(alice).GetReason())
+
+    // 评分等其他事件不检查提醒
+    evaluate(pb.LaptopEvent_RATED, 100)
+    require.Nil(t, nextNotification(alice))
+}
+
+func TestAlertEvaluatorRun(t *testing.T) {
+    received := make(chan *pb.AlertNotification, 1)
+    receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, err := ioutil.ReadAll(r.Body)
+        require.NoError(t, err)
+        require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+        notification := &pb.AlertNotification{}
+        require.NoError(t, serializer.ConvertJSONToProtobuf(string(body), notification))
+        received <- notification
+    }))
+    defer receiver.Close()
+
+    alertStore := service.NewInMemoryAlertStore()
+    laptopStore := service.NewInMemoryLaptopStore()
+    config := service.DefaultAlertConfig()
+    config.AllowPrivateAddresses = true
+    evaluator := service.NewAlertEvaluator(alertStore, laptopStore, config)
+    require.NoError(t, alertStore.Save(&pb.Alert{Id: "webhook", Owner: "alice", WebhookUrl: receiver.URL}))
+
+    notifications, cancel := evaluator.Subscribe("alice")
+    defer cancel()
+    done := make(chan error)
+    go func() {
+        done <- evaluator.Run(context.Background())
+    }()
+
+    // 检查器只处理开始之后的事件，持续保存直到收到提醒
+    var notification *pb.AlertNotification
+    for notification == nil {
+        require.NoError(t, laptopStore.Save(sample.NewLaptop()))
+        notification = nextNotification(notifications)
+    }
+
+    select {
+    case delivered := <-received:
+        require.Equal(t, notification.GetId(), delivered.GetId())
+        require.Equal(t, notification.GetLaptop().GetId(), delivered.GetLaptop().GetId())
+    case <-time.After(time.Second):
+        require.Fail(t, "webhook is not called")
+    }
+
+    // 便携电脑存储结束订阅时检查器结束，并关闭所有的订阅
+    laptopStore.CloseWatches()
+    require.ErrorIs(t, <-done, service.ErrWatchClosed)
+    for range notifications {
+    }
+}
+
+// fakeAlertStream 记录发送的提醒的服务端流
+type fakeAlertStream struct {
+    fakeServerStream
+    sent chan *pb.AlertNotification
+}
+
+func (stream *fakeAlertStream) Send(res *pb.SubscribeAlertsResponse) error {
+    stream.sent <- res.GetNotification()
+    return nil
+}
+
+func TestAlertServer(t *testing.T) {
+    alertStore := service.NewInMemoryAlertStore()
+    laptopStore := service.NewInMemoryLaptopStore()
+    config := service.AlertConfig{MaxPerUser: 2, WebhookTimeout: time.Second}
+    evaluator := service.NewAlertEvaluator(alertStore, laptopStore, config)
+    server := service.NewAlertServer(alertStore, evaluator, config)
+
+    alice := service.ContextWithPrincipal(context.Background(), &service.Principal{Username: "alice"})
+    bob := service.ContextWithPrincipal(context.Background(), &service.Principal{Username: "bob"})
+    apiKey := service.ContextWithPrincipal(context.Background(), &service.Principal{Username: "alice", APIKeyID: "key-1"})
+
+    req := &pb.CreateAlertRequest{Name: "cheap laptops", TargetPriceUsd: 1000}
+    res, err := server.CreateAlert(alice, req)
+    require.NoError(t, err)
+    require.Equal(t, "alice", res.GetAlert().GetOwner())
+    _, err = server.CreateAlert(alice, req)
+    require.NoError(t, err)
+    _, err = server.CreateAlert(alice, req)
+    require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+    _, err = server.CreateAlert(apiKey, req)
+    require.Equal(t, codes.PermissionDenied, status.Code(err))
+    _, err = server.CreateAlert(context.Background(), req)
+    require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+    // 用户只能看到和删除自己的提醒
+    list, err := server.ListAlerts(bob, &pb.ListAlertsRequest{})
+    require.NoError(t, err)
+    require.Empty(t, list.GetAlerts())
+    _, err = server.DeleteAlert(bob, &pb.DeleteAlertRequest{Id: res.GetAlert().GetId()})
+    require.Equal(t, codes.NotFound, status.Code(err))
+
+    _, err = server.DeleteAlert(alice, &pb.DeleteAlertRequest{Id: res.GetAlert().GetId()})
+    require.NoError(t, err)
+    list, err = server.ListAlerts(alice, &pb.ListAlertsRequest{})
+    require.NoError(t, err)
+    require.Len(t, list.GetAlerts(), 1)
+
+    // 订阅只收到自己的提醒
+    _, err = server.CreateAlert(bob, &pb.CreateAlertRequest{Name: "any laptop"})
+    require.NoError(t, err)
+
+    ctx, cancel := context.WithCancel(alice)
+    stream := &fakeAlertStream{fakeServerStream{ctx: ctx}, make(chan *pb.AlertNotification, 2)}
+    done := make(chan error)
+    go func() {
+        done <- server.SubscribeAlerts(&pb.SubscribeAlertsRequest{}, stream)
+    }()
+
+    laptop := sample.NewLaptop()
+    laptop.PriceUsd = 900
+    var notification *pb.AlertNotification
+    for notification == nil {
+        // 订阅开始之前的提醒不会推送，持续检查直到收到提醒
+        laptop.PriceUsd--
+        evaluator.Evaluate(context.Background(), &pb.LaptopEvent{Type: pb.LaptopEvent_UPDATED, Laptop: laptop})
+        notification = nextNotification(stream.sent)
+    }
+    require.Equal(t, list.GetAlerts()[0].GetId(), notification.GetAlertId())
+
+    cancel()
+    require.Equal(t, codes.Canceled, status.Code(<-done))
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+// apiKeyPrefix 明文 API key 的前缀，格式为 pcbk_<id>_<secret>
+const apiKeyPrefix = "pcbk"
+
+// APIKey 服务账号使用的 API key，只保存密钥的哈希
+type APIKey struct {
+    ID           string
+    Name         string
+    HashedSecret string
+    Roles        []string
+    Vendor       string
+    CreatedBy    string
+    CreatedAt    time.Time
+    ExpiresAt    time.Time
+    LastUsedAt   time.Time
+    Revoked      bool
+}
+
+// NewAPIKey 创建一个新的 API key，返回 API key 和只会出现这一次的明文密钥
+func NewAPIKey(name string, roles []string, vendor string, expiresAt time.Time) (*APIKey, string, error) {
+    id, err := uuid.NewRandom()
+    if err != nil {
+        return nil, "", fmt.Errorf("cannot generate api key id: %w", err)
+    }
+
+    secret := make([]byte, 32)
+    if _, err := rand.Read(secret); err != nil {
+        return nil, "", fmt.Errorf("cannot generate api key secret: %w", err)
+    }
+    plainSecret := hex.EncodeToString(secret)
+
+    key := &APIKey{
+        ID:           id.String(),
+        Name:         name,
+        HashedSecret: hashAPIKeySecret(plainSecret),
+        Roles:        append([]string(nil), roles...),
+        Vendor:       vendor,
+        CreatedAt:    time.Now(),
+        ExpiresAt:    expiresAt,
+    }
+
+    plainKey := fmt.Sprintf("%s_%s_%s", apiKeyPrefix, key.ID, plainSecret)
+    return key, plainKey, nil
+}
+
+// parseAPIKey 将明文 API key 拆分为 id 和密钥
+func parseAPIKey(plainKey string) (string, string, error) {
+    parts := strings.Split(plainKey, "_")
+    if len(parts) != 3 || parts[0] != apiKeyPrefix || parts[1] == "" || parts[2] == "" {
+        return "", "", fmt.Errorf("malformed api key")
+    }
+    return parts[1], parts[2], nil
+}
+
+// IsCorrectSecret 验证密钥是否正确
+func (key *APIKey) IsCorrectSecret(secret string) bool {
+    hashed := hashAPIKeySecret(secret)
+    return subtle.ConstantTimeCompare([]byte(hashed), []byte(key.HashedSecret)) == 1
+}
+
+// IsExpired 判断 API key 在指定时间是否已经过期
+func (key *APIKey) IsExpired(now time.Time) bool {
+    return !key.ExpiresAt.IsZero() && !now.Before(key.ExpiresAt)
+}
+
+// Clone 返回一个克隆的 APIKey
+func (key *APIKey) Clone() *APIKey {
+    other := *key
+    other.Roles = append([]string(nil), key.Roles...)
+    return &other
+}
+
+// API key 的密钥是高熵的随机数，使用 sha256 保存即可，不需要 bcrypt
+func hashAPIKeySecret(secret string) string {
+    sum := sha256.Sum256([]byte(secret))
+    return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,198 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "time"
+
+    "github.com/xiusl/pcbook/logging"
+    "github.com/xiusl/pcbook/pb"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// apiKeyLog API key 管理和认证的日志
+var apiKeyLog = logging.New("apikey")
+
+// apiKeyPrincipalPrefix 通过 API key 认证的调用方用户名的前缀
+const apiKeyPrincipalPrefix = "apikey:"
+
+// APIKeyServer 管理服务账号 API key 的服务
+type APIKeyServer struct {
+    apiKeyStore APIKeyStore
+    policy      *AccessPolicy
+}
+
+// NewAPIKeyServer 创建一个 API key 服务，policy 用于校验 API key 的角色
+func NewAPIKeyServer(apiKeyStore APIKeyStore, policy *AccessPolicy) *APIKeyServer {
+    return &APIKeyServer{
+        apiKeyStore: apiKeyStore,
+        policy:      policy,
+    }
+}
+
+// CreateAPIKey 创建一个 API key，明文密钥只在响应中返回一次
+func (server *APIKeyServer) CreateAPIKey(ctx context.Context, req *pb.CreateAPIKeyRequest) (*pb.CreateAPIKeyResponse, error) {
+    if req.GetName() == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "api key name is required")
+    }
+    if len(req.GetRoles()) == 0 {
+        return nil, status.Errorf(codes.InvalidArgument, "api key must have at least one role")
+    }
+    for _, role := range req.GetRoles() {
+        if server.policy != nil && !server.policy.HasRole(role) {
+            return nil, status.Errorf(codes.InvalidArgument, "unknown role %q", role)
+        }
+    }
+    if req.GetVendor() == "" && server.vendorScoped(req.GetRoles()) {
+        return nil, status.Errorf(codes.InvalidArgument, "api key with the %s role must belong to a vendor", RoleVendor)
+    }
+
+    var expiresAt time.Time
+    if req.GetExpiresAt() != nil {
+        expiresAt = req.GetExpiresAt().AsTime()
+        if !expiresAt.After(time.Now()) {
+            return nil, status.Errorf(codes.InvalidArgument, "api key expiry must be in the future")
+        }
+    }
+
+    key, plainKey, err := NewAPIKey(req.GetName(), req.GetRoles(), req.GetVendor(), expiresAt)
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot generate api key: %v", err)
+    }
+    if principal, ok := PrincipalFromContext(ctx); ok {
+        key.CreatedBy = principal.Username
+    }
+
+    if err := server.apiKeyStore.Save(key); err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot save api key: %v", err)
+    }
+    apiKeyLog.Info(ctx, "api key created", "key_id", key.ID, "name", key.Name, "roles", key.Roles)
+
+    res := &pb.CreateAPIKeyResponse{
+        ApiKey: apiKeyToProto(key),
+        Key:    plainKey,
+    }
+    return res, nil
+}
+
+// ListAPIKeys 列出所有的 API key，不包含密钥
+func (server *APIKeyServer) ListAPIKeys(ctx context.Context, req *pb.ListAPIKeysRequest) (*pb.ListAPIKeysResponse, error) {
+    keys, err := server.apiKeyStore.List()
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot list api keys: %v", err)
+    }
+
+    res := &pb.ListAPIKeysResponse{}
+    for _, key := range keys {
+        res.ApiKeys = append(res.ApiKeys, apiKeyToProto(key))
+    }
+    return res, nil
+}
+
+// vendorScoped 判断角色是否拥有厂商权限但不是管理员，这样的 API key 只能修改所属厂商的便携电脑
+func (server *APIKeyServer) vendorScoped(roles []string) bool {
+    inherits := func(role string, parent string) bool {
+        if server.policy == nil {
+            return role == parent
+        }
+        return server.policy.Inherits(role, parent)
+    }
+
+    vendor := false
+    for _, role := range roles {
+        if inherits(role, RoleAdmin) {
+            return false
+        }
+        vendor = vendor || inherits(role, RoleVendor)
+    }
+    return vendor
+}
+
+// RevokeAPIKey 吊销 API key，吊销后立即失效
+func (server *APIKeyServer) RevokeAPIKey(ctx context.Context, req *pb.RevokeAPIKeyRequest) (*pb.RevokeAPIKeyResponse, error) {
+    err := server.apiKeyStore.Revoke(req.GetId())
+    if err != nil {
+        code := codes.Internal
+        if errors.Is(err, ErrNotFound) {
+            code = codes.NotFound
+        }
+        return nil, status.Errorf(code, "cannot revoke api key: %v", err)
+    }
+    apiKeyLog.Info(ctx, "api key revoked", "key_id", req.GetId())
+
+    return &pb.RevokeAPIKeyResponse{}, nil
+}
+
+// APIKeyAuthenticator 使用请求元数据中的 x-api-key 识别调用方身份
+type APIKeyAuthenticator struct {
+    apiKeyStore APIKeyStore
+}
+
+// NewAPIKeyAuthenticator 创建一个 API key 认证方式
+func NewAPIKeyAuthenticator(apiKeyStore APIKeyStore) *APIKeyAuthenticator {
+    return &APIKeyAuthenticator{apiKeyStore}
+}
+
+// Authenticate 校验 x-api-key 并记录最近的使用时间
+func (authenticator *APIKeyAuthenticator) Authenticate(ctx context.Context) (*Principal, error) {
+    md, ok := metadata.FromIncomingContext(ctx)
+    if !ok {
+        return nil, nil
+    }
+
+    values := md["x-api-key"]
+    if len(values) == 0 {
+        return nil, nil
+    }
+
+    id, secret, err := parseAPIKey(values[0])
+    if err != nil {
+        return nil, status.Errorf(codes.Unauthenticated, "api key is invalid")
+    }
+
+    key, err := authenticator.apiKeyStore.Find(id)
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot find api key: %v", err)
+    }
+
+    now := time.Now()
+    if key == nil || !key.IsCorrectSecret(secret) || key.Revoked || key.IsExpired(now) {
+        return nil, status.Errorf(codes.Unauthenticated, "api key is invalid")
+    }
+
+    if err := authenticator.apiKeyStore.Touch(key.ID, now); err != nil {
+        apiKeyLog.Warn(ctx, "cannot record api key usage", "key_id", key.ID, "error", err)
+    }
+
+    // key 的名字可以随意填写并且不唯一，用 ID 区分调用方，避免在审计和日志中冒充用户
+    principal := &Principal{
+        Username:   apiKeyPrincipalPrefix + key.ID,
+        Roles:      key.Roles,
+        Vendor:     key.Vendor,
+        AuthMethod: AuthMethodAPIKey,
+        APIKeyID:   key.ID,
+    }
+    return principal, nil
+}
+
+func apiKeyToProto(key *APIKey) *pb.APIKey {
+    res := &pb.APIKey{
+        Id:        key.ID,
+        Name:      key.Name,
+        Roles:     key.Roles,
+        Vendor:    key.Vendor,
+        CreatedBy: key.CreatedBy,
+        CreatedAt: timestamppb.New(key.CreatedAt),
+        Revoked:   key.Revoked,
+    }
+    if !key.ExpiresAt.IsZero() {
+        res.ExpiresAt = timestamppb.New(key.ExpiresAt)
+    }
+    if !key.LastUsedAt.IsZero() {
+        res.LastUsedAt = timestamppb.New(key.LastUsedAt)
+    }
+    return res
+}
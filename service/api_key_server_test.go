@@ -0,0 +1,128 @@
+package service_test
+
+import (
+    "context"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestAPIKeyLifecycle(t *testing.T) {
+    policy, err := service.ParseAccessPolicy([]byte(testPolicy))
+    require.NoError(t, err)
+
+    store := service.NewInMemoryAPIKeyStore()
+    srv := service.NewAPIKeyServer(store, policy)
+    authenticator := service.NewAPIKeyAuthenticator(store)
+
+    admin := service.ContextWithPrincipal(context.Background(), &service.Principal{
+        Username: "admin",
+        Roles:    []string{service.RoleAdmin},
+    })
+
+    _, err = srv.CreateAPIKey(admin, &pb.CreateAPIKeyRequest{Name: "importer", Roles: []string{"root"}})
+    require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+    created, err := srv.CreateAPIKey(admin, &pb.CreateAPIKeyRequest{
+        Name:   "importer",
+        Roles:  []string{"admin"},
+        Vendor: "acme",
+    })
+    require.NoError(t, err)
+    require.NotEmpty(t, created.GetKey())
+    require.Equal(t, "admin", created.GetApiKey().GetCreatedBy())
+
+    // 只保存密钥的哈希
+    stored, err := store.Find(created.GetApiKey().GetId())
+    require.NoError(t, err)
+    require.NotContains(t, created.GetKey(), stored.HashedSecret)
+
+    principal, err := authenticator.Authenticate(apiKeyContext(created.GetKey()))
+    require.NoError(t, err)
+    require.Equal(t, "apikey:"+created.GetApiKey().GetId(), principal.Username)
+    require.Equal(t, []string{"admin"}, principal.Roles)
+    require.Equal(t, "acme", principal.Vendor)
+
+    list, err := srv.ListAPIKeys(admin, &pb.ListAPIKeysRequest{})
+    require.NoError(t, err)
+    require.Len(t, list.GetApiKeys(), 1)
+    require.NotNil(t, list.GetApiKeys()[0].GetLastUsedAt())
+
+    _, err = authenticator.Authenticate(apiKeyContext(created.GetKey() + "0"))
+    require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+    _, err = srv.RevokeAPIKey(admin, &pb.RevokeAPIKeyRequest{Id: created.GetApiKey().GetId()})
+    require.NoError(t, err)
+
+    _, err = authenticator.Authenticate(apiKeyContext(created.GetKey()))
+    require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+    _, err = srv.RevokeAPIKey(admin, &pb.RevokeAPIKeyRequest{Id: "unknown"})
+    require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestAPIKeyVendorScope(t *testing.T) {
+    policy, err := service.ParseAccessPolicy([]byte(`
+roles:
+  user: {}
+  vendor:
+    inherits: [user]
+  importer:
+    inherits: [vendor]
+  admin:
+    inherits: [vendor]
+rules:
+  - methods: ["/xiusl.pcbook.LaptopServices/*"]
+    roles: [vendor]
+`))
+    require.NoError(t, err)
+    srv := service.NewAPIKeyServer(service.NewInMemoryAPIKeyStore(), policy)
+
+    // 拥有厂商权限但不是管理员的 API key 必须属于一个厂商
+    for _, roles := range [][]string{{"vendor"}, {"importer"}, {"user", "vendor"}} {
+        _, err = srv.CreateAPIKey(context.Background(), &pb.CreateAPIKeyRequest{Name: "importer", Roles: roles})
+        require.Equal(t, codes.InvalidArgument, status.Code(err), roles)
+    }
+    for _, roles := range [][]string{{"user"}, {"admin"}, {"vendor", "admin"}} {
+        _, err = srv.CreateAPIKey(context.Background(), &pb.CreateAPIKeyRequest{Name: "importer", Roles: roles})
+        require.NoError(t, err, roles)
+    }
+    _, err = srv.CreateAPIKey(context.Background(), &pb.CreateAPIKeyRequest{Name: "importer", Roles: []string{"importer"}, Vendor: "acme"})
+    require.NoError(t, err)
+}
+
+func TestAPIKeyExpired(t *testing.T) {
+    store := service.NewInMemoryAPIKeyStore()
+    authenticator := service.NewAPIKeyAuthenticator(store)
+
+    key, plainKey, err := service.NewAPIKey("importer", []string{"user"}, "", time.Now().Add(-time.Minute))
+    require.NoError(t, err)
+    require.NoError(t, store.Save(key))
+
+    _, err = authenticator.Authenticate(apiKeyContext(plainKey))
+    require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+    srv := service.NewAPIKeyServer(store, nil)
+    _, err = srv.CreateAPIKey(context.Background(), &pb.CreateAPIKeyRequest{
+        Name:      "expired",
+        Roles:     []string{"user"},
+        ExpiresAt: timestamppb.New(time.Now().Add(-time.Hour)),
+    })
+    require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+    // 没有 x-api-key 时交给其他认证方式
+    principal, err := authenticator.Authenticate(context.Background())
+    require.NoError(t, err)
+    require.Nil(t, principal)
+}
+
+func apiKeyContext(key string) context.Context {
+    return metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", key))
+}
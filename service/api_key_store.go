@@ -0,0 +1,97 @@
+package service
+
+import (
+    "sort"
+    "sync"
+    "time"
+)
+
+// APIKeyStore 存储 API key 的接口
+type APIKeyStore interface {
+    Save(key *APIKey) error
+    Find(id string) (*APIKey, error)
+    List() ([]*APIKey, error)
+    Revoke(id string) error
+    // Touch 记录 API key 最近一次使用的时间
+    Touch(id string, usedAt time.Time) error
+}
+
+// InMemoryAPIKeyStore 在内存中存储 API key
+type InMemoryAPIKeyStore struct {
+    mutex sync.RWMutex
+    keys  map[string]*APIKey
+}
+
+// NewInMemoryAPIKeyStore 新建一个 API key 内存存储实例
+func NewInMemoryAPIKeyStore() *InMemoryAPIKeyStore {
+    return &InMemoryAPIKeyStore{
+        keys: make(map[string]*APIKey),
+    }
+}
+
+// Save 存储 API key 到内存中
+func (store *InMemoryAPIKeyStore) Save(key *APIKey) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    if store.keys[key.ID] != nil {
+        return ErrAlreadyExists
+    }
+    store.keys[key.ID] = key.Clone()
+    return nil
+}
+
+// Find 根据 id 查询 API key
+func (store *InMemoryAPIKeyStore) Find(id string) (*APIKey, error) {
+    store.mutex.RLock()
+    defer store.mutex.RUnlock()
+
+    key := store.keys[id]
+    if key != nil {
+        return key.Clone(), nil
+    }
+    return nil, nil
+}
+
+// List 按创建时间返回所有的 API key
+func (store *InMemoryAPIKeyStore) List() ([]*APIKey, error) {
+    store.mutex.RLock()
+    defer store.mutex.RUnlock()
+
+    keys := make([]*APIKey, 0, len(store.keys))
+    for _, key := range store.keys {
+        keys = append(keys, key.Clone())
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+    })
+    return keys, nil
+}
+
+// Revoke 吊销 API key
+func (store *InMemoryAPIKeyStore) Revoke(id string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    key := store.keys[id]
+    if key == nil {
+        return ErrNotFound
+    }
+    key.Revoked = true
+    return nil
+}
+
+// Touch 记录 API key 最近一次使用的时间
+func (store *InMemoryAPIKeyStore) Touch(id string, usedAt time.Time) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    key := store.keys[id]
+    if key == nil {
+        return ErrNotFound
+    }
+    if usedAt.After(key.LastUsedAt) {
+        key.LastUsedAt = usedAt
+    }
+    return nil
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+    "context"
+    "time"
+
+    "github.com/xiusl/pcbook/logging"
+    "github.com/xiusl/pcbook/pb"
+    "google.golang.org/grpc/peer"
+)
+
+// auditLog 审计日志写入失败时的日志
+var auditLog = logging.New("audit")
+
+// 审计事件类型
+const (
+    // AuditLoginSuccess 登录成功
+    AuditLoginSuccess = "login.success"
+    // AuditLoginFailure 登录失败，包括密码错误、验证码错误和被限流
+    AuditLoginFailure = "login.failure"
+    // AuditAccessDenied 没有通过认证或者没有权限访问 RPC
+    AuditAccessDenied = "access.denied"
+    // AuditRPC 修改数据的 RPC 调用
+    AuditRPC = "rpc"
+)
+
+// 审计事件结果
+const (
+    AuditOutcomeSuccess = "success"
+    AuditOutcomeFailure = "failure"
+    AuditOutcomeDenied  = "denied"
+)
+
+// AuditEvent 一条审计事件
+type AuditEvent struct {
+    Time        time.Time `json:"time"`
+    Type        string    `json:"type"`
+    Principal   string    `json:"principal,omitempty"`
+    AuthMethod  string    `json:"auth_method,omitempty"`
+    Method      string    `json:"method,omitempty"`
+    ResourceID  string    `json:"resource_id,omitempty"`
+    PeerAddress string    `json:"peer_address,omitempty"`
+    Outcome     string    `json:"outcome"`
+    Reason      string    `json:"reason,omitempty"`
+}
+
+// AuditFilter 查询审计事件的条件，零值表示不限制
+type AuditFilter struct {
+    Start     time.Time
+    End       time.Time
+    Principal string
+    Limit     int
+}
+
+// Match 判断事件是否满足查询条件
+func (filter *AuditFilter) Match(event *AuditEvent) bool {
+    if !filter.Start.IsZero() && event.Time.Before(filter.Start) {
+        return false
+    }
+    if !filter.End.IsZero() && !event.Time.Before(filter.End) {
+        return false
+    }
+    return filter.Principal == "" || filter.Principal == event.Principal
+}
+
+// AuditSink 审计事件的输出
+type AuditSink interface {
+    // Record 记录一条审计事件
+    Record(event *AuditEvent) error
+}
+
+// AuditStore 可以查询的审计事件输出
+type AuditStore interface {
+    AuditSink
+    // Query 按时间倒序返回满足条件的事件
+    Query(filter AuditFilter) ([]*AuditEvent, error)
+}
+
+// recordAudit 补全事件的时间和来源地址后写入 sink，sink 为 nil 时不记录
+// 审计失败不影响请求本身，只打印日志
+func recordAudit(ctx context.Context, sink AuditSink, event *AuditEvent) {
+    if sink == nil {
+        return
+    }
+    if event.Time.IsZero() {
+        event.Time = time.Now().UTC()
+    }
+    if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+        event.PeerAddress = p.Addr.String()
+    }
+    if err := sink.Record(event); err != nil {
+        auditLog.Error(ctx, "cannot record audit event", "type", event.Type, "error", err)
+    }
+}
+
+// auditedMethods 需要审计的修改数据的 RPC，以及从请求和响应中获取资源 ID 的方法
+var auditedMethods = map[string]func(req, res interface{}) string{
+    "/xiusl.pcbook.LaptopServices/CreateLaptop": func(req, res interface{}) string {
+        // 请求中没有 ID 时由服务端生成
+        if res, ok := res.(*pb.CreateLaptopResponse); ok && res.GetId() != "" {
+            return res.GetId()
+        }
+        return req.(*pb.CreateLaptopRequest).GetLaptop().GetId()
+    },
+    "/xiusl.pcbook.LaptopServices/UpdateLaptop": func(req, res interface{}) string {
+        return req.(*pb.UpdateLaptopRequest).GetLaptop().GetId()
+    },
+    "/xiusl.pcbook.LaptopServices/UploadImage": func(req, res interface{}) string {
+        upload, _ := req.(*pb.UploadImageRequest)
+        return upload.GetInfo().GetLaptopId()
+    },
+    "/xiusl.pcbook.LaptopServices/RateLaptop": func(req, res interface{}) string {
+        // 一个流可以评价多台便携电脑，只记录第一台
+        rate, _ := req.(*pb.RateLaptopRequest)
+        return rate.GetLaptopId()
+    },
+    "/xiusl.pcbook.LaptopServices/ImportLaptops": nil,
+    "/xiusl.pcbook.APIKeyService/CreateAPIKey": func(req, res interface{}) string {
+        key, _ := res.(*pb.CreateAPIKeyResponse)
+        return key.GetApiKey().GetId()
+    },
+    "/xiusl.pcbook.APIKeyService/RevokeAPIKey": func(req, res interface{}) string {
+        return req.(*pb.RevokeAPIKeyRequest).GetId()
+    },
+    "/xiusl.pcbook.AuthService/UnlockAccount": func(req, res interface{}) string {
+        return req.(*pb.UnlockAccountRequest).GetUsername()
+    },
+    "/xiusl.pcbook.AlertService/CreateAlert": func(req, res interface{}) string {
+        alert, _ := res.(*pb.CreateAlertResponse)
+        return alert.GetAlert().GetId()
+    },
+    "/xiusl.pcbook.AlertService/DeleteAlert": func(req, res interface{}) string {
+        return req.(*pb.DeleteAlertRequest).GetId()
+    },
+    "/xiusl.pcbook.WebhookService/CreateWebhook": func(req, res interface{}) string {
+        webhook, _ := res.(*pb.CreateWebhookResponse)
+        return webhook.GetWebhook().GetId()
+    },
+    "/xiusl.pcbook.WebhookService/DeleteWebhook": func(req, res interface{}) string {
+        return req.(*pb.DeleteWebhookRequest).GetId()
+    },
+    "/xiusl.pcbook.WebhookService/ReplayDeadLetters": func(req, res interface{}) string {
+        return req.(*pb.ReplayDeadLettersRequest).GetWebhookId()
+    },
+    "/xiusl.pcbook.AuthService/EnrollTOTP":     nil,
+    "/xiusl.pcbook.AuthService/ConfirmTOTP":    nil,
+    "/xiusl.pcbook.AuthService/ChangePassword": nil,
+}
+
+func isAuditedMethod(method string) bool {
+    _, ok := auditedMethods[method]
+    return ok
+}
+
+// auditResourceID 获取 RPC 操作的资源 ID，流式 RPC 的 req 是收到的第一条消息，没有收到消息时为 nil
+func auditResourceID(method string, req, res interface{}) string {
+    resourceID := auditedMethods[method]
+    if resourceID == nil || req == nil {
+        return ""
+    }
+    return resourceID(req, res)
+}
@@ -0,0 +1,248 @@
+package service
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "sync"
+    "time"
+)
+
+// auditRotateTimeFormat 轮转后的文件名后缀，按字典序排序即为时间顺序
+const auditRotateTimeFormat = "20060102T150405.000000000"
+
+// FileAuditStore 以 JSON lines 格式只追加写入审计事件的文件
+// 文件超过 maxSize 后改名为 filename.<时间> 并创建新文件，已经轮转的文件不会再被修改
+type FileAuditStore struct {
+    mutex      sync.Mutex
+    filename   string
+    maxSize    int64
+    maxBackups int
+    file       *os.File
+    size       int64
+}
+
+// NewFileAuditStore 打开或者创建审计文件
+// maxSize 为 0 时不轮转，maxBackups 为 0 时保留所有轮转的文件
+func NewFileAuditStore(filename string, maxSize int64, maxBackups int) (*FileAuditStore, error) {
+    store := &FileAuditStore{
+        filename:   filename,
+        maxSize:    maxSize,
+        maxBackups: maxBackups,
+    }
+    if err := store.open(); err != nil {
+        return nil, err
+    }
+    return store, nil
+}
+
+// Record 写入一条审计事件，写入的文件超过大小限制时先轮转
+func (store *FileAuditStore) Record(event *AuditEvent) error {
+    line, err := json.Marshal(event)
+    if err != nil {
+        return fmt.Errorf("cannot marshal audit event: %w", err)
+    }
+    line = append(line, '\n')
+
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    if store.file == nil {
+        return fmt.Errorf("audit store is closed")
+    }
+    if store.maxSize > 0 && store.size > 0 && store.size+int64(len(line)) > store.maxSize {
+        // 轮转失败时继续写入原来的文件，下次写入时再重试
+        if err := store.rotate(); err != nil {
+            auditLog.Error(context.Background(), "cannot rotate audit file", "filename", store.filename, "error", err)
+        }
+    }
+
+    n, err := store.file.Write(line)
+    store.size += int64(n)
+    if err != nil {
+        return fmt.Errorf("cannot write audit event: %w", err)
+    }
+    return nil
+}
+
+// Query 从新到旧扫描当前文件和轮转的文件，按时间倒序返回满足条件的事件
+// 只在打开文件时持有锁，轮转的文件不会再被修改，当前文件只读取到打开时的大小，读取时不阻塞 Record
+func (store *FileAuditStore) Query(filter AuditFilter) ([]*AuditEvent, error) {
+    files, size, err := store.openForQuery()
+    if err != nil {
+        return nil, err
+    }
+    defer func() {
+        for _, file := range files {
+            file.Close()
+        }
+    }()
+
+    // 越新的文件排在越后面，事件数满足 limit 后不再读取更旧的文件
+    var events []*AuditEvent
+    for i := len(files) - 1; i >= 0; i-- {
+        var reader io.Reader = files[i]
+        if i == len(files)-1 {
+            reader = io.LimitReader(files[i], size)
+        }
+        fileEvents, err := readAuditFile(files[i].Name(), reader, filter)
+        if err != nil {
+            return nil, err
+        }
+        events = append(events, fileEvents...)
+        if filter.Limit > 0 && len(events) >= filter.Limit {
+            break
+        }
+    }
+
+    sort.SliceStable(events, func(i, j int) bool {
+        return events[i].Time.After(events[j].Time)
+    })
+    if filter.Limit > 0 && len(events) > filter.Limit {
+        events = events[:filter.Limit]
+    }
+    return events, nil
+}
+
+// Close 把当前文件写入磁盘后关闭，之后不能再写入
+func (store *FileAuditStore) Close() error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    if store.file == nil {
+        return nil
+    }
+    err := store.file.Sync()
+    if closeErr := store.file.Close(); err == nil {
+        err = closeErr
+    }
+    store.file = nil
+    return err
+}
+
+func (store *FileAuditStore) open() error {
+    file, err := os.OpenFile(store.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+    if err != nil {
+        return fmt.Errorf("cannot open audit file: %w", err)
+    }
+    info, err := file.Stat()
+    if err != nil {
+        file.Close()
+        return fmt.Errorf("cannot stat audit file: %w", err)
+    }
+
+    store.file = file
+    store.size = info.Size()
+    return nil
+}
+
+// rotate 先改名再打开新文件，任何一步失败都继续使用原来的文件
+func (store *FileAuditStore) rotate() error {
+    file, size := store.file, store.size
+
+    rotated := store.filename + "." + time.Now().UTC().Format(auditRotateTimeFormat)
+    if err := os.Rename(store.filename, rotated); err != nil {
+        return fmt.Errorf("cannot rotate audit file: %w", err)
+    }
+    if err := store.open(); err != nil {
+        if renameErr := os.Rename(rotated, store.filename); renameErr != nil {
+            auditLog.Error(context.Background(), "cannot restore audit file", "filename", rotated, "error", renameErr)
+        }
+        store.file, store.size = file, size
+        return err
+    }
+    if err := file.Close(); err != nil {
+        auditLog.Warn(context.Background(), "cannot close rotated audit file", "filename", rotated, "error", err)
+    }
+
+    if store.maxBackups <= 0 {
+        return nil
+    }
+    backups, err := store.backups()
+    if err != nil {
+        return err
+    }
+    for len(backups) > store.maxBackups {
+        if err := os.Remove(backups[0]); err != nil {
+            return fmt.Errorf("cannot remove old audit file: %w", err)
+        }
+        backups = backups[1:]
+    }
+    return nil
+}
+
+// openForQuery 在锁内按时间顺序打开所有的文件，并返回当前文件已经写入的大小
+// 打开之后即使文件被轮转或者删除也能继续读取
+func (store *FileAuditStore) openForQuery() ([]*os.File, int64, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    filenames, err := store.backups()
+    if err != nil {
+        return nil, 0, err
+    }
+    filenames = append(filenames, store.filename)
+
+    files := make([]*os.File, 0, len(filenames))
+    for _, filename := range filenames {
+        file, err := os.Open(filename)
+        if err != nil {
+            for _, opened := range files {
+                opened.Close()
+            }
+            return nil, 0, fmt.Errorf("cannot open audit file: %w", err)
+        }
+        files = append(files, file)
+    }
+    return files, store.size, nil
+}
+
+// backups 按时间顺序返回轮转的文件
+func (store *FileAuditStore) backups() ([]string, error) {
+    filenames, err := filepath.Glob(store.filename + ".*")
+    if err != nil {
+        return nil, fmt.Errorf("cannot list audit files: %w", err)
+    }
+    sort.Strings(filenames)
+    return filenames, nil
+}
+
+// readAuditFile 读取满足条件的事件，limit 大于 0 时只保留文件中最新的 limit 个事件
+func readAuditFile(filename string, reader io.Reader, filter AuditFilter) ([]*AuditEvent, error) {
+    var events []*AuditEvent
+    // matched 匹配的事件总数，达到 limit 后 events 作为环形缓冲区，新的事件覆盖最早的事件
+    matched := 0
+    scanner := bufio.NewScanner(reader)
+    for scanner.Scan() {
+        event := &AuditEvent{}
+        if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+            return nil, fmt.Errorf("cannot parse audit event in %s: %w", filename, err)
+        }
+        if !filter.Match(event) {
+            continue
+        }
+        if filter.Limit > 0 && len(events) >= filter.Limit {
+            events[matched%filter.Limit] = event
+        } else {
+            events = append(events, event)
+        }
+        matched++
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("cannot read audit file: %w", err)
+    }
+
+    // 把环形缓冲区按写入顺序排列，最早的事件从下一个要覆盖的位置开始
+    if filter.Limit > 0 && matched > filter.Limit {
+        start := matched % filter.Limit
+        ordered := make([]*AuditEvent, 0, len(events))
+        ordered = append(ordered, events[start:]...)
+        events = append(ordered, events[:start]...)
+    }
+    return events, nil
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+    "context"
+
+    "github.com/xiusl/pcbook/pb"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+    // defaultAuditQueryLimit 请求没有指定数量时最多返回的事件数
+    defaultAuditQueryLimit = 100
+    // maxAuditQueryLimit 单次查询最多返回的事件数
+    maxAuditQueryLimit = 1000
+)
+
+// AuditServer 查询审计日志的服务
+type AuditServer struct {
+    auditStore AuditStore
+}
+
+// NewAuditServer 创建一个审计日志服务
+func NewAuditServer(auditStore AuditStore) *AuditServer {
+    return &AuditServer{auditStore}
+}
+
+// QueryAuditLog 按时间范围和调用方查询审计事件
+func (server *AuditServer) QueryAuditLog(ctx context.Context, req *pb.QueryAuditLogRequest) (*pb.QueryAuditLogResponse, error) {
+    filter := AuditFilter{
+        Principal: req.GetPrincipal(),
+        Limit:     int(req.GetLimit()),
+    }
+    if req.GetStartTime() != nil {
+        filter.Start = req.GetStartTime().AsTime()
+    }
+    if req.GetEndTime() != nil {
+        filter.End = req.GetEndTime().AsTime()
+    }
+    if !filter.Start.IsZero() && !filter.End.IsZero() && !filter.Start.Before(filter.End) {
+        return nil, status.Errorf(codes.InvalidArgument, "start time must be before end time")
+    }
+    if filter.Limit == 0 {
+        filter.Limit = defaultAuditQueryLimit
+    }
+    if filter.Limit > maxAuditQueryLimit {
+        filter.Limit = maxAuditQueryLimit
+    }
+
+    events, err := server.auditStore.Query(filter)
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot query audit log: %v", err)
+    }
+
+    res := &pb.QueryAuditLogResponse{}
+    for _, event := range events {
+        res.Events = append(res.Events, auditEventToProto(event))
+    }
+    return res, nil
+}
+
+func auditEventToProto(event *AuditEvent) *pb.AuditEvent {
+    return &pb.AuditEvent{
+        Time:        timestamppb.New(event.Time),
+        Type:        event.Type,
+        Principal:   event.Principal,
+        AuthMethod:  event.AuthMethod,
+        Method:      event.Method,
+        ResourceId:  event.ResourceID,
+        PeerAddress: event.PeerAddress,
+        Outcome:     event.Outcome,
+        Reason:      event.Reason,
+    }
+}
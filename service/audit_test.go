@@ -0,0 +1,257 @@
+package service_test
+
+import (
+    "context"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/sample"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+    "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func newTestAuditStore(t *testing.T, maxSize int64, maxBackups int) (*service.FileAuditStore, string) {
+    dir, err := ioutil.TempDir("", "audit")
+    require.NoError(t, err)
+    t.Cleanup(func() { os.RemoveAll(dir) })
+
+    filename := filepath.Join(dir, "audit.jsonl")
+    store, err := service.NewFileAuditStore(filename, maxSize, maxBackups)
+    require.NoError(t, err)
+    t.Cleanup(func() { store.Close() })
+    return store, filename
+}
+
+func TestFileAuditStoreRotate(t *testing.T) {
+    store, filename := newTestAuditStore(t, 300, 2)
+
+    start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+    for i := 0; i < 10; i++ {
+        principal := "admin"
+        if i%2 == 1 {
+            principal = "vendor1"
+        }
+        err := store.Record(&service.AuditEvent{
+            Time:      start.Add(time.Duration(i) * time.Minute),
+            Type:      service.AuditLoginSuccess,
+            Principal: principal,
+            Outcome:   service.AuditOutcomeSuccess,
+        })
+        require.NoError(t, err)
+    }
+
+    // 当前文件加上最多两个轮转的文件
+    backups, err := filepath.Glob(filename + ".*")
+    require.NoError(t, err)
+    require.Len(t, backups, 2)
+
+    events, err := store.Query(service.AuditFilter{})
+    require.NoError(t, err)
+    require.NotEmpty(t, events)
+    require.True(t, len(events) < 10)
+    require.Equal(t, start.Add(9*time.Minute), events[0].Time)
+    for i := 1; i < len(events); i++ {
+        require.True(t, events[i-1].Time.After(events[i].Time))
+    }
+
+    events, err = store.Query(service.AuditFilter{
+        Start:     start.Add(7 * time.Minute),
+        End:       start.Add(10 * time.Minute),
+        Principal: "admin",
+    })
+    require.NoError(t, err)
+    require.Len(t, events, 1)
+    require.Equal(t, start.Add(8*time.Minute), events[0].Time)
+
+    events, err = store.Query(service.AuditFilter{Limit: 2})
+    require.NoError(t, err)
+    require.Len(t, events, 2)
+}
+
+func TestFileAuditStoreQueryLimit(t *testing.T) {
+    store, _ := newTestAuditStore(t, 0, 0)
+
+    start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+    for i := 0; i < 10; i++ {
+        err := store.Record(&service.AuditEvent{
+            Time:      start.Add(time.Duration(i) * time.Minute),
+            Type:      service.AuditLoginSuccess,
+            Principal: "admin",
+            Outcome:   service.AuditOutcomeSuccess,
+        })
+        require.NoError(t, err)
+    }
+
+    // 只保留最新的 limit 个事件，按时间倒序返回
+    events, err := store.Query(service.AuditFilter{Limit: 3})
+    require.NoError(t, err)
+    require.Len(t, events, 3)
+    for i, event := range events {
+        require.Equal(t, start.Add(time.Duration(9-i)*time.Minute), event.Time)
+    }
+}
+
+func TestFileAuditStoreRotateFailure(t *testing.T) {
+    store, filename := newTestAuditStore(t, 100, 0)
+
+    event := &service.AuditEvent{
+        Type:      service.AuditLoginSuccess,
+        Principal: "admin",
+        Outcome:   service.AuditOutcomeSuccess,
+    }
+    require.NoError(t, store.Record(event))
+
+    // 轮转失败后继续写入原来的文件
+    require.NoError(t, os.RemoveAll(filepath.Dir(filename)))
+    for i := 0; i < 3; i++ {
+        require.NoError(t, store.Record(event))
+    }
+}
+
+func TestAuthInterceptorAudit(t *testing.T) {
+    store, _ := newTestAuditStore(t, 0, 0)
+
+    jwtManager := service.NewJWTManager("secret", time.Minute)
+    user, err := service.NewUser("user1", "secret", "user")
+    require.NoError(t, err)
+    token, err := jwtManager.Generate(user, service.AuthMethodPassword)
+    require.NoError(t, err)
+
+    policy, err := service.ParseAccessPolicy([]byte(testPolicy))
+    require.NoError(t, err)
+    interceptor := service.NewAuthInterceptor(policy, store, jwtManager).Unary()
+
+    laptop := sample.NewLaptop()
+    req := &pb.CreateLaptopRequest{Laptop: laptop}
+    createLaptop := &grpc.UnaryServerInfo{FullMethod: "/xiusl.pcbook.LaptopServices/CreateLaptop"}
+    handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+        return &pb.CreateLaptopResponse{Id: laptop.Id}, nil
+    }
+
+    ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", token))
+    _, err = interceptor(ctx, req, createLaptop, handler)
+    require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+    admin, err := service.NewUser("admin", "secret", "admin")
+    require.NoError(t, err)
+    token, err = jwtManager.Generate(admin, service.AuthMethodPassword)
+    require.NoError(t, err)
+
+    ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", token))
+    _, err = interceptor(ctx, req, createLaptop, handler)
+    require.NoError(t, err)
+
+    events, err := store.Query(service.AuditFilter{})
+    require.NoError(t, err)
+    require.Len(t, events, 2)
+
+    require.Equal(t, service.AuditRPC, events[0].Type)
+    require.Equal(t, "admin", events[0].Principal)
+    require.Equal(t, createLaptop.FullMethod, events[0].Method)
+    require.Equal(t, laptop.Id, events[0].ResourceID)
+    require.Equal(t, service.AuditOutcomeSuccess, events[0].Outcome)
+
+    require.Equal(t, service.AuditAccessDenied, events[1].Type)
+    require.Equal(t, "user1", events[1].Principal)
+    require.Equal(t, service.AuditOutcomeDenied, events[1].Outcome)
+
+    // 管理员按调用方查询审计日志
+    server := service.NewAuditServer(store)
+    res, err := server.QueryAuditLog(context.Background(), &pb.QueryAuditLogRequest{Principal: "user1"})
+    require.NoError(t, err)
+    require.Len(t, res.GetEvents(), 1)
+    require.Equal(t, service.AuditAccessDenied, res.GetEvents()[0].GetType())
+
+    _, err = server.QueryAuditLog(context.Background(), &pb.QueryAuditLogRequest{
+        StartTime: timestamppb.Now(),
+        EndTime:   timestamppb.New(time.Now().Add(-time.Hour)),
+    })
+    require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// testRecvStream 依次返回 requests 的服务端流
+type testRecvStream struct {
+    grpc.ServerStream
+    ctx      context.Context
+    requests []proto.Message
+}
+
+func (stream *testRecvStream) Context() context.Context {
+    return stream.ctx
+}
+
+func (stream *testRecvStream) RecvMsg(m interface{}) error {
+    if len(stream.requests) == 0 {
+        return io.EOF
+    }
+    proto.Merge(m.(proto.Message), stream.requests[0])
+    stream.requests = stream.requests[1:]
+    return nil
+}
+
+func TestAuthInterceptorAuditStream(t *testing.T) {
+    store, _ := newTestAuditStore(t, 0, 0)
+
+    jwtManager := service.NewJWTManager("secret", time.Minute)
+    admin, err := service.NewUser("admin", "secret", "admin")
+    require.NoError(t, err)
+    token, err := jwtManager.Generate(admin, service.AuthMethodPassword)
+    require.NoError(t, err)
+
+    policy, err := service.ParseAccessPolicy([]byte(testPolicy))
+    require.NoError(t, err)
+    interceptor := service.NewAuthInterceptor(policy, store, jwtManager).Stream()
+    ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", token))
+
+    // 流式 RPC 从收到的第一条消息中获取便携电脑的 ID
+    testCases := []struct {
+        method   string
+        requests []proto.Message
+    }{
+        {
+            method: "/xiusl.pcbook.LaptopServices/UploadImage",
+            requests: []proto.Message{
+                &pb.UploadImageRequest{Data: &pb.UploadImageRequest_Info{Info: &pb.ImageInfo{LaptopId: "laptop-1", ImageType: ".jpg"}}},
+                &pb.UploadImageRequest{Data: &pb.UploadImageRequest_ChunkData{ChunkData: []byte("image")}},
+            },
+        },
+        {
+            method: "/xiusl.pcbook.LaptopServices/RateLaptop",
+            requests: []proto.Message{
+                &pb.RateLaptopRequest{LaptopId: "laptop-1", Score: 8},
+                &pb.RateLaptopRequest{LaptopId: "laptop-2", Score: 6},
+            },
+        },
+    }
+
+    for _, tc := range testCases {
+        stream := &testRecvStream{ctx: ctx, requests: tc.requests}
+        info := &grpc.StreamServerInfo{FullMethod: tc.method, IsClientStream: true}
+        err := interceptor(nil, stream, info, func(srv interface{}, stream grpc.ServerStream) error {
+            for {
+                req := tc.requests[0].ProtoReflect().New().Interface()
+                if err := stream.RecvMsg(req); err == io.EOF {
+                    return nil
+                }
+            }
+        })
+        require.NoError(t, err)
+
+        events, err := store.Query(service.AuditFilter{Limit: 1})
+        require.NoError(t, err)
+        require.Len(t, events, 1)
+        require.Equal(t, tc.method, events[0].Method)
+        require.Equal(t, "laptop-1", events[0].ResourceID)
+    }
+}
@@ -0,0 +1,161 @@
+package service_test
+
+import (
+    "context"
+    "net"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/client"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/sample"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+// countingAuthServer 记录登录次数的授权服务
+type countingAuthServer struct {
+    *service.AuthServer
+    logins int32
+}
+
+func (server *countingAuthServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
+    atomic.AddInt32(&server.logins, 1)
+    return server.AuthServer.Login(ctx, req)
+}
+
+// rejectingAuthenticator 可以让下一次认证失败，模拟令牌被服务端拒绝
+type rejectingAuthenticator struct {
+    service.Authenticator
+    rejectNext int32
+}
+
+func (authenticator *rejectingAuthenticator) Authenticate(ctx context.Context) (*service.Principal, error) {
+    if atomic.CompareAndSwapInt32(&authenticator.rejectNext, 1, 0) {
+        return nil, status.Errorf(codes.Unauthenticated, "authorization token is invalid")
+    }
+    return authenticator.Authenticator.Authenticate(ctx)
+}
+
+func startTestAuthServer(t *testing.T) (string, *countingAuthServer, *rejectingAuthenticator) {
+    userStore := service.NewInMemoryUserStore()
+    user, err := service.NewUser("admin", "secret", "admin")
+    require.NoError(t, err)
+    require.NoError(t, userStore.Save(user))
+
+    jwtManager := service.NewJWTManager("secret", time.Minute)
+    authServer := &countingAuthServer{AuthServer: service.NewAuthServer(userStore, jwtManager, nil, nil, service.DefaultPasswordPolicy())}
+    authenticator := &rejectingAuthenticator{Authenticator: jwtManager}
+
+    policy, err := service.ParseAccessPolicy([]byte(testPolicy))
+    require.NoError(t, err)
+    interceptor := service.NewAuthInterceptor(policy, nil, authenticator)
+
+    grpcServer := grpc.NewServer(
+        grpc.UnaryInterceptor(interceptor.Unary()),
+        grpc.StreamInterceptor(interceptor.Stream()),
+    )
+    pb.RegisterAuthServiceServer(grpcServer, authServer)
+    laptopServer := service.NewLaptopServer(service.NewInMemoryLaptopStore(), nil, nil)
+    pb.RegisterLaptopServicesServer(grpcServer, laptopServer)
+
+    listener, err := net.Listen("tcp", ":0")
+    require.NoError(t, err)
+    go grpcServer.Serve(listener)
+    t.Cleanup(grpcServer.Stop)
+
+    return listener.Addr().String(), authServer, authenticator
+}
+
+func newTestAuthLaptopClient(t *testing.T, addr string) (pb.LaptopServicesClient, *client.AuthInterceptor) {
+    conn, err := grpc.Dial(addr, grpc.WithInsecure())
+    require.NoError(t, err)
+    t.Cleanup(func() { conn.Close() })
+
+    authClient := client.NewAuthClient(conn, "admin", "secret")
+    authMethods := func(method string) bool {
+        return method != "/xiusl.pcbook.AuthService/Login"
+    }
+    interceptor, err := client.NewAuthInterceptor(context.Background(), authClient, authMethods)
+    require.NoError(t, err)
+    t.Cleanup(interceptor.Close)
+
+    laptopConn, err := grpc.Dial(
+        addr,
+        grpc.WithInsecure(),
+        grpc.WithUnaryInterceptor(interceptor.Unary()),
+        grpc.WithStreamInterceptor(interceptor.Stream()),
+    )
+    require.NoError(t, err)
+    t.Cleanup(func() { laptopConn.Close() })
+
+    return pb.NewLaptopServicesClient(laptopConn), interceptor
+}
+
+func TestClientAuthInterceptorConcurrentCalls(t *testing.T) {
+    addr, authServer, _ := startTestAuthServer(t)
+    laptopClient, _ := newTestAuthLaptopClient(t, addr)
+
+    var wg sync.WaitGroup
+    errs := make(chan error, 20)
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            _, err := laptopClient.CreateLaptop(context.Background(), &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+            errs <- err
+        }()
+    }
+    wg.Wait()
+    close(errs)
+
+    for err := range errs {
+        require.NoError(t, err)
+    }
+    // 令牌还没有过期，只在创建拦截器时登录一次
+    require.Equal(t, int32(1), atomic.LoadInt32(&authServer.logins))
+}
+
+func TestClientAuthInterceptorRetryUnauthenticated(t *testing.T) {
+    addr, authServer, authenticator := startTestAuthServer(t)
+    laptopClient, _ := newTestAuthLaptopClient(t, addr)
+
+    // 服务端拒绝令牌后刷新令牌并重试一次
+    atomic.StoreInt32(&authenticator.rejectNext, 1)
+    _, err := laptopClient.CreateLaptop(context.Background(), &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+    require.NoError(t, err)
+    require.Equal(t, int32(2), atomic.LoadInt32(&authServer.logins))
+}
+
+func TestClientAuthInterceptorClose(t *testing.T) {
+    addr, _, _ := startTestAuthServer(t)
+
+    conn, err := grpc.Dial(addr, grpc.WithInsecure())
+    require.NoError(t, err)
+    defer conn.Close()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    authClient := client.NewAuthClient(conn, "admin", "secret")
+    interceptor, err := client.NewAuthInterceptor(ctx, authClient, func(string) bool { return true })
+    require.NoError(t, err)
+
+    // 取消 ctx 后后台刷新退出，Close 不会阻塞，并且可以重复调用
+    cancel()
+    done := make(chan struct{})
+    go func() {
+        interceptor.Close()
+        interceptor.Close()
+        close(done)
+    }()
+
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("interceptor did not stop")
+    }
+}
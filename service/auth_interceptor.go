@@ -2,23 +2,24 @@ package service
 
 import (
     "context"
-    "log"
 
     "google.golang.org/grpc"
     "google.golang.org/grpc/codes"
-    "google.golang.org/grpc/metadata"
     "google.golang.org/grpc/status"
 )
 
 // AuthInterceptor 服务授权拦截器
 type AuthInterceptor struct {
-    jwtManager      *JWTManager
-    accessibleRoles map[string][]string
+    policy         *AccessPolicy
+    auditSink      AuditSink
+    authenticators []Authenticator
 }
 
-// NewAuthInterceptor 新建一个服务授权拦截器
-func NewAuthInterceptor(jwtManager *JWTManager, accessibleRoles map[string][]string) *AuthInterceptor {
-    return &AuthInterceptor{jwtManager, accessibleRoles}
+// NewAuthInterceptor 新建一个服务授权拦截器，按照访问控制策略进行授权
+// 依次尝试各个认证方式，第一个识别出调用方身份的认证方式生效
+// 拒绝的请求和修改数据的 RPC 会写入 auditSink，auditSink 为 nil 时不记录
+func NewAuthInterceptor(policy *AccessPolicy, auditSink AuditSink, authenticators ...Authenticator) *AuthInterceptor {
+    return &AuthInterceptor{policy, auditSink, authenticators}
 }
 
 // Unary 一元 RPC 授权拦截器
@@ -29,13 +30,14 @@ func (interceptor *AuthInterceptor) Unary() grpc.UnaryServerInterceptor {
         info *grpc.UnaryServerInfo,
         handler grpc.UnaryHandler,
     ) (interface{}, error) {
-
-        log.Println("---> unary interceptor: ", info.FullMethod)
-
-        if err := interceptor.authorize(ctx, info.FullMethod); err != nil {
+        ctx, err := interceptor.authorize(ctx, info.FullMethod)
+        if err != nil {
             return nil, err
         }
-        return handler(ctx, req)
+
+        res, err := handler(ctx, req)
+        interceptor.auditRPC(ctx, info.FullMethod, req, res, err)
+        return res, err
     }
 }
 
@@ -47,40 +49,130 @@ func (interceptor *AuthInterceptor) Stream() grpc.StreamServerInterceptor {
         info *grpc.StreamServerInfo,
         handler grpc.StreamHandler,
     ) error {
-        log.Println("---> stream interceptor: ", info.FullMethod)
-        if err := interceptor.authorize(ss.Context(), info.FullMethod); err != nil {
+        ctx, err := interceptor.authorize(ss.Context(), info.FullMethod)
+        if err != nil {
             return err
         }
-        return handler(srv, ss)
+
+        if !isAuditedMethod(info.FullMethod) {
+            return handler(srv, &contextServerStream{ss, ctx})
+        }
+
+        // 流式 RPC 没有单独的请求，使用收到的第一条消息获取资源 ID
+        stream := &firstMessageServerStream{ServerStream: &contextServerStream{ss, ctx}}
+        err = handler(srv, stream)
+        interceptor.auditRPC(ctx, info.FullMethod, stream.first, nil, err)
+        return err
     }
 }
 
-func (interceptor *AuthInterceptor) authorize(ctx context.Context, method string) error {
-    accessibleRoles, ok := interceptor.accessibleRoles[method]
-    if !ok {
-        return nil
+// firstMessageServerStream 保存收到的第一条消息的服务端流
+type firstMessageServerStream struct {
+    grpc.ServerStream
+    first interface{}
+}
+
+func (stream *firstMessageServerStream) RecvMsg(m interface{}) error {
+    err := stream.ServerStream.RecvMsg(m)
+    if err == nil && stream.first == nil {
+        stream.first = m
     }
+    return err
+}
+
+// contextServerStream 替换了上下文的服务端流
+type contextServerStream struct {
+    grpc.ServerStream
+    ctx context.Context
+}
+
+func (stream *contextServerStream) Context() context.Context {
+    return stream.ctx
+}
+
+// authorize 校验调用方是否有权限访问方法，通过后返回带有调用方身份的上下文
+func (interceptor *AuthInterceptor) authorize(ctx context.Context, method string) (_ context.Context, err error) {
+    // 返回的上下文不包含授权的 span，之后的 span 仍然是 RPC span 的子 span
+    _, span := startSpan(ctx, "AuthInterceptor.authorize")
+    defer func() { endSpan(span, err) }()
 
-    md, ok := metadata.FromIncomingContext(ctx)
-    if !ok {
-        return status.Errorf(codes.Unauthenticated, "metadata is not provided")
+    // 整个判断使用同一份策略，避免热加载后前后的检查使用不同的策略
+    decision := interceptor.policy.Check(method)
+    if !decision.Covered() {
+        err := status.Errorf(codes.PermissionDenied, "no permission to access this RPC")
+        interceptor.auditDenied(ctx, method, nil, err)
+        return nil, err
+    }
+    if decision.Public() {
+        return ctx, nil
     }
 
-    values := md["authorization"]
-    if len(values) == 0 {
-        return status.Errorf(codes.Unauthenticated, "authorization token is not provided")
+    principal, err := interceptor.authenticate(ctx)
+    if err != nil {
+        interceptor.auditDenied(ctx, method, nil, err)
+        return nil, err
     }
 
-    accessToken := values[0]
-    claims, err := interceptor.jwtManager.Verify(accessToken)
+    if err := decision.Authorize(principal); err != nil {
+        interceptor.auditDenied(ctx, method, principal, err)
+        return nil, err
+    }
+
+    // 认证方式可能缓存调用方身份，复制后再记录授权结果
+    authorized := *principal
+    authorized.Admin = decision.Admin(principal)
+    return ContextWithPrincipal(ctx, &authorized), nil
+}
+
+// auditDenied 记录被拒绝的请求
+func (interceptor *AuthInterceptor) auditDenied(ctx context.Context, method string, principal *Principal, err error) {
+    event := &AuditEvent{
+        Type:    AuditAccessDenied,
+        Method:  method,
+        Outcome: AuditOutcomeDenied,
+        Reason:  status.Convert(err).Message(),
+    }
+    if principal != nil {
+        event.Principal = principal.Username
+        event.AuthMethod = principal.AuthMethod
+    }
+    recordAudit(ctx, interceptor.auditSink, event)
+}
+
+// auditRPC 记录修改数据的 RPC 调用和结果
+func (interceptor *AuthInterceptor) auditRPC(ctx context.Context, method string, req, res interface{}, err error) {
+    if !isAuditedMethod(method) {
+        return
+    }
+
+    event := &AuditEvent{
+        Type:       AuditRPC,
+        Method:     method,
+        ResourceID: auditResourceID(method, req, res),
+        Outcome:    AuditOutcomeSuccess,
+    }
+    if principal, ok := PrincipalFromContext(ctx); ok {
+        event.Principal = principal.Username
+        event.AuthMethod = principal.AuthMethod
+    }
     if err != nil {
-        return status.Errorf(codes.Unauthenticated, "authorization token is invalid")
+        event.Outcome = AuditOutcomeFailure
+        event.Reason = status.Convert(err).Message()
     }
+    recordAudit(ctx, interceptor.auditSink, event)
+}
 
-    for _, role := range accessibleRoles {
-        if role == claims.Role {
-            return nil
+// authenticate 使用配置的认证方式识别调用方身份
+func (interceptor *AuthInterceptor) authenticate(ctx context.Context) (*Principal, error) {
+    for _, authenticator := range interceptor.authenticators {
+        principal, err := authenticator.Authenticate(ctx)
+        if err != nil {
+            tokenVerificationFailures.WithLabelValues(authenticatorName(authenticator)).Inc()
+            return nil, err
+        }
+        if principal != nil {
+            return principal, nil
         }
     }
-    return status.Errorf(codes.PermissionDenied, "no permission to access this RPC")
+    return nil, status.Errorf(codes.Unauthenticated, "authorization credentials are not provided")
 }
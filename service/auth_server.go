@@ -2,42 +2,373 @@ package service
 
 import (
     "context"
+    "net"
+    "time"
 
+    "github.com/xiusl/pcbook/logging"
     "github.com/xiusl/pcbook/pb"
     "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/peer"
     "google.golang.org/grpc/status"
 )
 
 // AuthServer 授权服务
 type AuthServer struct {
-    userStore  UserStore
-    jwtManager *JWTManager
+    userStore      UserStore
+    jwtManager     *JWTManager
+    loginLimiter   *LoginLimiter
+    auditSink      AuditSink
+    passwordPolicy PasswordPolicy
 }
 
-// NewAuthServer 创建一个授权服务
-func NewAuthServer(userStore UserStore, jwtManager *JWTManager) *AuthServer {
+// NewAuthServer 创建一个授权服务，loginLimiter 为 nil 时不限制登录尝试，auditSink 为 nil 时不记录审计事件
+// 修改密码时按照 passwordPolicy 检查新密码的强度
+func NewAuthServer(
+    userStore UserStore,
+    jwtManager *JWTManager,
+    loginLimiter *LoginLimiter,
+    auditSink AuditSink,
+    passwordPolicy PasswordPolicy,
+) *AuthServer {
     return &AuthServer{
-        userStore:  userStore,
-        jwtManager: jwtManager,
+        userStore:      userStore,
+        jwtManager:     jwtManager,
+        loginLimiter:   loginLimiter,
+        auditSink:      auditSink,
+        passwordPolicy: passwordPolicy,
     }
 }
 
+// totpIssuer 身份验证器应用中显示的发行方
+const totpIssuer = "pcbook"
+
+// authLog 认证和授权的日志
+var authLog = logging.New("auth")
+
 // Login 用户登录 RPC
 func (server *AuthServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
-    user, err := server.userStore.Find(req.GetUsername())
+    username := req.GetUsername()
+    peerIP := peerIPFromContext(ctx)
+
+    // 在进行代价较高的密码哈希之前检查限流
+    if server.loginLimiter != nil {
+        if retryAfter, locked := server.loginLimiter.Check(username, peerIP); retryAfter > 0 {
+            authLog.Warn(ctx, "login is throttled", "username", username, "peer", peerIP, "retry_after", retryAfter)
+            err := loginThrottledError(retryAfter, locked)
+            server.auditLogin(ctx, username, AuthMethodPassword, err)
+            return nil, err
+        }
+        defer server.loginLimiter.Release(username, peerIP)
+    }
+
+    _, span := startSpan(ctx, "UserStore.Find")
+    user, err := server.userStore.Find(username)
+    endSpan(span, err)
     if err != nil {
         return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
     }
 
-    if user == nil || !user.IsCorrentPassword(req.GetPassword()) {
-        return nil, status.Errorf(codes.NotFound, "incorrect username/password")
+    _, span = startSpan(ctx, "password.compare")
+    if user == nil {
+        _ = ComparePassword(dummyPasswordHash(), req.GetPassword())
+    }
+    correct := user != nil && user.IsCorrentPassword(req.GetPassword())
+    span.End()
+    if !correct {
+        if server.loginLimiter != nil {
+            server.loginLimiter.RecordFailure(username, peerIP)
+        }
+        err := status.Errorf(codes.Unauthenticated, "incorrect username/password")
+        server.auditLogin(ctx, username, AuthMethodPassword, err)
+        return nil, err
     }
+    server.rehashPassword(ctx, user, req.GetPassword())
 
-    token, err := server.jwtManager.Generate(user)
+    // 开启了两步验证的账号需要再使用 VerifyLogin 提交验证码
+    if user.TOTPEnabled {
+        challenge, err := server.jwtManager.GenerateMFAChallenge(user)
+        if err != nil {
+            return nil, status.Errorf(codes.Internal, "cannot generate mfa challenge")
+        }
+
+        resp := &pb.LoginResponse{
+            MfaRequired:  true,
+            MfaChallenge: challenge,
+        }
+        return resp, nil
+    }
+
+    if server.loginLimiter != nil {
+        server.loginLimiter.RecordSuccess(username)
+    }
+
+    token, err := server.jwtManager.Generate(user, AuthMethodPassword)
     if err != nil {
         return nil, status.Errorf(codes.Internal, "cannot generate access token")
     }
+    server.auditLogin(ctx, username, AuthMethodPassword, nil)
 
     resp := &pb.LoginResponse{AccessToken: token}
     return resp, nil
 }
+
+// VerifyLogin 两步验证登录的第二步，使用 TOTP 验证码或者恢复码换取访问令牌
+func (server *AuthServer) VerifyLogin(ctx context.Context, req *pb.VerifyLoginRequest) (*pb.LoginResponse, error) {
+    username, err := server.jwtManager.VerifyMFAChallenge(req.GetMfaChallenge())
+    if err != nil {
+        return nil, status.Errorf(codes.Unauthenticated, "mfa challenge is invalid")
+    }
+    peerIP := peerIPFromContext(ctx)
+
+    // 验证码只有六位数字，同样需要限制尝试次数
+    if server.loginLimiter != nil {
+        if retryAfter, locked := server.loginLimiter.Check(username, peerIP); retryAfter > 0 {
+            authLog.Warn(ctx, "mfa verification is throttled", "username", username, "peer", peerIP, "retry_after", retryAfter)
+            err := loginThrottledError(retryAfter, locked)
+            server.auditLogin(ctx, username, AuthMethodPasswordTOTP, err)
+            return nil, err
+        }
+        defer server.loginLimiter.Release(username, peerIP)
+    }
+
+    user, err := server.userStore.Find(username)
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
+    }
+    if user == nil || !user.TOTPEnabled {
+        return nil, status.Errorf(codes.Unauthenticated, "mfa challenge is invalid")
+    }
+
+    // 先用读到的用户过滤掉错误的验证码，再由存储原子地消耗，同一个验证码只能换取一次令牌
+    verified := false
+    switch factor := req.GetFactor().(type) {
+    case *pb.VerifyLoginRequest_TotpCode:
+        counter, ok := ValidateTOTPCode(user.TOTPSecret, factor.TotpCode, time.Now(), user.TOTPLastCounter)
+        if ok {
+            verified, err = server.userStore.ConsumeTOTP(username, counter)
+        }
+    case *pb.VerifyLoginRequest_RecoveryCode:
+        verified, err = server.userStore.ConsumeRecoveryCode(username, hashRecoveryCode(factor.RecoveryCode))
+    }
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot update user: %v", err)
+    }
+
+    if !verified {
+        if server.loginLimiter != nil {
+            server.loginLimiter.RecordFailure(username, peerIP)
+        }
+        err := status.Errorf(codes.Unauthenticated, "incorrect verification code")
+        server.auditLogin(ctx, username, AuthMethodPasswordTOTP, err)
+        return nil, err
+    }
+
+    if server.loginLimiter != nil {
+        server.loginLimiter.RecordSuccess(username)
+    }
+
+    token, err := server.jwtManager.Generate(user, AuthMethodPasswordTOTP)
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot generate access token")
+    }
+    server.auditLogin(ctx, username, AuthMethodPasswordTOTP, nil)
+
+    resp := &pb.LoginResponse{AccessToken: token}
+    return resp, nil
+}
+
+// EnrollTOTP 为当前用户生成新的 TOTP 密钥，需要调用 ConfirmTOTP 验证第一个验证码后才会生效
+func (server *AuthServer) EnrollTOTP(ctx context.Context, req *pb.EnrollTOTPRequest) (*pb.EnrollTOTPResponse, error) {
+    user, err := server.currentUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if user.TOTPEnabled {
+        return nil, status.Errorf(codes.FailedPrecondition, "two-factor authentication is already enabled")
+    }
+
+    secret, err := GenerateTOTPSecret()
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot generate totp secret: %v", err)
+    }
+
+    user.TOTPSecret = secret
+    user.TOTPLastCounter = 0
+    if err := server.userStore.Update(user); err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot update user: %v", err)
+    }
+
+    res := &pb.EnrollTOTPResponse{
+        Secret:     secret,
+        OtpauthUri: TOTPURI(totpIssuer, user.Username, secret),
+    }
+    return res, nil
+}
+
+// ConfirmTOTP 验证第一个验证码，开启两步验证并返回一次性的恢复码
+func (server *AuthServer) ConfirmTOTP(ctx context.Context, req *pb.ConfirmTOTPRequest) (*pb.ConfirmTOTPResponse, error) {
+    user, err := server.currentUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if user.TOTPEnabled {
+        return nil, status.Errorf(codes.FailedPrecondition, "two-factor authentication is already enabled")
+    }
+    if user.TOTPSecret == "" {
+        return nil, status.Errorf(codes.FailedPrecondition, "totp enrollment is not started")
+    }
+
+    counter, ok := ValidateTOTPCode(user.TOTPSecret, req.GetTotpCode(), time.Now(), user.TOTPLastCounter)
+    if !ok {
+        return nil, status.Errorf(codes.InvalidArgument, "incorrect verification code")
+    }
+
+    recoveryCodes, hashes, err := GenerateRecoveryCodes()
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot generate recovery codes: %v", err)
+    }
+
+    user.TOTPEnabled = true
+    user.TOTPLastCounter = counter
+    user.RecoveryCodeHashes = hashes
+    if err := server.userStore.Update(user); err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot update user: %v", err)
+    }
+    authLog.Info(ctx, "two-factor authentication enabled", "username", user.Username)
+
+    return &pb.ConfirmTOTPResponse{RecoveryCodes: recoveryCodes}, nil
+}
+
+// currentUser 获取当前登录的用户
+func (server *AuthServer) currentUser(ctx context.Context) (*User, error) {
+    principal, ok := PrincipalFromContext(ctx)
+    if !ok {
+        return nil, status.Errorf(codes.Unauthenticated, "user is not logged in")
+    }
+    // API key、客户端证书等服务账号没有对应的用户
+    if principal.AuthMethod != AuthMethodPassword && principal.AuthMethod != AuthMethodPasswordTOTP {
+        return nil, status.Errorf(codes.FailedPrecondition, "%s is not a user account", principal.Username)
+    }
+
+    user, err := server.userStore.Find(principal.Username)
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
+    }
+    if user == nil {
+        return nil, status.Errorf(codes.FailedPrecondition, "%s is not a user account", principal.Username)
+    }
+    return user, nil
+}
+
+// ChangePassword 当前用户修改自己的密码，新密码需要满足密码强度要求
+func (server *AuthServer) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+    user, err := server.currentUser(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    // 令牌被盗用时不能直接修改密码；不使用 Unauthenticated，避免客户端当作令牌失效重新登录
+    if !user.IsCorrentPassword(req.GetCurrentPassword()) {
+        return nil, status.Errorf(codes.PermissionDenied, "current password is incorrect")
+    }
+    if err := server.passwordPolicy.Validate(user.Username, req.GetNewPassword()); err != nil {
+        return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+    }
+    if req.GetNewPassword() == req.GetCurrentPassword() {
+        return nil, status.Errorf(codes.InvalidArgument, "new password must be different from the current password")
+    }
+
+    if err := user.SetPassword(req.GetNewPassword()); err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot set password: %v", err)
+    }
+    if err := server.userStore.Update(user); err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot update user: %v", err)
+    }
+    authLog.Info(ctx, "password changed", "username", user.Username)
+
+    return &pb.ChangePasswordResponse{}, nil
+}
+
+// rehashPassword 密码验证通过后，把使用旧算法或者弱参数保存的哈希升级为当前的参数
+// 只替换哈希本身，并且只在保存的哈希仍然是验证过的哈希时替换，避免覆盖同时修改的密码或者其他字段
+func (server *AuthServer) rehashPassword(ctx context.Context, user *User, password string) {
+    if !user.PasswordNeedsRehash() {
+        return
+    }
+    hashedPassword, err := HashPassword(password, currentArgon2Params())
+    if err != nil {
+        authLog.Error(ctx, "cannot rehash password", "username", user.Username, "error", err)
+        return
+    }
+    replaced, err := server.userStore.ReplacePasswordHash(user.Username, user.HashedPassword, hashedPassword)
+    if err != nil {
+        authLog.Error(ctx, "cannot save rehashed password", "username", user.Username, "error", err)
+        return
+    }
+    if !replaced {
+        authLog.Info(ctx, "password changed concurrently, skip hash upgrade", "username", user.Username)
+        return
+    }
+    user.HashedPassword = hashedPassword
+    authLog.Info(ctx, "password hash upgraded", "username", user.Username)
+}
+
+// UnlockAccount 管理员解除账号的登录锁定
+func (server *AuthServer) UnlockAccount(ctx context.Context, req *pb.UnlockAccountRequest) (*pb.UnlockAccountResponse, error) {
+    if req.GetUsername() == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "username is required")
+    }
+    if server.loginLimiter == nil {
+        return &pb.UnlockAccountResponse{}, nil
+    }
+
+    cleared := server.loginLimiter.Unlock(req.GetUsername())
+    authLog.Info(ctx, "account unlocked", "username", req.GetUsername(), "cleared", cleared)
+
+    return &pb.UnlockAccountResponse{Cleared: cleared}, nil
+}
+
+// auditLogin 记录登录结果，err 为 nil 表示登录成功
+func (server *AuthServer) auditLogin(ctx context.Context, username, authMethod string, err error) {
+    event := &AuditEvent{
+        Type:       AuditLoginSuccess,
+        Principal:  username,
+        AuthMethod: authMethod,
+        Method:     "/xiusl.pcbook.AuthService/Login",
+        Outcome:    AuditOutcomeSuccess,
+    }
+    // 两步验证登录的结果由 VerifyLogin 产生
+    if authMethod == AuthMethodPasswordTOTP {
+        event.Method = "/xiusl.pcbook.AuthService/VerifyLogin"
+    }
+    if err != nil {
+        event.Type = AuditLoginFailure
+        event.Outcome = AuditOutcomeFailure
+        event.Reason = status.Convert(err).Message()
+    }
+    recordAudit(ctx, server.auditSink, event)
+}
+
+// loginThrottledError 返回带有重试时间的 ResourceExhausted 错误
+func loginThrottledError(retryAfter time.Duration, locked bool) error {
+    message := "too many failed login attempts, retry later"
+    if locked {
+        message = "account is temporarily locked due to too many failed login attempts"
+    }
+
+    return resourceExhaustedError(message, retryAfter)
+}
+
+// peerIPFromContext 获取请求来源的 IP 地址
+func peerIPFromContext(ctx context.Context) string {
+    p, ok := peer.FromContext(ctx)
+    if !ok || p.Addr == nil {
+        return ""
+    }
+
+    host, _, err := net.SplitHostPort(p.Addr.String())
+    if err != nil {
+        return p.Addr.String()
+    }
+    return host
+}
@@ -0,0 +1,160 @@
+package service_test
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/genproto/googleapis/rpc/errdetails"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/peer"
+    "google.golang.org/grpc/status"
+)
+
+func TestServerLoginLockout(t *testing.T) {
+    userStore := service.NewInMemoryUserStore()
+    user, err := service.NewUser("admin", "secret", "admin")
+    require.NoError(t, err)
+    require.NoError(t, userStore.Save(user))
+
+    limiter := service.NewLoginLimiter(service.LoginLimiterConfig{
+        MaxUserFailures: 3,
+        MaxPeerFailures: 100,
+        BaseDelay:       5 * time.Millisecond,
+        MaxDelay:        10 * time.Millisecond,
+        LockoutDuration: time.Hour,
+    })
+    jwtManager := service.NewJWTManager("secret", time.Minute)
+    srv := service.NewAuthServer(userStore, jwtManager, limiter, nil, service.DefaultPasswordPolicy())
+
+    ctx := peer.NewContext(context.Background(), &peer.Peer{
+        Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000},
+    })
+    wrong := &pb.LoginRequest{Username: "admin", Password: "wrong"}
+    right := &pb.LoginRequest{Username: "admin", Password: "secret"}
+
+    _, err = srv.Login(ctx, &pb.LoginRequest{Username: "nobody", Password: "wrong"})
+    require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+    // 来源 IP 同样需要退避
+    _, err = srv.Login(ctx, wrong)
+    require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+    time.Sleep(20 * time.Millisecond)
+    _, err = srv.Login(ctx, wrong)
+    require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+    // 失败后立即重试会被退避拒绝
+    _, err = srv.Login(ctx, right)
+    require.Equal(t, codes.ResourceExhausted, status.Code(err))
+    require.NotZero(t, retryDelay(t, err))
+
+    for i := 0; i < 2; i++ {
+        time.Sleep(20 * time.Millisecond)
+        _, err = srv.Login(ctx, wrong)
+        require.Equal(t, codes.Unauthenticated, status.Code(err))
+    }
+
+    // 达到失败次数后账号被锁定，正确的密码也无法登录
+    time.Sleep(20 * time.Millisecond)
+    _, err = srv.Login(ctx, right)
+    require.Equal(t, codes.ResourceExhausted, status.Code(err))
+    require.Greater(t, retryDelay(t, err), time.Minute)
+
+    res, err := srv.UnlockAccount(context.Background(), &pb.UnlockAccountRequest{Username: "admin"})
+    require.NoError(t, err)
+    require.True(t, res.GetCleared())
+
+    login, err := srv.Login(ctx, right)
+    require.NoError(t, err)
+    require.NotEmpty(t, login.GetAccessToken())
+}
+
+func TestServerLoginParallelGuesses(t *testing.T) {
+    userStore := service.NewInMemoryUserStore()
+    user, err := service.NewUser("admin", "secret", "admin")
+    require.NoError(t, err)
+    require.NoError(t, userStore.Save(user))
+
+    limiter := service.NewLoginLimiter(service.LoginLimiterConfig{
+        MaxUserFailures: 3,
+        MaxPeerFailures: 100,
+        BaseDelay:       time.Minute,
+        MaxDelay:        time.Minute,
+        LockoutDuration: time.Hour,
+    })
+    jwtManager := service.NewJWTManager("secret", time.Minute)
+    srv := service.NewAuthServer(userStore, jwtManager, limiter, nil, service.DefaultPasswordPolicy())
+
+    ctx := peer.NewContext(context.Background(), &peer.Peer{
+        Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000},
+    })
+
+    // 同时发起的猜测不能超过失败次数的限制
+    const n = 20
+    codeCh := make(chan codes.Code, n)
+    for i := 0; i < n; i++ {
+        go func() {
+            _, err := srv.Login(ctx, &pb.LoginRequest{Username: "admin", Password: "wrong"})
+            codeCh <- status.Code(err)
+        }()
+    }
+
+    attempted := 0
+    for i := 0; i < n; i++ {
+        code := <-codeCh
+        if code == codes.Unauthenticated {
+            attempted++
+            continue
+        }
+        require.Equal(t, codes.ResourceExhausted, code)
+    }
+    require.GreaterOrEqual(t, attempted, 1)
+    require.LessOrEqual(t, attempted, 3)
+
+    _, err = srv.Login(ctx, &pb.LoginRequest{Username: "admin", Password: "secret"})
+    require.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func retryDelay(t *testing.T, err error) time.Duration {
+    for _, detail := range status.Convert(err).Details() {
+        if info, ok := detail.(*errdetails.RetryInfo); ok {
+            return info.GetRetryDelay().AsDuration()
+        }
+    }
+    t.Fatal("retry info is not provided")
+    return 0
+}
+
+func TestLoginLimiterBounded(t *testing.T) {
+    limiter := service.NewLoginLimiter(service.LoginLimiterConfig{
+        MaxUserFailures: 1,
+        BaseDelay:       time.Hour,
+        MaxDelay:        time.Hour,
+        LockoutDuration: time.Hour,
+    })
+    fail := func(username string) {
+        wait, _ := limiter.Check(username, "")
+        require.Zero(t, wait)
+        limiter.RecordFailure(username, "")
+        limiter.Release(username, "")
+    }
+
+    // 不断尝试不同的用户名时只保留最近的记录，最早的记录被丢弃
+    fail("first")
+    for i := 0; i < 10000; i++ {
+        fail(fmt.Sprintf("spray-%d", i))
+    }
+    wait, _ := limiter.Check("first", "")
+    require.Zero(t, wait)
+    limiter.Release("first", "")
+
+    wait, locked := limiter.Check("spray-9999", "")
+    require.NotZero(t, wait)
+    require.True(t, locked)
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+    "context"
+    "crypto/x509"
+    "fmt"
+    "io/ioutil"
+
+    "google.golang.org/grpc/credentials"
+    "google.golang.org/grpc/peer"
+    "gopkg.in/yaml.v3"
+)
+
+// CertIdentityMapper 将已验证的客户端证书映射为调用方身份，用于服务间调用
+type CertIdentityMapper struct {
+    identities []CertIdentity
+}
+
+// CertIdentity 一条证书身份映射规则，URI、DNS、CommonName 中指定的字段都必须匹配
+type CertIdentity struct {
+    // URI 证书 SAN 中的 URI，例如 spiffe://pcbook.com/importer
+    URI string `yaml:"uri"`
+    // DNS 证书 SAN 中的 DNS 名称
+    DNS string `yaml:"dns"`
+    // CommonName 证书 subject 中的 CN
+    CommonName string `yaml:"common_name"`
+
+    Principal string   `yaml:"principal"`
+    Roles     []string `yaml:"roles"`
+    Vendor    string   `yaml:"vendor"`
+}
+
+type certIdentityFile struct {
+    Identities []CertIdentity `yaml:"identities"`
+}
+
+// LoadCertIdentityMapper 从 YAML/JSON 文件中加载证书身份映射
+func LoadCertIdentityMapper(filename string) (*CertIdentityMapper, error) {
+    data, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return nil, fmt.Errorf("cannot read cert identity file: %w", err)
+    }
+
+    file := &certIdentityFile{}
+    if err := yaml.Unmarshal(data, file); err != nil {
+        return nil, fmt.Errorf("cannot parse cert identity file: %w", err)
+    }
+    return NewCertIdentityMapper(file.Identities)
+}
+
+// NewCertIdentityMapper 创建证书身份映射，规则按顺序匹配
+func NewCertIdentityMapper(identities []CertIdentity) (*CertIdentityMapper, error) {
+    for i, identity := range identities {
+        if identity.URI == "" && identity.DNS == "" && identity.CommonName == "" {
+            return nil, fmt.Errorf("identity %d must match uri, dns or common_name", i)
+        }
+        if identity.Principal == "" {
+            return nil, fmt.Errorf("identity %d has no principal", i)
+        }
+        if len(identity.Roles) == 0 {
+            return nil, fmt.Errorf("identity %d has no roles", i)
+        }
+    }
+    return &CertIdentityMapper{identities}, nil
+}
+
+// Map 查找与证书匹配的调用方身份
+func (mapper *CertIdentityMapper) Map(cert *x509.Certificate) (*Principal, bool) {
+    for _, identity := range mapper.identities {
+        if identity.matches(cert) {
+            principal := &Principal{
+                Username:   identity.Principal,
+                Roles:      append([]string(nil), identity.Roles...),
+                Vendor:     identity.Vendor,
+                AuthMethod: AuthMethodCertificate,
+            }
+            return principal, true
+        }
+    }
+    return nil, false
+}
+
+// Authenticate 使用 TLS 连接中已验证的客户端证书识别调用方身份
+// 没有客户端证书或者证书没有对应的映射时返回 nil, nil
+func (mapper *CertIdentityMapper) Authenticate(ctx context.Context) (*Principal, error) {
+    p, ok := peer.FromContext(ctx)
+    if !ok {
+        return nil, nil
+    }
+
+    tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+    if !ok {
+        return nil, nil
+    }
+
+    // 只信任握手时已经通过 CA 验证的证书链
+    chains := tlsInfo.State.VerifiedChains
+    if len(chains) == 0 || len(chains[0]) == 0 {
+        return nil, nil
+    }
+
+    principal, ok := mapper.Map(chains[0][0])
+    if !ok {
+        return nil, nil
+    }
+    return principal, nil
+}
+
+func (identity *CertIdentity) matches(cert *x509.Certificate) bool {
+    if identity.CommonName != "" && identity.CommonName != cert.Subject.CommonName {
+        return false
+    }
+
+    if identity.URI != "" {
+        found := false
+        for _, uri := range cert.URIs {
+            if uri.String() == identity.URI {
+                found = true
+                break
+            }
+        }
+        if !found {
+            return false
+        }
+    }
+
+    if identity.DNS != "" {
+        found := false
+        for _, name := range cert.DNSNames {
+            if name == identity.DNS {
+                found = true
+                break
+            }
+        }
+        if !found {
+            return false
+        }
+    }
+    return true
+}
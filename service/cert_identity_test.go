@@ -0,0 +1,73 @@
+package service_test
+
+import (
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "net/url"
+    "testing"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/grpc/credentials"
+    "google.golang.org/grpc/peer"
+)
+
+func TestCertIdentityAuthenticate(t *testing.T) {
+    mapper, err := service.NewCertIdentityMapper([]service.CertIdentity{
+        {
+            URI:       "spiffe://pcbook.com/importer",
+            Principal: "importer",
+            Roles:     []string{"vendor"},
+            Vendor:    "acme",
+        },
+        {
+            CommonName: "indexer.pcbook.com",
+            Principal:  "indexer",
+            Roles:      []string{"user"},
+        },
+    })
+    require.NoError(t, err)
+
+    importerURI, err := url.Parse("spiffe://pcbook.com/importer")
+    require.NoError(t, err)
+
+    importer := &x509.Certificate{URIs: []*url.URL{importerURI}}
+    indexer := &x509.Certificate{Subject: pkix.Name{CommonName: "indexer.pcbook.com"}}
+    unknown := &x509.Certificate{Subject: pkix.Name{CommonName: "unknown.pcbook.com"}}
+
+    principal, err := mapper.Authenticate(tlsPeerContext(importer, true))
+    require.NoError(t, err)
+    require.Equal(t, "importer", principal.Username)
+    require.Equal(t, []string{"vendor"}, principal.Roles)
+    require.Equal(t, "acme", principal.Vendor)
+
+    principal, err = mapper.Authenticate(tlsPeerContext(indexer, true))
+    require.NoError(t, err)
+    require.Equal(t, "indexer", principal.Username)
+
+    // 没有映射、没有经过验证的证书、没有 TLS 时都不识别身份
+    for _, ctx := range []context.Context{
+        tlsPeerContext(unknown, true),
+        tlsPeerContext(importer, false),
+        context.Background(),
+    } {
+        principal, err = mapper.Authenticate(ctx)
+        require.NoError(t, err)
+        require.Nil(t, principal)
+    }
+
+    _, err = service.NewCertIdentityMapper([]service.CertIdentity{{Principal: "any", Roles: []string{"admin"}}})
+    require.Error(t, err)
+}
+
+func tlsPeerContext(cert *x509.Certificate, verified bool) context.Context {
+    state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+    if verified {
+        state.VerifiedChains = [][]*x509.Certificate{{cert}}
+    }
+    return peer.NewContext(context.Background(), &peer.Peer{
+        AuthInfo: credentials.TLSInfo{State: state},
+    })
+}
@@ -0,0 +1,259 @@
+package service
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+
+    "github.com/xiusl/pcbook/pb"
+    "google.golang.org/protobuf/encoding/protojson"
+)
+
+// deadLetterCompactRecords 文件中的记录数超过这个数量并且超过死信数量的两倍时压缩文件
+const deadLetterCompactRecords = 1000
+
+// deadLetterRecord 死信文件中的一行，Removed 为 true 时表示删除 ID 对应的死信，事件按 protobuf 的 JSON 格式保存
+type deadLetterRecord struct {
+    ID         string          `json:"id"`
+    Removed    bool            `json:"removed,omitempty"`
+    WebhookID  string          `json:"webhook_id,omitempty"`
+    DeliveryID string          `json:"delivery_id,omitempty"`
+    Event      json.RawMessage `json:"event,omitempty"`
+    Attempts   int             `json:"attempts,omitempty"`
+    LastError  string          `json:"last_error,omitempty"`
+    FailedAt   time.Time       `json:"failed_at"`
+}
+
+// newDeadLetterRecord 把死信转换为文件中的记录
+func newDeadLetterRecord(letter *DeadLetter) (*deadLetterRecord, error) {
+    event, err := protojson.Marshal(letter.Event)
+    if err != nil {
+        return nil, fmt.Errorf("cannot marshal dead letter event: %w", err)
+    }
+    record := &deadLetterRecord{
+        ID:         letter.ID,
+        WebhookID:  letter.WebhookID,
+        DeliveryID: letter.DeliveryID,
+        Event:      event,
+        Attempts:   letter.Attempts,
+        LastError:  letter.LastError,
+        FailedAt:   letter.FailedAt,
+    }
+    return record, nil
+}
+
+// letter 把文件中的记录转换为死信
+func (record *deadLetterRecord) letter() (*DeadLetter, error) {
+    event := &pb.LaptopEvent{}
+    if err := protojson.Unmarshal(record.Event, event); err != nil {
+        return nil, fmt.Errorf("cannot decode dead letter event: %w", err)
+    }
+    letter := &DeadLetter{
+        ID:         record.ID,
+        WebhookID:  record.WebhookID,
+        DeliveryID: record.DeliveryID,
+        Event:      event,
+        Attempts:   record.Attempts,
+        LastError:  record.LastError,
+        FailedAt:   record.FailedAt,
+    }
+    return letter, nil
+}
+
+// FileDeadLetterStore 在内存中保存死信，以 JSON lines 格式只追加写入文件，删除时写入删除记录
+// 打开时按顺序重放文件恢复死信，打开时和删除的记录过多时把现有的死信写入新文件，替换原来的文件
+type FileDeadLetterStore struct {
+    mutex    sync.Mutex
+    filename string
+    letters  *InMemoryDeadLetterStore
+    file     *os.File
+    // records 文件中的记录数，包括已经删除和超过上限被丢弃的死信
+    records int
+}
+
+// NewFileDeadLetterStore 打开或者创建死信文件，最多保存 max 条死信
+func NewFileDeadLetterStore(filename string, max int) (*FileDeadLetterStore, error) {
+    store := &FileDeadLetterStore{
+        filename: filename,
+        letters:  NewInMemoryDeadLetterStore(max),
+    }
+    if err := store.load(); err != nil {
+        return nil, err
+    }
+    if err := store.compact(); err != nil {
+        return nil, err
+    }
+    return store, nil
+}
+
+// Save 保存一条死信并追加到文件
+func (store *FileDeadLetterStore) Save(letter *DeadLetter) error {
+    record, err := newDeadLetterRecord(letter)
+    if err != nil {
+        return err
+    }
+
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    if err := store.letters.Save(letter); err != nil {
+        return err
+    }
+    if err := store.append(record); err != nil {
+        // 没有写入文件的死信重启后会丢失，同时从内存中删除，保持和文件一致
+        store.letters.Remove(letter.ID)
+        return err
+    }
+    return nil
+}
+
+// Find 根据 id 查询死信
+func (store *FileDeadLetterStore) Find(id string) (*DeadLetter, error) {
+    return store.letters.Find(id)
+}
+
+// List 按失败时间返回 webhookID 的死信
+func (store *FileDeadLetterStore) List(webhookID string, limit int) ([]*DeadLetter, error) {
+    return store.letters.List(webhookID, limit)
+}
+
+// Remove 删除一条死信并追加删除记录
+func (store *FileDeadLetterStore) Remove(id string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    if err := store.letters.Remove(id); err != nil {
+        return err
+    }
+    return store.append(&deadLetterRecord{ID: id, Removed: true})
+}
+
+// Close 把文件写入磁盘并关闭
+func (store *FileDeadLetterStore) Close() error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    if store.file == nil {
+        return nil
+    }
+    err := store.file.Sync()
+    if closeErr := store.file.Close(); err == nil {
+        err = closeErr
+    }
+    store.file = nil
+    return err
+}
+
+// append 追加一条记录，删除和丢弃的记录过多时压缩文件，调用方需要持有锁
+func (store *FileDeadLetterStore) append(record *deadLetterRecord) error {
+    if store.file == nil {
+        return fmt.Errorf("dead letter store is closed")
+    }
+    line, err := json.Marshal(record)
+    if err != nil {
+        return fmt.Errorf("cannot marshal dead letter: %w", err)
+    }
+    if _, err := store.file.Write(append(line, '\n')); err != nil {
+        return fmt.Errorf("cannot write dead letter file: %w", err)
+    }
+    store.records++
+
+    if store.records > deadLetterCompactRecords && store.records > 2*store.letters.count() {
+        // 记录已经写入文件，压缩失败时继续追加到原来的文件
+        if err := store.compact(); err != nil {
+            webhookLog.Error(context.Background(), "cannot compact dead letter file", "filename", store.filename, "error", err)
+        }
+    }
+    return nil
+}
+
+// load 按顺序重放文件中的记录，文件不存在时为空
+func (store *FileDeadLetterStore) load() error {
+    file, err := os.Open(store.filename)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("cannot open dead letter file: %w", err)
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(make([]byte, 64*1024), 16<<20)
+    for line := 1; scanner.Scan(); line++ {
+        record := &deadLetterRecord{}
+        if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+            return fmt.Errorf("cannot decode dead letter at %s:%d: %w", store.filename, line, err)
+        }
+        if record.Removed {
+            // 超过上限时死信可能已经被丢弃
+            store.letters.Remove(record.ID)
+            continue
+        }
+        letter, err := record.letter()
+        if err != nil {
+            return fmt.Errorf("cannot decode dead letter at %s:%d: %w", store.filename, line, err)
+        }
+        if err := store.letters.Save(letter); err != nil {
+            return fmt.Errorf("cannot load dead letter %s: %w", letter.ID, err)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return fmt.Errorf("cannot read dead letter file: %w", err)
+    }
+    return nil
+}
+
+// compact 把现有的死信写入临时文件，替换原来的文件后继续追加到临时文件的句柄，调用方需要持有锁或者还没有开始使用
+// 任何一步失败都继续使用原来的文件
+func (store *FileDeadLetterStore) compact() error {
+    letters, err := store.letters.List("", 0)
+    if err != nil {
+        return err
+    }
+
+    temp, err := ioutil.TempFile(filepath.Dir(store.filename), filepath.Base(store.filename)+".tmp*")
+    if err != nil {
+        return fmt.Errorf("cannot create dead letter file: %w", err)
+    }
+    defer os.Remove(temp.Name())
+
+    writer := bufio.NewWriter(temp)
+    encoder := json.NewEncoder(writer)
+    for _, letter := range letters {
+        record, err := newDeadLetterRecord(letter)
+        if err != nil {
+            temp.Close()
+            return err
+        }
+        if err := encoder.Encode(record); err != nil {
+            temp.Close()
+            return fmt.Errorf("cannot write dead letter file: %w", err)
+        }
+    }
+    if err := writer.Flush(); err != nil {
+        temp.Close()
+        return fmt.Errorf("cannot write dead letter file: %w", err)
+    }
+    if err := temp.Sync(); err != nil {
+        temp.Close()
+        return fmt.Errorf("cannot sync dead letter file: %w", err)
+    }
+    if err := os.Rename(temp.Name(), store.filename); err != nil {
+        temp.Close()
+        return fmt.Errorf("cannot replace dead letter file: %w", err)
+    }
+
+    if store.file != nil {
+        store.file.Close()
+    }
+    store.file = temp
+    store.records = len(letters)
+    return nil
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "sync"
+
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/peer"
+)
+
+// GatewayPeerHeader 进程内网关转发流式请求时携带调用方令牌的 metadata
+const GatewayPeerHeader = "x-pcbook-gateway-peer"
+
+// gatewayPeerTokenLength 调用方令牌的字节数
+const gatewayPeerTokenLength = 16
+
+// GatewayPeers 保存进程内网关正在转发的请求的调用方
+// 流式请求经过内存中的连接到达 gRPC 服务端，拦截器按令牌还原真实的地址和证书，
+// 令牌只保存在进程内，外部的调用方无法伪造
+type GatewayPeers struct {
+    mutex sync.Mutex
+    peers map[string]*peer.Peer
+}
+
+// NewGatewayPeers 新建一个调用方登记表
+func NewGatewayPeers() *GatewayPeers {
+    return &GatewayPeers{
+        peers: make(map[string]*peer.Peer),
+    }
+}
+
+// Register 登记 ctx 对应的 HTTP 请求的调用方，返回放入 GatewayPeerHeader 的令牌，ctx 结束后删除登记
+func (peers *GatewayPeers) Register(ctx context.Context, p *peer.Peer) (string, error) {
+    raw := make([]byte, gatewayPeerTokenLength)
+    if _, err := rand.Read(raw); err != nil {
+        return "", fmt.Errorf("cannot generate gateway peer token: %w", err)
+    }
+    token := hex.EncodeToString(raw)
+
+    peers.mutex.Lock()
+    peers.peers[token] = p
+    peers.mutex.Unlock()
+
+    go func() {
+        <-ctx.Done()
+        peers.mutex.Lock()
+        delete(peers.peers, token)
+        peers.mutex.Unlock()
+    }()
+    return token, nil
+}
+
+// Unary 一元 RPC 拦截器，需要放在最外层
+func (peers *GatewayPeers) Unary() grpc.UnaryServerInterceptor {
+    return func(
+        ctx context.Context,
+        req interface{},
+        info *grpc.UnaryServerInfo,
+        handler grpc.UnaryHandler,
+    ) (interface{}, error) {
+        return handler(peers.restore(ctx), req)
+    }
+}
+
+// Stream 流式 RPC 拦截器，需要放在最外层
+func (peers *GatewayPeers) Stream() grpc.StreamServerInterceptor {
+    return func(
+        srv interface{},
+        ss grpc.ServerStream,
+        info *grpc.StreamServerInfo,
+        handler grpc.StreamHandler,
+    ) error {
+        ctx := peers.restore(ss.Context())
+        if ctx == ss.Context() {
+            return handler(srv, ss)
+        }
+        return handler(srv, &contextServerStream{ss, ctx})
+    }
+}
+
+// restore 请求带有登记过的令牌时，把上下文中的调用方替换为网关收到的 HTTP 请求的调用方
+func (peers *GatewayPeers) restore(ctx context.Context) context.Context {
+    md, ok := metadata.FromIncomingContext(ctx)
+    if !ok {
+        return ctx
+    }
+    values := md.Get(GatewayPeerHeader)
+    if len(values) != 1 {
+        return ctx
+    }
+
+    peers.mutex.Lock()
+    p := peers.peers[values[0]]
+    peers.mutex.Unlock()
+    if p == nil {
+        return ctx
+    }
+    return peer.NewContext(ctx, p)
+}
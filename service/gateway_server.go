@@ -0,0 +1,299 @@
+package service
+
+import (
+    "context"
+
+    "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+    "github.com/xiusl/pcbook/pb"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+// GatewayServer 在进程内处理 REST 网关请求的服务
+// 网关直接调用服务实现时不会经过 gRPC 拦截器，这里对每个方法手动执行拦截器，
+// 使 REST 调用方同样经过认证、授权和审计
+type GatewayServer struct {
+    authServer    pb.AuthServiceServer
+    laptopServer  pb.LaptopServicesServer
+    apiKeyServer  pb.APIKeyServiceServer
+    auditServer   pb.AuditServiceServer
+    alertServer   pb.AlertServiceServer
+    webhookServer pb.WebhookServiceServer
+    interceptor   grpc.UnaryServerInterceptor
+}
+
+// NewGatewayServer 新建一个进程内的网关服务，interceptor 与 gRPC 服务端使用的一元拦截器相同
+func NewGatewayServer(
+    interceptor grpc.UnaryServerInterceptor,
+    authServer pb.AuthServiceServer,
+    laptopServer pb.LaptopServicesServer,
+    apiKeyServer pb.APIKeyServiceServer,
+    auditServer pb.AuditServiceServer,
+    alertServer pb.AlertServiceServer,
+    webhookServer pb.WebhookServiceServer,
+) *GatewayServer {
+    return &GatewayServer{authServer, laptopServer, apiKeyServer, auditServer, alertServer, webhookServer, interceptor}
+}
+
+// RegisterHandlers 在网关上注册所有服务的进程内处理函数
+// 进程内处理函数不支持流式方法，这些方法需要另外通过 gRPC 连接转发
+func (server *GatewayServer) RegisterHandlers(ctx context.Context, mux *runtime.ServeMux) error {
+    if err := pb.RegisterAuthServiceHandlerServer(ctx, mux, server); err != nil {
+        return err
+    }
+    if err := pb.RegisterLaptopServicesHandlerServer(ctx, mux, server); err != nil {
+        return err
+    }
+    if err := pb.RegisterAPIKeyServiceHandlerServer(ctx, mux, server); err != nil {
+        return err
+    }
+    if err := pb.RegisterAuditServiceHandlerServer(ctx, mux, server); err != nil {
+        return err
+    }
+    if err := pb.RegisterAlertServiceHandlerServer(ctx, mux, server); err != nil {
+        return err
+    }
+    return pb.RegisterWebhookServiceHandlerServer(ctx, mux, server)
+}
+
+// invoke 经过拦截器调用服务方法
+func (server *GatewayServer) invoke(ctx context.Context, method string, req interface{}, handler grpc.UnaryHandler) (interface{}, error) {
+    info := &grpc.UnaryServerInfo{FullMethod: method}
+    return server.interceptor(ctx, req, info, handler)
+}
+
+func (server *GatewayServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.AuthService/Login", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.authServer.Login(ctx, req.(*pb.LoginRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.LoginResponse), nil
+}
+
+func (server *GatewayServer) VerifyLogin(ctx context.Context, req *pb.VerifyLoginRequest) (*pb.LoginResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.AuthService/VerifyLogin", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.authServer.VerifyLogin(ctx, req.(*pb.VerifyLoginRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.LoginResponse), nil
+}
+
+func (server *GatewayServer) EnrollTOTP(ctx context.Context, req *pb.EnrollTOTPRequest) (*pb.EnrollTOTPResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.AuthService/EnrollTOTP", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.authServer.EnrollTOTP(ctx, req.(*pb.EnrollTOTPRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.EnrollTOTPResponse), nil
+}
+
+func (server *GatewayServer) ConfirmTOTP(ctx context.Context, req *pb.ConfirmTOTPRequest) (*pb.ConfirmTOTPResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.AuthService/ConfirmTOTP", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.authServer.ConfirmTOTP(ctx, req.(*pb.ConfirmTOTPRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.ConfirmTOTPResponse), nil
+}
+
+func (server *GatewayServer) UnlockAccount(ctx context.Context, req *pb.UnlockAccountRequest) (*pb.UnlockAccountResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.AuthService/UnlockAccount", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.authServer.UnlockAccount(ctx, req.(*pb.UnlockAccountRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.UnlockAccountResponse), nil
+}
+
+func (server *GatewayServer) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.AuthService/ChangePassword", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.authServer.ChangePassword(ctx, req.(*pb.ChangePasswordRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.ChangePasswordResponse), nil
+}
+
+func (server *GatewayServer) CreateLaptop(ctx context.Context, req *pb.CreateLaptopRequest) (*pb.CreateLaptopResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.LaptopServices/CreateLaptop", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.laptopServer.CreateLaptop(ctx, req.(*pb.CreateLaptopRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.CreateLaptopResponse), nil
+}
+
+func (server *GatewayServer) UpdateLaptop(ctx context.Context, req *pb.UpdateLaptopRequest) (*pb.UpdateLaptopResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.LaptopServices/UpdateLaptop", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.laptopServer.UpdateLaptop(ctx, req.(*pb.UpdateLaptopRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.UpdateLaptopResponse), nil
+}
+
+// SearchLaptop 网关的进程内处理函数不会调用流式方法
+func (server *GatewayServer) SearchLaptop(req *pb.SearchLaptopRequest, stream pb.LaptopServices_SearchLaptopServer) error {
+    return status.Errorf(codes.Unimplemented, "streaming calls are not supported in the in-process gateway")
+}
+
+// UploadImage 网关的进程内处理函数不会调用流式方法
+func (server *GatewayServer) UploadImage(stream pb.LaptopServices_UploadImageServer) error {
+    return status.Errorf(codes.Unimplemented, "streaming calls are not supported in the in-process gateway")
+}
+
+// RateLaptop 网关的进程内处理函数不会调用流式方法
+func (server *GatewayServer) RateLaptop(stream pb.LaptopServices_RateLaptopServer) error {
+    return status.Errorf(codes.Unimplemented, "streaming calls are not supported in the in-process gateway")
+}
+
+// WatchLaptops 网关的进程内处理函数不会调用流式方法
+func (server *GatewayServer) WatchLaptops(req *pb.WatchLaptopsRequest, stream pb.LaptopServices_WatchLaptopsServer) error {
+    return status.Errorf(codes.Unimplemented, "streaming calls are not supported in the in-process gateway")
+}
+
+// ImportLaptops 网关的进程内处理函数不会调用流式方法
+func (server *GatewayServer) ImportLaptops(stream pb.LaptopServices_ImportLaptopsServer) error {
+    return status.Errorf(codes.Unimplemented, "streaming calls are not supported in the in-process gateway")
+}
+
+// ExportLaptops 网关的进程内处理函数不会调用流式方法
+func (server *GatewayServer) ExportLaptops(req *pb.ExportLaptopsRequest, stream pb.LaptopServices_ExportLaptopsServer) error {
+    return status.Errorf(codes.Unimplemented, "streaming calls are not supported in the in-process gateway")
+}
+
+func (server *GatewayServer) CreateAPIKey(ctx context.Context, req *pb.CreateAPIKeyRequest) (*pb.CreateAPIKeyResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.APIKeyService/CreateAPIKey", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.apiKeyServer.CreateAPIKey(ctx, req.(*pb.CreateAPIKeyRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.CreateAPIKeyResponse), nil
+}
+
+func (server *GatewayServer) ListAPIKeys(ctx context.Context, req *pb.ListAPIKeysRequest) (*pb.ListAPIKeysResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.APIKeyService/ListAPIKeys", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.apiKeyServer.ListAPIKeys(ctx, req.(*pb.ListAPIKeysRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.ListAPIKeysResponse), nil
+}
+
+func (server *GatewayServer) RevokeAPIKey(ctx context.Context, req *pb.RevokeAPIKeyRequest) (*pb.RevokeAPIKeyResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.APIKeyService/RevokeAPIKey", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.apiKeyServer.RevokeAPIKey(ctx, req.(*pb.RevokeAPIKeyRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.RevokeAPIKeyResponse), nil
+}
+
+func (server *GatewayServer) QueryAuditLog(ctx context.Context, req *pb.QueryAuditLogRequest) (*pb.QueryAuditLogResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.AuditService/QueryAuditLog", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.auditServer.QueryAuditLog(ctx, req.(*pb.QueryAuditLogRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.QueryAuditLogResponse), nil
+}
+
+func (server *GatewayServer) CreateAlert(ctx context.Context, req *pb.CreateAlertRequest) (*pb.CreateAlertResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.AlertService/CreateAlert", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.alertServer.CreateAlert(ctx, req.(*pb.CreateAlertRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.CreateAlertResponse), nil
+}
+
+func (server *GatewayServer) ListAlerts(ctx context.Context, req *pb.ListAlertsRequest) (*pb.ListAlertsResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.AlertService/ListAlerts", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.alertServer.ListAlerts(ctx, req.(*pb.ListAlertsRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.ListAlertsResponse), nil
+}
+
+func (server *GatewayServer) DeleteAlert(ctx context.Context, req *pb.DeleteAlertRequest) (*pb.DeleteAlertResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.AlertService/DeleteAlert", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.alertServer.DeleteAlert(ctx, req.(*pb.DeleteAlertRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.DeleteAlertResponse), nil
+}
+
+// SubscribeAlerts 网关的进程内处理函数不会调用流式方法
+func (server *GatewayServer) SubscribeAlerts(req *pb.SubscribeAlertsRequest, stream pb.AlertService_SubscribeAlertsServer) error {
+    return status.Errorf(codes.Unimplemented, "streaming calls are not supported in the in-process gateway")
+}
+
+func (server *GatewayServer) CreateWebhook(ctx context.Context, req *pb.CreateWebhookRequest) (*pb.CreateWebhookResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.WebhookService/CreateWebhook", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.webhookServer.CreateWebhook(ctx, req.(*pb.CreateWebhookRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.CreateWebhookResponse), nil
+}
+
+func (server *GatewayServer) ListWebhooks(ctx context.Context, req *pb.ListWebhooksRequest) (*pb.ListWebhooksResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.WebhookService/ListWebhooks", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.webhookServer.ListWebhooks(ctx, req.(*pb.ListWebhooksRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.ListWebhooksResponse), nil
+}
+
+func (server *GatewayServer) DeleteWebhook(ctx context.Context, req *pb.DeleteWebhookRequest) (*pb.DeleteWebhookResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.WebhookService/DeleteWebhook", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.webhookServer.DeleteWebhook(ctx, req.(*pb.DeleteWebhookRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.DeleteWebhookResponse), nil
+}
+
+func (server *GatewayServer) ListDeadLetters(ctx context.Context, req *pb.ListDeadLettersRequest) (*pb.ListDeadLettersResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.WebhookService/ListDeadLetters", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.webhookServer.ListDeadLetters(ctx, req.(*pb.ListDeadLettersRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.ListDeadLettersResponse), nil
+}
+
+func (server *GatewayServer) ReplayDeadLetters(ctx context.Context, req *pb.ReplayDeadLettersRequest) (*pb.ReplayDeadLettersResponse, error) {
+    res, err := server.invoke(ctx, "/xiusl.pcbook.WebhookService/ReplayDeadLetters", req, func(ctx context.Context, req interface{}) (interface{}, error) {
+        return server.webhookServer.ReplayDeadLetters(ctx, req.(*pb.ReplayDeadLettersRequest))
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res.(*pb.ReplayDeadLettersResponse), nil
+}
@@ -0,0 +1,69 @@
+package service_test
+
+import (
+    "context"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestGatewayServerAuthorize(t *testing.T) {
+    userStore := service.NewInMemoryUserStore()
+    user, err := service.NewUser("admin", "secret", "admin")
+    require.NoError(t, err)
+    require.NoError(t, userStore.Save(user))
+
+    jwtManager := service.NewJWTManager("secret", time.Minute)
+    authServer := service.NewAuthServer(userStore, jwtManager, nil, nil, service.DefaultPasswordPolicy())
+    laptopServer := service.NewLaptopServer(service.NewInMemoryLaptopStore(), nil, nil)
+
+    policy, err := service.ParseAccessPolicy([]byte(testPolicy))
+    require.NoError(t, err)
+    interceptor := service.NewAuthInterceptor(policy, nil, jwtManager)
+
+    mux := runtime.NewServeMux()
+    gatewayServer := service.NewGatewayServer(interceptor.Unary(), authServer, laptopServer, nil, nil, nil, nil)
+    require.NoError(t, gatewayServer.RegisterHandlers(context.Background(), mux))
+    server := httptest.NewServer(mux)
+    defer server.Close()
+
+    post := func(path, token, body string) *http.Response {
+        req, err := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(body))
+        require.NoError(t, err)
+        if token != "" {
+            req.Header.Set("Authorization", token)
+        }
+        res, err := http.DefaultClient.Do(req)
+        require.NoError(t, err)
+        t.Cleanup(func() { res.Body.Close() })
+        return res
+    }
+
+    // 进程内调用同样经过授权拦截器
+    res := post("/v1/laptop/create", "", `{"laptop":{}}`)
+    require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+    // 不在访问控制策略中的方法默认拒绝
+    res = post("/v1/auth/unlock", "", `{"username":"admin"}`)
+    require.Equal(t, http.StatusForbidden, res.StatusCode)
+
+    res = post("/v1/auth/login", "", `{"username":"admin","password":"secret"}`)
+    require.Equal(t, http.StatusOK, res.StatusCode)
+    login := &pb.LoginResponse{}
+    body, err := ioutil.ReadAll(res.Body)
+    require.NoError(t, err)
+    require.NoError(t, protojson.Unmarshal(body, login))
+    require.NotEmpty(t, login.GetAccessToken())
+
+    res = post("/v1/laptop/create", login.GetAccessToken(), `{"laptop":{}}`)
+    require.Equal(t, http.StatusOK, res.StatusCode)
+}
@@ -0,0 +1,238 @@
+package service
+
+import (
+    "context"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/xiusl/pcbook/logging"
+    "google.golang.org/grpc/health"
+    healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// healthLog 健康状态变化的日志
+var healthLog = logging.New("health")
+
+// HealthCheck 一项健康检查，Check 返回错误表示服务不可用
+type HealthCheck struct {
+    Name  string
+    Check func(ctx context.Context) error
+}
+
+// HealthMonitor 实现 gRPC 健康检查服务，定期执行各个服务的健康检查并更新服务状态
+// 服务名为空字符串表示整个服务端，只有所有服务都可用时才是 SERVING
+type HealthMonitor struct {
+    *health.Server
+    timeout time.Duration
+
+    mutex    sync.Mutex
+    services map[string][]HealthCheck
+    failures map[string][]string
+    shutdown bool
+    done     chan struct{}
+}
+
+// NewHealthMonitor 新建一个健康检查服务，每项检查最多执行 timeout
+func NewHealthMonitor(timeout time.Duration) *HealthMonitor {
+    return &HealthMonitor{
+        Server:   health.NewServer(),
+        timeout:  timeout,
+        services: make(map[string][]HealthCheck),
+        failures: make(map[string][]string),
+    }
+}
+
+// Register 注册服务的健康检查，service 为完整的服务名，例如 xiusl.pcbook.AuthService
+// 在第一次检查之前服务状态为 NOT_SERVING
+func (monitor *HealthMonitor) Register(service string, checks ...HealthCheck) {
+    monitor.mutex.Lock()
+    defer monitor.mutex.Unlock()
+
+    monitor.services[service] = append(monitor.services[service], checks...)
+    monitor.Server.SetServingStatus(service, healthpb.HealthCheckResponse_NOT_SERVING)
+    monitor.Server.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+}
+
+// RunChecks 执行所有的健康检查并更新服务状态，返回每个服务失败的检查
+func (monitor *HealthMonitor) RunChecks(ctx context.Context) map[string][]string {
+    monitor.mutex.Lock()
+    services := make(map[string][]HealthCheck, len(monitor.services))
+    for service, checks := range monitor.services {
+        services[service] = checks
+    }
+    monitor.mutex.Unlock()
+
+    failures := make(map[string][]string)
+    for service, checks := range services {
+        for _, check := range checks {
+            checkCtx, cancel := context.WithTimeout(ctx, monitor.timeout)
+            err := check.Check(checkCtx)
+            cancel()
+            if err != nil {
+                failures[service] = append(failures[service], fmt.Sprintf("%s: %v", check.Name, err))
+            }
+        }
+    }
+
+    monitor.mutex.Lock()
+    defer monitor.mutex.Unlock()
+
+    // 关闭后保持 NOT_SERVING，不再根据检查结果恢复
+    if monitor.shutdown {
+        return failures
+    }
+
+    overall := healthpb.HealthCheckResponse_SERVING
+    for service := range services {
+        status := healthpb.HealthCheckResponse_SERVING
+        if len(failures[service]) > 0 {
+            status = healthpb.HealthCheckResponse_NOT_SERVING
+            overall = healthpb.HealthCheckResponse_NOT_SERVING
+        }
+        if fmt.Sprint(failures[service]) != fmt.Sprint(monitor.failures[service]) {
+            healthLog.Info(ctx, "health changed", "service", service, "status", status, "failures", failures[service])
+        }
+        monitor.Server.SetServingStatus(service, status)
+    }
+    monitor.Server.SetServingStatus("", overall)
+    monitor.failures = failures
+    return failures
+}
+
+// Services 已注册的服务名
+func (monitor *HealthMonitor) Services() []string {
+    monitor.mutex.Lock()
+    defer monitor.mutex.Unlock()
+
+    services := make([]string, 0, len(monitor.services))
+    for service := range monitor.services {
+        services = append(services, service)
+    }
+    sort.Strings(services)
+    return services
+}
+
+// Start 立即检查一次，之后每隔 interval 检查一次，直到调用 Close 或者 Shutdown
+func (monitor *HealthMonitor) Start(interval time.Duration) {
+    monitor.mutex.Lock()
+    if monitor.done != nil || monitor.shutdown {
+        monitor.mutex.Unlock()
+        return
+    }
+    done := make(chan struct{})
+    monitor.done = done
+    monitor.mutex.Unlock()
+
+    monitor.RunChecks(context.Background())
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-done:
+                return
+            case <-ticker.C:
+                monitor.RunChecks(context.Background())
+            }
+        }
+    }()
+}
+
+// Close 停止定期检查
+func (monitor *HealthMonitor) Close() {
+    monitor.mutex.Lock()
+    defer monitor.mutex.Unlock()
+
+    if monitor.done != nil {
+        close(monitor.done)
+        monitor.done = nil
+    }
+}
+
+// Shutdown 停止定期检查，并把所有服务设置为 NOT_SERVING，用于服务端退出前通知负载均衡
+func (monitor *HealthMonitor) Shutdown() {
+    monitor.Close()
+
+    monitor.mutex.Lock()
+    defer monitor.mutex.Unlock()
+
+    monitor.shutdown = true
+    monitor.Server.Shutdown()
+}
+
+// UserStoreCheck 检查用户存储是否可以访问
+func UserStoreCheck(store UserStore) HealthCheck {
+    return HealthCheck{
+        Name: "user store",
+        Check: func(ctx context.Context) error {
+            _, err := store.Find("")
+            return err
+        },
+    }
+}
+
+// LaptopStoreCheck 检查便携电脑存储是否可以访问
+func LaptopStoreCheck(store LaptopStore) HealthCheck {
+    return HealthCheck{
+        Name: "laptop store",
+        Check: func(ctx context.Context) error {
+            _, err := store.FindByID("")
+            return err
+        },
+    }
+}
+
+// ImageFolderCheck 检查图片目录是否可以写入
+func ImageFolderCheck(folder string) HealthCheck {
+    return HealthCheck{
+        Name: "image folder",
+        Check: func(ctx context.Context) error {
+            file, err := ioutil.TempFile(folder, ".healthcheck-*")
+            if err != nil {
+                return fmt.Errorf("folder is not writable: %w", err)
+            }
+            defer os.Remove(file.Name())
+
+            if _, err := file.Write([]byte("ok")); err != nil {
+                file.Close()
+                return fmt.Errorf("folder is not writable: %w", err)
+            }
+            return file.Close()
+        },
+    }
+}
+
+// SigningKeyCheck 检查访问令牌的密钥可以签发和验证令牌
+func SigningKeyCheck(manager *JWTManager) HealthCheck {
+    return HealthCheck{
+        Name: "signing key",
+        Check: func(ctx context.Context) error {
+            token, err := manager.Generate(&User{Username: "healthcheck"}, AuthMethodPassword)
+            if err != nil {
+                return err
+            }
+            _, err = manager.Verify(token)
+            return err
+        },
+    }
+}
+
+// OIDCKeysCheck 检查是否已经从身份提供方加载了签名公钥
+func OIDCKeysCheck(authenticator *OIDCAuthenticator) HealthCheck {
+    return HealthCheck{
+        Name: "oidc keys",
+        Check: func(ctx context.Context) error {
+            authenticator.mutex.Lock()
+            defer authenticator.mutex.Unlock()
+
+            if len(authenticator.keys) == 0 {
+                return fmt.Errorf("no signing keys loaded from %s", authenticator.jwksURI)
+            }
+            return nil
+        },
+    }
+}
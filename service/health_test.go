@@ -0,0 +1,72 @@
+package service_test
+
+import (
+    "context"
+    "errors"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/service"
+    healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestHealthMonitor(t *testing.T) {
+    var storeDown int32
+    monitor := service.NewHealthMonitor(time.Second)
+    monitor.Register("xiusl.pcbook.AuthService", service.SigningKeyCheck(service.NewJWTManager("secret", time.Minute)))
+    monitor.Register("xiusl.pcbook.LaptopServices", service.HealthCheck{
+        Name: "laptop store",
+        Check: func(ctx context.Context) error {
+            if atomic.LoadInt32(&storeDown) == 1 {
+                return errors.New("connection refused")
+            }
+            return nil
+        },
+    })
+    require.Equal(t, []string{"xiusl.pcbook.AuthService", "xiusl.pcbook.LaptopServices"}, monitor.Services())
+
+    status := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+        res, err := monitor.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+        require.NoError(t, err)
+        return res.GetStatus()
+    }
+
+    // 第一次检查之前不可用
+    require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, status(""))
+
+    require.Empty(t, monitor.RunChecks(context.Background()))
+    require.Equal(t, healthpb.HealthCheckResponse_SERVING, status(""))
+    require.Equal(t, healthpb.HealthCheckResponse_SERVING, status("xiusl.pcbook.LaptopServices"))
+
+    atomic.StoreInt32(&storeDown, 1)
+    failures := monitor.RunChecks(context.Background())
+    require.Equal(t, []string{"laptop store: connection refused"}, failures["xiusl.pcbook.LaptopServices"])
+    require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, status(""))
+    require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, status("xiusl.pcbook.LaptopServices"))
+    require.Equal(t, healthpb.HealthCheckResponse_SERVING, status("xiusl.pcbook.AuthService"))
+
+    // 退出时保持 NOT_SERVING
+    atomic.StoreInt32(&storeDown, 0)
+    monitor.Shutdown()
+    monitor.RunChecks(context.Background())
+    require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, status(""))
+    require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, status("xiusl.pcbook.AuthService"))
+}
+
+func TestImageFolderCheck(t *testing.T) {
+    dir, err := ioutil.TempDir("", "img")
+    require.NoError(t, err)
+    defer os.RemoveAll(dir)
+
+    require.NoError(t, service.ImageFolderCheck(dir).Check(context.Background()))
+    files, err := ioutil.ReadDir(dir)
+    require.NoError(t, err)
+    require.Empty(t, files)
+
+    require.Error(t, service.ImageFolderCheck(filepath.Join(dir, "missing")).Check(context.Background()))
+}
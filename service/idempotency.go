@@ -0,0 +1,473 @@
+package service
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/binary"
+    "fmt"
+    "hash"
+    "io"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/xiusl/pcbook/logging"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+    "google.golang.org/protobuf/reflect/protoreflect"
+    "google.golang.org/protobuf/reflect/protoregistry"
+)
+
+const (
+    // IdempotencyKeyHeader 调用方传入幂等键的元数据
+    IdempotencyKeyHeader = "idempotency-key"
+    // IdempotentReplayedHeader 响应是重放的第一次请求的结果时，响应头中带有这个元数据
+    IdempotentReplayedHeader = "idempotent-replayed"
+    // maxIdempotencyKeyLength 幂等键的最大长度
+    maxIdempotencyKeyLength = 255
+)
+
+// idempotencyLog 幂等请求相关的日志
+var idempotencyLog = logging.New("idempotency")
+
+// IdempotencyConfig 幂等键的配置
+type IdempotencyConfig struct {
+    // Window 记住幂等键和响应的时长，超过后同一个键会被当作新的请求
+    Window time.Duration `yaml:"window"`
+    // Methods 接受幂等键的方法，只支持一元方法和客户端流方法
+    Methods []string `yaml:"methods"`
+}
+
+// DefaultIdempotencyConfig 默认的幂等键配置
+func DefaultIdempotencyConfig() IdempotencyConfig {
+    return IdempotencyConfig{
+        Window: 24 * time.Hour,
+        Methods: []string{
+            "/xiusl.pcbook.LaptopServices/CreateLaptop",
+            "/xiusl.pcbook.LaptopServices/UpdateLaptop",
+            "/xiusl.pcbook.LaptopServices/UploadImage",
+            "/xiusl.pcbook.LaptopServices/ImportLaptops",
+        },
+    }
+}
+
+// Validate 检查幂等键的配置，方法必须存在并且服务端只返回一条响应
+func (config IdempotencyConfig) Validate() error {
+    if config.Window <= 0 {
+        return fmt.Errorf("window must be positive")
+    }
+    for _, method := range config.Methods {
+        descriptor, err := methodDescriptor(method)
+        if err != nil {
+            return err
+        }
+        if descriptor.IsStreamingServer() {
+            return fmt.Errorf("%s returns a stream and cannot be replayed", method)
+        }
+    }
+    return nil
+}
+
+// IdempotencyRecord 幂等键对应的请求和响应
+type IdempotencyRecord struct {
+    // RequestHash 请求内容的摘要，同一个键只能用于内容相同的请求，请求完成后才会保存
+    RequestHash []byte
+    // Done 为 false 表示第一次请求还在处理中
+    Done bool
+    // Response 第一次请求成功时的响应
+    Response []byte
+}
+
+// IdempotencyStore 保存幂等键的存储，进程内的实现是 InMemoryIdempotencyStore，多个实例之间可以换成共享的后端
+type IdempotencyStore interface {
+    // Reserve 键没有记录时保存一条处理中的记录并返回 nil，已有记录时返回该记录
+    Reserve(ctx context.Context, key string, ttl time.Duration) (*IdempotencyRecord, error)
+    // Complete 保存请求的摘要和请求成功时的响应
+    Complete(ctx context.Context, key string, requestHash []byte, response []byte, ttl time.Duration) error
+    // Release 删除处理中的记录，请求失败后调用方可以用同一个键重试
+    Release(ctx context.Context, key string) error
+}
+
+// InMemoryIdempotencyStore 在内存中保存幂等键
+type InMemoryIdempotencyStore struct {
+    mutex   sync.Mutex
+    records map[string]*idempotencyEntry
+}
+
+type idempotencyEntry struct {
+    record    IdempotencyRecord
+    expiresAt time.Time
+}
+
+// maxTrackedIdempotencyKeys 记录数超过这个值时清理过期的记录
+const maxTrackedIdempotencyKeys = 10000
+
+// NewInMemoryIdempotencyStore 创建一个内存幂等键存储
+func NewInMemoryIdempotencyStore() *InMemoryIdempotencyStore {
+    return &InMemoryIdempotencyStore{
+        records: make(map[string]*idempotencyEntry),
+    }
+}
+
+// Reserve 键没有记录时保存一条处理中的记录并返回 nil，已有记录时返回该记录
+func (store *InMemoryIdempotencyStore) Reserve(ctx context.Context, key string, ttl time.Duration) (*IdempotencyRecord, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    now := time.Now()
+    if entry, ok := store.records[key]; ok && now.Before(entry.expiresAt) {
+        record := entry.record
+        return &record, nil
+    }
+
+    if len(store.records) >= maxTrackedIdempotencyKeys {
+        store.prune(now)
+    }
+    store.records[key] = &idempotencyEntry{expiresAt: now.Add(ttl)}
+    return nil, nil
+}
+
+// Complete 保存请求的摘要和请求成功时的响应
+func (store *InMemoryIdempotencyStore) Complete(ctx context.Context, key string, requestHash []byte, response []byte, ttl time.Duration) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    entry, ok := store.records[key]
+    if !ok {
+        return fmt.Errorf("idempotency key is not reserved")
+    }
+    entry.record = IdempotencyRecord{
+        RequestHash: requestHash,
+        Done:        true,
+        Response:    response,
+    }
+    entry.expiresAt = time.Now().Add(ttl)
+    return nil
+}
+
+// Release 删除处理中的记录
+func (store *InMemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    if entry, ok := store.records[key]; ok && !entry.record.Done {
+        delete(store.records, key)
+    }
+    return nil
+}
+
+// prune 清理过期的记录，避免内存无限增长
+func (store *InMemoryIdempotencyStore) prune(now time.Time) {
+    for key, entry := range store.records {
+        if !now.Before(entry.expiresAt) {
+            delete(store.records, key)
+        }
+    }
+}
+
+// IdempotencyInterceptor 按幂等键去重的拦截器
+// 带有幂等键的请求第一次成功后，窗口期内用同一个键重试会得到第一次的响应，不会再次执行
+// 键按调用方和方法隔离，同一个键用于内容不同的请求会被拒绝
+type IdempotencyInterceptor struct {
+    store   IdempotencyStore
+    window  time.Duration
+    methods map[string]protoreflect.MethodDescriptor
+}
+
+// NewIdempotencyInterceptor 新建一个幂等键拦截器，需要放在请求校验拦截器之后，只记录合法的请求
+func NewIdempotencyInterceptor(store IdempotencyStore, config IdempotencyConfig) (*IdempotencyInterceptor, error) {
+    if err := config.Validate(); err != nil {
+        return nil, err
+    }
+
+    methods := make(map[string]protoreflect.MethodDescriptor)
+    for _, method := range config.Methods {
+        descriptor, err := methodDescriptor(method)
+        if err != nil {
+            return nil, err
+        }
+        methods[method] = descriptor
+    }
+    return &IdempotencyInterceptor{
+        store:   store,
+        window:  config.Window,
+        methods: methods,
+    }, nil
+}
+
+// Unary 一元 RPC 幂等键拦截器
+func (interceptor *IdempotencyInterceptor) Unary() grpc.UnaryServerInterceptor {
+    return func(
+        ctx context.Context,
+        req interface{},
+        info *grpc.UnaryServerInfo,
+        handler grpc.UnaryHandler,
+    ) (interface{}, error) {
+        descriptor, ok := interceptor.methods[info.FullMethod]
+        msg, isMessage := req.(proto.Message)
+        if !ok || !isMessage {
+            return handler(ctx, req)
+        }
+        key, err := idempotencyKey(ctx, info.FullMethod)
+        if err != nil {
+            return nil, err
+        }
+        if key == "" {
+            return handler(ctx, req)
+        }
+
+        requestHash := newRequestHash()
+        if err := requestHash.add(msg); err != nil {
+            return nil, status.Errorf(codes.Internal, "cannot hash request: %v", err)
+        }
+
+        record, err := interceptor.reserve(ctx, key)
+        if err != nil {
+            return nil, err
+        }
+        if record != nil {
+            res, err := interceptor.replay(ctx, descriptor, record, requestHash.sum())
+            if err != nil {
+                return nil, err
+            }
+            grpc.SetHeader(ctx, metadata.Pairs(IdempotentReplayedHeader, "true"))
+            return res, nil
+        }
+
+        completed := false
+        defer func() {
+            if !completed {
+                interceptor.release(ctx, key)
+            }
+        }()
+
+        res, err := handler(ctx, req)
+        if err != nil {
+            return nil, err
+        }
+        if msg, ok := res.(proto.Message); ok {
+            completed = interceptor.complete(ctx, key, requestHash.sum(), msg)
+        }
+        return res, nil
+    }
+}
+
+// Stream 客户端流 RPC 幂等键拦截器，请求摘要包含流中的所有消息
+func (interceptor *IdempotencyInterceptor) Stream() grpc.StreamServerInterceptor {
+    return func(
+        srv interface{},
+        ss grpc.ServerStream,
+        info *grpc.StreamServerInfo,
+        handler grpc.StreamHandler,
+    ) error {
+        descriptor, ok := interceptor.methods[info.FullMethod]
+        if !ok {
+            return handler(srv, ss)
+        }
+        ctx := ss.Context()
+        key, err := idempotencyKey(ctx, info.FullMethod)
+        if err != nil {
+            return err
+        }
+        if key == "" {
+            return handler(srv, ss)
+        }
+
+        record, err := interceptor.reserve(ctx, key)
+        if err != nil {
+            return err
+        }
+        if record != nil {
+            // 读完整个请求流才能确认重试的内容与第一次相同，读取时只计算摘要，不保存消息
+            requestHash := newRequestHash()
+            for {
+                msg := newMessage(descriptor.Input())
+                err := ss.RecvMsg(msg)
+                if err == io.EOF {
+                    break
+                }
+                if err != nil {
+                    return err
+                }
+                if err := requestHash.add(msg); err != nil {
+                    return status.Errorf(codes.Internal, "cannot hash request: %v", err)
+                }
+            }
+
+            res, err := interceptor.replay(ctx, descriptor, record, requestHash.sum())
+            if err != nil {
+                return err
+            }
+            if err := ss.SetHeader(metadata.Pairs(IdempotentReplayedHeader, "true")); err != nil {
+                return err
+            }
+            return ss.SendMsg(res)
+        }
+
+        completed := false
+        defer func() {
+            if !completed {
+                interceptor.release(ctx, key)
+            }
+        }()
+
+        stream := &hashingServerStream{ServerStream: ss, requestHash: newRequestHash()}
+        if err := handler(srv, stream); err != nil {
+            return err
+        }
+        if stream.err != nil {
+            return status.Errorf(codes.Internal, "cannot hash request: %v", stream.err)
+        }
+        if stream.response != nil {
+            completed = interceptor.complete(ctx, key, stream.requestHash.sum(), stream.response)
+        }
+        return nil
+    }
+}
+
+// reserve 预留幂等键，键已经被使用时返回第一次请求的记录，第一次请求还在处理中时返回 Aborted 错误
+func (interceptor *IdempotencyInterceptor) reserve(ctx context.Context, key string) (*IdempotencyRecord, error) {
+    record, err := interceptor.store.Reserve(ctx, key, interceptor.window)
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot reserve idempotency key: %v", err)
+    }
+    if record != nil && !record.Done {
+        return nil, status.Errorf(codes.Aborted, "a request with the same idempotency key is in progress, retry later")
+    }
+    return record, nil
+}
+
+// replay 检查重试的内容与第一次相同，返回第一次请求的响应
+func (interceptor *IdempotencyInterceptor) replay(
+    ctx context.Context,
+    descriptor protoreflect.MethodDescriptor,
+    record *IdempotencyRecord,
+    requestHash []byte,
+) (proto.Message, error) {
+    if !bytes.Equal(record.RequestHash, requestHash) {
+        idempotencyLog.Warn(ctx, "idempotency key reused with a different request")
+        return nil, status.Errorf(codes.InvalidArgument, "idempotency key has already been used for a different request")
+    }
+
+    res := newMessage(descriptor.Output())
+    if err := proto.Unmarshal(record.Response, res); err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot read stored response: %v", err)
+    }
+    idempotencyLog.Info(ctx, "replay response for idempotency key")
+    return res, nil
+}
+
+// complete 保存响应，保存失败时请求本身仍然成功，只是不能再被重放
+func (interceptor *IdempotencyInterceptor) complete(ctx context.Context, key string, requestHash []byte, res proto.Message) bool {
+    data, err := proto.Marshal(res)
+    if err == nil {
+        err = interceptor.store.Complete(ctx, key, requestHash, data, interceptor.window)
+    }
+    if err != nil {
+        idempotencyLog.Error(ctx, "cannot store idempotent response", "error", err)
+        return false
+    }
+    return true
+}
+
+func (interceptor *IdempotencyInterceptor) release(ctx context.Context, key string) {
+    // 请求的上下文可能已经取消，释放记录不能依赖它
+    if err := interceptor.store.Release(context.Background(), key); err != nil {
+        idempotencyLog.Error(ctx, "cannot release idempotency key", "error", err)
+    }
+}
+
+// idempotencyKey 读取调用方传入的幂等键，返回按调用方和方法隔离后的存储键，没有传入时返回空字符串
+func idempotencyKey(ctx context.Context, method string) (string, error) {
+    md, ok := metadata.FromIncomingContext(ctx)
+    if !ok {
+        return "", nil
+    }
+    values := md.Get(IdempotencyKeyHeader)
+    if len(values) == 0 {
+        return "", nil
+    }
+
+    key := values[0]
+    if len(key) == 0 || len(key) > maxIdempotencyKeyLength || strings.IndexFunc(key, func(r rune) bool { return r <= ' ' || r > '~' }) >= 0 {
+        return "", status.Errorf(codes.InvalidArgument, "idempotency key must be 1 to %d printable ASCII characters", maxIdempotencyKeyLength)
+    }
+    return callerID(ctx) + " " + method + " " + key, nil
+}
+
+// methodDescriptor 按 gRPC 方法全名查找方法的描述，例如 /xiusl.pcbook.LaptopServices/CreateLaptop
+func methodDescriptor(method string) (protoreflect.MethodDescriptor, error) {
+    name := protoreflect.FullName(strings.Replace(strings.TrimPrefix(method, "/"), "/", ".", 1))
+    descriptor, err := protoregistry.GlobalFiles.FindDescriptorByName(name)
+    if err != nil {
+        return nil, fmt.Errorf("unknown method %s", method)
+    }
+    methodDescriptor, ok := descriptor.(protoreflect.MethodDescriptor)
+    if !ok {
+        return nil, fmt.Errorf("unknown method %s", method)
+    }
+    return methodDescriptor, nil
+}
+
+// newMessage 新建一个指定类型的空消息
+func newMessage(descriptor protoreflect.MessageDescriptor) proto.Message {
+    messageType, err := protoregistry.GlobalTypes.FindMessageByName(descriptor.FullName())
+    if err != nil {
+        panic(fmt.Sprintf("message type %s is not registered", descriptor.FullName()))
+    }
+    return messageType.New().Interface()
+}
+
+// requestHash 按顺序计算请求中所有消息的摘要，每条消息前写入长度，消息的边界不同时摘要也不同
+type requestHash struct {
+    hash hash.Hash
+}
+
+func newRequestHash() *requestHash {
+    return &requestHash{hash: sha256.New()}
+}
+
+func (h *requestHash) add(msg proto.Message) error {
+    data, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+    if err != nil {
+        return err
+    }
+    var length [8]byte
+    binary.BigEndian.PutUint64(length[:], uint64(len(data)))
+    h.hash.Write(length[:])
+    h.hash.Write(data)
+    return nil
+}
+
+func (h *requestHash) sum() []byte {
+    return h.hash.Sum(nil)
+}
+
+// hashingServerStream 计算处理函数读取的所有请求消息的摘要，并记录处理函数返回的响应
+type hashingServerStream struct {
+    grpc.ServerStream
+    requestHash *requestHash
+    response    proto.Message
+    err         error
+}
+
+func (stream *hashingServerStream) RecvMsg(m interface{}) error {
+    if err := stream.ServerStream.RecvMsg(m); err != nil {
+        return err
+    }
+    if msg, ok := m.(proto.Message); ok && stream.err == nil {
+        stream.err = stream.requestHash.add(msg)
+    }
+    return nil
+}
+
+func (stream *hashingServerStream) SendMsg(m interface{}) error {
+    if msg, ok := m.(proto.Message); ok {
+        stream.response = msg
+    }
+    return stream.ServerStream.SendMsg(m)
+}
@@ -0,0 +1,198 @@
+package service_test
+
+import (
+    "context"
+    "io/ioutil"
+    "net"
+    "os"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/sample"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+)
+
+// startIdempotentLaptopServer 启动只带有幂等键拦截器的便携电脑服务
+func startIdempotentLaptopServer(t *testing.T, laptopStore service.LaptopStore) pb.LaptopServicesClient {
+    imageFolder, err := ioutil.TempDir("", "images")
+    require.NoError(t, err)
+    t.Cleanup(func() { os.RemoveAll(imageFolder) })
+
+    idempotency, err := service.NewIdempotencyInterceptor(service.NewInMemoryIdempotencyStore(), service.DefaultIdempotencyConfig())
+    require.NoError(t, err)
+    grpcServer := grpc.NewServer(
+        grpc.UnaryInterceptor(idempotency.Unary()),
+        grpc.StreamInterceptor(idempotency.Stream()),
+    )
+    laptopServer := service.NewLaptopServer(laptopStore, service.NewDiskImageStore(imageFolder), service.NewInMemoryRatingStore())
+    pb.RegisterLaptopServicesServer(grpcServer, laptopServer)
+
+    listener, err := net.Listen("tcp", ":0")
+    require.NoError(t, err)
+    go grpcServer.Serve(listener)
+    t.Cleanup(grpcServer.Stop)
+
+    conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+    require.NoError(t, err)
+    t.Cleanup(func() { conn.Close() })
+    return pb.NewLaptopServicesClient(conn)
+}
+
+// countLaptops 返回存储中便携电脑的数量
+func countLaptops(t *testing.T, store service.LaptopStore) int {
+    count := 0
+    err := store.Search(context.Background(), &pb.Filter{MaxPriceUsd: 1e9}, func(laptop *pb.Laptop) error {
+        count++
+        return nil
+    })
+    require.NoError(t, err)
+    return count
+}
+
+func TestIdempotentCreateLaptop(t *testing.T) {
+    laptopStore := service.NewInMemoryLaptopStore()
+    laptopClient := startIdempotentLaptopServer(t, laptopStore)
+
+    withKey := func(key string) context.Context {
+        return metadata.AppendToOutgoingContext(context.Background(), service.IdempotencyKeyHeader, key)
+    }
+
+    // 没有 ID 的便携电脑每次创建都会生成新的 ID，重试时返回第一次生成的 ID
+    laptop := sample.NewLaptop()
+    laptop.Id = ""
+    req := &pb.CreateLaptopRequest{Laptop: laptop}
+
+    var header metadata.MD
+    first, err := laptopClient.CreateLaptop(withKey("create-1"), req, grpc.Header(&header))
+    require.NoError(t, err)
+    require.Empty(t, header.Get(service.IdempotentReplayedHeader))
+
+    second, err := laptopClient.CreateLaptop(withKey("create-1"), req, grpc.Header(&header))
+    require.NoError(t, err)
+    require.Equal(t, first.GetId(), second.GetId())
+    require.Equal(t, []string{"true"}, header.Get(service.IdempotentReplayedHeader))
+    require.Equal(t, 1, countLaptops(t, laptopStore))
+
+    // 同一个键不能用于内容不同的请求
+    other := sample.NewLaptop()
+    other.Id = ""
+    _, err = laptopClient.CreateLaptop(withKey("create-1"), &pb.CreateLaptopRequest{Laptop: other})
+    require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+    // 没有幂等键的请求不会去重
+    _, err = laptopClient.CreateLaptop(context.Background(), req)
+    require.NoError(t, err)
+    require.Equal(t, 2, countLaptops(t, laptopStore))
+
+    // 失败的请求不会被记住，可以用同一个键重试
+    invalid := sample.NewLaptop()
+    invalid.Id = "invalid-id"
+    for i := 0; i < 2; i++ {
+        _, err = laptopClient.CreateLaptop(withKey("create-2"), &pb.CreateLaptopRequest{Laptop: invalid})
+        require.Equal(t, codes.InvalidArgument, status.Code(err))
+    }
+    invalid.Id = ""
+    _, err = laptopClient.CreateLaptop(withKey("create-2"), &pb.CreateLaptopRequest{Laptop: invalid})
+    require.NoError(t, err)
+
+    _, err = laptopClient.CreateLaptop(withKey("bad key"), req)
+    require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestIdempotentUploadImage(t *testing.T) {
+    laptopStore := service.NewInMemoryLaptopStore()
+    laptopClient := startIdempotentLaptopServer(t, laptopStore)
+
+    laptop := sample.NewLaptop()
+    require.NoError(t, laptopStore.Save(laptop))
+
+    upload := func(key string, chunks ...[]byte) (*pb.UploadImageResponse, metadata.MD, error) {
+        ctx := metadata.AppendToOutgoingContext(context.Background(), service.IdempotencyKeyHeader, key)
+        stream, err := laptopClient.UploadImage(ctx)
+        require.NoError(t, err)
+
+        info := &pb.ImageInfo{LaptopId: laptop.GetId(), ImageType: ".jpg"}
+        require.NoError(t, stream.Send(&pb.UploadImageRequest{Data: &pb.UploadImageRequest_Info{Info: info}}))
+        for _, chunk := range chunks {
+            require.NoError(t, stream.Send(&pb.UploadImageRequest{Data: &pb.UploadImageRequest_ChunkData{ChunkData: chunk}}))
+        }
+        res, err := stream.CloseAndRecv()
+        header, headerErr := stream.Header()
+        require.NoError(t, headerErr)
+        return res, header, err
+    }
+
+    first, header, err := upload("upload-1", []byte("first"), []byte("chunk"))
+    require.NoError(t, err)
+    require.Empty(t, header.Get(service.IdempotentReplayedHeader))
+
+    second, header, err := upload("upload-1", []byte("first"), []byte("chunk"))
+    require.NoError(t, err)
+    require.Equal(t, first.GetId(), second.GetId())
+    require.Equal(t, []string{"true"}, header.Get(service.IdempotentReplayedHeader))
+
+    // 消息的边界也是请求内容的一部分
+    _, _, err = upload("upload-1", []byte("firstchunk"))
+    require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestIdempotencyInProgress(t *testing.T) {
+    idempotency, err := service.NewIdempotencyInterceptor(service.NewInMemoryIdempotencyStore(), service.DefaultIdempotencyConfig())
+    require.NoError(t, err)
+    unary := idempotency.Unary()
+    info := &grpc.UnaryServerInfo{FullMethod: "/xiusl.pcbook.LaptopServices/CreateLaptop"}
+    ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(service.IdempotencyKeyHeader, "slow"))
+    req := &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()}
+
+    started := make(chan struct{})
+    finish := make(chan struct{})
+    done := make(chan error)
+    go func() {
+        _, err := unary(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+            close(started)
+            <-finish
+            return &pb.CreateLaptopResponse{Id: "slow"}, nil
+        })
+        done <- err
+    }()
+    <-started
+
+    handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+        return &pb.CreateLaptopResponse{Id: "again"}, nil
+    }
+    _, err = unary(ctx, req, info, handler)
+    require.Equal(t, codes.Aborted, status.Code(err))
+
+    close(finish)
+    require.NoError(t, <-done)
+
+    res, err := unary(ctx, req, info, handler)
+    require.NoError(t, err)
+    require.Equal(t, "slow", res.(*pb.CreateLaptopResponse).GetId())
+}
+
+func TestIdempotencyConfigValidate(t *testing.T) {
+    require.NoError(t, service.DefaultIdempotencyConfig().Validate())
+
+    testCases := []struct {
+        name   string
+        config service.IdempotencyConfig
+    }{
+        {"window", service.IdempotencyConfig{}},
+        {"unknown method", service.IdempotencyConfig{Window: time.Hour, Methods: []string{"/xiusl.pcbook.LaptopServices/DeleteLaptop"}}},
+        {"server stream", service.IdempotencyConfig{Window: time.Hour, Methods: []string{"/xiusl.pcbook.LaptopServices/SearchLaptop"}}},
+    }
+
+    for _, tc := range testCases {
+        tc := tc
+        t.Run(tc.name, func(t *testing.T) {
+            require.Error(t, tc.config.Validate())
+        })
+    }
+}
@@ -13,6 +13,8 @@ import (
 type ImageStore interface {
     // Save 将便携计算机的图片存储下来
     Save(laptopID string, imageType string, imageData bytes.Buffer) (string, error)
+    // List 按上传顺序返回便携计算机的所有图片信息
+    List(laptopID string) ([]*ImageInfo, error)
 }
 
 // DiskImageStore 存储图像到硬盘，并在内存中保存图像的信息
@@ -20,20 +22,25 @@ type DiskImageStore struct {
     mutex       sync.RWMutex
     imageFolder string
     images      map[string]*ImageInfo
+    // laptopImages 每个便携计算机按上传顺序的图片 ID
+    laptopImages map[string][]string
 }
 
 // ImageInfo 包含了便携计算机图像的一些信息
 type ImageInfo struct {
+    ID       string
     LaptopID string
     Type     string
     Path     string
+    Size     int
 }
 
 // NewDiskImageStore 创建一个新的 DiskImageStore
 func NewDiskImageStore(imageFolder string) *DiskImageStore {
     return &DiskImageStore{
-        imageFolder: imageFolder,
-        images:      make(map[string]*ImageInfo),
+        imageFolder:  imageFolder,
+        images:       make(map[string]*ImageInfo),
+        laptopImages: make(map[string][]string),
     }
 }
 
@@ -54,7 +61,7 @@ func (store *DiskImageStore) Save(laptopID string, imageType string, imageData b
     }
 
     // 将图片的二进制数据写入文件中
-    _, err = imageData.WriteTo(file)
+    size, err := imageData.WriteTo(file)
     if err != nil {
         return "", fmt.Errorf("cannot write image date to file %w", err)
     }
@@ -65,10 +72,26 @@ func (store *DiskImageStore) Save(laptopID string, imageType string, imageData b
 
     // 更新内存中的图像信息
     store.images[imageID.String()] = &ImageInfo{
+        ID:       imageID.String(),
         LaptopID: laptopID,
         Type:     imageType,
         Path:     imagePath,
+        Size:     int(size),
     }
+    store.laptopImages[laptopID] = append(store.laptopImages[laptopID], imageID.String())
 
     return imageID.String(), nil
 }
+
+// List 按上传顺序返回便携计算机的所有图片信息
+func (store *DiskImageStore) List(laptopID string) ([]*ImageInfo, error) {
+    store.mutex.RLock()
+    defer store.mutex.RUnlock()
+
+    images := make([]*ImageInfo, 0, len(store.laptopImages[laptopID]))
+    for _, imageID := range store.laptopImages[laptopID] {
+        info := *store.images[imageID]
+        images = append(images, &info)
+    }
+    return images, nil
+}
@@ -1,10 +1,14 @@
 package service
 
 import (
+    "context"
     "fmt"
     "time"
 
     "github.com/dgrijalva/jwt-go"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
 )
 
 // JWTManager jwt 管理类
@@ -18,8 +22,19 @@ type UserClaims struct {
     jwt.StandardClaims
     Username string `json:"username"`
     Role     string `json:"role"`
+    Vendor   string `json:"vendor,omitempty"`
+    // AuthMethod 用户的登录方式，例如是否通过了两步验证
+    AuthMethod string `json:"auth_method,omitempty"`
+    // Purpose 不为空时表示这是一个有特定用途的令牌，不能作为访问令牌使用
+    Purpose string `json:"purpose,omitempty"`
 }
 
+// mfaChallengePurpose 两步验证登录挑战令牌的用途
+const mfaChallengePurpose = "mfa_challenge"
+
+// mfaChallengeDuration 两步验证登录挑战令牌的有效期
+const mfaChallengeDuration = 5 * time.Minute
+
 // NewJWTManager 新建一个 JWT 管理对象
 func NewJWTManager(secretKey string, duration time.Duration) *JWTManager {
     return &JWTManager{
@@ -28,22 +43,61 @@ func NewJWTManager(secretKey string, duration time.Duration) *JWTManager {
     }
 }
 
-// Generate 根据用户信息生成 jwt token
-func (manager *JWTManager) Generate(user *User) (string, error) {
+// Generate 根据用户信息和登录方式生成 jwt token
+func (manager *JWTManager) Generate(user *User, authMethod string) (string, error) {
     claims := UserClaims{
         StandardClaims: jwt.StandardClaims{
             ExpiresAt: time.Now().Add(manager.tokenDuration).Unix(),
         },
+        Username:   user.Username,
+        Role:       user.Role,
+        Vendor:     user.Vendor,
+        AuthMethod: authMethod,
+    }
+
+    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+    return token.SignedString([]byte(manager.secretKey))
+}
+
+// GenerateMFAChallenge 密码验证通过后生成短期的两步验证挑战令牌
+func (manager *JWTManager) GenerateMFAChallenge(user *User) (string, error) {
+    claims := UserClaims{
+        StandardClaims: jwt.StandardClaims{
+            ExpiresAt: time.Now().Add(mfaChallengeDuration).Unix(),
+        },
         Username: user.Username,
-        Role:     user.Role,
+        Purpose:  mfaChallengePurpose,
     }
 
     token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
     return token.SignedString([]byte(manager.secretKey))
 }
 
-// Verify 验证 token 字符串，如果有效将返回用户 claims
+// VerifyMFAChallenge 验证两步验证挑战令牌，返回其中的用户名
+func (manager *JWTManager) VerifyMFAChallenge(tokenString string) (string, error) {
+    claims, err := manager.parse(tokenString)
+    if err != nil {
+        return "", err
+    }
+    if claims.Purpose != mfaChallengePurpose {
+        return "", fmt.Errorf("token is not a mfa challenge")
+    }
+    return claims.Username, nil
+}
+
+// Verify 验证访问令牌字符串，如果有效将返回用户 claims
 func (manager *JWTManager) Verify(tokenString string) (*UserClaims, error) {
+    claims, err := manager.parse(tokenString)
+    if err != nil {
+        return nil, err
+    }
+    if claims.Purpose != "" {
+        return nil, fmt.Errorf("token is not an access token")
+    }
+    return claims, nil
+}
+
+func (manager *JWTManager) parse(tokenString string) (*UserClaims, error) {
     token, err := jwt.ParseWithClaims(tokenString, &UserClaims{}, func(t *jwt.Token) (interface{}, error) {
         _, ok := t.Method.(*jwt.SigningMethodHMAC)
         if !ok {
@@ -64,3 +118,35 @@ func (manager *JWTManager) Verify(tokenString string) (*UserClaims, error) {
 
     return claims, nil
 }
+
+// Authenticate 使用请求元数据中的 authorization 令牌识别调用方身份
+func (manager *JWTManager) Authenticate(ctx context.Context) (*Principal, error) {
+    md, ok := metadata.FromIncomingContext(ctx)
+    if !ok {
+        return nil, nil
+    }
+
+    values := md["authorization"]
+    if len(values) == 0 {
+        return nil, nil
+    }
+
+    accessToken := values[0]
+    claims, err := manager.Verify(accessToken)
+    if err != nil {
+        return nil, status.Errorf(codes.Unauthenticated, "authorization token is invalid")
+    }
+
+    authMethod := claims.AuthMethod
+    if authMethod == "" {
+        authMethod = AuthMethodPassword
+    }
+
+    principal := &Principal{
+        Username:   claims.Username,
+        Roles:      []string{claims.Role},
+        Vendor:     claims.Vendor,
+        AuthMethod: authMethod,
+    }
+    return principal, nil
+}
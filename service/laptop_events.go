@@ -0,0 +1,164 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "time"
+
+    "github.com/xiusl/pcbook/pb"
+    "google.golang.org/protobuf/proto"
+    "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultEventHistory 默认在内存中保留的便携电脑变更事件数
+const DefaultEventHistory = 1000
+
+// ErrCompacted 错误：请求的版本号已经从事件记录中清理
+var ErrCompacted = errors.New("revision has been compacted")
+
+// ErrFutureRevision 错误：请求的版本号大于下一个事件的版本号，通常是服务端重启后版本号重新开始
+var ErrFutureRevision = errors.New("revision is in the future")
+
+// ErrWatchClosed 错误：存储不再接受订阅，例如服务端正在退出
+var ErrWatchClosed = errors.New("watch is closed")
+
+// laptopEvent 事件记录中的一条事件，previous 是更新前的便携电脑，用于判断是否符合订阅条件
+// 存储中的便携电脑不会被原地修改，事件直接引用它们，发送给订阅方之前再复制
+type laptopEvent struct {
+    event    *pb.LaptopEvent
+    previous *pb.Laptop
+}
+
+// eventLog 环形缓冲区保存的最近的变更事件，版本号为 r 的事件保存在 r % len(events) 的位置
+// eventLog 不是并发安全的，由 InMemoryLaptopStore 的锁保护
+type eventLog struct {
+    events   []*laptopEvent
+    revision uint64
+    // changed 有新事件或者关闭时关闭，然后换成新的通道
+    changed chan struct{}
+    closed  bool
+}
+
+// newEventLog 新建一个最多保留 size 条事件的事件记录
+func newEventLog(size int) *eventLog {
+    if size < 1 {
+        size = 1
+    }
+    return &eventLog{
+        events:  make([]*laptopEvent, size),
+        changed: make(chan struct{}),
+    }
+}
+
+// append 追加一条事件，分配版本号并通知等待的订阅
+func (history *eventLog) append(eventType pb.LaptopEvent_Type, laptop *pb.Laptop, previous *pb.Laptop, event *pb.LaptopEvent) {
+    if event == nil {
+        event = &pb.LaptopEvent{}
+    }
+    history.revision++
+    event.Revision = history.revision
+    event.Type = eventType
+    event.Time = timestamppb.New(time.Now())
+    event.Laptop = laptop
+    history.events[history.revision%uint64(len(history.events))] = &laptopEvent{event: event, previous: previous}
+    laptopEvents.WithLabelValues(eventType.String()).Inc()
+
+    close(history.changed)
+    history.changed = make(chan struct{})
+}
+
+// oldest 返回还保留着的最早的版本号
+func (history *eventLog) oldest() uint64 {
+    if history.revision < uint64(len(history.events)) {
+        return 1
+    }
+    return history.revision - uint64(len(history.events)) + 1
+}
+
+// since 返回从 revision 开始的所有事件，revision 必须在保留的范围内
+func (history *eventLog) since(revision uint64) []*laptopEvent {
+    var events []*laptopEvent
+    for ; revision <= history.revision; revision++ {
+        events = append(events, history.events[revision%uint64(len(history.events))])
+    }
+    return events
+}
+
+// close 结束所有的订阅
+func (history *eventLog) close() {
+    if history.closed {
+        return
+    }
+    history.closed = true
+    close(history.changed)
+    history.changed = make(chan struct{})
+}
+
+// Publish 记录一个不修改便携电脑数据的变更事件，例如评分和上传图片，事件中的便携电脑是当前保存的数据
+func (store *InMemoryLaptopStore) Publish(laptopID string, eventType pb.LaptopEvent_Type, event *pb.LaptopEvent) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    laptop := store.data[laptopID]
+    if laptop == nil {
+        return ErrNotFound
+    }
+    store.events.append(eventType, laptop, nil, event)
+    return nil
+}
+
+// Watch 从 startRevision 开始把符合条件的变更事件依次交给 found，直到 ctx 结束或者 found 返回错误
+// startRevision 为 0 时只接收之后发生的事件，filter 为空时接收所有事件
+// 更新事件在更新前或者更新后符合条件时都会交给 found，订阅方可以据此移除不再符合条件的便携电脑
+func (store *InMemoryLaptopStore) Watch(ctx context.Context, filter *pb.Filter, startRevision uint64, found func(event *pb.LaptopEvent) error) error {
+    filter = normalizeFilter(filter)
+    next := startRevision
+    for {
+        store.mutex.Lock()
+        history := store.events
+        if history.closed {
+            store.mutex.Unlock()
+            return ErrWatchClosed
+        }
+        if next == 0 {
+            next = history.revision + 1
+        }
+        if next < history.oldest() {
+            store.mutex.Unlock()
+            return fmt.Errorf("%w: revision %d is older than %d", ErrCompacted, next, history.oldest())
+        }
+        if next > history.revision+1 {
+            store.mutex.Unlock()
+            return fmt.Errorf("%w: revision %d is after the current revision %d", ErrFutureRevision, next, history.revision)
+        }
+        events := history.since(next)
+        changed := history.changed
+        store.mutex.Unlock()
+
+        // 发送事件时不持有锁，慢的订阅方不会阻塞写入，落后太多时会收到 ErrCompacted
+        for _, e := range events {
+            next = e.event.GetRevision() + 1
+            if !isQualified(filter, e.event.GetLaptop()) && (e.previous == nil || !isQualified(filter, e.previous)) {
+                continue
+            }
+            if err := found(proto.Clone(e.event).(*pb.LaptopEvent)); err != nil {
+                return err
+            }
+        }
+
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-changed:
+        }
+    }
+}
+
+// CloseWatches 结束所有的订阅并拒绝新的订阅，服务端退出前调用，使订阅方尽快连接到其他实例
+func (store *InMemoryLaptopStore) CloseWatches() {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    store.events.close()
+}
@@ -0,0 +1,171 @@
+package service_test
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/sample"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+// errStopWatch 测试中用来结束订阅的错误
+var errStopWatch = errors.New("stop watch")
+
+// collectEvents 从 startRevision 开始订阅，收到 count 个事件后返回
+func collectEvents(t *testing.T, store service.LaptopStore, filter *pb.Filter, startRevision uint64, count int) []*pb.LaptopEvent {
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+
+    var events []*pb.LaptopEvent
+    err := store.Watch(ctx, filter, startRevision, func(event *pb.LaptopEvent) error {
+        events = append(events, event)
+        if len(events) == count {
+            return errStopWatch
+        }
+        return nil
+    })
+    require.ErrorIs(t, err, errStopWatch)
+    return events
+}
+
+func TestInMemoryLaptopStoreWatch(t *testing.T) {
+    store := service.NewInMemoryLaptopStoreWithHistory(3)
+
+    cheap := sample.NewLaptop()
+    cheap.PriceUsd = 1000
+    expensive := sample.NewLaptop()
+    expensive.PriceUsd = 3000
+    require.NoError(t, store.Save(cheap))
+    require.NoError(t, store.Save(expensive))
+    require.NoError(t, store.Publish(cheap.Id, pb.LaptopEvent_RATED, &pb.LaptopEvent{
+        Detail: &pb.LaptopEvent_Rating{Rating: &pb.LaptopRating{RatedCount: 1, AverageScore: 8}},
+    }))
+    require.ErrorIs(t, store.Publish("unknown", pb.LaptopEvent_RATED, nil), service.ErrNotFound)
+
+    events := collectEvents(t, store, nil, 1, 3)
+    for i, eventType := range []pb.LaptopEvent_Type{pb.LaptopEvent_CREATED, pb.LaptopEvent_CREATED, pb.LaptopEvent_RATED} {
+        require.Equal(t, uint64(i+1), events[i].GetRevision())
+        require.Equal(t, eventType, events[i].GetType())
+    }
+    require.Equal(t, expensive.Id, events[1].GetLaptop().GetId())
+    require.Equal(t, uint32(1), events[2].GetRating().GetRatedCount())
+
+    // 没有设置价格上限时不限制价格，搜索和订阅的条件一致
+    events = collectEvents(t, store, &pb.Filter{MinCpuCores: 1}, 1, 3)
+    require.Equal(t, expensive.Id, events[1].GetLaptop().GetId())
+    found := 0
+    require.NoError(t, store.Search(context.Background(), &pb.Filter{MinCpuCores: 1}, func(laptop *pb.Laptop) error {
+        found++
+        return nil
+    }))
+    require.Equal(t, 2, found)
+
+    // 更新前符合条件的便携电脑在更新后不符合条件时也会收到事件
+    cheap.PriceUsd = 2500
+    require.NoError(t, store.Update(cheap))
+    events = collectEvents(t, store, &pb.Filter{MaxPriceUsd: 2000}, 3, 2)
+    require.Equal(t, pb.LaptopEvent_RATED, events[0].GetType())
+    require.Equal(t, pb.LaptopEvent_UPDATED, events[1].GetType())
+    require.Equal(t, 2500.0, events[1].GetLaptop().GetPriceUsd())
+
+    // 只保留最近的 3 个事件，超出范围的版本号不能继续订阅
+    err := store.Watch(context.Background(), nil, 1, func(event *pb.LaptopEvent) error { return nil })
+    require.ErrorIs(t, err, service.ErrCompacted)
+    err = store.Watch(context.Background(), nil, 6, func(event *pb.LaptopEvent) error { return nil })
+    require.ErrorIs(t, err, service.ErrFutureRevision)
+}
+
+func TestInMemoryLaptopStoreWatchNewEvents(t *testing.T) {
+    store := service.NewInMemoryLaptopStore()
+    require.NoError(t, store.Save(sample.NewLaptop()))
+
+    // 版本号为 0 时只接收订阅之后的事件
+    received := make(chan *pb.LaptopEvent, 100)
+    done := make(chan error)
+    go func() {
+        done <- store.Watch(context.Background(), nil, 0, func(event *pb.LaptopEvent) error {
+            received <- event
+            return nil
+        })
+    }()
+
+    // 订阅开始之前保存的便携电脑可能会被跳过，持续保存直到收到事件
+    laptop := sample.NewLaptop()
+    require.NoError(t, store.Save(laptop))
+    var event *pb.LaptopEvent
+    for event == nil {
+        select {
+        case event = <-received:
+        case <-time.After(10 * time.Millisecond):
+            laptop = sample.NewLaptop()
+            require.NoError(t, store.Save(laptop))
+        }
+    }
+    require.True(t, event.GetRevision() > 1)
+    require.Equal(t, pb.LaptopEvent_CREATED, event.GetType())
+
+    // 结束订阅后不再接受新的订阅
+    store.CloseWatches()
+    require.ErrorIs(t, <-done, service.ErrWatchClosed)
+    err := store.Watch(context.Background(), nil, 0, func(event *pb.LaptopEvent) error { return nil })
+    require.ErrorIs(t, err, service.ErrWatchClosed)
+}
+
+func TestClientWatchLaptops(t *testing.T) {
+    laptopStore := service.NewInMemoryLaptopStoreWithHistory(2)
+    serverAddr := startTestLaptopServer(t, laptopStore, nil, service.NewInMemoryRatingStore())
+    laptopClient := newTestLaptopClient(t, serverAddr)
+
+    laptop := sample.NewLaptop()
+    _, err := laptopClient.CreateLaptop(context.Background(), &pb.CreateLaptopRequest{Laptop: laptop})
+    require.NoError(t, err)
+
+    rateStream, err := laptopClient.RateLaptop(context.Background())
+    require.NoError(t, err)
+    require.NoError(t, rateStream.Send(&pb.RateLaptopRequest{LaptopId: laptop.Id, Score: 6}))
+    _, err = rateStream.Recv()
+    require.NoError(t, err)
+    require.NoError(t, rateStream.CloseSend())
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    stream, err := laptopClient.WatchLaptops(ctx, &pb.WatchLaptopsRequest{StartRevision: 1})
+    require.NoError(t, err)
+
+    res, err := stream.Recv()
+    require.NoError(t, err)
+    require.Equal(t, pb.LaptopEvent_CREATED, res.GetEvent().GetType())
+    requireSameLaptop(t, laptop, res.GetEvent().GetLaptop())
+
+    res, err = stream.Recv()
+    require.NoError(t, err)
+    require.Equal(t, uint64(2), res.GetEvent().GetRevision())
+    require.Equal(t, pb.LaptopEvent_RATED, res.GetEvent().GetType())
+    require.Equal(t, 6.0, res.GetEvent().GetRating().GetAverageScore())
+
+    // 被清理的版本号返回 OutOfRange，订阅方需要重新搜索
+    for i := 0; i < 2; i++ {
+        _, err = laptopClient.CreateLaptop(context.Background(), &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+        require.NoError(t, err)
+    }
+    stream, err = laptopClient.WatchLaptops(ctx, &pb.WatchLaptopsRequest{StartRevision: 1})
+    require.NoError(t, err)
+    _, err = stream.Recv()
+    require.Equal(t, codes.OutOfRange, status.Code(err))
+
+    // 服务端退出时结束订阅
+    stream, err = laptopClient.WatchLaptops(ctx, &pb.WatchLaptopsRequest{StartRevision: 4})
+    require.NoError(t, err)
+    res, err = stream.Recv()
+    require.NoError(t, err)
+    require.Equal(t, uint64(4), res.GetEvent().GetRevision())
+    laptopStore.CloseWatches()
+    _, err = stream.Recv()
+    require.Equal(t, codes.Unavailable, status.Code(err))
+}
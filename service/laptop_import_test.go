@@ -0,0 +1,188 @@
+package service_test
+
+import (
+    "bytes"
+    "context"
+    "io"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/client"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/sample"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+)
+
+func TestClientImportLaptops(t *testing.T) {
+    laptopStore := service.NewInMemoryLaptopStore()
+    existing := sample.NewLaptop()
+    require.NoError(t, laptopStore.Save(existing))
+
+    serverAddr := startTestLaptopServer(t, laptopStore, nil, service.NewInMemoryRatingStore())
+    conn, err := grpc.Dial(serverAddr, grpc.WithInsecure())
+    require.NoError(t, err)
+    defer conn.Close()
+    laptopClient := client.NewLaptopClient(conn)
+
+    generated := sample.NewLaptop()
+    generated.Id = ""
+    withID := sample.NewLaptop()
+    invalid := sample.NewLaptop()
+    invalid.Brand = ""
+    invalid.Screen = nil
+    newLaptops := func() []*pb.Laptop {
+        return []*pb.Laptop{
+            proto.Clone(generated).(*pb.Laptop),
+            proto.Clone(withID).(*pb.Laptop),
+            proto.Clone(existing).(*pb.Laptop),
+            proto.Clone(invalid).(*pb.Laptop),
+            proto.Clone(withID).(*pb.Laptop),
+        }
+    }
+    outcomes := []pb.ImportResult_Outcome{
+        pb.ImportResult_CREATED,
+        pb.ImportResult_CREATED,
+        pb.ImportResult_DUPLICATE,
+        pb.ImportResult_INVALID,
+        pb.ImportResult_DUPLICATE,
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    // 试运行只报告结果，不保存也不生成 ID
+    res, err := laptopClient.ImportLaptops(ctx, newLaptops(), true)
+    require.NoError(t, err)
+    require.True(t, res.GetDryRun())
+    require.Len(t, res.GetResults(), len(outcomes))
+    for i, result := range res.GetResults() {
+        require.Equal(t, uint32(i), result.GetIndex())
+        require.Equal(t, outcomes[i], result.GetOutcome())
+    }
+    require.Empty(t, res.GetResults()[0].GetLaptopId())
+    require.Contains(t, res.GetResults()[3].GetError(), "brand is required")
+    require.Contains(t, res.GetResults()[3].GetError(), "screen is required")
+    require.True(t, proto.Equal(&pb.ImportSummary{Total: 5, Created: 2, Duplicate: 2, Invalid: 1}, res.GetSummary()))
+    found, err := laptopStore.FindByID(withID.Id)
+    require.NoError(t, err)
+    require.Nil(t, found)
+
+    res, err = laptopClient.ImportLaptops(ctx, newLaptops(), false)
+    require.NoError(t, err)
+    require.False(t, res.GetDryRun())
+    for i, result := range res.GetResults() {
+        require.Equal(t, outcomes[i], result.GetOutcome())
+    }
+    require.True(t, proto.Equal(&pb.ImportSummary{Total: 5, Created: 2, Duplicate: 2, Invalid: 1}, res.GetSummary()))
+    for _, id := range []string{res.GetResults()[0].GetLaptopId(), withID.Id} {
+        found, err := laptopStore.FindByID(id)
+        require.NoError(t, err)
+        require.NotNil(t, found)
+    }
+
+    // 再次导入时已经导入的便携电脑都是重复的
+    res, err = laptopClient.ImportLaptops(ctx, []*pb.Laptop{proto.Clone(withID).(*pb.Laptop)}, false)
+    require.NoError(t, err)
+    require.Equal(t, pb.ImportResult_DUPLICATE, res.GetResults()[0].GetOutcome())
+
+    // 超过一批的便携电脑分多条消息发送
+    var laptops []*pb.Laptop
+    for i := 0; i < 250; i++ {
+        laptops = append(laptops, sample.NewLaptop())
+    }
+    res, err = laptopClient.ImportLaptops(ctx, laptops, false)
+    require.NoError(t, err)
+    require.Equal(t, uint32(250), res.GetSummary().GetCreated())
+    require.Equal(t, uint32(249), res.GetResults()[249].GetIndex())
+
+    // 导入选项只能是第一条消息
+    stream, err := newTestLaptopClient(t, serverAddr).ImportLaptops(ctx)
+    require.NoError(t, err)
+    require.NoError(t, stream.Send(&pb.ImportLaptopsRequest{
+        Data: &pb.ImportLaptopsRequest_Batch{Batch: &pb.LaptopBatch{Laptops: []*pb.Laptop{sample.NewLaptop()}}},
+    }))
+    require.NoError(t, stream.Send(&pb.ImportLaptopsRequest{
+        Data: &pb.ImportLaptopsRequest_Options{Options: &pb.ImportOptions{DryRun: true}},
+    }))
+    _, err = stream.CloseAndRecv()
+    require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+    // 一次导入的便携电脑数有上限，服务端拒绝后发送会返回 io.EOF
+    stream, err = newTestLaptopClient(t, serverAddr).ImportLaptops(ctx)
+    require.NoError(t, err)
+    batch := &pb.LaptopBatch{Laptops: make([]*pb.Laptop, 500)}
+    for i := range batch.Laptops {
+        batch.Laptops[i] = &pb.Laptop{}
+    }
+    for sent := 0; sent <= service.MaxImportLaptops; sent += len(batch.Laptops) {
+        if err := stream.Send(&pb.ImportLaptopsRequest{Data: &pb.ImportLaptopsRequest_Batch{Batch: batch}}); err != nil {
+            require.ErrorIs(t, err, io.EOF)
+            break
+        }
+    }
+    _, err = stream.CloseAndRecv()
+    require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestClientExportLaptops(t *testing.T) {
+    laptopStore := service.NewInMemoryLaptopStore()
+    imageStore := service.NewDiskImageStore(t.TempDir())
+    ratingStore := service.NewInMemoryRatingStore()
+
+    cheap := sample.NewLaptop()
+    cheap.PriceUsd = 1000
+    expensive := sample.NewLaptop()
+    expensive.PriceUsd = 3000
+    require.NoError(t, laptopStore.Save(cheap))
+    require.NoError(t, laptopStore.Save(expensive))
+
+    _, err := ratingStore.Add(cheap.Id, 6)
+    require.NoError(t, err)
+    _, err = ratingStore.Add(cheap.Id, 9)
+    require.NoError(t, err)
+    imageID, err := imageStore.Save(cheap.Id, ".jpg", *bytes.NewBufferString("image"))
+    require.NoError(t, err)
+
+    serverAddr := startTestLaptopServer(t, laptopStore, imageStore, ratingStore)
+    conn, err := grpc.Dial(serverAddr, grpc.WithInsecure())
+    require.NoError(t, err)
+    defer conn.Close()
+    laptopClient := client.NewLaptopClient(conn)
+
+    export := func(filter *pb.Filter) map[string]*pb.ExportLaptopsResponse {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+
+        exported := make(map[string]*pb.ExportLaptopsResponse)
+        err := laptopClient.ExportLaptops(ctx, filter, func(res *pb.ExportLaptopsResponse) error {
+            exported[res.GetLaptop().GetId()] = res
+            return nil
+        })
+        require.NoError(t, err)
+        return exported
+    }
+
+    // 没有条件时导出所有的便携电脑
+    exported := export(nil)
+    require.Len(t, exported, 2)
+    requireSameLaptop(t, cheap, exported[cheap.Id].GetLaptop())
+    require.Equal(t, uint32(2), exported[cheap.Id].GetRating().GetRatedCount())
+    require.Equal(t, 7.5, exported[cheap.Id].GetRating().GetAverageScore())
+    require.Len(t, exported[cheap.Id].GetImages(), 1)
+    require.True(t, proto.Equal(&pb.LaptopImage{Id: imageID, ImageType: ".jpg", Size: 5}, exported[cheap.Id].GetImages()[0]))
+    require.Nil(t, exported[expensive.Id].GetRating())
+    require.Empty(t, exported[expensive.Id].GetImages())
+
+    exported = export(&pb.Filter{MaxPriceUsd: 2000})
+    require.Len(t, exported, 1)
+    require.NotNil(t, exported[cheap.Id])
+
+    // 只设置了其他条件时不限制价格
+    exported = export(&pb.Filter{MinCpuCores: 1})
+    require.Len(t, exported, 2)
+}
@@ -4,42 +4,60 @@ import (
     "bytes"
     "context"
     "errors"
-    "fmt"
     "io"
-    "log"
+    "strings"
 
     "github.com/google/uuid"
+    "github.com/xiusl/pcbook/logging"
     "github.com/xiusl/pcbook/pb"
+    "go.opentelemetry.io/otel/attribute"
     "google.golang.org/grpc/codes"
     "google.golang.org/grpc/status"
 )
 
-// 1 mb
-const maxImageSize = 1 << 20
+// laptopLog 便携电脑服务和存储的日志
+var laptopLog = logging.New("laptop")
+
+// DefaultMaxImageSize 默认的图片大小上限，1 mb
+const DefaultMaxImageSize = 1 << 20
+
+// MaxImportLaptops 一次导入最多包含的便携电脑数，每个便携电脑的结果都在同一个响应中返回
+const MaxImportLaptops = 10000
 
 // LaptopServer 提供 laptop 服务的服务器
 type LaptopServer struct {
     laptopStore LaptopStore
     imageStore  ImageStore
     ratingStore RatingStore
+    // maxImageSize 上传图片的大小上限，单位为字节
+    maxImageSize int
 }
 
 // NewLaptopServer 创建一个 laptop 服务器
 func NewLaptopServer(laptopStore LaptopStore, imageStore ImageStore, ratingStore RatingStore) *LaptopServer {
+    return NewLaptopServerWithImageLimit(laptopStore, imageStore, ratingStore, DefaultMaxImageSize)
+}
+
+// NewLaptopServerWithImageLimit 创建一个 LaptopServer，上传的图片不能超过 maxImageSize 字节
+func NewLaptopServerWithImageLimit(laptopStore LaptopStore, imageStore ImageStore, ratingStore RatingStore, maxImageSize int) *LaptopServer {
     return &LaptopServer{
-        laptopStore: laptopStore,
-        imageStore:  imageStore,
-        ratingStore: ratingStore,
+        laptopStore:  laptopStore,
+        imageStore:   imageStore,
+        ratingStore:  ratingStore,
+        maxImageSize: maxImageSize,
     }
 }
 
 // CreateLaptop 实现创建 laptop 的方法
 func (server *LaptopServer) CreateLaptop(ctx context.Context, req *pb.CreateLaptopRequest) (*pb.CreateLaptopResponse, error) {
     laptop := req.GetLaptop()
-    log.Printf("receive a create-laptop request with id:%s.\n", laptop.Id)
+    if laptop == nil {
+        return nil, status.Errorf(codes.InvalidArgument, "laptop is required")
+    }
+    laptopLog.Info(ctx, "create laptop", "laptop_id", laptop.GetId())
     // 检查 UUID
-    if len(laptop.Id) > 0 {
-        _, err := uuid.Parse(laptop.Id)
+    if len(laptop.GetId()) > 0 {
+        _, err := uuid.Parse(laptop.GetId())
         if err != nil {
             return nil, status.Errorf(codes.InvalidArgument, "laptap ID is not a valid UUID: %v", err)
         }
@@ -51,17 +69,18 @@ func (server *LaptopServer) CreateLaptop(ctx context.Context, req *pb.CreateLapt
         laptop.Id = id.String()
     }
 
-    if ctx.Err() == context.Canceled {
-        log.Print("context is canceled")
-        return nil, fmt.Errorf("context is canceled")
+    if err := assignVendor(ctx, laptop); err != nil {
+        return nil, err
     }
 
-    if ctx.Err() == context.DeadlineExceeded {
-        log.Print("deadline is exceeded")
-        return nil, fmt.Errorf("deadline is exceeded")
+    if err := contextError(ctx); err != nil {
+        laptopLog.Warn(ctx, "request is done", "error", ctx.Err())
+        return nil, err
     }
 
+    _, span := startSpan(ctx, "LaptopStore.Save")
     err := server.laptopStore.Save(laptop)
+    endSpan(span, err)
     if err != nil {
         code := codes.Internal
         if errors.Is(err, ErrAlreadyExists) {
@@ -74,9 +93,51 @@ func (server *LaptopServer) CreateLaptop(ctx context.Context, req *pb.CreateLapt
     return res, nil
 }
 
+// UpdateLaptop 实现更新 laptop 的方法，只能更新调用方有权限修改的 laptop
+func (server *LaptopServer) UpdateLaptop(ctx context.Context, req *pb.UpdateLaptopRequest) (*pb.UpdateLaptopResponse, error) {
+    laptop := req.GetLaptop()
+    laptopLog.Info(ctx, "update laptop", "laptop_id", laptop.GetId())
+
+    _, span := startSpan(ctx, "LaptopStore.FindByID")
+    existing, err := server.laptopStore.FindByID(laptop.GetId())
+    endSpan(span, err)
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot find the laptop: %v", err)
+    }
+    if existing == nil {
+        return nil, status.Errorf(codes.NotFound, "laptop %s doesn't exist", laptop.GetId())
+    }
+
+    if err := checkOwnership(ctx, existing); err != nil {
+        return nil, err
+    }
+    if err := assignVendor(ctx, laptop); err != nil {
+        return nil, err
+    }
+
+    if err := contextError(ctx); err != nil {
+        laptopLog.Warn(ctx, "request is done", "error", ctx.Err())
+        return nil, err
+    }
+
+    _, span = startSpan(ctx, "LaptopStore.Update")
+    err = server.laptopStore.Update(laptop)
+    endSpan(span, err)
+    if err != nil {
+        code := codes.Internal
+        if errors.Is(err, ErrNotFound) {
+            code = codes.NotFound
+        }
+        return nil, status.Errorf(code, "cannot update the laptop in store: %v", err)
+    }
+
+    res := &pb.UpdateLaptopResponse{Id: laptop.Id}
+    return res, nil
+}
+
 func (server *LaptopServer) SearchLaptop(req *pb.SearchLaptopRequest, stream pb.LaptopServices_SearchLaptopServer) error {
     filter := req.GetFilter()
-    log.Printf("receive a search-laptop request with filter: %v", filter)
+    laptopLog.Info(stream.Context(), "search laptops", "filter", filter)
 
     err := server.laptopStore.Search(stream.Context(), filter, func(laptop *pb.Laptop) error {
         res := &pb.SearchLaptopResponse{
@@ -90,6 +151,9 @@ func (server *LaptopServer) SearchLaptop(req *pb.SearchLaptopRequest, stream pb.
     })
 
     if err != nil {
+        if contextErr := contextError(stream.Context()); contextErr != nil {
+            return contextErr
+        }
         return status.Errorf(codes.Internal, "unexpected error: %v", err)
     }
     return nil
@@ -100,51 +164,53 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopServices_UploadImageServ
     // 读取请求信息
     req, err := stream.Recv()
     if err != nil {
-        log.Print("cannot receive image info", err)
+        laptopLog.Warn(stream.Context(), "cannot receive image info", "error", err)
         return status.Error(codes.Unknown, "cannot receive image info")
     }
 
     laptapID := req.GetInfo().GetLaptopId()
     imageType := req.GetInfo().GetImageType()
-    log.Printf("receive an upload-image request for laptop %s with image type %s", laptapID, imageType)
+    laptopLog.Info(stream.Context(), "upload image", "laptop_id", laptapID, "image_type", imageType)
 
     // 获取需要存储图片的便携电脑
+    _, span := startSpan(stream.Context(), "LaptopStore.FindByID")
     laptap, err := server.laptopStore.FindByID(laptapID)
+    endSpan(span, err)
     if err != nil {
-        log.Print("cannot find the laptop", err)
+        laptopLog.Error(stream.Context(), "cannot find the laptop", "error", err)
         return status.Error(codes.Internal, "cannot find the laptop")
     }
     if laptap == nil {
-        log.Printf("laptop %s doesn't exist", laptapID)
+        laptopLog.Warn(stream.Context(), "laptop doesn't exist", "laptop_id", laptapID)
         return status.Errorf(codes.InvalidArgument, "laptop %s doesn't exist", laptapID)
     }
 
+    if err := checkOwnership(stream.Context(), laptap); err != nil {
+        laptopLog.Warn(stream.Context(), "cannot upload image", "laptop_id", laptapID, "error", err)
+        return err
+    }
+
     imageData := bytes.Buffer{}
     imageSize := 0
 
     // 开始从请求中不断接受数据
     for {
-        log.Print("wait to receive more data")
+        laptopLog.Debug(stream.Context(), "wait to receive more data")
 
         // 对上下文进行判断
-        if stream.Context().Err() == context.Canceled {
-            log.Print("context is canceled")
-            return fmt.Errorf("context is canceled")
-        }
-
-        if stream.Context().Err() == context.DeadlineExceeded {
-            log.Print("deadline is exceeded")
-            return fmt.Errorf("deadline is exceeded")
+        if err := contextError(stream.Context()); err != nil {
+            laptopLog.Warn(stream.Context(), "request is done", "error", stream.Context().Err())
+            return err
         }
 
         // 接受请求
         req, err := stream.Recv()
         if err == io.EOF {
-            log.Print("no more data")
+            laptopLog.Debug(stream.Context(), "no more data")
             break
         }
         if err != nil {
-            log.Printf("cannot receive chunk data: %v", err)
+            laptopLog.Warn(stream.Context(), "cannot receive chunk data", "error", err)
             return status.Errorf(codes.Unknown, "cannot receive chunk data: %v", err)
         }
 
@@ -153,23 +219,25 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopServices_UploadImageServ
         size := len(chunk)
 
         imageSize += size
-        if imageSize > maxImageSize {
-            log.Printf("image to large %v > %v", imageSize, maxImageSize)
-            return status.Errorf(codes.InvalidArgument, "image to large %v > %v", imageSize, maxImageSize)
+        if imageSize > server.maxImageSize {
+            laptopLog.Warn(stream.Context(), "image too large", "size", imageSize, "max_size", server.maxImageSize)
+            return status.Errorf(codes.InvalidArgument, "image to large %v > %v", imageSize, server.maxImageSize)
         }
 
         // 将分块的数据写入到 imageData 中
         _, err = imageData.Write(chunk)
         if err != nil {
-            log.Printf("cannot write chunk data: %v", err)
+            laptopLog.Error(stream.Context(), "cannot write chunk data", "error", err)
             return status.Errorf(codes.Internal, "cannot write chunk data: %v", err)
         }
     }
 
     // 调用存储，保存图片
+    _, span = startSpan(stream.Context(), "ImageStore.Save", attribute.Int("image.size", imageSize))
     imageID, err := server.imageStore.Save(laptapID, imageType, imageData)
+    endSpan(span, err)
     if err != nil {
-        log.Printf("cannot save image to file: %v", err)
+        laptopLog.Error(stream.Context(), "cannot save image to file", "error", err)
         return status.Errorf(codes.Internal, "cannot save image to file: %v", err)
     }
 
@@ -181,11 +249,18 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopServices_UploadImageServ
     // 发送结束响应并关闭流
     err = stream.SendAndClose(res)
     if err != nil {
-        log.Printf("cannot send the response: %v", err)
+        laptopLog.Warn(stream.Context(), "cannot send the response", "error", err)
         return status.Errorf(codes.Internal, "cannot send the response: %v", err)
     }
 
-    log.Printf("saved image with id: %s, size: %d", imageID, imageSize)
+    imageUploadBytes.Add(float64(imageSize))
+    imageUploadSize.Observe(float64(imageSize))
+
+    server.publish(stream.Context(), laptapID, pb.LaptopEvent_IMAGE_UPLOADED, &pb.LaptopEvent{
+        Detail: &pb.LaptopEvent_Image{Image: &pb.LaptopImage{Id: imageID, ImageType: imageType, Size: uint32(imageSize)}},
+    })
+
+    laptopLog.Info(stream.Context(), "image saved", "image_id", imageID, "size", imageSize)
     return nil
 }
 
@@ -193,14 +268,9 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopServices_UploadImageServ
 func (server *LaptopServer) RateLaptop(stream pb.LaptopServices_RateLaptopServer) error {
     for {
         // 对上下文进行判断
-        if stream.Context().Err() == context.Canceled {
-            log.Print("context is canceled")
-            return fmt.Errorf("context is canceled")
-        }
-
-        if stream.Context().Err() == context.DeadlineExceeded {
-            log.Print("deadline is exceeded")
-            return fmt.Errorf("deadline is exceeded")
+        if err := contextError(stream.Context()); err != nil {
+            laptopLog.Warn(stream.Context(), "request is done", "error", stream.Context().Err())
+            return err
         }
 
         req, err := stream.Recv()
@@ -208,26 +278,30 @@ func (server *LaptopServer) RateLaptop(stream pb.LaptopServices_RateLaptopServer
             break
         }
         if err != nil {
-            log.Printf("cannot receive stream data: %v", err)
+            laptopLog.Warn(stream.Context(), "cannot receive stream data", "error", err)
             return status.Errorf(codes.Unknown, "cannot receive stream data: %v", err)
         }
 
         laptopID := req.GetLaptopId()
         scroe := req.GetScore()
 
+        _, span := startSpan(stream.Context(), "LaptopStore.FindByID")
         laptap, err := server.laptopStore.FindByID(laptopID)
+        endSpan(span, err)
         if err != nil {
-            log.Print("cannot find the laptop", err)
+            laptopLog.Error(stream.Context(), "cannot find the laptop", "error", err)
             return status.Error(codes.Internal, "cannot find the laptop")
         }
         if laptap == nil {
-            log.Printf("laptop %s doesn't exist", laptopID)
+            laptopLog.Warn(stream.Context(), "laptop doesn't exist", "laptop_id", laptopID)
             return status.Errorf(codes.InvalidArgument, "laptop %s doesn't exist", laptopID)
         }
 
+        _, span = startSpan(stream.Context(), "RatingStore.Add")
         rating, err := server.ratingStore.Add(laptopID, scroe)
+        endSpan(span, err)
         if err != nil {
-            log.Printf("cannot add the score to store %v.", err)
+            laptopLog.Error(stream.Context(), "cannot add the score to store", "error", err)
             return status.Errorf(codes.Internal, "cannot add the score to store %v.", err)
         }
 
@@ -236,12 +310,222 @@ func (server *LaptopServer) RateLaptop(stream pb.LaptopServices_RateLaptopServer
             RatedCount:   rating.Count,
             AverageScote: rating.Sum / float64(rating.Count),
         }
+        server.publish(stream.Context(), laptopID, pb.LaptopEvent_RATED, &pb.LaptopEvent{
+            Detail: &pb.LaptopEvent_Rating{Rating: &pb.LaptopRating{RatedCount: res.RatedCount, AverageScore: res.AverageScote}},
+        })
 
         err = stream.Send(res)
         if err != nil {
-            log.Printf("cannot send the response: %v", err)
+            laptopLog.Warn(stream.Context(), "cannot send the response", "error", err)
             return status.Errorf(codes.Internal, "cannot send the response: %v", err)
         }
     }
     return nil
 }
+
+// WatchLaptops 把便携电脑的变更事件推送给订阅方，直到订阅方断开或者服务端退出
+func (server *LaptopServer) WatchLaptops(req *pb.WatchLaptopsRequest, stream pb.LaptopServices_WatchLaptopsServer) error {
+    laptopLog.Info(stream.Context(), "watch laptops", "filter", req.GetFilter(), "start_revision", req.GetStartRevision())
+
+    err := server.laptopStore.Watch(stream.Context(), req.GetFilter(), req.GetStartRevision(), func(event *pb.LaptopEvent) error {
+        return stream.Send(&pb.WatchLaptopsResponse{Event: event})
+    })
+
+    if contextErr := contextError(stream.Context()); contextErr != nil {
+        return contextErr
+    }
+    switch {
+    case errors.Is(err, ErrCompacted), errors.Is(err, ErrFutureRevision):
+        // 订阅方需要重新搜索便携电脑，再从最新的事件开始订阅
+        laptopLog.Warn(stream.Context(), "cannot resume watch", "error", err)
+        return status.Errorf(codes.OutOfRange, "cannot watch laptops: %v", err)
+    case errors.Is(err, ErrWatchClosed):
+        return status.Error(codes.Unavailable, "server is shutting down, resume the watch on another server")
+    case err != nil:
+        return status.Errorf(codes.Internal, "unexpected error: %v", err)
+    }
+    return nil
+}
+
+// ImportLaptops 批量导入便携电脑，每个便携电脑单独报告结果，不合法或者重复的便携电脑不影响其他便携电脑
+// 试运行时只检查便携电脑，不保存也不生成 ID
+func (server *LaptopServer) ImportLaptops(stream pb.LaptopServices_ImportLaptopsServer) error {
+    res := &pb.ImportLaptopsResponse{Summary: &pb.ImportSummary{}}
+    // seen 本次导入中已经出现的 ID
+    seen := make(map[string]bool)
+
+    for received := 0; ; received++ {
+        if err := contextError(stream.Context()); err != nil {
+            laptopLog.Warn(stream.Context(), "request is done", "error", stream.Context().Err())
+            return err
+        }
+
+        req, err := stream.Recv()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            laptopLog.Warn(stream.Context(), "cannot receive stream data", "error", err)
+            return status.Errorf(codes.Unknown, "cannot receive stream data: %v", err)
+        }
+
+        switch data := req.GetData().(type) {
+        case *pb.ImportLaptopsRequest_Options:
+            if received > 0 {
+                return status.Error(codes.InvalidArgument, "import options must be the first message")
+            }
+            res.DryRun = data.Options.GetDryRun()
+            laptopLog.Info(stream.Context(), "import laptops", "dry_run", res.DryRun)
+        case *pb.ImportLaptopsRequest_Batch:
+            // 超出上限时整个导入失败，之前的批次已经保存的便携电脑不会撤销
+            if int(res.Summary.Total)+len(data.Batch.GetLaptops()) > MaxImportLaptops {
+                laptopLog.Warn(stream.Context(), "too many laptops to import", "max", MaxImportLaptops)
+                return status.Errorf(codes.InvalidArgument, "cannot import more than %d laptops in one request", MaxImportLaptops)
+            }
+            for _, laptop := range data.Batch.GetLaptops() {
+                result, err := server.importLaptop(stream.Context(), laptop, res.DryRun, seen)
+                if err != nil {
+                    return err
+                }
+                result.Index = res.Summary.Total
+                res.Results = append(res.Results, result)
+                res.Summary.Total++
+                switch result.Outcome {
+                case pb.ImportResult_CREATED:
+                    res.Summary.Created++
+                case pb.ImportResult_DUPLICATE:
+                    res.Summary.Duplicate++
+                case pb.ImportResult_INVALID:
+                    res.Summary.Invalid++
+                }
+                if !res.DryRun {
+                    laptopImports.WithLabelValues(strings.ToLower(result.Outcome.String())).Inc()
+                }
+            }
+        }
+    }
+
+    summary := res.Summary
+    laptopLog.Info(stream.Context(), "laptops imported", "dry_run", res.DryRun, "total", summary.Total,
+        "created", summary.Created, "duplicate", summary.Duplicate, "invalid", summary.Invalid)
+
+    if err := stream.SendAndClose(res); err != nil {
+        laptopLog.Warn(stream.Context(), "cannot send the response", "error", err)
+        return status.Errorf(codes.Internal, "cannot send the response: %v", err)
+    }
+    return nil
+}
+
+// importLaptop 导入一个便携电脑，只有存储出错时返回错误并结束导入
+func (server *LaptopServer) importLaptop(ctx context.Context, laptop *pb.Laptop, dryRun bool, seen map[string]bool) (*pb.ImportResult, error) {
+    result := &pb.ImportResult{LaptopId: laptop.GetId()}
+    invalid := func(err error) (*pb.ImportResult, error) {
+        result.Outcome = pb.ImportResult_INVALID
+        result.Error = status.Convert(err).Message()
+        return result, nil
+    }
+
+    if err := Validate(laptop); err != nil {
+        return invalid(err)
+    }
+    if err := assignVendor(ctx, laptop); err != nil {
+        return invalid(err)
+    }
+
+    if laptop.GetId() == "" {
+        result.Outcome = pb.ImportResult_CREATED
+        if dryRun {
+            return result, nil
+        }
+        laptop.Id = uuid.New().String()
+        result.LaptopId = laptop.Id
+    }
+    if seen[laptop.GetId()] {
+        result.Outcome = pb.ImportResult_DUPLICATE
+        result.Error = "laptop appears earlier in the import"
+        return result, nil
+    }
+    seen[laptop.GetId()] = true
+
+    if dryRun {
+        existing, err := server.laptopStore.FindByID(laptop.GetId())
+        if err != nil {
+            return nil, status.Errorf(codes.Internal, "cannot find the laptop: %v", err)
+        }
+        result.Outcome = pb.ImportResult_CREATED
+        if existing != nil {
+            result.Outcome = pb.ImportResult_DUPLICATE
+            result.Error = "laptop already exists"
+        }
+        return result, nil
+    }
+
+    err := server.laptopStore.Save(laptop)
+    if errors.Is(err, ErrAlreadyExists) {
+        result.Outcome = pb.ImportResult_DUPLICATE
+        result.Error = "laptop already exists"
+        return result, nil
+    }
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot save the laptop to store: %v", err)
+    }
+    result.Outcome = pb.ImportResult_CREATED
+    return result, nil
+}
+
+// ExportLaptops 导出符合条件的便携电脑以及它们的评分和图片信息
+// 先从存储中取出所有符合条件的便携电脑再逐个发送，发送较慢时不会长时间占用存储
+func (server *LaptopServer) ExportLaptops(req *pb.ExportLaptopsRequest, stream pb.LaptopServices_ExportLaptopsServer) error {
+    filter := req.GetFilter()
+    laptopLog.Info(stream.Context(), "export laptops", "filter", filter)
+
+    var laptops []*pb.Laptop
+    err := server.laptopStore.Search(stream.Context(), filter, func(laptop *pb.Laptop) error {
+        laptops = append(laptops, laptop)
+        return nil
+    })
+    if err != nil {
+        if contextErr := contextError(stream.Context()); contextErr != nil {
+            return contextErr
+        }
+        return status.Errorf(codes.Internal, "unexpected error: %v", err)
+    }
+
+    for _, laptop := range laptops {
+        res := &pb.ExportLaptopsResponse{Laptop: laptop}
+
+        rating, err := server.ratingStore.Find(laptop.GetId())
+        if err != nil {
+            return status.Errorf(codes.Internal, "cannot find the rating: %v", err)
+        }
+        if rating != nil {
+            res.Rating = &pb.LaptopRating{RatedCount: rating.Count, AverageScore: rating.Sum / float64(rating.Count)}
+        }
+
+        if server.imageStore != nil {
+            images, err := server.imageStore.List(laptop.GetId())
+            if err != nil {
+                return status.Errorf(codes.Internal, "cannot list the images: %v", err)
+            }
+            for _, image := range images {
+                res.Images = append(res.Images, &pb.LaptopImage{Id: image.ID, ImageType: image.Type, Size: uint32(image.Size)})
+            }
+        }
+
+        if err := stream.Send(res); err != nil {
+            if contextErr := contextError(stream.Context()); contextErr != nil {
+                return contextErr
+            }
+            return status.Errorf(codes.Internal, "cannot send the laptop: %v", err)
+        }
+    }
+    laptopLog.Info(stream.Context(), "laptops exported", "count", len(laptops))
+    return nil
+}
+
+// publish 记录一个变更事件，数据已经保存成功，记录失败只写日志不影响请求的结果
+func (server *LaptopServer) publish(ctx context.Context, laptopID string, eventType pb.LaptopEvent_Type, event *pb.LaptopEvent) {
+    if err := server.laptopStore.Publish(laptopID, eventType, event); err != nil {
+        laptopLog.Error(ctx, "cannot publish laptop event", "laptop_id", laptopID, "type", eventType, "error", err)
+    }
+}
@@ -9,6 +9,7 @@ import (
     "github.com/xiusl/pcbook/pb"
     "github.com/xiusl/pcbook/sample"
     "github.com/xiusl/pcbook/service"
+    "google.golang.org/grpc"
     "google.golang.org/grpc/codes"
     "google.golang.org/grpc/status"
 )
@@ -56,6 +57,12 @@ func TestServerCreateLaptop(t *testing.T) {
             store:  storeDuplicateID,
             code:   codes.AlreadyExists,
         },
+        {
+            name:   "failure_nil_laptop",
+            laptop: nil,
+            store:  service.NewInMemoryLaptopStore(),
+            code:   codes.InvalidArgument,
+        },
     }
 
     for _, tc := range testCases {
@@ -88,3 +95,119 @@ func TestServerCreateLaptop(t *testing.T) {
         })
     }
 }
+
+func TestServerLaptopOwnership(t *testing.T) {
+    store := service.NewInMemoryLaptopStore()
+    srv := service.NewLaptopServer(store, nil, nil)
+
+    admin := service.ContextWithPrincipal(context.Background(), &service.Principal{
+        Username: "admin",
+        Roles:    []string{service.RoleAdmin},
+        Admin:    true,
+    })
+    vendor := service.ContextWithPrincipal(context.Background(), &service.Principal{
+        Username: "vendor1",
+        Roles:    []string{service.RoleVendor},
+        Vendor:   "acme",
+    })
+    otherVendor := service.ContextWithPrincipal(context.Background(), &service.Principal{
+        Username: "vendor2",
+        Roles:    []string{service.RoleVendor},
+        Vendor:   "globex",
+    })
+
+    // 厂商创建的便携电脑归属于自己的厂商
+    laptop := sample.NewLaptop()
+    _, err := srv.CreateLaptop(vendor, &pb.CreateLaptopRequest{Laptop: laptop})
+    require.NoError(t, err)
+
+    stored, err := store.FindByID(laptop.Id)
+    require.NoError(t, err)
+    require.Equal(t, "acme", stored.GetVendor())
+
+    // 厂商不能为其他厂商创建便携电脑
+    foreign := sample.NewLaptop()
+    foreign.Vendor = "globex"
+    _, err = srv.CreateLaptop(vendor, &pb.CreateLaptopRequest{Laptop: foreign})
+    require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+    // 其他厂商不能修改
+    stored.PriceUsd = 1
+    _, err = srv.UpdateLaptop(otherVendor, &pb.UpdateLaptopRequest{Laptop: stored})
+    require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+    // 所属厂商和管理员可以修改
+    _, err = srv.UpdateLaptop(vendor, &pb.UpdateLaptopRequest{Laptop: stored})
+    require.NoError(t, err)
+
+    stored.PriceUsd = 2
+    _, err = srv.UpdateLaptop(admin, &pb.UpdateLaptopRequest{Laptop: stored})
+    require.NoError(t, err)
+
+    updated, err := store.FindByID(laptop.Id)
+    require.NoError(t, err)
+    require.Equal(t, float64(2), updated.GetPriceUsd())
+    require.Equal(t, "acme", updated.GetVendor())
+
+    _, err = srv.UpdateLaptop(admin, &pb.UpdateLaptopRequest{Laptop: sample.NewLaptop()})
+    require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// principalAuthenticator 把固定的调用方作为认证结果
+type principalAuthenticator struct {
+    principal *service.Principal
+}
+
+func (authenticator *principalAuthenticator) Authenticate(ctx context.Context) (*service.Principal, error) {
+    return authenticator.principal, nil
+}
+
+func TestServerLaptopOwnershipPolicy(t *testing.T) {
+    policy, err := service.ParseAccessPolicy([]byte(`
+roles:
+  vendor: {}
+  admin:
+    inherits: [vendor]
+    require_mfa: true
+  superadmin:
+    inherits: [admin]
+rules:
+  - methods: ["/xiusl.pcbook.LaptopServices/*"]
+    roles: [vendor]
+`))
+    require.NoError(t, err)
+
+    store := service.NewInMemoryLaptopStore()
+    srv := service.NewLaptopServer(store, nil, nil)
+    foreign := sample.NewLaptop()
+    foreign.Vendor = "globex"
+    require.NoError(t, store.Save(foreign))
+
+    // 通过授权拦截器调用，是否为管理员由策略判定
+    update := func(principal *service.Principal, laptop *pb.Laptop) error {
+        interceptor := service.NewAuthInterceptor(policy, nil, &principalAuthenticator{principal}).Unary()
+        info := &grpc.UnaryServerInfo{FullMethod: "/xiusl.pcbook.LaptopServices/UpdateLaptop"}
+        _, err := interceptor(context.Background(), &pb.UpdateLaptopRequest{Laptop: laptop}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+            return srv.UpdateLaptop(ctx, req.(*pb.UpdateLaptopRequest))
+        })
+        return err
+    }
+
+    // 继承了管理员的角色可以修改任意厂商的便携电脑
+    superadmin := &service.Principal{Username: "root", Roles: []string{"superadmin"}, AuthMethod: service.AuthMethodPasswordTOTP}
+    foreign.PriceUsd = 1
+    require.NoError(t, update(superadmin, foreign))
+
+    // 管理员角色要求两步验证，只通过密码登录时按厂商用户处理
+    vendorAdmin := &service.Principal{Username: "alice", Roles: []string{service.RoleAdmin, service.RoleVendor}, Vendor: "acme", AuthMethod: service.AuthMethodPassword}
+    foreign.PriceUsd = 2
+    require.Equal(t, codes.PermissionDenied, status.Code(update(vendorAdmin, foreign)))
+
+    vendorAdmin.AuthMethod = service.AuthMethodPasswordTOTP
+    require.NoError(t, update(vendorAdmin, foreign))
+
+    stored, err := store.FindByID(foreign.Id)
+    require.NoError(t, err)
+    require.Equal(t, float64(2), stored.GetPriceUsd())
+    require.Equal(t, "globex", stored.GetVendor())
+}
@@ -4,33 +4,51 @@ import (
     "context"
     "errors"
     "fmt"
-    "log"
+    "math"
     "sync"
 
     "github.com/jinzhu/copier"
+    "github.com/xiusl/pcbook/logging"
     "github.com/xiusl/pcbook/pb"
+    "go.opentelemetry.io/otel/attribute"
+    "google.golang.org/protobuf/proto"
 )
 
 // ErrAlreadyExists 错误：对象已经存在
 var ErrAlreadyExists = errors.New("record already exists")
 
+// ErrNotFound 错误：对象不存在
+var ErrNotFound = errors.New("record not found")
+
 // LaptopStore 存储 laptop 的接口
 type LaptopStore interface {
     Save(laptop *pb.Laptop) error
+    Update(laptop *pb.Laptop) error
     FindByID(id string) (*pb.Laptop, error)
     Search(ctx context.Context, filter *pb.Filter, found func(laptop *pb.Laptop) error) error
+    // Publish 记录一个不修改便携电脑数据的变更事件，Save 和 Update 会自动记录事件
+    Publish(laptopID string, eventType pb.LaptopEvent_Type, event *pb.LaptopEvent) error
+    // Watch 从 startRevision 开始把符合条件的变更事件依次交给 found
+    Watch(ctx context.Context, filter *pb.Filter, startRevision uint64, found func(event *pb.LaptopEvent) error) error
 }
 
 // InMemoryLaptopStore 内存存储
 type InMemoryLaptopStore struct {
-    mutex sync.Mutex
-    data  map[string]*pb.Laptop
+    mutex  sync.Mutex
+    data   map[string]*pb.Laptop
+    events *eventLog
 }
 
 // NewInMemoryLaptopStore 创建一个内存存储
 func NewInMemoryLaptopStore() *InMemoryLaptopStore {
+    return NewInMemoryLaptopStoreWithHistory(DefaultEventHistory)
+}
+
+// NewInMemoryLaptopStoreWithHistory 创建一个内存存储，最多保留 history 条变更事件供订阅方断开后继续接收
+func NewInMemoryLaptopStoreWithHistory(history int) *InMemoryLaptopStore {
     return &InMemoryLaptopStore{
-        data: make(map[string]*pb.Laptop),
+        data:   make(map[string]*pb.Laptop),
+        events: newEventLog(history),
     }
 }
 
@@ -49,8 +67,31 @@ func (store *InMemoryLaptopStore) Save(laptop *pb.Laptop) error {
         return fmt.Errorf("connot copy laptop data: %w", err)
     }
     store.data[tmp.Id] = tmp
+    laptopsStored.Inc()
+    store.events.append(pb.LaptopEvent_CREATED, tmp, nil, nil)
 
-    log.Printf("store save success %s.\n", tmp.Id)
+    laptopLog.Debug(context.Background(), "laptop saved", "laptop_id", tmp.Id)
+    return nil
+}
+
+// Update 内存存储，使用新的数据替换已存在的 laptop
+func (store *InMemoryLaptopStore) Update(laptop *pb.Laptop) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    previous := store.data[laptop.Id]
+    if previous == nil {
+        return ErrNotFound
+    }
+
+    tmp, err := deepCopy(laptop)
+    if err != nil {
+        return err
+    }
+    store.data[tmp.Id] = tmp
+    store.events.append(pb.LaptopEvent_UPDATED, tmp, previous, nil)
+
+    laptopLog.Debug(context.Background(), "laptop updated", "laptop_id", tmp.Id)
     return nil
 }
 
@@ -75,17 +116,31 @@ func (store *InMemoryLaptopStore) FindByID(id string) (*pb.Laptop, error) {
 
 // Search 搜索指定的便携电脑
 func (store *InMemoryLaptopStore) Search(ctx context.Context, filter *pb.Filter, found func(laptop *pb.Laptop) error) error {
+    _, span := startSpan(ctx, "LaptopStore.Search")
+    filter = normalizeFilter(filter)
+    scanned := 0
+    defer func() {
+        span.SetAttributes(attribute.Int("laptop.scanned", scanned))
+        span.End()
+    }()
+
     store.mutex.Lock()
     defer store.mutex.Unlock()
 
+    laptopSearches.Inc()
     for _, laptop := range store.data {
 
-        if ctx.Err() == context.Canceled || ctx.Err() == context.DeadlineExceeded {
-            log.Print("context is canceled")
-            return errors.New("context is canceled")
+        if err := ctx.Err(); err != nil {
+            laptopLog.Warn(ctx, "search is canceled", "error", err)
+            return err
         }
 
-        log.Print("check laptop id ", laptop.Id)
+        // 每个便携电脑都会执行，关闭调试日志时不构造参数
+        if laptopLog.Enabled(logging.LevelDebug) {
+            laptopLog.Debug(ctx, "check laptop", "laptop_id", laptop.Id)
+        }
+        laptopSearchScanned.Inc()
+        scanned++
         if isQualified(filter, laptop) {
             other, err := deepCopy(laptop)
             if err != nil {
@@ -100,6 +155,18 @@ func (store *InMemoryLaptopStore) Search(ctx context.Context, filter *pb.Filter,
     return nil
 }
 
+// normalizeFilter 返回搜索、订阅和导出共用的条件，filter 为空时符合所有便携电脑，价格上限为 0 时不限制价格
+func normalizeFilter(filter *pb.Filter) *pb.Filter {
+    if filter == nil {
+        return &pb.Filter{MaxPriceUsd: math.Inf(1)}
+    }
+    if filter.GetMaxPriceUsd() == 0 {
+        filter = proto.Clone(filter).(*pb.Filter)
+        filter.MaxPriceUsd = math.Inf(1)
+    }
+    return filter
+}
+
 func isQualified(filter *pb.Filter, laptop *pb.Laptop) bool {
     if laptop.GetPriceUsd() > filter.MaxPriceUsd {
         return false
@@ -0,0 +1,270 @@
+package service
+
+import (
+    "container/list"
+    "sync"
+    "time"
+)
+
+// LoginLimiterConfig 登录限流的配置
+type LoginLimiterConfig struct {
+    // MaxUserFailures 同一个用户名连续失败多少次后锁定账号
+    MaxUserFailures int `yaml:"max_user_failures"`
+    // MaxPeerFailures 同一个来源 IP 连续失败多少次后锁定该 IP
+    MaxPeerFailures int `yaml:"max_peer_failures"`
+    // BaseDelay 第一次失败后需要等待的时间，之后每次失败翻倍
+    BaseDelay time.Duration `yaml:"base_delay"`
+    // MaxDelay 指数退避的最长等待时间
+    MaxDelay time.Duration `yaml:"max_delay"`
+    // LockoutDuration 锁定的时长，同时也是失败记录的有效期
+    LockoutDuration time.Duration `yaml:"lockout_duration"`
+}
+
+// DefaultLoginLimiterConfig 默认的登录限流配置
+func DefaultLoginLimiterConfig() LoginLimiterConfig {
+    return LoginLimiterConfig{
+        MaxUserFailures: 5,
+        MaxPeerFailures: 20,
+        BaseDelay:       time.Second,
+        MaxDelay:        time.Minute,
+        LockoutDuration: 15 * time.Minute,
+    }
+}
+
+// LoginLimiter 按用户名和来源 IP 记录登录失败次数，进行指数退避和临时锁定
+type LoginLimiter struct {
+    mutex  sync.Mutex
+    config LoginLimiterConfig
+    users  *attemptTable
+    peers  *attemptTable
+}
+
+type loginAttempts struct {
+    failures     int
+    lastFailure  time.Time
+    blockedUntil time.Time
+    locked       bool
+    // pending 已经通过检查但还没有结束的尝试
+    pending int
+}
+
+// maxTrackedAttempts 用户名和来源 IP 各自最多保存的记录数，超过时丢弃最早更新的记录
+const maxTrackedAttempts = 10000
+
+// attemptTable 按最近更新时间排序的尝试记录，记录数有上限，调用方需要持有 LoginLimiter 的锁
+type attemptTable struct {
+    entries map[string]*list.Element
+    // order 最早更新的记录在最前面，元素的值为 *attemptEntry
+    order *list.List
+}
+
+type attemptEntry struct {
+    key      string
+    attempts *loginAttempts
+}
+
+func newAttemptTable() *attemptTable {
+    return &attemptTable{
+        entries: make(map[string]*list.Element),
+        order:   list.New(),
+    }
+}
+
+func (table *attemptTable) get(key string) *loginAttempts {
+    element := table.entries[key]
+    if element == nil {
+        return nil
+    }
+    return element.Value.(*attemptEntry).attempts
+}
+
+// put 保存记录并标记为最近更新，新增记录超过上限时丢弃最早更新的、没有正在进行的尝试的记录
+func (table *attemptTable) put(key string, attempts *loginAttempts) {
+    if element := table.entries[key]; element != nil {
+        element.Value.(*attemptEntry).attempts = attempts
+        table.order.MoveToBack(element)
+        return
+    }
+
+    for element := table.order.Front(); element != nil && len(table.entries) >= maxTrackedAttempts; {
+        next := element.Next()
+        if entry := element.Value.(*attemptEntry); entry.attempts.pending == 0 {
+            table.order.Remove(element)
+            delete(table.entries, entry.key)
+        }
+        element = next
+    }
+    table.entries[key] = table.order.PushBack(&attemptEntry{key: key, attempts: attempts})
+}
+
+func (table *attemptTable) remove(key string) {
+    if element := table.entries[key]; element != nil {
+        table.order.Remove(element)
+        delete(table.entries, key)
+    }
+}
+
+// NewLoginLimiter 创建一个登录限流器
+func NewLoginLimiter(config LoginLimiterConfig) *LoginLimiter {
+    return &LoginLimiter{
+        config: config,
+        users:  newAttemptTable(),
+        peers:  newAttemptTable(),
+    }
+}
+
+// Check 检查是否允许本次登录尝试，返回需要等待的时间（为 0 表示允许）以及是否处于锁定状态。
+// 允许时会为用户名和来源 IP 预留一次尝试，调用方必须在尝试结束后调用 Release
+func (limiter *LoginLimiter) Check(username, peerIP string) (time.Duration, bool) {
+    limiter.mutex.Lock()
+    defer limiter.mutex.Unlock()
+
+    now := time.Now()
+    var retryAfter time.Duration
+    locked := false
+
+    user, peer := limiter.users.get(username), limiter.peers.get(peerIP)
+    for _, attempts := range []*loginAttempts{user, peer} {
+        if attempts == nil || !now.Before(attempts.blockedUntil) {
+            continue
+        }
+        if wait := attempts.blockedUntil.Sub(now); wait > retryAfter {
+            retryAfter = wait
+        }
+        locked = locked || attempts.locked
+    }
+    if retryAfter > 0 {
+        return retryAfter, locked
+    }
+
+    // 正在进行的尝试也计入失败次数，避免并发的猜测绕过退避和锁定
+    if !limiter.available(user, limiter.config.MaxUserFailures, now) ||
+        (peerIP != "" && !limiter.available(peer, limiter.config.MaxPeerFailures, now)) {
+        retryAfter = limiter.config.BaseDelay
+        if retryAfter <= 0 {
+            retryAfter = time.Second
+        }
+        return retryAfter, false
+    }
+
+    limiter.reserve(limiter.users, username)
+    if peerIP != "" {
+        limiter.reserve(limiter.peers, peerIP)
+    }
+    return 0, false
+}
+
+// RecordFailure 记录一次失败的登录
+func (limiter *LoginLimiter) RecordFailure(username, peerIP string) {
+    limiter.mutex.Lock()
+    defer limiter.mutex.Unlock()
+
+    now := time.Now()
+    limiter.recordFailure(limiter.users, username, limiter.config.MaxUserFailures, now)
+    if peerIP != "" {
+        limiter.recordFailure(limiter.peers, peerIP, limiter.config.MaxPeerFailures, now)
+    }
+}
+
+// RecordSuccess 登录成功后清除该用户名的失败记录
+func (limiter *LoginLimiter) RecordSuccess(username string) {
+    limiter.mutex.Lock()
+    defer limiter.mutex.Unlock()
+
+    attempts := limiter.users.get(username)
+    if attempts == nil {
+        return
+    }
+    if attempts.pending == 0 {
+        limiter.users.remove(username)
+        return
+    }
+    limiter.users.put(username, &loginAttempts{pending: attempts.pending})
+}
+
+// Release 结束 Check 预留的尝试
+func (limiter *LoginLimiter) Release(username, peerIP string) {
+    limiter.mutex.Lock()
+    defer limiter.mutex.Unlock()
+
+    limiter.release(limiter.users, username)
+    if peerIP != "" {
+        limiter.release(limiter.peers, peerIP)
+    }
+}
+
+// Unlock 解除账号的锁定，返回账号之前是否有失败记录
+func (limiter *LoginLimiter) Unlock(username string) bool {
+    limiter.mutex.Lock()
+    defer limiter.mutex.Unlock()
+
+    ok := limiter.users.get(username) != nil
+    limiter.users.remove(username)
+    return ok
+}
+
+func (limiter *LoginLimiter) recordFailure(table *attemptTable, key string, maxFailures int, now time.Time) {
+    attempts := table.get(key)
+    expired := attempts != nil && attempts.locked && !now.Before(attempts.blockedUntil)
+    if attempts == nil || expired || now.Sub(attempts.lastFailure) > limiter.config.LockoutDuration {
+        pending := 0
+        if attempts != nil {
+            pending = attempts.pending
+        }
+        attempts = &loginAttempts{pending: pending}
+    }
+    table.put(key, attempts)
+
+    attempts.failures++
+    attempts.lastFailure = now
+
+    if maxFailures > 0 && attempts.failures >= maxFailures {
+        attempts.locked = true
+        attempts.blockedUntil = now.Add(limiter.config.LockoutDuration)
+        return
+    }
+
+    delay := limiter.config.MaxDelay
+    if shift := attempts.failures - 1; shift < 30 {
+        if backoff := limiter.config.BaseDelay << uint(shift); backoff < delay {
+            delay = backoff
+        }
+    }
+    attempts.blockedUntil = now.Add(delay)
+}
+
+// available 判断加上正在进行的尝试后是否还能再尝试一次，已经有失败记录时同一时间只允许一次尝试
+func (limiter *LoginLimiter) available(attempts *loginAttempts, maxFailures int, now time.Time) bool {
+    if attempts == nil {
+        return true
+    }
+    failures := attempts.failures
+    expired := attempts.locked && !now.Before(attempts.blockedUntil)
+    if expired || now.Sub(attempts.lastFailure) > limiter.config.LockoutDuration {
+        failures = 0
+    }
+    if maxFailures > 0 && failures+attempts.pending >= maxFailures {
+        return false
+    }
+    return failures == 0 || attempts.pending == 0
+}
+
+func (limiter *LoginLimiter) reserve(table *attemptTable, key string) {
+    attempts := table.get(key)
+    if attempts == nil {
+        attempts = &loginAttempts{}
+    }
+    attempts.pending++
+    table.put(key, attempts)
+}
+
+func (limiter *LoginLimiter) release(table *attemptTable, key string) {
+    attempts := table.get(key)
+    if attempts == nil || attempts.pending == 0 {
+        return
+    }
+    attempts.pending--
+    if attempts.pending == 0 && attempts.failures == 0 {
+        table.remove(key)
+    }
+}
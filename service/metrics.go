@@ -0,0 +1,195 @@
+package service
+
+import (
+    "context"
+    "net/http"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/status"
+)
+
+// metricsRegistry 服务端所有指标的注册表，通过 MetricsHandler 以 Prometheus 文本格式导出
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+    rpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "pcbook_rpc_requests_total",
+        Help: "Number of RPCs completed on the server, by method and status code.",
+    }, []string{"method", "code"})
+
+    rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+        Name:    "pcbook_rpc_duration_seconds",
+        Help:    "Time taken to complete RPCs on the server, including authorization.",
+        Buckets: prometheus.DefBuckets,
+    }, []string{"method"})
+
+    rpcInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+        Name: "pcbook_rpc_in_flight",
+        Help: "Number of RPCs currently being handled, by method.",
+    }, []string{"method"})
+
+    rpcPanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "pcbook_rpc_panics_total",
+        Help: "Number of panics recovered while handling RPCs, by method.",
+    }, []string{"method"})
+
+    rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "pcbook_rate_limited_total",
+        Help: "Number of RPCs rejected by rate or concurrent stream limits, by method and limit.",
+    }, []string{"method", "limit"})
+
+    laptopsStored = prometheus.NewGauge(prometheus.GaugeOpts{
+        Name: "pcbook_laptops_stored",
+        Help: "Number of laptops in the laptop store.",
+    })
+
+    laptopSearches = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "pcbook_laptop_searches_total",
+        Help: "Number of laptop searches run against the laptop store.",
+    })
+
+    laptopSearchScanned = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "pcbook_laptop_search_scanned_total",
+        Help: "Number of laptops examined by laptop searches.",
+    })
+
+    laptopEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "pcbook_laptop_events_total",
+        Help: "Number of laptop change events recorded for watchers, by type.",
+    }, []string{"type"})
+
+    laptopImports = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "pcbook_laptop_imports_total",
+        Help: "Number of laptops processed by bulk imports, by outcome. Dry runs are not counted.",
+    }, []string{"outcome"})
+
+    ratingWrites = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "pcbook_rating_writes_total",
+        Help: "Number of laptop scores written to the rating store.",
+    })
+
+    imageUploadBytes = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "pcbook_image_upload_bytes_total",
+        Help: "Number of image bytes saved by UploadImage.",
+    })
+
+    imageUploadSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+        Name:    "pcbook_image_upload_size_bytes",
+        Help:    "Size of images saved by UploadImage.",
+        Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+    })
+
+    alertDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "pcbook_alert_deliveries_total",
+        Help: "Number of alert notifications delivered or dropped, by channel and outcome.",
+    }, []string{"channel", "outcome"})
+
+    webhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "pcbook_webhook_deliveries_total",
+        Help: "Number of webhook delivery attempts, by outcome.",
+    }, []string{"outcome"})
+
+    tokenVerificationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "pcbook_token_verification_failures_total",
+        Help: "Number of rejected credentials, by authenticator.",
+    }, []string{"authenticator"})
+)
+
+func init() {
+    metricsRegistry.MustRegister(
+        prometheus.NewGoCollector(),
+        prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+        rpcRequests,
+        rpcDuration,
+        rpcInFlight,
+        rpcPanics,
+        rateLimited,
+        laptopsStored,
+        laptopSearches,
+        laptopSearchScanned,
+        laptopEvents,
+        laptopImports,
+        ratingWrites,
+        imageUploadBytes,
+        imageUploadSize,
+        alertDeliveries,
+        webhookDeliveries,
+        tokenVerificationFailures,
+    )
+}
+
+// MetricsHandler 以 Prometheus 文本格式导出指标的 HTTP 处理函数
+func MetricsHandler() http.Handler {
+    return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// MetricsInterceptor 记录 RPC 请求数、耗时和进行中请求数的拦截器
+// 需要放在授权拦截器之前，被拒绝的请求也会按照状态码计数
+type MetricsInterceptor struct{}
+
+// NewMetricsInterceptor 新建一个指标拦截器
+func NewMetricsInterceptor() *MetricsInterceptor {
+    return &MetricsInterceptor{}
+}
+
+// Unary 一元 RPC 指标拦截器
+func (interceptor *MetricsInterceptor) Unary() grpc.UnaryServerInterceptor {
+    return func(
+        ctx context.Context,
+        req interface{},
+        info *grpc.UnaryServerInfo,
+        handler grpc.UnaryHandler,
+    ) (interface{}, error) {
+        done := observeRPC(info.FullMethod)
+        res, err := handler(ctx, req)
+        done(err)
+        return res, err
+    }
+}
+
+// Stream 流式 RPC 指标拦截器，耗时为整个流的持续时间
+func (interceptor *MetricsInterceptor) Stream() grpc.StreamServerInterceptor {
+    return func(
+        srv interface{},
+        ss grpc.ServerStream,
+        info *grpc.StreamServerInfo,
+        handler grpc.StreamHandler,
+    ) error {
+        done := observeRPC(info.FullMethod)
+        err := handler(srv, ss)
+        done(err)
+        return err
+    }
+}
+
+// observeRPC 记录 RPC 开始，返回在 RPC 结束时调用的函数
+func observeRPC(method string) func(err error) {
+    start := time.Now()
+    inFlight := rpcInFlight.WithLabelValues(method)
+    inFlight.Inc()
+
+    return func(err error) {
+        inFlight.Dec()
+        rpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+        rpcRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+    }
+}
+
+// authenticatorName 指标中认证方式的名称
+func authenticatorName(authenticator Authenticator) string {
+    switch authenticator.(type) {
+    case *JWTManager:
+        return "jwt"
+    case *OIDCAuthenticator:
+        return "oidc"
+    case *APIKeyAuthenticator:
+        return "api_key"
+    case *CertIdentityMapper:
+        return "certificate"
+    default:
+        return "other"
+    }
+}
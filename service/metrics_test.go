@@ -0,0 +1,137 @@
+package service_test
+
+import (
+    "context"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    dto "github.com/prometheus/client_model/go"
+    "github.com/prometheus/common/expfmt"
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/sample"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+)
+
+// scrapeMetrics 抓取并解析 /metrics 的输出
+func scrapeMetrics(t *testing.T) map[string]*dto.MetricFamily {
+    server := httptest.NewServer(service.MetricsHandler())
+    defer server.Close()
+
+    res, err := http.Get(server.URL)
+    require.NoError(t, err)
+    defer res.Body.Close()
+    require.Equal(t, http.StatusOK, res.StatusCode)
+
+    var parser expfmt.TextParser
+    families, err := parser.TextToMetricFamilies(res.Body)
+    require.NoError(t, err)
+    return families
+}
+
+// metricValue 返回标签完全匹配的计数器、仪表或者直方图样本数的值
+func metricValue(families map[string]*dto.MetricFamily, name string, labels map[string]string) float64 {
+    family := families[name]
+    if family == nil {
+        return 0
+    }
+
+    for _, metric := range family.GetMetric() {
+        if len(metric.GetLabel()) != len(labels) {
+            continue
+        }
+        matched := true
+        for _, label := range metric.GetLabel() {
+            if labels[label.GetName()] != label.GetValue() {
+                matched = false
+            }
+        }
+        if !matched {
+            continue
+        }
+
+        switch family.GetType() {
+        case dto.MetricType_COUNTER:
+            return metric.GetCounter().GetValue()
+        case dto.MetricType_GAUGE:
+            return metric.GetGauge().GetValue()
+        case dto.MetricType_HISTOGRAM:
+            return float64(metric.GetHistogram().GetSampleCount())
+        }
+    }
+    return 0
+}
+
+func TestMetrics(t *testing.T) {
+    jwtManager := service.NewJWTManager("secret", time.Minute)
+    policy, err := service.ParseAccessPolicy([]byte(testPolicy))
+    require.NoError(t, err)
+
+    auth := service.NewAuthInterceptor(policy, nil, jwtManager)
+    metrics := service.NewMetricsInterceptor()
+    grpcServer := grpc.NewServer(
+        grpc.ChainUnaryInterceptor(metrics.Unary(), auth.Unary()),
+        grpc.ChainStreamInterceptor(metrics.Stream(), auth.Stream()),
+    )
+    laptopServer := service.NewLaptopServer(service.NewInMemoryLaptopStore(), nil, service.NewInMemoryRatingStore())
+    pb.RegisterLaptopServicesServer(grpcServer, laptopServer)
+
+    listener, err := net.Listen("tcp", ":0")
+    require.NoError(t, err)
+    go grpcServer.Serve(listener)
+    defer grpcServer.Stop()
+
+    conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+    require.NoError(t, err)
+    defer conn.Close()
+    laptopClient := pb.NewLaptopServicesClient(conn)
+
+    const createLaptop = "/xiusl.pcbook.LaptopServices/CreateLaptop"
+    const rateLaptop = "/xiusl.pcbook.LaptopServices/RateLaptop"
+    before := scrapeMetrics(t)
+
+    admin, err := service.NewUser("admin", "secret", "admin")
+    require.NoError(t, err)
+    token, err := jwtManager.Generate(admin, service.AuthMethodPassword)
+    require.NoError(t, err)
+    ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", token)
+
+    laptop := sample.NewLaptop()
+    _, err = laptopClient.CreateLaptop(ctx, &pb.CreateLaptopRequest{Laptop: laptop})
+    require.NoError(t, err)
+
+    invalid := metadata.AppendToOutgoingContext(context.Background(), "authorization", "invalid")
+    _, err = laptopClient.CreateLaptop(invalid, &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+    require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+    stream, err := laptopClient.RateLaptop(ctx)
+    require.NoError(t, err)
+    require.NoError(t, stream.Send(&pb.RateLaptopRequest{LaptopId: laptop.GetId(), Score: 8}))
+    _, err = stream.Recv()
+    require.NoError(t, err)
+    require.NoError(t, stream.CloseSend())
+    _, err = stream.Recv()
+    require.Error(t, err)
+
+    after := scrapeMetrics(t)
+    delta := func(name string, labels map[string]string) float64 {
+        return metricValue(after, name, labels) - metricValue(before, name, labels)
+    }
+
+    require.Equal(t, 1.0, delta("pcbook_rpc_requests_total", map[string]string{"method": createLaptop, "code": "OK"}))
+    require.Equal(t, 1.0, delta("pcbook_rpc_requests_total", map[string]string{"method": createLaptop, "code": "Unauthenticated"}))
+    require.Equal(t, 1.0, delta("pcbook_rpc_requests_total", map[string]string{"method": rateLaptop, "code": "OK"}))
+    require.Equal(t, 2.0, delta("pcbook_rpc_duration_seconds", map[string]string{"method": createLaptop}))
+    require.Equal(t, 0.0, metricValue(after, "pcbook_rpc_in_flight", map[string]string{"method": createLaptop}))
+    require.Equal(t, 1.0, delta("pcbook_laptops_stored", nil))
+    require.Equal(t, 1.0, delta("pcbook_rating_writes_total", nil))
+    require.Equal(t, 1.0, delta("pcbook_token_verification_failures_total", map[string]string{"authenticator": "jwt"}))
+    require.NotNil(t, after["go_goroutines"])
+}
@@ -0,0 +1,353 @@
+package service
+
+import (
+    "context"
+    "crypto/rsa"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "math/big"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/dgrijalva/jwt-go"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+    "gopkg.in/yaml.v3"
+)
+
+const (
+    // oidcJWKSMaxAge 超过这个时间后重新获取签名公钥，以便跟上身份提供方的密钥轮换
+    oidcJWKSMaxAge = time.Hour
+    // oidcJWKSMinRefreshInterval 遇到未知 kid 时最多按这个频率重新获取公钥，避免伪造的令牌打满身份提供方
+    oidcJWKSMinRefreshInterval = 30 * time.Second
+    // oidcHTTPTimeout 访问身份提供方的超时时间
+    oidcHTTPTimeout = 10 * time.Second
+)
+
+// OIDCConfig 接入公司 SSO 的 OIDC 配置
+type OIDCConfig struct {
+    // Issuer 身份提供方地址，必须与令牌中的 iss 完全一致
+    Issuer string `yaml:"issuer"`
+    // Audience 令牌的 aud 中必须包含这个值，通常是 SSO 中注册的 client id
+    Audience string `yaml:"audience"`
+    // UsernameClaim 作为用户名的 claim，默认为 sub
+    UsernameClaim string `yaml:"username_claim"`
+    // GroupsClaim 用户所属分组的 claim，默认为 groups
+    GroupsClaim string `yaml:"groups_claim"`
+    // VendorClaim 用户所属厂商的 claim，可以不设置
+    VendorClaim string `yaml:"vendor_claim"`
+    // GroupRoles SSO 分组到 pcbook 角色的映射
+    GroupRoles map[string]string `yaml:"group_roles"`
+}
+
+// LoadOIDCConfig 从 YAML/JSON 文件中加载 OIDC 配置
+func LoadOIDCConfig(filename string) (*OIDCConfig, error) {
+    data, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return nil, fmt.Errorf("cannot read oidc config file: %w", err)
+    }
+
+    config := &OIDCConfig{}
+    if err := yaml.Unmarshal(data, config); err != nil {
+        return nil, fmt.Errorf("cannot parse oidc config file: %w", err)
+    }
+    return config, nil
+}
+
+// OIDCAuthenticator 验证公司 SSO 签发的 OIDC 令牌并映射为调用方身份
+type OIDCAuthenticator struct {
+    config     OIDCConfig
+    httpClient *http.Client
+    jwksURI    string
+
+    mutex       sync.Mutex
+    keys        map[string]*rsa.PublicKey
+    lastRefresh time.Time
+}
+
+type oidcDiscovery struct {
+    Issuer  string `json:"issuer"`
+    JWKSURI string `json:"jwks_uri"`
+}
+
+type jsonWebKeySet struct {
+    Keys []jsonWebKey `json:"keys"`
+}
+
+type jsonWebKey struct {
+    Kty string `json:"kty"`
+    Kid string `json:"kid"`
+    Use string `json:"use"`
+    N   string `json:"n"`
+    E   string `json:"e"`
+}
+
+// NewOIDCAuthenticator 通过 issuer 的 discovery 文档找到 JWKS 并获取签名公钥
+// httpClient 为 nil 时使用默认的客户端
+func NewOIDCAuthenticator(config OIDCConfig, httpClient *http.Client) (*OIDCAuthenticator, error) {
+    if config.Issuer == "" {
+        return nil, fmt.Errorf("oidc issuer is required")
+    }
+    if config.Audience == "" {
+        return nil, fmt.Errorf("oidc audience is required")
+    }
+    if len(config.GroupRoles) == 0 {
+        return nil, fmt.Errorf("oidc group_roles is required")
+    }
+    if config.UsernameClaim == "" {
+        config.UsernameClaim = "sub"
+    }
+    if config.GroupsClaim == "" {
+        config.GroupsClaim = "groups"
+    }
+    if httpClient == nil {
+        httpClient = &http.Client{Timeout: oidcHTTPTimeout}
+    }
+
+    authenticator := &OIDCAuthenticator{
+        config:     config,
+        httpClient: httpClient,
+    }
+
+    discovery := &oidcDiscovery{}
+    discoveryURL := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+    if err := authenticator.getJSON(discoveryURL, discovery); err != nil {
+        return nil, fmt.Errorf("cannot discover oidc provider: %w", err)
+    }
+    if discovery.Issuer != config.Issuer {
+        return nil, fmt.Errorf("oidc discovery issuer %q does not match %q", discovery.Issuer, config.Issuer)
+    }
+    if discovery.JWKSURI == "" {
+        return nil, fmt.Errorf("oidc discovery document has no jwks_uri")
+    }
+    authenticator.jwksURI = discovery.JWKSURI
+
+    if err := authenticator.refreshKeys(); err != nil {
+        return nil, err
+    }
+    return authenticator, nil
+}
+
+// Authenticate 验证请求元数据中 authorization 的 OIDC 令牌
+// 令牌不是由配置的 issuer 签发时返回 nil, nil，交给其他认证方式处理
+func (authenticator *OIDCAuthenticator) Authenticate(ctx context.Context) (*Principal, error) {
+    md, ok := metadata.FromIncomingContext(ctx)
+    if !ok {
+        return nil, nil
+    }
+
+    values := md["authorization"]
+    if len(values) == 0 {
+        return nil, nil
+    }
+
+    tokenString := values[0]
+    if len(tokenString) > 7 && strings.EqualFold(tokenString[:7], "bearer ") {
+        tokenString = tokenString[7:]
+    }
+
+    // 签名验证之前只用 iss 判断令牌是否由 SSO 签发
+    unverified := jwt.MapClaims{}
+    if _, _, err := new(jwt.Parser).ParseUnverified(tokenString, unverified); err != nil {
+        return nil, nil
+    }
+    if issuer, _ := unverified["iss"].(string); issuer != authenticator.config.Issuer {
+        return nil, nil
+    }
+
+    claims := jwt.MapClaims{}
+    _, err := jwt.ParseWithClaims(tokenString, claims, authenticator.keyFunc)
+    if err != nil {
+        return nil, status.Errorf(codes.Unauthenticated, "oidc token is invalid: %v", err)
+    }
+
+    // MapClaims 只在 exp 存在时检查，SSO 的令牌必须有过期时间
+    if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+        return nil, status.Errorf(codes.Unauthenticated, "oidc token is expired")
+    }
+    if !authenticator.hasAudience(claims) {
+        return nil, status.Errorf(codes.Unauthenticated, "oidc token is not issued for this service")
+    }
+
+    username, _ := claims[authenticator.config.UsernameClaim].(string)
+    if username == "" {
+        return nil, status.Errorf(codes.Unauthenticated, "oidc token has no %s claim", authenticator.config.UsernameClaim)
+    }
+
+    roles := authenticator.mapRoles(claims)
+    if len(roles) == 0 {
+        return nil, status.Errorf(codes.PermissionDenied, "%s is not in any group mapped to a pcbook role", username)
+    }
+
+    principal := &Principal{
+        Username:   username,
+        Roles:      roles,
+        AuthMethod: AuthMethodOIDC,
+    }
+    if authenticator.config.VendorClaim != "" {
+        principal.Vendor, _ = claims[authenticator.config.VendorClaim].(string)
+    }
+    if hasMFA(claims) {
+        principal.AuthMethod = AuthMethodOIDCMFA
+    }
+    return principal, nil
+}
+
+// keyFunc 根据令牌头中的 kid 查找签名公钥，只接受 RSA 签名
+func (authenticator *OIDCAuthenticator) keyFunc(token *jwt.Token) (interface{}, error) {
+    if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+        return nil, fmt.Errorf("unexpected token signing method %v", token.Header["alg"])
+    }
+
+    kid, _ := token.Header["kid"].(string)
+    key, ok := authenticator.key(kid)
+    if !ok {
+        return nil, fmt.Errorf("unknown signing key %q", kid)
+    }
+    return key, nil
+}
+
+// key 查找签名公钥，未知的 kid 或者公钥过期时重新获取 JWKS
+func (authenticator *OIDCAuthenticator) key(kid string) (*rsa.PublicKey, bool) {
+    authenticator.mutex.Lock()
+    key, ok := authenticator.keys[kid]
+    sinceRefresh := time.Since(authenticator.lastRefresh)
+    authenticator.mutex.Unlock()
+
+    stale := sinceRefresh > oidcJWKSMaxAge
+    if (ok && !stale) || sinceRefresh < oidcJWKSMinRefreshInterval {
+        return key, ok
+    }
+
+    if err := authenticator.refreshKeys(); err != nil {
+        // 身份提供方暂时不可用时继续使用已有的公钥
+        return key, ok
+    }
+
+    authenticator.mutex.Lock()
+    defer authenticator.mutex.Unlock()
+    key, ok = authenticator.keys[kid]
+    return key, ok
+}
+
+// refreshKeys 重新获取 JWKS 中的 RSA 签名公钥
+func (authenticator *OIDCAuthenticator) refreshKeys() error {
+    authenticator.mutex.Lock()
+    authenticator.lastRefresh = time.Now()
+    authenticator.mutex.Unlock()
+
+    set := &jsonWebKeySet{}
+    if err := authenticator.getJSON(authenticator.jwksURI, set); err != nil {
+        return fmt.Errorf("cannot fetch oidc jwks: %w", err)
+    }
+
+    keys := make(map[string]*rsa.PublicKey)
+    for _, jwk := range set.Keys {
+        if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+            continue
+        }
+        key, err := jwk.rsaPublicKey()
+        if err != nil {
+            return fmt.Errorf("invalid oidc jwk %q: %w", jwk.Kid, err)
+        }
+        keys[jwk.Kid] = key
+    }
+    if len(keys) == 0 {
+        return fmt.Errorf("oidc jwks has no rsa signing keys")
+    }
+
+    authenticator.mutex.Lock()
+    authenticator.keys = keys
+    authenticator.mutex.Unlock()
+    return nil
+}
+
+func (authenticator *OIDCAuthenticator) getJSON(url string, v interface{}) error {
+    res, err := authenticator.httpClient.Get(url)
+    if err != nil {
+        return err
+    }
+    defer res.Body.Close()
+
+    if res.StatusCode != http.StatusOK {
+        return fmt.Errorf("GET %s: unexpected status %s", url, res.Status)
+    }
+    return json.NewDecoder(res.Body).Decode(v)
+}
+
+// hasAudience aud 可以是字符串也可以是字符串数组
+func (authenticator *OIDCAuthenticator) hasAudience(claims jwt.MapClaims) bool {
+    for _, aud := range stringsClaim(claims["aud"]) {
+        if aud == authenticator.config.Audience {
+            return true
+        }
+    }
+    return false
+}
+
+// mapRoles 将令牌中的分组映射为 pcbook 角色，没有映射的分组忽略
+func (authenticator *OIDCAuthenticator) mapRoles(claims jwt.MapClaims) []string {
+    var roles []string
+    seen := make(map[string]bool)
+    for _, group := range stringsClaim(claims[authenticator.config.GroupsClaim]) {
+        role, ok := authenticator.config.GroupRoles[group]
+        if !ok || seen[role] {
+            continue
+        }
+        seen[role] = true
+        roles = append(roles, role)
+    }
+    return roles
+}
+
+// hasMFA 根据 amr 判断 SSO 登录时是否通过了多因素认证（RFC 8176）
+func hasMFA(claims jwt.MapClaims) bool {
+    for _, method := range stringsClaim(claims["amr"]) {
+        switch method {
+        case "mfa", "otp", "hwk", "swk":
+            return true
+        }
+    }
+    return false
+}
+
+func stringsClaim(value interface{}) []string {
+    switch v := value.(type) {
+    case string:
+        return []string{v}
+    case []interface{}:
+        values := make([]string, 0, len(v))
+        for _, item := range v {
+            if s, ok := item.(string); ok {
+                values = append(values, s)
+            }
+        }
+        return values
+    }
+    return nil
+}
+
+func (jwk *jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+    n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+    if err != nil {
+        return nil, fmt.Errorf("invalid modulus: %w", err)
+    }
+    e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+    if err != nil {
+        return nil, fmt.Errorf("invalid exponent: %w", err)
+    }
+    if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+        return nil, fmt.Errorf("invalid rsa key size")
+    }
+
+    key := &rsa.PublicKey{
+        N: new(big.Int).SetBytes(n),
+        E: int(new(big.Int).SetBytes(e).Int64()),
+    }
+    return key, nil
+}
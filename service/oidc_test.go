@@ -0,0 +1,189 @@
+package service_test
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/rsa"
+    "encoding/base64"
+    "encoding/json"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/dgrijalva/jwt-go"
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+)
+
+// fakeOIDCProvider 进程内的 OIDC 身份提供方，提供 discovery 文档和 JWKS
+type fakeOIDCProvider struct {
+    *httptest.Server
+    key *rsa.PrivateKey
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    require.NoError(t, err)
+
+    provider := &fakeOIDCProvider{key: key}
+    mux := http.NewServeMux()
+    mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(map[string]string{
+            "issuer":   provider.URL,
+            "jwks_uri": provider.URL + "/keys",
+        })
+    })
+    mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "keys": []map[string]string{{
+                "kty": "RSA",
+                "kid": "key1",
+                "use": "sig",
+                "n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+                "e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+            }},
+        })
+    })
+    provider.Server = httptest.NewServer(mux)
+    t.Cleanup(provider.Close)
+    return provider
+}
+
+func (provider *fakeOIDCProvider) sign(t *testing.T, key *rsa.PrivateKey, claims jwt.MapClaims) string {
+    token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+    token.Header["kid"] = "key1"
+    signed, err := token.SignedString(key)
+    require.NoError(t, err)
+    return signed
+}
+
+func authorizationContext(token string) context.Context {
+    return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", token))
+}
+
+func TestOIDCAuthenticate(t *testing.T) {
+    provider := newFakeOIDCProvider(t)
+
+    authenticator, err := service.NewOIDCAuthenticator(service.OIDCConfig{
+        Issuer:      provider.URL,
+        Audience:    "pcbook",
+        VendorClaim: "vendor",
+        GroupRoles: map[string]string{
+            "pcbook-admins":  "admin",
+            "pcbook-vendors": "vendor",
+        },
+    }, provider.Client())
+    require.NoError(t, err)
+
+    claims := func(overrides jwt.MapClaims) jwt.MapClaims {
+        claims := jwt.MapClaims{
+            "iss":    provider.URL,
+            "aud":    []string{"other", "pcbook"},
+            "sub":    "alice",
+            "exp":    time.Now().Add(time.Minute).Unix(),
+            "groups": []string{"everyone", "pcbook-vendors"},
+            "vendor": "acme",
+        }
+        for name, value := range overrides {
+            if value == nil {
+                delete(claims, name)
+                continue
+            }
+            claims[name] = value
+        }
+        return claims
+    }
+
+    token := provider.sign(t, provider.key, claims(nil))
+    principal, err := authenticator.Authenticate(authorizationContext("Bearer " + token))
+    require.NoError(t, err)
+    require.Equal(t, "alice", principal.Username)
+    require.Equal(t, []string{"vendor"}, principal.Roles)
+    require.Equal(t, "acme", principal.Vendor)
+    require.Equal(t, service.AuthMethodOIDC, principal.AuthMethod)
+
+    token = provider.sign(t, provider.key, claims(jwt.MapClaims{"amr": []string{"pwd", "otp"}}))
+    principal, err = authenticator.Authenticate(authorizationContext(token))
+    require.NoError(t, err)
+    require.Equal(t, service.AuthMethodOIDCMFA, principal.AuthMethod)
+
+    otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    require.NoError(t, err)
+
+    testCases := []struct {
+        name  string
+        token string
+        code  codes.Code
+    }{
+        {
+            name:  "wrong_audience",
+            token: provider.sign(t, provider.key, claims(jwt.MapClaims{"aud": "other"})),
+            code:  codes.Unauthenticated,
+        },
+        {
+            name:  "expired",
+            token: provider.sign(t, provider.key, claims(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})),
+            code:  codes.Unauthenticated,
+        },
+        {
+            name:  "no_expiry",
+            token: provider.sign(t, provider.key, claims(jwt.MapClaims{"exp": nil})),
+            code:  codes.Unauthenticated,
+        },
+        {
+            name:  "wrong_key",
+            token: provider.sign(t, otherKey, claims(nil)),
+            code:  codes.Unauthenticated,
+        },
+        {
+            name:  "no_mapped_group",
+            token: provider.sign(t, provider.key, claims(jwt.MapClaims{"groups": []string{"everyone"}})),
+            code:  codes.PermissionDenied,
+        },
+        {
+            name: "hmac_with_issuer",
+            token: func() string {
+                token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims(nil))
+                signed, err := token.SignedString([]byte("secret"))
+                require.NoError(t, err)
+                return signed
+            }(),
+            code: codes.Unauthenticated,
+        },
+    }
+
+    for _, tc := range testCases {
+        t.Run(tc.name, func(t *testing.T) {
+            principal, err := authenticator.Authenticate(authorizationContext(tc.token))
+            require.Nil(t, principal)
+            require.Equal(t, tc.code, status.Code(err))
+        })
+    }
+
+    // 其他 issuer 签发的令牌交给 JWTManager 等认证方式处理
+    jwtManager := service.NewJWTManager("secret", time.Minute)
+    user, err := service.NewUser("bob", "secret", "user")
+    require.NoError(t, err)
+    localToken, err := jwtManager.Generate(user, service.AuthMethodPassword)
+    require.NoError(t, err)
+
+    principal, err = authenticator.Authenticate(authorizationContext(localToken))
+    require.NoError(t, err)
+    require.Nil(t, principal)
+}
+
+func TestOIDCDiscoveryError(t *testing.T) {
+    provider := newFakeOIDCProvider(t)
+
+    _, err := service.NewOIDCAuthenticator(service.OIDCConfig{
+        Issuer:     provider.URL + "/other",
+        Audience:   "pcbook",
+        GroupRoles: map[string]string{"pcbook-admins": "admin"},
+    }, provider.Client())
+    require.Error(t, err)
+}
@@ -0,0 +1,43 @@
+package service
+
+import (
+    "context"
+
+    "github.com/xiusl/pcbook/pb"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+// assignVendor 根据调用方身份设置便携电脑所属的厂商
+// 管理员可以指定任意厂商，厂商用户只能创建属于自己厂商的便携电脑，是否为管理员由授权拦截器按策略判定
+// 上下文中没有调用方身份（未启用授权拦截器）时保持原样
+func assignVendor(ctx context.Context, laptop *pb.Laptop) error {
+    principal, ok := PrincipalFromContext(ctx)
+    if !ok || principal.Admin {
+        return nil
+    }
+
+    if principal.Vendor == "" {
+        return status.Errorf(codes.PermissionDenied, "user %s does not belong to any vendor", principal.Username)
+    }
+    if laptop.GetVendor() != "" && laptop.GetVendor() != principal.Vendor {
+        return status.Errorf(codes.PermissionDenied, "cannot assign laptop to vendor %s", laptop.GetVendor())
+    }
+
+    laptop.Vendor = principal.Vendor
+    return nil
+}
+
+// checkOwnership 检查调用方是否可以修改该便携电脑
+// 管理员可以修改所有便携电脑，其他用户只能修改自己厂商的便携电脑
+func checkOwnership(ctx context.Context, laptop *pb.Laptop) error {
+    principal, ok := PrincipalFromContext(ctx)
+    if !ok || principal.Admin {
+        return nil
+    }
+
+    if principal.Vendor == "" || principal.Vendor != laptop.GetVendor() {
+        return status.Errorf(codes.PermissionDenied, "laptop %s does not belong to your vendor", laptop.GetId())
+    }
+    return nil
+}
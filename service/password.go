@@ -0,0 +1,310 @@
+package service
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/rand"
+    "crypto/subtle"
+    _ "embed"
+    "encoding/base64"
+    "fmt"
+    "math"
+    "runtime"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "unicode"
+    "unicode/utf8"
+
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/bcrypt"
+)
+
+// PasswordPolicy 设置和修改密码时的强度要求
+type PasswordPolicy struct {
+    // MinLength 最少字符数
+    MinLength int `yaml:"min_length"`
+    // MaxLength 最多字符数，避免超长密码消耗过多的哈希计算
+    MaxLength int `yaml:"max_length"`
+    // MinCharacterClasses 至少包含小写字母、大写字母、数字、符号中的几类
+    MinCharacterClasses int `yaml:"min_character_classes"`
+    // Denylist 是否拒绝常见的弱密码
+    Denylist bool `yaml:"denylist"`
+}
+
+// DefaultPasswordPolicy 默认的密码强度要求
+func DefaultPasswordPolicy() PasswordPolicy {
+    return PasswordPolicy{
+        MinLength:           10,
+        MaxLength:           128,
+        MinCharacterClasses: 3,
+        Denylist:            true,
+    }
+}
+
+//go:embed common_passwords.txt
+var commonPasswordsFile []byte
+
+// commonPasswords 编译进程序的常见弱密码，全部为小写
+var commonPasswords = func() map[string]bool {
+    passwords := make(map[string]bool)
+    scanner := bufio.NewScanner(bytes.NewReader(commonPasswordsFile))
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line != "" && !strings.HasPrefix(line, "#") {
+            passwords[strings.ToLower(line)] = true
+        }
+    }
+    return passwords
+}()
+
+// Validate 检查密码是否满足强度要求，返回的错误信息可以直接展示给用户
+func (policy PasswordPolicy) Validate(username, password string) error {
+    length := utf8.RuneCountInString(password)
+    if length < policy.MinLength {
+        return fmt.Errorf("password must be at least %d characters", policy.MinLength)
+    }
+    if policy.MaxLength > 0 && length > policy.MaxLength {
+        return fmt.Errorf("password must be at most %d characters", policy.MaxLength)
+    }
+
+    if classes := characterClasses(password); classes < policy.MinCharacterClasses {
+        return fmt.Errorf(
+            "password must contain at least %d of lowercase letters, uppercase letters, digits and symbols",
+            policy.MinCharacterClasses,
+        )
+    }
+
+    if policy.Denylist {
+        lower := strings.ToLower(password)
+        if commonPasswords[lower] {
+            return fmt.Errorf("password is too common")
+        }
+        if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+            return fmt.Errorf("password must not contain the username")
+        }
+    }
+    return nil
+}
+
+func characterClasses(password string) int {
+    var lower, upper, digit, symbol int
+    for _, r := range password {
+        switch {
+        case unicode.IsLower(r):
+            lower = 1
+        case unicode.IsUpper(r):
+            upper = 1
+        case unicode.IsDigit(r):
+            digit = 1
+        default:
+            symbol = 1
+        }
+    }
+    return lower + upper + digit + symbol
+}
+
+// Argon2Params argon2id 哈希参数
+type Argon2Params struct {
+    Memory      uint32
+    Iterations  uint32
+    Parallelism uint8
+    SaltLength  uint32
+    KeyLength   uint32
+}
+
+// defaultArgon2Params 默认的哈希参数（RFC 9106 推荐的 64 MiB 配置）
+var defaultArgon2Params = Argon2Params{
+    Memory:      64 * 1024,
+    Iterations:  3,
+    Parallelism: 4,
+    SaltLength:  16,
+    KeyLength:   32,
+}
+
+// PasswordHashConfig 新密码的 argon2id 参数和同时进行的哈希计算数量
+// 以更弱的参数或者 bcrypt 保存的密码会在下次登录时重新哈希
+type PasswordHashConfig struct {
+    // MemoryKiB 每次哈希使用的内存，单位为 KiB
+    MemoryKiB int `yaml:"memory_kib"`
+    // Iterations 迭代次数
+    Iterations int `yaml:"iterations"`
+    // Parallelism 每次哈希使用的线程数
+    Parallelism int `yaml:"parallelism"`
+    // MaxConcurrent 同时进行的哈希计算数量，超过时排队等待，避免并发登录耗尽内存
+    MaxConcurrent int `yaml:"max_concurrent"`
+}
+
+// DefaultPasswordHashConfig 默认的密码哈希配置，同时进行的哈希计算数量与 CPU 数量相同
+func DefaultPasswordHashConfig() PasswordHashConfig {
+    return PasswordHashConfig{
+        MemoryKiB:     int(defaultArgon2Params.Memory),
+        Iterations:    int(defaultArgon2Params.Iterations),
+        Parallelism:   int(defaultArgon2Params.Parallelism),
+        MaxConcurrent: runtime.NumCPU(),
+    }
+}
+
+// Validate 检查配置是否合法
+func (config PasswordHashConfig) Validate() error {
+    if config.Parallelism < 1 || config.Parallelism > math.MaxUint8 {
+        return fmt.Errorf("parallelism must be between 1 and %d", math.MaxUint8)
+    }
+    if config.MemoryKiB < 8*config.Parallelism || config.MemoryKiB > math.MaxUint32 {
+        return fmt.Errorf("memory_kib must be at least 8 times parallelism")
+    }
+    if config.Iterations < 1 || config.Iterations > math.MaxUint32 {
+        return fmt.Errorf("iterations must be positive")
+    }
+    if config.MaxConcurrent < 1 {
+        return fmt.Errorf("max_concurrent must be positive")
+    }
+    return nil
+}
+
+// Params 返回配置对应的哈希参数
+func (config PasswordHashConfig) Params() Argon2Params {
+    return Argon2Params{
+        Memory:      uint32(config.MemoryKiB),
+        Iterations:  uint32(config.Iterations),
+        Parallelism: uint8(config.Parallelism),
+        SaltLength:  defaultArgon2Params.SaltLength,
+        KeyLength:   defaultArgon2Params.KeyLength,
+    }
+}
+
+// passwordHasher 新密码的哈希参数，以及限制同时进行的哈希计算的信号量
+type passwordHasher struct {
+    params    Argon2Params
+    slots     chan struct{}
+    dummyOnce sync.Once
+    dummyHash string
+}
+
+// currentPasswordHasher 保存 *passwordHasher，由 ConfigurePasswordHashing 替换
+var currentPasswordHasher atomic.Value
+
+func init() {
+    currentPasswordHasher.Store(newPasswordHasher(DefaultPasswordHashConfig()))
+}
+
+func newPasswordHasher(config PasswordHashConfig) *passwordHasher {
+    return &passwordHasher{
+        params: config.Params(),
+        slots:  make(chan struct{}, config.MaxConcurrent),
+    }
+}
+
+// ConfigurePasswordHashing 设置新密码的哈希参数和同时进行的哈希计算数量，需要在创建用户和处理请求之前调用
+func ConfigurePasswordHashing(config PasswordHashConfig) error {
+    if err := config.Validate(); err != nil {
+        return err
+    }
+    currentPasswordHasher.Store(newPasswordHasher(config))
+    return nil
+}
+
+func loadPasswordHasher() *passwordHasher {
+    return currentPasswordHasher.Load().(*passwordHasher)
+}
+
+// acquire 等待空闲的哈希计算名额，返回释放名额的函数
+func (hasher *passwordHasher) acquire() func() {
+    hasher.slots <- struct{}{}
+    return func() { <-hasher.slots }
+}
+
+// currentArgon2Params 新密码使用的哈希参数
+func currentArgon2Params() Argon2Params {
+    return loadPasswordHasher().params
+}
+
+// dummyPasswordHash 用户不存在时也进行一次哈希比较，避免通过响应时间判断用户名是否存在
+func dummyPasswordHash() string {
+    hasher := loadPasswordHasher()
+    hasher.dummyOnce.Do(func() {
+        hasher.dummyHash, _ = HashPassword("pcbook-dummy-password", hasher.params)
+    })
+    return hasher.dummyHash
+}
+
+// HashPassword 使用 argon2id 哈希密码，返回 PHC 格式的字符串
+func HashPassword(password string, params Argon2Params) (string, error) {
+    salt := make([]byte, params.SaltLength)
+    if _, err := rand.Read(salt); err != nil {
+        return "", fmt.Errorf("cannot generate salt: %w", err)
+    }
+
+    release := loadPasswordHasher().acquire()
+    key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+    release()
+    encoded := fmt.Sprintf(
+        "$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+        argon2.Version,
+        params.Memory,
+        params.Iterations,
+        params.Parallelism,
+        base64.RawStdEncoding.EncodeToString(salt),
+        base64.RawStdEncoding.EncodeToString(key),
+    )
+    return encoded, nil
+}
+
+// ComparePassword 验证密码与哈希是否匹配，支持 argon2id 和旧的 bcrypt 哈希
+func ComparePassword(hashedPassword, password string) bool {
+    release := loadPasswordHasher().acquire()
+    defer release()
+
+    if !strings.HasPrefix(hashedPassword, "$argon2id$") {
+        return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)) == nil
+    }
+
+    params, salt, key, err := decodeArgon2Hash(hashedPassword)
+    if err != nil {
+        return false
+    }
+    other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+    return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// PasswordNeedsRehash 判断哈希是否使用了比 params 更弱的算法或者参数
+func PasswordNeedsRehash(hashedPassword string, params Argon2Params) bool {
+    current, _, _, err := decodeArgon2Hash(hashedPassword)
+    if err != nil {
+        return true
+    }
+    return current.Memory < params.Memory ||
+        current.Iterations < params.Iterations ||
+        current.Parallelism < params.Parallelism ||
+        current.KeyLength < params.KeyLength
+}
+
+func decodeArgon2Hash(hashedPassword string) (Argon2Params, []byte, []byte, error) {
+    var params Argon2Params
+
+    parts := strings.Split(hashedPassword, "$")
+    if len(parts) != 6 || parts[1] != "argon2id" {
+        return params, nil, nil, fmt.Errorf("not an argon2id hash")
+    }
+
+    var version int
+    if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+        return params, nil, nil, fmt.Errorf("unsupported argon2 version")
+    }
+    if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+        return params, nil, nil, fmt.Errorf("invalid argon2 parameters: %w", err)
+    }
+
+    salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+    if err != nil {
+        return params, nil, nil, fmt.Errorf("invalid argon2 salt: %w", err)
+    }
+    key, err := base64.RawStdEncoding.DecodeString(parts[5])
+    if err != nil {
+        return params, nil, nil, fmt.Errorf("invalid argon2 key: %w", err)
+    }
+
+    params.SaltLength = uint32(len(salt))
+    params.KeyLength = uint32(len(key))
+    return params, salt, key, nil
+}
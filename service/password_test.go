@@ -0,0 +1,184 @@
+package service_test
+
+import (
+    "context"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/service"
+    "golang.org/x/crypto/bcrypt"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+    policy := service.DefaultPasswordPolicy()
+
+    testCases := []struct {
+        name     string
+        password string
+        valid    bool
+    }{
+        {"empty", "", false},
+        {"too_short", "Ab1-x", false},
+        {"too_long", strings.Repeat("Ab1-", 40), false},
+        {"two_classes", "abcdefghij123", false},
+        {"common", "Password123!", false},
+        {"contains_username", "Alice-2021-pc", false},
+        {"valid", "Book-Keeper-42", true},
+        {"valid_unicode", "笔记本电脑-Pc-2021", true},
+    }
+
+    for _, tc := range testCases {
+        t.Run(tc.name, func(t *testing.T) {
+            err := policy.Validate("alice", tc.password)
+            if tc.valid {
+                require.NoError(t, err)
+            } else {
+                require.Error(t, err)
+            }
+        })
+    }
+
+    // 放宽要求时仍然拒绝内置的常见密码
+    policy = service.PasswordPolicy{MinLength: 4, Denylist: true}
+    require.Error(t, policy.Validate("alice", "qwerty"))
+    require.NoError(t, policy.Validate("alice", "qwertz"))
+}
+
+func TestPasswordHash(t *testing.T) {
+    weak := service.Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+    hashed, err := service.HashPassword("Book-Keeper-42", weak)
+    require.NoError(t, err)
+    require.True(t, strings.HasPrefix(hashed, "$argon2id$v=19$m=1024,t=1,p=1$"))
+    require.True(t, service.ComparePassword(hashed, "Book-Keeper-42"))
+    require.False(t, service.ComparePassword(hashed, "Book-Keeper-43"))
+
+    require.True(t, service.PasswordNeedsRehash(hashed, service.DefaultPasswordHashConfig().Params()))
+    require.False(t, service.PasswordNeedsRehash(hashed, weak))
+
+    legacy, err := bcrypt.GenerateFromPassword([]byte("Book-Keeper-42"), bcrypt.MinCost)
+    require.NoError(t, err)
+    require.True(t, service.ComparePassword(string(legacy), "Book-Keeper-42"))
+    require.True(t, service.PasswordNeedsRehash(string(legacy), weak))
+
+    _, err = service.NewUser("alice", "", "user")
+    require.Error(t, err)
+}
+
+func TestServerLoginRehash(t *testing.T) {
+    legacy, err := bcrypt.GenerateFromPassword([]byte("Book-Keeper-42"), bcrypt.MinCost)
+    require.NoError(t, err)
+
+    userStore := service.NewInMemoryUserStore()
+    require.NoError(t, userStore.Save(&service.User{Username: "alice", HashedPassword: string(legacy), Role: "user"}))
+
+    jwtManager := service.NewJWTManager("secret", time.Minute)
+    srv := service.NewAuthServer(userStore, jwtManager, nil, nil, service.DefaultPasswordPolicy())
+
+    _, err = srv.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "Book-Keeper-42"})
+    require.NoError(t, err)
+
+    // 登录成功后 bcrypt 哈希升级为 argon2id
+    user, err := userStore.Find("alice")
+    require.NoError(t, err)
+    require.True(t, strings.HasPrefix(user.HashedPassword, "$argon2id$"))
+    require.False(t, user.PasswordNeedsRehash())
+
+    _, err = srv.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "Book-Keeper-42"})
+    require.NoError(t, err)
+}
+
+func TestServerChangePassword(t *testing.T) {
+    userStore := service.NewInMemoryUserStore()
+    user, err := service.NewUser("alice", "Book-Keeper-42", "user")
+    require.NoError(t, err)
+    require.NoError(t, userStore.Save(user))
+
+    jwtManager := service.NewJWTManager("secret", time.Minute)
+    srv := service.NewAuthServer(userStore, jwtManager, nil, nil, service.DefaultPasswordPolicy())
+    ctx := service.ContextWithPrincipal(context.Background(), &service.Principal{
+        Username:   "alice",
+        Roles:      []string{"user"},
+        AuthMethod: service.AuthMethodPassword,
+    })
+
+    testCases := []struct {
+        name     string
+        current  string
+        password string
+        code     codes.Code
+    }{
+        {"wrong_current", "Book-Keeper-41", "Shelf-Reader-17", codes.PermissionDenied},
+        {"weak", "Book-Keeper-42", "password", codes.InvalidArgument},
+        {"unchanged", "Book-Keeper-42", "Book-Keeper-42", codes.InvalidArgument},
+        {"ok", "Book-Keeper-42", "Shelf-Reader-17", codes.OK},
+    }
+
+    for _, tc := range testCases {
+        t.Run(tc.name, func(t *testing.T) {
+            _, err := srv.ChangePassword(ctx, &pb.ChangePasswordRequest{
+                CurrentPassword: tc.current,
+                NewPassword:     tc.password,
+            })
+            require.Equal(t, tc.code, status.Code(err))
+        })
+    }
+
+    _, err = srv.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "Book-Keeper-42"})
+    require.Equal(t, codes.Unauthenticated, status.Code(err))
+    _, err = srv.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "Shelf-Reader-17"})
+    require.NoError(t, err)
+}
+
+func TestConfigurePasswordHashing(t *testing.T) {
+    t.Cleanup(func() {
+        require.NoError(t, service.ConfigurePasswordHashing(service.DefaultPasswordHashConfig()))
+    })
+
+    invalid := service.DefaultPasswordHashConfig()
+    invalid.MaxConcurrent = 0
+    require.Error(t, service.ConfigurePasswordHashing(invalid))
+    invalid = service.PasswordHashConfig{MemoryKiB: 16, Iterations: 1, Parallelism: 4, MaxConcurrent: 1}
+    require.Error(t, service.ConfigurePasswordHashing(invalid))
+
+    // 新密码使用配置的参数，按配置的参数保存的哈希不需要升级
+    weak := service.PasswordHashConfig{MemoryKiB: 1024, Iterations: 1, Parallelism: 1, MaxConcurrent: 1}
+    require.NoError(t, service.ConfigurePasswordHashing(weak))
+    user, err := service.NewUser("alice", "Book-Keeper-42", "user")
+    require.NoError(t, err)
+    require.True(t, strings.HasPrefix(user.HashedPassword, "$argon2id$v=19$m=1024,t=1,p=1$"))
+    require.False(t, user.PasswordNeedsRehash())
+    require.True(t, user.IsCorrentPassword("Book-Keeper-42"))
+}
+
+func TestUserStoreReplacePasswordHash(t *testing.T) {
+    userStore := service.NewInMemoryUserStore()
+    require.NoError(t, userStore.Save(&service.User{Username: "alice", HashedPassword: "old", Role: "user"}))
+
+    // 升级哈希时只替换哈希，不覆盖同时开启的两步验证
+    user, err := userStore.Find("alice")
+    require.NoError(t, err)
+    user.TOTPEnabled = true
+    require.NoError(t, userStore.Update(user))
+
+    replaced, err := userStore.ReplacePasswordHash("alice", "old", "new")
+    require.NoError(t, err)
+    require.True(t, replaced)
+    user, err = userStore.Find("alice")
+    require.NoError(t, err)
+    require.Equal(t, "new", user.HashedPassword)
+    require.True(t, user.TOTPEnabled)
+
+    // 密码已经被修改时不再替换
+    replaced, err = userStore.ReplacePasswordHash("alice", "old", "newer")
+    require.NoError(t, err)
+    require.False(t, replaced)
+
+    _, err = userStore.ReplacePasswordHash("bob", "old", "new")
+    require.ErrorIs(t, err, service.ErrNotFound)
+}
@@ -0,0 +1,72 @@
+package service
+
+import "context"
+
+const (
+    // RoleAdmin 管理员，可以访问和修改所有资源
+    RoleAdmin = "admin"
+    // RoleVendor 厂商，只能修改自己厂商的资源
+    RoleVendor = "vendor"
+)
+
+const (
+    // AuthMethodPassword 只通过密码登录
+    AuthMethodPassword = "password"
+    // AuthMethodPasswordTOTP 通过密码和 TOTP 两步验证登录
+    AuthMethodPasswordTOTP = "password+totp"
+    // AuthMethodAPIKey 服务账号的 API key
+    AuthMethodAPIKey = "api_key"
+    // AuthMethodCertificate 客户端证书
+    AuthMethodCertificate = "certificate"
+    // AuthMethodOIDC 公司 SSO 签发的 OIDC 令牌
+    AuthMethodOIDC = "oidc"
+    // AuthMethodOIDCMFA 公司 SSO 签发的 OIDC 令牌，并且登录时通过了多因素认证
+    AuthMethodOIDCMFA = "oidc+mfa"
+)
+
+// Principal 通过认证的调用方身份
+type Principal struct {
+    Username string
+    Roles    []string
+    Vendor   string
+    // AuthMethod 调用方的认证方式
+    AuthMethod string
+    // APIKeyID 通过 API key 认证时 key 的 ID
+    APIKeyID string
+    // Admin 授权拦截器按策略判定调用方拥有管理员权限，包括继承了管理员的角色，不满足两步验证要求的角色不算
+    Admin bool
+}
+
+// SingleFactor 判断调用方是否只通过单一因素（密码）登录
+func (principal *Principal) SingleFactor() bool {
+    return principal.AuthMethod == AuthMethodPassword || principal.AuthMethod == AuthMethodOIDC
+}
+
+// HasRole 判断调用方是否直接拥有指定角色
+func (principal *Principal) HasRole(role string) bool {
+    for _, owned := range principal.Roles {
+        if owned == role {
+            return true
+        }
+    }
+    return false
+}
+
+type principalKey struct{}
+
+// ContextWithPrincipal 将调用方身份保存到上下文中
+func ContextWithPrincipal(ctx context.Context, principal *Principal) context.Context {
+    return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext 从上下文中获取调用方身份
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+    principal, ok := ctx.Value(principalKey{}).(*Principal)
+    return principal, ok
+}
+
+// Authenticator 从请求上下文中识别调用方身份
+// 请求中没有该认证方式的凭证时返回 nil, nil，凭证无效时返回 Unauthenticated 错误
+type Authenticator interface {
+    Authenticate(ctx context.Context) (*Principal, error)
+}
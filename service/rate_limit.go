@@ -0,0 +1,315 @@
+package service
+
+import (
+    "context"
+    "fmt"
+    "math"
+    "path"
+    "sync"
+    "time"
+
+    "github.com/xiusl/pcbook/logging"
+    "google.golang.org/genproto/googleapis/rpc/errdetails"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/types/known/durationpb"
+)
+
+// rateLimitLog 限流相关的日志
+var rateLimitLog = logging.New("ratelimit")
+
+// streamRetryDelay 并发流已满时建议调用方等待的时间
+const streamRetryDelay = time.Second
+
+// RateLimit 一组限流参数
+type RateLimit struct {
+    // Rate 每秒补充的令牌数，为 0 时不限制请求频率
+    Rate float64 `yaml:"rate"`
+    // Burst 令牌桶的容量，即允许的突发请求数
+    Burst int `yaml:"burst"`
+    // MaxStreams 同一个调用方对该方法同时打开的流的上限，为 0 时不限制，只对流式方法生效
+    MaxStreams int `yaml:"max_streams"`
+}
+
+// MethodRateLimit 单独配置限流参数的方法，方法支持通配符，例如 /xiusl.pcbook.LaptopServices/*
+type MethodRateLimit struct {
+    Method    string `yaml:"method"`
+    RateLimit `yaml:",inline"`
+}
+
+// RateLimitConfig 按方法配置的限流参数
+// 调用方按 API key、用户名、来源 IP 的顺序识别，每个调用方在每个方法上有独立的令牌桶
+type RateLimitConfig struct {
+    // Default 没有单独配置的方法使用的限流参数
+    Default RateLimit `yaml:"default"`
+    // Methods 按顺序匹配，第一条匹配的配置生效
+    Methods []MethodRateLimit `yaml:"methods"`
+}
+
+// DefaultRateLimitConfig 默认的限流配置，搜索、上传图片和批量导入导出的流比一元请求更昂贵，限制更严格
+func DefaultRateLimitConfig() RateLimitConfig {
+    return RateLimitConfig{
+        Default: RateLimit{Rate: 50, Burst: 100},
+        Methods: []MethodRateLimit{
+            {Method: "/xiusl.pcbook.LaptopServices/SearchLaptop", RateLimit: RateLimit{Rate: 5, Burst: 10, MaxStreams: 2}},
+            {Method: "/xiusl.pcbook.LaptopServices/UploadImage", RateLimit: RateLimit{Rate: 1, Burst: 5, MaxStreams: 2}},
+            {Method: "/xiusl.pcbook.LaptopServices/RateLaptop", RateLimit: RateLimit{Rate: 5, Burst: 10, MaxStreams: 4}},
+            {Method: "/xiusl.pcbook.LaptopServices/WatchLaptops", RateLimit: RateLimit{Rate: 1, Burst: 5, MaxStreams: 4}},
+            {Method: "/xiusl.pcbook.LaptopServices/ImportLaptops", RateLimit: RateLimit{Rate: 1, Burst: 5, MaxStreams: 1}},
+            {Method: "/xiusl.pcbook.LaptopServices/ExportLaptops", RateLimit: RateLimit{Rate: 1, Burst: 5, MaxStreams: 1}},
+            {Method: "/xiusl.pcbook.AlertService/SubscribeAlerts", RateLimit: RateLimit{Rate: 1, Burst: 5, MaxStreams: 2}},
+        },
+    }
+}
+
+// Validate 检查限流配置
+func (config RateLimitConfig) Validate() error {
+    limits := append([]MethodRateLimit{{Method: "default", RateLimit: config.Default}}, config.Methods...)
+    for _, limit := range limits {
+        if limit.Method != "default" {
+            if _, err := path.Match(limit.Method, ""); err != nil || len(limit.Method) == 0 || limit.Method[0] != '/' {
+                return fmt.Errorf("invalid method pattern %q", limit.Method)
+            }
+        }
+        if limit.Rate < 0 || math.IsNaN(limit.Rate) || math.IsInf(limit.Rate, 0) {
+            return fmt.Errorf("%s: rate must not be negative", limit.Method)
+        }
+        if limit.Rate > 0 && limit.Burst < 1 {
+            return fmt.Errorf("%s: burst must be at least 1", limit.Method)
+        }
+        if limit.MaxStreams < 0 {
+            return fmt.Errorf("%s: max_streams must not be negative", limit.Method)
+        }
+    }
+    return nil
+}
+
+// limitFor 返回方法对应的限流参数
+func (config RateLimitConfig) limitFor(method string) RateLimit {
+    for _, limit := range config.Methods {
+        if ok, _ := path.Match(limit.Method, method); ok {
+            return limit.RateLimit
+        }
+    }
+    return config.Default
+}
+
+// RateLimiter 限流状态的存储，进程内的实现是 InMemoryRateLimiter，多个实例共享限额时可以换成共享的后端
+type RateLimiter interface {
+    // Take 从 key 对应的令牌桶中取一个令牌，返回需要等待的时间，为 0 表示允许
+    Take(ctx context.Context, key string, rate float64, burst int) (time.Duration, error)
+    // Acquire 占用 key 的一个并发名额，已经占满时返回 false，成功时需要在结束后调用 Release
+    Acquire(ctx context.Context, key string, max int) (bool, error)
+    // Release 释放 Acquire 占用的名额
+    Release(ctx context.Context, key string) error
+}
+
+// InMemoryRateLimiter 在内存中保存令牌桶和并发数的限流器
+type InMemoryRateLimiter struct {
+    mutex   sync.Mutex
+    buckets map[string]*tokenBucket
+    streams map[string]int
+}
+
+type tokenBucket struct {
+    tokens float64
+    rate   float64
+    burst  float64
+    last   time.Time
+}
+
+// maxTrackedBuckets 令牌桶数量超过这个值时清理已经补满的令牌桶
+const maxTrackedBuckets = 10000
+
+// NewInMemoryRateLimiter 创建一个内存限流器
+func NewInMemoryRateLimiter() *InMemoryRateLimiter {
+    return &InMemoryRateLimiter{
+        buckets: make(map[string]*tokenBucket),
+        streams: make(map[string]int),
+    }
+}
+
+// Take 从 key 对应的令牌桶中取一个令牌，返回需要等待的时间，为 0 表示允许
+func (limiter *InMemoryRateLimiter) Take(ctx context.Context, key string, rate float64, burst int) (time.Duration, error) {
+    limiter.mutex.Lock()
+    defer limiter.mutex.Unlock()
+
+    now := time.Now()
+    bucket := limiter.buckets[key]
+    if bucket == nil {
+        if len(limiter.buckets) >= maxTrackedBuckets {
+            limiter.prune(now)
+        }
+        bucket = &tokenBucket{tokens: float64(burst), last: now}
+        limiter.buckets[key] = bucket
+    }
+    bucket.rate = rate
+    bucket.burst = float64(burst)
+    bucket.refill(now)
+
+    if bucket.tokens >= 1 {
+        bucket.tokens--
+        return 0, nil
+    }
+    wait := time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+    return wait, nil
+}
+
+// Acquire 占用 key 的一个并发名额，已经占满时返回 false
+func (limiter *InMemoryRateLimiter) Acquire(ctx context.Context, key string, max int) (bool, error) {
+    limiter.mutex.Lock()
+    defer limiter.mutex.Unlock()
+
+    if limiter.streams[key] >= max {
+        return false, nil
+    }
+    limiter.streams[key]++
+    return true, nil
+}
+
+// Release 释放 Acquire 占用的名额
+func (limiter *InMemoryRateLimiter) Release(ctx context.Context, key string) error {
+    limiter.mutex.Lock()
+    defer limiter.mutex.Unlock()
+
+    if limiter.streams[key] <= 1 {
+        delete(limiter.streams, key)
+        return nil
+    }
+    limiter.streams[key]--
+    return nil
+}
+
+// refill 按照经过的时间补充令牌，不超过令牌桶的容量
+func (bucket *tokenBucket) refill(now time.Time) {
+    if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+        bucket.tokens = math.Min(bucket.burst, bucket.tokens+elapsed*bucket.rate)
+    }
+    bucket.last = now
+}
+
+// prune 清理已经补满的令牌桶，补满的令牌桶和新建的令牌桶没有区别
+func (limiter *InMemoryRateLimiter) prune(now time.Time) {
+    for key, bucket := range limiter.buckets {
+        bucket.refill(now)
+        if bucket.tokens >= bucket.burst {
+            delete(limiter.buckets, key)
+        }
+    }
+}
+
+// RateLimitInterceptor 按调用方和方法限制请求频率和并发流数量的拦截器
+// 限流后端出错时放行请求并记录日志，不因为限流后端不可用而拒绝服务
+type RateLimitInterceptor struct {
+    limiter RateLimiter
+    config  RateLimitConfig
+}
+
+// NewRateLimitInterceptor 新建一个限流拦截器，需要放在授权拦截器之后，才能按认证的调用方限流
+func NewRateLimitInterceptor(limiter RateLimiter, config RateLimitConfig) *RateLimitInterceptor {
+    return &RateLimitInterceptor{
+        limiter: limiter,
+        config:  config,
+    }
+}
+
+// Unary 一元 RPC 限流拦截器
+func (interceptor *RateLimitInterceptor) Unary() grpc.UnaryServerInterceptor {
+    return func(
+        ctx context.Context,
+        req interface{},
+        info *grpc.UnaryServerInfo,
+        handler grpc.UnaryHandler,
+    ) (interface{}, error) {
+        key := rateLimitKey(ctx, info.FullMethod)
+        if err := interceptor.take(ctx, info.FullMethod, key); err != nil {
+            return nil, err
+        }
+        return handler(ctx, req)
+    }
+}
+
+// Stream 流式 RPC 限流拦截器，打开流时取一个令牌，并在流结束前占用一个并发名额
+func (interceptor *RateLimitInterceptor) Stream() grpc.StreamServerInterceptor {
+    return func(
+        srv interface{},
+        ss grpc.ServerStream,
+        info *grpc.StreamServerInfo,
+        handler grpc.StreamHandler,
+    ) error {
+        ctx := ss.Context()
+        key := rateLimitKey(ctx, info.FullMethod)
+        if err := interceptor.take(ctx, info.FullMethod, key); err != nil {
+            return err
+        }
+
+        if maxStreams := interceptor.config.limitFor(info.FullMethod).MaxStreams; maxStreams > 0 {
+            ok, err := interceptor.limiter.Acquire(ctx, key, maxStreams)
+            switch {
+            case err != nil:
+                rateLimitLog.Error(ctx, "cannot acquire stream", "method", info.FullMethod, "error", err)
+            case !ok:
+                rateLimited.WithLabelValues(info.FullMethod, "streams").Inc()
+                rateLimitLog.Warn(ctx, "too many concurrent streams", "key", key, "max_streams", maxStreams)
+                return resourceExhaustedError(fmt.Sprintf("too many concurrent streams, at most %d are allowed", maxStreams), streamRetryDelay)
+            default:
+                defer func() {
+                    // 流结束时上下文可能已经取消，释放名额不能依赖它
+                    if err := interceptor.limiter.Release(context.Background(), key); err != nil {
+                        rateLimitLog.Error(ctx, "cannot release stream", "method", info.FullMethod, "error", err)
+                    }
+                }()
+            }
+        }
+        return handler(srv, ss)
+    }
+}
+
+// take 为本次请求取一个令牌，超过频率限制时返回 ResourceExhausted 错误
+func (interceptor *RateLimitInterceptor) take(ctx context.Context, method string, key string) error {
+    limit := interceptor.config.limitFor(method)
+    if limit.Rate <= 0 {
+        return nil
+    }
+
+    retryAfter, err := interceptor.limiter.Take(ctx, key, limit.Rate, limit.Burst)
+    if err != nil {
+        rateLimitLog.Error(ctx, "cannot check rate limit", "method", method, "error", err)
+        return nil
+    }
+    if retryAfter > 0 {
+        rateLimited.WithLabelValues(method, "rate").Inc()
+        rateLimitLog.Warn(ctx, "rate limit exceeded", "key", key, "retry_after", retryAfter)
+        return resourceExhaustedError("rate limit exceeded, retry later", retryAfter)
+    }
+    return nil
+}
+
+// rateLimitKey 限流的键，每个调用方在每个方法上有独立的令牌桶
+func rateLimitKey(ctx context.Context, method string) string {
+    return callerID(ctx) + " " + method
+}
+
+// callerID 按 API key、用户名、来源 IP 的顺序识别调用方
+func callerID(ctx context.Context) string {
+    if principal, ok := PrincipalFromContext(ctx); ok {
+        if principal.APIKeyID != "" {
+            return "api_key:" + principal.APIKeyID
+        }
+        return "user:" + principal.Username
+    }
+    return "peer:" + peerIPFromContext(ctx)
+}
+
+// resourceExhaustedError 返回带有重试时间的 ResourceExhausted 错误
+func resourceExhaustedError(message string, retryAfter time.Duration) error {
+    st := status.New(codes.ResourceExhausted, message)
+    detailed, err := st.WithDetails(&errdetails.RetryInfo{
+        RetryDelay: durationpb.New(retryAfter),
+    })
+    if err != nil {
+        return st.Err()
+    }
+    return detailed.Err()
+}
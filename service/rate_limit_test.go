@@ -0,0 +1,168 @@
+package service_test
+
+import (
+    "context"
+    "net"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/peer"
+    "google.golang.org/grpc/status"
+)
+
+// exhaustedRetryDelay 检查错误是 ResourceExhausted，返回详情中的重试时间
+func exhaustedRetryDelay(t *testing.T, err error) time.Duration {
+    require.Equal(t, codes.ResourceExhausted, status.Code(err), err)
+    return retryDelay(t, err)
+}
+
+func TestInMemoryRateLimiter(t *testing.T) {
+    limiter := service.NewInMemoryRateLimiter()
+    ctx := context.Background()
+
+    // 令牌桶开始时是满的，取完后按照速率补充
+    for i := 0; i < 2; i++ {
+        wait, err := limiter.Take(ctx, "alice", 20, 2)
+        require.NoError(t, err)
+        require.Zero(t, wait)
+    }
+    wait, err := limiter.Take(ctx, "alice", 20, 2)
+    require.NoError(t, err)
+    require.True(t, wait > 0 && wait <= 50*time.Millisecond, wait)
+
+    // 其他调用方有独立的令牌桶
+    wait, err = limiter.Take(ctx, "bob", 20, 2)
+    require.NoError(t, err)
+    require.Zero(t, wait)
+
+    // 每秒 20 个令牌，60ms 后至少补充了一个
+    time.Sleep(60 * time.Millisecond)
+    wait, err = limiter.Take(ctx, "alice", 20, 2)
+    require.NoError(t, err)
+    require.Zero(t, wait)
+
+    // 并发名额释放后可以再次占用
+    for i := 0; i < 2; i++ {
+        ok, err := limiter.Acquire(ctx, "alice", 2)
+        require.NoError(t, err)
+        require.True(t, ok)
+    }
+    ok, err := limiter.Acquire(ctx, "alice", 2)
+    require.NoError(t, err)
+    require.False(t, ok)
+
+    require.NoError(t, limiter.Release(ctx, "alice"))
+    ok, err = limiter.Acquire(ctx, "alice", 2)
+    require.NoError(t, err)
+    require.True(t, ok)
+}
+
+func TestRateLimitInterceptorUnary(t *testing.T) {
+    config := service.RateLimitConfig{
+        Default: service.RateLimit{Rate: 1, Burst: 2},
+        Methods: []service.MethodRateLimit{
+            {Method: "/xiusl.pcbook.AuthService/*", RateLimit: service.RateLimit{Rate: 1, Burst: 1}},
+            {Method: "/xiusl.pcbook.AuditService/*"},
+        },
+    }
+    unary := service.NewRateLimitInterceptor(service.NewInMemoryRateLimiter(), config).Unary()
+    handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+        return "ok", nil
+    }
+    call := func(ctx context.Context, method string) error {
+        _, err := unary(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+        return err
+    }
+
+    alice := service.ContextWithPrincipal(context.Background(), &service.Principal{Username: "alice"})
+    bob := service.ContextWithPrincipal(context.Background(), &service.Principal{Username: "bob"})
+    apiKey := service.ContextWithPrincipal(context.Background(), &service.Principal{Username: "alice", APIKeyID: "key-1"})
+    anonymous := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}})
+
+    const createLaptop = "/xiusl.pcbook.LaptopServices/CreateLaptop"
+    require.NoError(t, call(alice, createLaptop))
+    require.NoError(t, call(alice, createLaptop))
+    delay := exhaustedRetryDelay(t, call(alice, createLaptop))
+    require.True(t, delay > 0 && delay <= time.Second, delay)
+
+    // 限额按调用方和方法分开计算，API key 和同名用户互不影响
+    require.NoError(t, call(bob, createLaptop))
+    require.NoError(t, call(apiKey, createLaptop))
+    require.NoError(t, call(alice, "/xiusl.pcbook.LaptopServices/UpdateLaptop"))
+
+    // 匹配到的第一条配置生效
+    require.NoError(t, call(anonymous, "/xiusl.pcbook.AuthService/Login"))
+    exhaustedRetryDelay(t, call(anonymous, "/xiusl.pcbook.AuthService/Login"))
+
+    // rate 为 0 时不限制
+    for i := 0; i < 5; i++ {
+        require.NoError(t, call(alice, "/xiusl.pcbook.AuditService/QueryAuditLog"))
+    }
+}
+
+// fakeServerStream 只提供上下文的服务端流
+type fakeServerStream struct {
+    grpc.ServerStream
+    ctx context.Context
+}
+
+func (stream *fakeServerStream) Context() context.Context {
+    return stream.ctx
+}
+
+func TestRateLimitInterceptorStreams(t *testing.T) {
+    config := service.RateLimitConfig{
+        Default: service.RateLimit{MaxStreams: 1},
+    }
+    stream := service.NewRateLimitInterceptor(service.NewInMemoryRateLimiter(), config).Stream()
+    info := &grpc.StreamServerInfo{FullMethod: "/xiusl.pcbook.LaptopServices/SearchLaptop"}
+    alice := &fakeServerStream{ctx: service.ContextWithPrincipal(context.Background(), &service.Principal{Username: "alice"})}
+    bob := &fakeServerStream{ctx: service.ContextWithPrincipal(context.Background(), &service.Principal{Username: "bob"})}
+
+    started := make(chan struct{})
+    finish := make(chan struct{})
+    done := make(chan error)
+    go func() {
+        done <- stream(nil, alice, info, func(srv interface{}, ss grpc.ServerStream) error {
+            close(started)
+            <-finish
+            return nil
+        })
+    }()
+    <-started
+
+    noop := func(srv interface{}, ss grpc.ServerStream) error { return nil }
+    require.Equal(t, time.Second, exhaustedRetryDelay(t, stream(nil, alice, info, noop)))
+    require.NoError(t, stream(nil, bob, info, noop))
+
+    // 第一个流结束后释放名额
+    close(finish)
+    require.NoError(t, <-done)
+    require.NoError(t, stream(nil, alice, info, noop))
+}
+
+func TestRateLimitConfigValidate(t *testing.T) {
+    require.NoError(t, service.DefaultRateLimitConfig().Validate())
+
+    testCases := []struct {
+        name   string
+        config service.RateLimitConfig
+    }{
+        {"negative rate", service.RateLimitConfig{Default: service.RateLimit{Rate: -1, Burst: 1}}},
+        {"no burst", service.RateLimitConfig{Default: service.RateLimit{Rate: 1}}},
+        {"negative streams", service.RateLimitConfig{Default: service.RateLimit{MaxStreams: -1}}},
+        {"method name", service.RateLimitConfig{Methods: []service.MethodRateLimit{{Method: "SearchLaptop"}}}},
+        {"method pattern", service.RateLimitConfig{Methods: []service.MethodRateLimit{{Method: "/xiusl.pcbook.LaptopServices/["}}}},
+    }
+
+    for _, tc := range testCases {
+        tc := tc
+        t.Run(tc.name, func(t *testing.T) {
+            require.Error(t, tc.config.Validate())
+        })
+    }
+}
@@ -5,6 +5,8 @@ import "sync"
 // RatingStore 分数存储接口
 type RatingStore interface {
     Add(laptopID string, score float64) (*Rating, error)
+    // Find 返回便携电脑的评分，没有评分时返回 nil
+    Find(laptopID string) (*Rating, error)
 }
 
 // Rating 分数对象
@@ -42,5 +44,19 @@ func (store *InMemoryRatingStore) Add(laptopID string, score float64) (*Rating,
         rating.Sum += score
     }
     store.rating[laptopID] = rating
+    ratingWrites.Inc()
     return rating, nil
 }
+
+// Find 查询便携电脑的评分
+func (store *InMemoryRatingStore) Find(laptopID string) (*Rating, error) {
+    store.mutex.RLock()
+    defer store.mutex.RUnlock()
+
+    rating := store.rating[laptopID]
+    if rating == nil {
+        return nil, nil
+    }
+    other := *rating
+    return &other, nil
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "runtime/debug"
+
+    "github.com/google/uuid"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+// RecoveryInterceptor 把处理请求时的 panic 转换为 Internal 错误的拦截器，单个请求的错误不会让整个服务退出
+// 同时把处理函数返回的上下文错误转换为 Canceled 和 DeadlineExceeded 状态码
+type RecoveryInterceptor struct{}
+
+// NewRecoveryInterceptor 新建一个 panic 恢复拦截器，需要放在访问日志和指标拦截器之后，授权拦截器之前
+func NewRecoveryInterceptor() *RecoveryInterceptor {
+    return &RecoveryInterceptor{}
+}
+
+// Unary 一元 RPC panic 恢复拦截器
+func (interceptor *RecoveryInterceptor) Unary() grpc.UnaryServerInterceptor {
+    return func(
+        ctx context.Context,
+        req interface{},
+        info *grpc.UnaryServerInfo,
+        handler grpc.UnaryHandler,
+    ) (res interface{}, err error) {
+        defer func() {
+            if r := recover(); r != nil {
+                res, err = nil, recoverPanic(ctx, info.FullMethod, r)
+            }
+        }()
+
+        res, err = handler(ctx, req)
+        return res, normalizeError(err)
+    }
+}
+
+// Stream 流式 RPC panic 恢复拦截器
+func (interceptor *RecoveryInterceptor) Stream() grpc.StreamServerInterceptor {
+    return func(
+        srv interface{},
+        ss grpc.ServerStream,
+        info *grpc.StreamServerInfo,
+        handler grpc.StreamHandler,
+    ) (err error) {
+        defer func() {
+            if r := recover(); r != nil {
+                err = recoverPanic(ss.Context(), info.FullMethod, r)
+            }
+        }()
+
+        return normalizeError(handler(srv, ss))
+    }
+}
+
+// recoverPanic 记录 panic 的调用栈，返回只带有事件 ID 的 Internal 错误，调用方凭事件 ID 可以找到对应的日志
+func recoverPanic(ctx context.Context, method string, r interface{}) error {
+    incidentID := uuid.New().String()
+    rpcPanics.WithLabelValues(method).Inc()
+    rpcLog.Error(ctx, "panic while handling rpc",
+        "method", method,
+        "incident_id", incidentID,
+        "panic", fmt.Sprint(r),
+        "stack", string(debug.Stack()),
+    )
+    return status.Errorf(codes.Internal, "internal error, incident id %s", incidentID)
+}
+
+// normalizeError 把没有状态码的上下文错误转换为对应的状态码，其他错误保持不变
+func normalizeError(err error) error {
+    if err == nil {
+        return nil
+    }
+    if _, ok := status.FromError(err); ok {
+        return err
+    }
+    if contextErr := statusFromContextError(err); contextErr != nil {
+        return contextErr
+    }
+    return err
+}
+
+// contextError 上下文已经取消或超时时返回对应状态码的错误，否则返回 nil
+func contextError(ctx context.Context) error {
+    return statusFromContextError(ctx.Err())
+}
+
+// statusFromContextError 把 context.Canceled 和 context.DeadlineExceeded 转换为状态码错误，其他错误返回 nil
+func statusFromContextError(err error) error {
+    switch {
+    case errors.Is(err, context.Canceled):
+        return status.Error(codes.Canceled, "request is canceled")
+    case errors.Is(err, context.DeadlineExceeded):
+        return status.Error(codes.DeadlineExceeded, "deadline is exceeded")
+    default:
+        return nil
+    }
+}
@@ -0,0 +1,118 @@
+package service_test
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "net"
+    "os"
+    "sync/atomic"
+    "testing"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/logging"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/sample"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+// panicOnceLaptopStore 第一次保存时 panic 的便携电脑存储
+type panicOnceLaptopStore struct {
+    service.LaptopStore
+    panicked int32
+}
+
+func (store *panicOnceLaptopStore) Save(laptop *pb.Laptop) error {
+    if atomic.CompareAndSwapInt32(&store.panicked, 0, 1) {
+        var missing *pb.Laptop
+        return store.LaptopStore.Save(&pb.Laptop{Id: missing.Id})
+    }
+    return store.LaptopStore.Save(laptop)
+}
+
+func TestRecoveryInterceptorPanic(t *testing.T) {
+    var buffer bytes.Buffer
+    require.NoError(t, logging.Configure(&buffer, logging.Config{Format: "json"}))
+    defer logging.Configure(os.Stderr, logging.Config{})
+
+    recovery := service.NewRecoveryInterceptor()
+    grpcServer := grpc.NewServer(
+        grpc.UnaryInterceptor(recovery.Unary()),
+        grpc.StreamInterceptor(recovery.Stream()),
+    )
+    laptopStore := &panicOnceLaptopStore{LaptopStore: service.NewInMemoryLaptopStore()}
+    laptopServer := service.NewLaptopServer(laptopStore, nil, service.NewInMemoryRatingStore())
+    pb.RegisterLaptopServicesServer(grpcServer, laptopServer)
+
+    listener, err := net.Listen("tcp", ":0")
+    require.NoError(t, err)
+    go grpcServer.Serve(listener)
+    defer grpcServer.Stop()
+
+    conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+    require.NoError(t, err)
+    defer conn.Close()
+    laptopClient := pb.NewLaptopServicesClient(conn)
+
+    // 处理函数中 panic 时，调用方只拿到事件 ID
+    _, err = laptopClient.CreateLaptop(context.Background(), &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+    st, ok := status.FromError(err)
+    require.True(t, ok)
+    require.Equal(t, codes.Internal, st.Code())
+    require.Contains(t, st.Message(), "incident id ")
+    require.NotContains(t, st.Message(), "nil pointer")
+
+    incidentID := st.Message()[len("internal error, incident id "):]
+    require.Contains(t, buffer.String(), `"incident_id":"`+incidentID+`"`)
+    require.Contains(t, buffer.String(), "nil pointer dereference")
+    require.Contains(t, buffer.String(), "CreateLaptop")
+
+    // 服务仍然可以处理后续的请求
+    res, err := laptopClient.CreateLaptop(context.Background(), &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+    require.NoError(t, err)
+    require.NotEmpty(t, res.GetId())
+}
+
+func TestRecoveryInterceptorNormalizeError(t *testing.T) {
+    unary := service.NewRecoveryInterceptor().Unary()
+    info := &grpc.UnaryServerInfo{FullMethod: "/test/Method"}
+
+    testCases := []struct {
+        name string
+        err  error
+        code codes.Code
+    }{
+        {"ok", nil, codes.OK},
+        {"canceled", context.Canceled, codes.Canceled},
+        {"deadline", context.DeadlineExceeded, codes.DeadlineExceeded},
+        {"status", status.Error(codes.NotFound, "not found"), codes.NotFound},
+        {"other", errors.New("boom"), codes.Unknown},
+    }
+
+    for _, tc := range testCases {
+        tc := tc
+        t.Run(tc.name, func(t *testing.T) {
+            _, err := unary(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+                return nil, tc.err
+            })
+            require.Equal(t, tc.code, status.Code(err))
+        })
+    }
+}
+
+func TestServerCreateLaptopCanceled(t *testing.T) {
+    srv := service.NewLaptopServer(service.NewInMemoryLaptopStore(), nil, nil)
+
+    canceled, cancel := context.WithCancel(context.Background())
+    cancel()
+    _, err := srv.CreateLaptop(canceled, &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+    require.Equal(t, codes.Canceled, status.Code(err))
+
+    expired, cancel := context.WithTimeout(context.Background(), 0)
+    defer cancel()
+    _, err = srv.CreateLaptop(expired, &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+    require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+}
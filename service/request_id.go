@@ -0,0 +1,98 @@
+package service
+
+import (
+    "context"
+    "time"
+
+    "github.com/xiusl/pcbook/logging"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+)
+
+// rpcLog 每个 RPC 结束时输出的访问日志
+var rpcLog = logging.New("rpc")
+
+// RequestIDInterceptor 为每个请求分配请求 ID 的拦截器，并在 RPC 结束时输出访问日志
+// 调用方通过 x-request-id 元数据传入的 ID 会被沿用，响应头中会返回最终使用的 ID
+type RequestIDInterceptor struct{}
+
+// NewRequestIDInterceptor 新建一个请求 ID 拦截器，需要放在授权拦截器之前，被拒绝的请求也有请求 ID
+func NewRequestIDInterceptor() *RequestIDInterceptor {
+    return &RequestIDInterceptor{}
+}
+
+// Unary 一元 RPC 请求 ID 拦截器
+func (interceptor *RequestIDInterceptor) Unary() grpc.UnaryServerInterceptor {
+    return func(
+        ctx context.Context,
+        req interface{},
+        info *grpc.UnaryServerInfo,
+        handler grpc.UnaryHandler,
+    ) (interface{}, error) {
+        ctx, id := withRequestID(ctx)
+        grpc.SetHeader(ctx, metadata.Pairs(logging.RequestIDKey, id))
+
+        start := time.Now()
+        res, err := handler(ctx, req)
+        logRPC(ctx, info.FullMethod, start, err)
+        return res, err
+    }
+}
+
+// Stream 流式 RPC 请求 ID 拦截器
+func (interceptor *RequestIDInterceptor) Stream() grpc.StreamServerInterceptor {
+    return func(
+        srv interface{},
+        ss grpc.ServerStream,
+        info *grpc.StreamServerInfo,
+        handler grpc.StreamHandler,
+    ) error {
+        ctx, id := withRequestID(ss.Context())
+        ss.SetHeader(metadata.Pairs(logging.RequestIDKey, id))
+
+        start := time.Now()
+        err := handler(srv, &contextServerStream{ss, ctx})
+        logRPC(ctx, info.FullMethod, start, err)
+        return err
+    }
+}
+
+// withRequestID 沿用调用方传入的合法请求 ID，否则生成新的 ID
+func withRequestID(ctx context.Context) (context.Context, string) {
+    id := logging.RequestIDFromContext(ctx)
+    if id == "" {
+        if md, ok := metadata.FromIncomingContext(ctx); ok {
+            if values := md.Get(logging.RequestIDKey); len(values) > 0 && logging.ValidRequestID(values[0]) {
+                id = values[0]
+            }
+        }
+    }
+    if id == "" {
+        id = logging.NewRequestID()
+    }
+    return logging.ContextWithRequestID(ctx, id), id
+}
+
+// logRPC 输出访问日志，服务端错误使用 error 级别，调用方的错误使用 warn 级别
+func logRPC(ctx context.Context, method string, start time.Time, err error) {
+    code := status.Code(err)
+    level := logging.LevelInfo
+    switch code {
+    case codes.OK:
+    case codes.Internal, codes.Unknown, codes.DataLoss, codes.Unavailable:
+        level = logging.LevelError
+    default:
+        level = logging.LevelWarn
+    }
+    if !rpcLog.Enabled(level) {
+        return
+    }
+
+    fields := []interface{}{"method", method, "code", code, "duration", time.Since(start)}
+    if err != nil {
+        fields = append(fields, "error", status.Convert(err).Message())
+    }
+    rpcLog.Log(ctx, level, "rpc finished", fields...)
+}
@@ -0,0 +1,97 @@
+package service_test
+
+import (
+    "bytes"
+    "context"
+    "net"
+    "os"
+    "testing"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/client"
+    "github.com/xiusl/pcbook/logging"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/sample"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/metadata"
+)
+
+func TestRequestIDInterceptor(t *testing.T) {
+    var buffer bytes.Buffer
+    require.NoError(t, logging.Configure(&buffer, logging.Config{Format: "json"}))
+    defer logging.Configure(os.Stderr, logging.Config{})
+
+    requestID := service.NewRequestIDInterceptor()
+    grpcServer := grpc.NewServer(
+        grpc.UnaryInterceptor(requestID.Unary()),
+        grpc.StreamInterceptor(requestID.Stream()),
+    )
+    laptopServer := service.NewLaptopServer(service.NewInMemoryLaptopStore(), nil, service.NewInMemoryRatingStore())
+    pb.RegisterLaptopServicesServer(grpcServer, laptopServer)
+
+    listener, err := net.Listen("tcp", ":0")
+    require.NoError(t, err)
+    go grpcServer.Serve(listener)
+    defer grpcServer.Stop()
+
+    clientRequestID := client.NewRequestIDInterceptor()
+    conn, err := grpc.Dial(
+        listener.Addr().String(),
+        grpc.WithInsecure(),
+        grpc.WithUnaryInterceptor(clientRequestID.Unary()),
+        grpc.WithStreamInterceptor(clientRequestID.Stream()),
+    )
+    require.NoError(t, err)
+    defer conn.Close()
+    laptopClient := pb.NewLaptopServicesClient(conn)
+
+    testCases := []struct {
+        name string
+        ctx  context.Context
+        // want 为空时只检查服务端返回了请求 ID
+        want string
+    }{
+        {
+            name: "from context",
+            ctx:  logging.ContextWithRequestID(context.Background(), "client-1"),
+            want: "client-1",
+        },
+        {
+            name: "from metadata",
+            ctx:  metadata.AppendToOutgoingContext(context.Background(), logging.RequestIDKey, "client-2"),
+            want: "client-2",
+        },
+        {
+            name: "generated",
+            ctx:  context.Background(),
+        },
+        {
+            name: "invalid",
+            ctx:  metadata.AppendToOutgoingContext(context.Background(), logging.RequestIDKey, "forged id level=error"),
+        },
+    }
+
+    for _, tc := range testCases {
+        tc := tc
+        t.Run(tc.name, func(t *testing.T) {
+            buffer.Reset()
+
+            var header metadata.MD
+            _, err := laptopClient.CreateLaptop(tc.ctx, &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()}, grpc.Header(&header))
+            require.NoError(t, err)
+
+            values := header.Get(logging.RequestIDKey)
+            require.Len(t, values, 1)
+            if tc.want != "" {
+                require.Equal(t, tc.want, values[0])
+            } else {
+                require.True(t, logging.ValidRequestID(values[0]))
+            }
+
+            // 处理请求时的日志和访问日志都带有同一个请求 ID
+            require.Contains(t, buffer.String(), `"msg":"create laptop","request_id":"`+values[0]+`"`)
+            require.Contains(t, buffer.String(), `"msg":"rpc finished","request_id":"`+values[0]+`"`)
+        })
+    }
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base32"
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "net/url"
+    "strings"
+    "time"
+)
+
+// RFC 6238 TOTP 参数，与常见的身份验证器应用保持一致
+const (
+    totpPeriod = 30 * time.Second
+    totpDigits = 6
+    // totpSkew 允许前后各一个时间窗口的误差
+    totpSkew = 1
+)
+
+const (
+    recoveryCodeCount  = 10
+    recoveryCodeLength = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret 生成一个 160 位的随机 TOTP 密钥，使用 base32 编码
+func GenerateTOTPSecret() (string, error) {
+    secret := make([]byte, 20)
+    if _, err := rand.Read(secret); err != nil {
+        return "", fmt.Errorf("cannot generate totp secret: %w", err)
+    }
+    return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPURI 生成身份验证器应用可以扫描的 otpauth URI
+func TOTPURI(issuer, account, secret string) string {
+    query := url.Values{}
+    query.Set("secret", secret)
+    query.Set("issuer", issuer)
+    query.Set("algorithm", "SHA1")
+    query.Set("digits", fmt.Sprint(totpDigits))
+    query.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+
+    label := url.PathEscape(issuer + ":" + account)
+    return fmt.Sprintf("otpauth://totp/%s?%s", label, query.Encode())
+}
+
+// GenerateTOTPCode 计算指定时间的 TOTP 验证码
+func GenerateTOTPCode(secret string, t time.Time) (string, error) {
+    key, err := decodeTOTPSecret(secret)
+    if err != nil {
+        return "", err
+    }
+    return hotp(key, totpCounter(t)), nil
+}
+
+// ValidateTOTPCode 验证 TOTP 验证码，返回匹配的时间窗口计数
+// 计数不大于 lastCounter 的验证码视为重放，不予通过
+func ValidateTOTPCode(secret, code string, t time.Time, lastCounter int64) (int64, bool) {
+    key, err := decodeTOTPSecret(secret)
+    if err != nil || len(code) != totpDigits {
+        return 0, false
+    }
+
+    current := totpCounter(t)
+    for offset := int64(-totpSkew); offset <= totpSkew; offset++ {
+        counter := current + offset
+        if counter <= lastCounter {
+            continue
+        }
+        if subtle.ConstantTimeCompare([]byte(hotp(key, counter)), []byte(code)) == 1 {
+            return counter, true
+        }
+    }
+    return 0, false
+}
+
+// GenerateRecoveryCodes 生成一次性恢复码，返回明文和对应的哈希
+func GenerateRecoveryCodes() ([]string, []string, error) {
+    codes := make([]string, recoveryCodeCount)
+    hashes := make([]string, recoveryCodeCount)
+
+    for i := range codes {
+        raw := make([]byte, recoveryCodeLength)
+        if _, err := rand.Read(raw); err != nil {
+            return nil, nil, fmt.Errorf("cannot generate recovery code: %w", err)
+        }
+        code := strings.ToLower(totpEncoding.EncodeToString(raw)[:recoveryCodeLength])
+        codes[i] = code[:recoveryCodeLength/2] + "-" + code[recoveryCodeLength/2:]
+        hashes[i] = hashRecoveryCode(codes[i])
+    }
+    return codes, hashes, nil
+}
+
+// hashRecoveryCode 恢复码是随机生成的，忽略大小写和分隔符后使用 sha256 保存
+func hashRecoveryCode(code string) string {
+    normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+    sum := sha256.Sum256([]byte(normalized))
+    return hex.EncodeToString(sum[:])
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+    key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+    if err != nil {
+        return nil, fmt.Errorf("invalid totp secret: %w", err)
+    }
+    return key, nil
+}
+
+func totpCounter(t time.Time) int64 {
+    return t.Unix() / int64(totpPeriod/time.Second)
+}
+
+// hotp RFC 4226 HOTP 算法
+func hotp(key []byte, counter int64) string {
+    message := make([]byte, 8)
+    binary.BigEndian.PutUint64(message, uint64(counter))
+
+    mac := hmac.New(sha1.New, key)
+    mac.Write(message)
+    sum := mac.Sum(nil)
+
+    offset := sum[len(sum)-1] & 0x0f
+    value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+    modulo := uint32(1)
+    for i := 0; i < totpDigits; i++ {
+        modulo *= 10
+    }
+    return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
@@ -0,0 +1,210 @@
+package service_test
+
+import (
+    "context"
+    "encoding/base32"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+func TestTOTPCode(t *testing.T) {
+    // RFC 6238 附录 B 的 SHA1 测试向量，取后六位
+    secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+    testCases := []struct {
+        unix int64
+        code string
+    }{
+        {59, "287082"},
+        {1111111109, "081804"},
+        {1234567890, "005924"},
+        {2000000000, "279037"},
+    }
+
+    for _, tc := range testCases {
+        code, err := service.GenerateTOTPCode(secret, time.Unix(tc.unix, 0))
+        require.NoError(t, err)
+        require.Equal(t, tc.code, code)
+    }
+
+    now := time.Unix(1111111109, 0)
+    counter, ok := service.ValidateTOTPCode(secret, "081804", now, 0)
+    require.True(t, ok)
+
+    // 同一个验证码不能重复使用
+    _, ok = service.ValidateTOTPCode(secret, "081804", now, counter)
+    require.False(t, ok)
+
+    uri := service.TOTPURI("pcbook", "admin", secret)
+    require.True(t, strings.HasPrefix(uri, "otpauth://totp/pcbook:admin?"))
+    require.Contains(t, uri, "secret="+secret)
+}
+
+func TestServerTOTPLogin(t *testing.T) {
+    userStore := service.NewInMemoryUserStore()
+    user, err := service.NewUser("admin", "secret", "admin")
+    require.NoError(t, err)
+    require.NoError(t, userStore.Save(user))
+
+    jwtManager := service.NewJWTManager("secret", time.Minute)
+    srv := service.NewAuthServer(userStore, jwtManager, nil, nil, service.DefaultPasswordPolicy())
+
+    ctx := service.ContextWithPrincipal(context.Background(), &service.Principal{
+        Username:   "admin",
+        Roles:      []string{"admin"},
+        AuthMethod: service.AuthMethodPassword,
+    })
+
+    enroll, err := srv.EnrollTOTP(ctx, &pb.EnrollTOTPRequest{})
+    require.NoError(t, err)
+    require.NotEmpty(t, enroll.GetSecret())
+
+    // 验证码错误时不会开启两步验证
+    _, err = srv.ConfirmTOTP(ctx, &pb.ConfirmTOTPRequest{TotpCode: "000000"})
+    require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+    now := time.Now()
+    code, err := service.GenerateTOTPCode(enroll.GetSecret(), now)
+    require.NoError(t, err)
+    confirm, err := srv.ConfirmTOTP(ctx, &pb.ConfirmTOTPRequest{TotpCode: code})
+    require.NoError(t, err)
+    require.Len(t, confirm.GetRecoveryCodes(), 10)
+
+    login, err := srv.Login(context.Background(), &pb.LoginRequest{Username: "admin", Password: "secret"})
+    require.NoError(t, err)
+    require.True(t, login.GetMfaRequired())
+    require.Empty(t, login.GetAccessToken())
+
+    // 挑战令牌不能作为访问令牌
+    _, err = jwtManager.Verify(login.GetMfaChallenge())
+    require.Error(t, err)
+
+    // 确认时使用过的验证码不能再次使用
+    _, err = srv.VerifyLogin(context.Background(), &pb.VerifyLoginRequest{
+        MfaChallenge: login.GetMfaChallenge(),
+        Factor:       &pb.VerifyLoginRequest_TotpCode{TotpCode: code},
+    })
+    require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+    next, err := service.GenerateTOTPCode(enroll.GetSecret(), now.Add(30*time.Second))
+    require.NoError(t, err)
+    verified, err := srv.VerifyLogin(context.Background(), &pb.VerifyLoginRequest{
+        MfaChallenge: login.GetMfaChallenge(),
+        Factor:       &pb.VerifyLoginRequest_TotpCode{TotpCode: next},
+    })
+    require.NoError(t, err)
+
+    claims, err := jwtManager.Verify(verified.GetAccessToken())
+    require.NoError(t, err)
+    require.Equal(t, service.AuthMethodPasswordTOTP, claims.AuthMethod)
+
+    // 恢复码只能使用一次
+    recovery := &pb.VerifyLoginRequest{
+        MfaChallenge: login.GetMfaChallenge(),
+        Factor:       &pb.VerifyLoginRequest_RecoveryCode{RecoveryCode: confirm.GetRecoveryCodes()[0]},
+    }
+    _, err = srv.VerifyLogin(context.Background(), recovery)
+    require.NoError(t, err)
+    _, err = srv.VerifyLogin(context.Background(), recovery)
+    require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestServerVerifyLoginParallelReplay(t *testing.T) {
+    secret, err := service.GenerateTOTPSecret()
+    require.NoError(t, err)
+    recoveryCodes, recoveryHashes, err := service.GenerateRecoveryCodes()
+    require.NoError(t, err)
+
+    userStore := service.NewInMemoryUserStore()
+    user, err := service.NewUser("admin", "secret", "admin")
+    require.NoError(t, err)
+    user.TOTPSecret = secret
+    user.TOTPEnabled = true
+    user.RecoveryCodeHashes = recoveryHashes
+    require.NoError(t, userStore.Save(user))
+
+    jwtManager := service.NewJWTManager("secret", time.Minute)
+    srv := service.NewAuthServer(userStore, jwtManager, nil, nil, service.DefaultPasswordPolicy())
+
+    login, err := srv.Login(context.Background(), &pb.LoginRequest{Username: "admin", Password: "secret"})
+    require.NoError(t, err)
+    require.True(t, login.GetMfaRequired())
+
+    code, err := service.GenerateTOTPCode(secret, time.Now())
+    require.NoError(t, err)
+
+    // 并发提交同一个验证码或者恢复码时只有一个请求能换到令牌
+    factors := []*pb.VerifyLoginRequest{
+        {
+            MfaChallenge: login.GetMfaChallenge(),
+            Factor:       &pb.VerifyLoginRequest_TotpCode{TotpCode: code},
+        },
+        {
+            MfaChallenge: login.GetMfaChallenge(),
+            Factor:       &pb.VerifyLoginRequest_RecoveryCode{RecoveryCode: recoveryCodes[0]},
+        },
+    }
+    for _, req := range factors {
+        const n = 20
+        errCh := make(chan error, n)
+        for i := 0; i < n; i++ {
+            go func() {
+                _, err := srv.VerifyLogin(context.Background(), req)
+                errCh <- err
+            }()
+        }
+
+        verified := 0
+        for i := 0; i < n; i++ {
+            err := <-errCh
+            if err == nil {
+                verified++
+                continue
+            }
+            require.Equal(t, codes.Unauthenticated, status.Code(err))
+        }
+        require.Equal(t, 1, verified)
+    }
+}
+
+func TestAccessPolicyRequireMFA(t *testing.T) {
+    policy, err := service.ParseAccessPolicy([]byte(`
+roles:
+  user: {}
+  admin:
+    inherits: [user]
+    require_mfa: true
+rules:
+  - methods: [/xiusl.pcbook.AuthService/EnrollTOTP]
+    authenticated: true
+  - methods: ["/xiusl.pcbook.LaptopServices/*"]
+    roles: [admin]
+`))
+    require.NoError(t, err)
+
+    const createLaptop = "/xiusl.pcbook.LaptopServices/CreateLaptop"
+    admin := &service.Principal{Username: "admin", Roles: []string{"admin"}, AuthMethod: service.AuthMethodPassword}
+
+    err = policy.Authorize(createLaptop, admin)
+    require.Equal(t, codes.PermissionDenied, status.Code(err))
+    require.Contains(t, err.Error(), "two-factor")
+
+    // 没有两步验证时仍然可以开启两步验证
+    require.NoError(t, policy.Authorize("/xiusl.pcbook.AuthService/EnrollTOTP", admin))
+
+    admin.AuthMethod = service.AuthMethodPasswordTOTP
+    require.NoError(t, policy.Authorize(createLaptop, admin))
+
+    // SSO 登录时没有多因素认证同样视为单一因素
+    admin.AuthMethod = service.AuthMethodOIDC
+    require.Error(t, policy.Authorize(createLaptop, admin))
+    admin.AuthMethod = service.AuthMethodOIDCMFA
+    require.NoError(t, policy.Authorize(createLaptop, admin))
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "sync"
+    "time"
+
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// FileSpanExporter 把 span 以 JSON 行的格式写入文件，不依赖外部的收集器，方便本地调试和测试
+type FileSpanExporter struct {
+    mutex   sync.Mutex
+    writer  io.Writer
+    closer  io.Closer
+    encoder *json.Encoder
+}
+
+// ExportedSpan 导出文件中的一行
+type ExportedSpan struct {
+    TraceID      string                 `json:"trace_id"`
+    SpanID       string                 `json:"span_id"`
+    ParentSpanID string                 `json:"parent_span_id,omitempty"`
+    Name         string                 `json:"name"`
+    Kind         string                 `json:"kind"`
+    Start        time.Time              `json:"start"`
+    End          time.Time              `json:"end"`
+    Duration     string                 `json:"duration"`
+    Status       string                 `json:"status"`
+    Description  string                 `json:"description,omitempty"`
+    Attributes   map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// NewFileSpanExporter 新建一个导出器，span 追加到 filename 的末尾
+func NewFileSpanExporter(filename string) (*FileSpanExporter, error) {
+    file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+    if err != nil {
+        return nil, fmt.Errorf("cannot open trace file: %w", err)
+    }
+
+    exporter := NewWriterSpanExporter(file)
+    exporter.closer = file
+    return exporter, nil
+}
+
+// NewWriterSpanExporter 新建一个把 span 写入 writer 的导出器
+func NewWriterSpanExporter(writer io.Writer) *FileSpanExporter {
+    return &FileSpanExporter{
+        writer:  writer,
+        encoder: json.NewEncoder(writer),
+    }
+}
+
+// ExportSpans 写入一批已经结束的 span
+func (exporter *FileSpanExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+    exporter.mutex.Lock()
+    defer exporter.mutex.Unlock()
+
+    for _, span := range spans {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        if err := exporter.encoder.Encode(toExportedSpan(span)); err != nil {
+            return fmt.Errorf("cannot write span: %w", err)
+        }
+    }
+    return nil
+}
+
+// Shutdown 关闭文件
+func (exporter *FileSpanExporter) Shutdown(ctx context.Context) error {
+    exporter.mutex.Lock()
+    defer exporter.mutex.Unlock()
+
+    if exporter.closer == nil {
+        return nil
+    }
+    closer := exporter.closer
+    exporter.closer = nil
+    if file, ok := closer.(*os.File); ok {
+        if err := file.Sync(); err != nil {
+            closer.Close()
+            return err
+        }
+    }
+    return closer.Close()
+}
+
+func toExportedSpan(span sdktrace.ReadOnlySpan) ExportedSpan {
+    exported := ExportedSpan{
+        TraceID:     span.SpanContext().TraceID().String(),
+        SpanID:      span.SpanContext().SpanID().String(),
+        Name:        span.Name(),
+        Kind:        span.SpanKind().String(),
+        Start:       span.StartTime(),
+        End:         span.EndTime(),
+        Duration:    span.EndTime().Sub(span.StartTime()).String(),
+        Status:      span.Status().Code.String(),
+        Description: span.Status().Description,
+    }
+    if span.Parent().IsValid() {
+        exported.ParentSpanID = span.Parent().SpanID().String()
+    }
+
+    if attributes := span.Attributes(); len(attributes) > 0 {
+        exported.Attributes = make(map[string]interface{}, len(attributes))
+        for _, attribute := range attributes {
+            exported.Attributes[string(attribute.Key)] = attribute.Value.AsInterface()
+        }
+    }
+    return exported
+}
@@ -0,0 +1,180 @@
+package service
+
+import (
+    "context"
+    "net/http"
+    "strings"
+
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/attribute"
+    otelcodes "go.opentelemetry.io/otel/codes"
+    "go.opentelemetry.io/otel/propagation"
+    "go.opentelemetry.io/otel/trace"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+)
+
+// tracerName 服务端创建 span 使用的 tracer 名称
+const tracerName = "github.com/xiusl/pcbook/service"
+
+// TracePropagator 在 HTTP 请求头和 gRPC 元数据中传递 W3C traceparent
+var TracePropagator = propagation.TraceContext{}
+
+// startSpan 创建一个内部 span，每次从全局的 TracerProvider 获取 tracer，没有配置时不会记录
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+    return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// endSpan 记录错误并结束 span
+func endSpan(span trace.Span, err error) {
+    if err != nil {
+        span.RecordError(err)
+        span.SetStatus(otelcodes.Error, err.Error())
+    }
+    span.End()
+}
+
+// MetadataCarrier 让 gRPC 元数据可以读写 trace context
+type MetadataCarrier metadata.MD
+
+// Get 返回第一个值
+func (carrier MetadataCarrier) Get(key string) string {
+    values := metadata.MD(carrier).Get(key)
+    if len(values) == 0 {
+        return ""
+    }
+    return values[0]
+}
+
+// Set 设置值
+func (carrier MetadataCarrier) Set(key string, value string) {
+    metadata.MD(carrier).Set(key, value)
+}
+
+// Keys 返回所有的键
+func (carrier MetadataCarrier) Keys() []string {
+    keys := make([]string, 0, len(carrier))
+    for key := range carrier {
+        keys = append(keys, key)
+    }
+    return keys
+}
+
+// TracingInterceptor 为每个 RPC 创建服务端 span 的拦截器
+// 调用方通过 traceparent 元数据传递的 trace 会作为父 span，进程内的网关调用直接沿用上下文中的 span
+type TracingInterceptor struct{}
+
+// NewTracingInterceptor 新建一个链路追踪拦截器，需要放在其他拦截器之前
+func NewTracingInterceptor() *TracingInterceptor {
+    return &TracingInterceptor{}
+}
+
+// Unary 一元 RPC 链路追踪拦截器
+func (interceptor *TracingInterceptor) Unary() grpc.UnaryServerInterceptor {
+    return func(
+        ctx context.Context,
+        req interface{},
+        info *grpc.UnaryServerInfo,
+        handler grpc.UnaryHandler,
+    ) (interface{}, error) {
+        ctx, span := startRPCSpan(ctx, info.FullMethod)
+        res, err := handler(ctx, req)
+        endRPCSpan(span, err)
+        return res, err
+    }
+}
+
+// Stream 流式 RPC 链路追踪拦截器
+func (interceptor *TracingInterceptor) Stream() grpc.StreamServerInterceptor {
+    return func(
+        srv interface{},
+        ss grpc.ServerStream,
+        info *grpc.StreamServerInfo,
+        handler grpc.StreamHandler,
+    ) error {
+        ctx, span := startRPCSpan(ss.Context(), info.FullMethod)
+        err := handler(srv, &contextServerStream{ss, ctx})
+        endRPCSpan(span, err)
+        return err
+    }
+}
+
+func startRPCSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+    if md, ok := metadata.FromIncomingContext(ctx); ok {
+        ctx = TracePropagator.Extract(ctx, MetadataCarrier(md))
+    }
+
+    service, name := splitMethodName(method)
+    return otel.Tracer(tracerName).Start(
+        ctx,
+        method,
+        trace.WithSpanKind(trace.SpanKindServer),
+        trace.WithAttributes(
+            attribute.String("rpc.system", "grpc"),
+            attribute.String("rpc.service", service),
+            attribute.String("rpc.method", name),
+        ),
+    )
+}
+
+func endRPCSpan(span trace.Span, err error) {
+    code := status.Code(err)
+    span.SetAttributes(attribute.String("rpc.grpc.status_code", code.String()))
+    if err != nil {
+        span.SetStatus(otelcodes.Error, status.Convert(err).Message())
+    }
+    span.End()
+}
+
+// splitMethodName 把 /package.Service/Method 拆分为服务名和方法名
+func splitMethodName(fullMethod string) (string, string) {
+    fullMethod = strings.TrimPrefix(fullMethod, "/")
+    if i := strings.LastIndex(fullMethod, "/"); i >= 0 {
+        return fullMethod[:i], fullMethod[i+1:]
+    }
+    return "unknown", fullMethod
+}
+
+// TracingHandler 为每个 HTTP 请求创建服务端 span，请求头中的 traceparent 作为父 span
+func TracingHandler(handler http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ctx := TracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+        ctx, span := otel.Tracer(tracerName).Start(
+            ctx,
+            "HTTP "+r.Method+" "+r.URL.Path,
+            trace.WithSpanKind(trace.SpanKindServer),
+            trace.WithAttributes(
+                attribute.String("http.method", r.Method),
+                attribute.String("http.target", r.URL.Path),
+            ),
+        )
+        defer span.End()
+
+        recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+        handler.ServeHTTP(recorder, r.WithContext(ctx))
+
+        span.SetAttributes(attribute.Int("http.status_code", recorder.status))
+        if recorder.status >= http.StatusInternalServerError {
+            span.SetStatus(otelcodes.Error, http.StatusText(recorder.status))
+        }
+    })
+}
+
+// statusRecorder 记录响应状态码
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+    recorder.status = status
+    recorder.ResponseWriter.WriteHeader(status)
+}
+
+// Flush 流式响应需要立即发送每条消息
+func (recorder *statusRecorder) Flush() {
+    if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+        flusher.Flush()
+    }
+}
@@ -0,0 +1,218 @@
+package service_test
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/json"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/client"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/sample"
+    "github.com/xiusl/pcbook/service"
+    "go.opentelemetry.io/otel"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+    "go.opentelemetry.io/otel/sdk/trace/tracetest"
+    "go.opentelemetry.io/otel/trace"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/metadata"
+)
+
+// recordSpans 在测试期间把全局的 TracerProvider 替换为记录所有 span 的 provider
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+    recorder := tracetest.NewSpanRecorder()
+    provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+    previous := otel.GetTracerProvider()
+    otel.SetTracerProvider(provider)
+    t.Cleanup(func() {
+        otel.SetTracerProvider(previous)
+        provider.Shutdown(context.Background())
+    })
+    return recorder
+}
+
+// findSpan 返回 trace 中名称和类型都匹配的 span
+func findSpan(t *testing.T, spans []sdktrace.ReadOnlySpan, traceID trace.TraceID, name string, kind trace.SpanKind) sdktrace.ReadOnlySpan {
+    for _, span := range spans {
+        if span.SpanContext().TraceID() == traceID && span.Name() == name && span.SpanKind() == kind {
+            return span
+        }
+    }
+    require.FailNow(t, "span not found", "%s (%s)", name, kind)
+    return nil
+}
+
+func TestTracingSpanTree(t *testing.T) {
+    recorder := recordSpans(t)
+
+    jwtManager := service.NewJWTManager("secret", time.Minute)
+    policy, err := service.ParseAccessPolicy([]byte(testPolicy))
+    require.NoError(t, err)
+    auth := service.NewAuthInterceptor(policy, nil, jwtManager)
+
+    tracing := service.NewTracingInterceptor()
+    grpcServer := grpc.NewServer(
+        grpc.ChainUnaryInterceptor(tracing.Unary(), auth.Unary()),
+        grpc.ChainStreamInterceptor(tracing.Stream(), auth.Stream()),
+    )
+    laptopServer := service.NewLaptopServer(service.NewInMemoryLaptopStore(), nil, service.NewInMemoryRatingStore())
+    pb.RegisterLaptopServicesServer(grpcServer, laptopServer)
+
+    listener, err := net.Listen("tcp", ":0")
+    require.NoError(t, err)
+    go grpcServer.Serve(listener)
+    defer grpcServer.Stop()
+
+    clientTracing := client.NewTracingInterceptor()
+    conn, err := grpc.Dial(
+        listener.Addr().String(),
+        grpc.WithInsecure(),
+        grpc.WithUnaryInterceptor(clientTracing.Unary()),
+        grpc.WithStreamInterceptor(clientTracing.Stream()),
+    )
+    require.NoError(t, err)
+    defer conn.Close()
+    laptopClient := pb.NewLaptopServicesClient(conn)
+
+    admin, err := service.NewUser("admin", "secret", "admin")
+    require.NoError(t, err)
+    token, err := jwtManager.Generate(admin, service.AuthMethodPassword)
+    require.NoError(t, err)
+    ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", token)
+
+    ctx, root := otel.Tracer("test").Start(ctx, "test")
+    laptop := sample.NewLaptop()
+    _, err = laptopClient.CreateLaptop(ctx, &pb.CreateLaptopRequest{Laptop: laptop})
+    require.NoError(t, err)
+
+    stream, err := laptopClient.RateLaptop(ctx)
+    require.NoError(t, err)
+    require.NoError(t, stream.Send(&pb.RateLaptopRequest{LaptopId: laptop.GetId(), Score: 8}))
+    _, err = stream.Recv()
+    require.NoError(t, err)
+    require.NoError(t, stream.CloseSend())
+    _, err = stream.Recv()
+    require.Error(t, err)
+    root.End()
+
+    spans := recorder.Ended()
+    traceID := root.SpanContext().TraceID()
+    rootID := root.SpanContext().SpanID()
+
+    // test -> 客户端 span -> 服务端 span -> 授权和存储的 span
+    testCases := []struct {
+        method   string
+        children []string
+    }{
+        {
+            method:   "/xiusl.pcbook.LaptopServices/CreateLaptop",
+            children: []string{"AuthInterceptor.authorize", "LaptopStore.Save"},
+        },
+        {
+            method:   "/xiusl.pcbook.LaptopServices/RateLaptop",
+            children: []string{"AuthInterceptor.authorize", "LaptopStore.FindByID", "RatingStore.Add"},
+        },
+    }
+
+    for _, tc := range testCases {
+        clientSpan := findSpan(t, spans, traceID, tc.method, trace.SpanKindClient)
+        require.Equal(t, rootID, clientSpan.Parent().SpanID())
+
+        serverSpan := findSpan(t, spans, traceID, tc.method, trace.SpanKindServer)
+        require.Equal(t, clientSpan.SpanContext().SpanID(), serverSpan.Parent().SpanID())
+        require.True(t, serverSpan.Parent().IsRemote())
+
+        var children []string
+        for _, span := range spans {
+            if span.Parent().SpanID() == serverSpan.SpanContext().SpanID() {
+                children = append(children, span.Name())
+            }
+        }
+        require.ElementsMatch(t, tc.children, children)
+    }
+}
+
+func TestTracingGatewayTraceparent(t *testing.T) {
+    recorder := recordSpans(t)
+
+    policy, err := service.ParseAccessPolicy([]byte(testPolicy))
+    require.NoError(t, err)
+    jwtManager := service.NewJWTManager("secret", time.Minute)
+    interceptor := service.NewAuthInterceptor(policy, nil, jwtManager)
+    authServer := service.NewAuthServer(service.NewInMemoryUserStore(), jwtManager, nil, nil, service.DefaultPasswordPolicy())
+
+    mux := runtime.NewServeMux()
+    tracing := service.NewTracingInterceptor()
+    unary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+        return tracing.Unary()(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+            return interceptor.Unary()(ctx, req, info, handler)
+        })
+    }
+    gatewayServer := service.NewGatewayServer(unary, authServer, nil, nil, nil, nil, nil)
+    require.NoError(t, gatewayServer.RegisterHandlers(context.Background(), mux))
+    server := httptest.NewServer(service.TracingHandler(mux))
+    defer server.Close()
+
+    const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+    req, err := http.NewRequest(http.MethodPost, server.URL+"/v1/auth/login", strings.NewReader(`{"username":"nobody","password":"secret"}`))
+    require.NoError(t, err)
+    req.Header.Set("traceparent", traceparent)
+    res, err := http.DefaultClient.Do(req)
+    require.NoError(t, err)
+    res.Body.Close()
+    require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+    traceID, err := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+    require.NoError(t, err)
+    parentID, err := trace.SpanIDFromHex("00f067aa0ba902b7")
+    require.NoError(t, err)
+
+    spans := recorder.Ended()
+    httpSpan := findSpan(t, spans, traceID, "HTTP POST /v1/auth/login", trace.SpanKindServer)
+    require.Equal(t, parentID, httpSpan.Parent().SpanID())
+
+    // 进程内的网关调用沿用 HTTP 请求的 span
+    rpcSpan := findSpan(t, spans, traceID, "/xiusl.pcbook.AuthService/Login", trace.SpanKindServer)
+    require.Equal(t, httpSpan.SpanContext().SpanID(), rpcSpan.Parent().SpanID())
+
+    for _, name := range []string{"AuthInterceptor.authorize", "UserStore.Find", "password.compare"} {
+        findSpan(t, spans, traceID, name, trace.SpanKindInternal)
+    }
+}
+
+func TestFileSpanExporter(t *testing.T) {
+    var buffer bytes.Buffer
+    provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(service.NewWriterSpanExporter(&buffer)))
+    defer provider.Shutdown(context.Background())
+
+    tracer := provider.Tracer("test")
+    ctx, parent := tracer.Start(context.Background(), "parent")
+    _, child := tracer.Start(ctx, "child", trace.WithSpanKind(trace.SpanKindClient))
+    child.End()
+    parent.End()
+
+    var spans []service.ExportedSpan
+    scanner := bufio.NewScanner(&buffer)
+    for scanner.Scan() {
+        var span service.ExportedSpan
+        require.NoError(t, json.Unmarshal(scanner.Bytes(), &span))
+        spans = append(spans, span)
+    }
+    require.Len(t, spans, 2)
+
+    require.Equal(t, "child", spans[0].Name)
+    require.Equal(t, "client", spans[0].Kind)
+    require.Equal(t, "parent", spans[1].Name)
+    require.Empty(t, spans[1].ParentSpanID)
+    require.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+    require.Equal(t, spans[1].TraceID, spans[0].TraceID)
+}
@@ -1,9 +1,8 @@
 package service
 
 import (
+    "crypto/subtle"
     "fmt"
-
-    "golang.org/x/crypto/bcrypt"
 )
 
 // User 用户基本信息
@@ -11,28 +10,64 @@ type User struct {
     Username       string
     HashedPassword string
     Role           string
+    // Vendor 用户所属的厂商，厂商用户只能管理该厂商的便携电脑
+    Vendor string
+
+    // TOTPSecret 两步验证的密钥，TOTPEnabled 为 false 时表示还在等待确认
+    TOTPSecret  string
+    TOTPEnabled bool
+    // TOTPLastCounter 最近一次使用的验证码时间窗口，用于防止重放
+    TOTPLastCounter int64
+    // RecoveryCodeHashes 还未使用的一次性恢复码的哈希
+    RecoveryCodeHashes []string
 }
 
-// NewUser 创建一个新的用户
+// NewUser 创建一个新的用户，密码强度由调用方按照 PasswordPolicy 检查
 func NewUser(username, password, role string) (*User, error) {
-    hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-    if err != nil {
-        return nil, fmt.Errorf("cannot hashed password, %w", err)
-    }
-
     user := &User{
-        Username:       username,
-        HashedPassword: string(hashedPassword),
-        Role:           role,
+        Username: username,
+        Role:     role,
+    }
+    if err := user.SetPassword(password); err != nil {
+        return nil, err
     }
 
     return user, nil
 }
 
+// SetPassword 使用 argon2id 哈希并保存新密码
+func (user *User) SetPassword(password string) error {
+    if password == "" {
+        return fmt.Errorf("password must not be empty")
+    }
+
+    hashedPassword, err := HashPassword(password, currentArgon2Params())
+    if err != nil {
+        return fmt.Errorf("cannot hashed password, %w", err)
+    }
+    user.HashedPassword = hashedPassword
+    return nil
+}
+
 // IsCorrentPassword 验证密码是否正确
 func (user *User) IsCorrentPassword(password string) bool {
-    err := bcrypt.CompareHashAndPassword([]byte(user.HashedPassword), []byte(password))
-    return err == nil
+    return ComparePassword(user.HashedPassword, password)
+}
+
+// PasswordNeedsRehash 判断密码是否使用了 bcrypt 或者比当前配置更弱的参数保存
+func (user *User) PasswordNeedsRehash() bool {
+    return PasswordNeedsRehash(user.HashedPassword, currentArgon2Params())
+}
+
+// useRecoveryCodeHash 消耗一个恢复码的哈希，每个恢复码只能使用一次
+func (user *User) useRecoveryCodeHash(hashed string) bool {
+    for i, candidate := range user.RecoveryCodeHashes {
+        if subtle.ConstantTimeCompare([]byte(candidate), []byte(hashed)) == 1 {
+            user.RecoveryCodeHashes = append(user.RecoveryCodeHashes[:i:i], user.RecoveryCodeHashes[i+1:]...)
+            return true
+        }
+    }
+    return false
 }
 
 // Clone 返回一个克隆的 User
@@ -41,5 +76,11 @@ func (user *User) Clone() *User {
         Username:       user.Username,
         HashedPassword: user.HashedPassword,
         Role:           user.Role,
+        Vendor:         user.Vendor,
+
+        TOTPSecret:         user.TOTPSecret,
+        TOTPEnabled:        user.TOTPEnabled,
+        TOTPLastCounter:    user.TOTPLastCounter,
+        RecoveryCodeHashes: append([]string(nil), user.RecoveryCodeHashes...),
     }
 }
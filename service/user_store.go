@@ -5,7 +5,14 @@ import "sync"
 // UserStore 存储用户接口
 type UserStore interface {
     Save(user *User) error
+    Update(user *User) error
     Find(username string) (*User, error)
+    // ReplacePasswordHash 保存的密码哈希仍然是 oldHash 时替换为 newHash，否则返回 false
+    ReplacePasswordHash(username, oldHash, newHash string) (bool, error)
+    // ConsumeTOTP 记录已使用的验证码时间窗口，counter 不大于已记录的值时返回 false
+    ConsumeTOTP(username string, counter int64) (bool, error)
+    // ConsumeRecoveryCode 消耗哈希为 hashed 的恢复码，恢复码不存在或已使用时返回 false
+    ConsumeRecoveryCode(username, hashed string) (bool, error)
 }
 
 // InMemoryUserStore 在内存中存储用户
@@ -33,6 +40,18 @@ func (store *InMemoryUserStore) Save(user *User) error {
     return nil
 }
 
+// Update 更新内存中已存在的用户
+func (store *InMemoryUserStore) Update(user *User) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    if store.users[user.Username] == nil {
+        return ErrNotFound
+    }
+    store.users[user.Username] = user.Clone()
+    return nil
+}
+
 // Find 根据用户名在内存中查询用户
 func (store *InMemoryUserStore) Find(username string) (*User, error) {
     store.mutex.Lock()
@@ -44,3 +63,47 @@ func (store *InMemoryUserStore) Find(username string) (*User, error) {
     }
     return nil, nil
 }
+
+// ReplacePasswordHash 在同一个锁内比较并替换密码哈希，不会覆盖并发修改的其他字段
+func (store *InMemoryUserStore) ReplacePasswordHash(username, oldHash, newHash string) (bool, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user := store.users[username]
+    if user == nil {
+        return false, ErrNotFound
+    }
+    if user.HashedPassword != oldHash {
+        return false, nil
+    }
+    user.HashedPassword = newHash
+    return true, nil
+}
+
+// ConsumeTOTP 在同一个锁内检查并记录已使用的验证码时间窗口，防止并发重放
+func (store *InMemoryUserStore) ConsumeTOTP(username string, counter int64) (bool, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user := store.users[username]
+    if user == nil {
+        return false, ErrNotFound
+    }
+    if counter <= user.TOTPLastCounter {
+        return false, nil
+    }
+    user.TOTPLastCounter = counter
+    return true, nil
+}
+
+// ConsumeRecoveryCode 在同一个锁内检查并删除恢复码，防止并发重放
+func (store *InMemoryUserStore) ConsumeRecoveryCode(username, hashed string) (bool, error) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    user := store.users[username]
+    if user == nil {
+        return false, ErrNotFound
+    }
+    return user.useRecoveryCodeHash(hashed), nil
+}
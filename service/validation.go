@@ -0,0 +1,166 @@
+package service
+
+import (
+    "context"
+    "fmt"
+    "strings"
+
+    "google.golang.org/genproto/googleapis/rpc/errdetails"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+    "google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Validator 一种消息的校验规则，把不合法的字段记录到 violations 中
+type Validator func(msg proto.Message, violations *FieldViolations)
+
+// validators 按消息全名注册的校验规则，只在 init 中写入
+var validators = make(map[protoreflect.FullName]Validator)
+
+// RegisterValidator 注册一种消息的校验规则，同一种消息重复注册时后注册的规则生效，只应该在 init 中调用
+func RegisterValidator(msg proto.Message, validator Validator) {
+    validators[msg.ProtoReflect().Descriptor().FullName()] = validator
+}
+
+// Validate 按照注册的规则校验消息及其嵌套的消息，没有注册规则的消息总是合法的
+// 不合法时返回 InvalidArgument 错误，详情中带有 google.rpc.BadRequest 列出的所有不合法字段
+func Validate(msg proto.Message) error {
+    violations := &FieldViolations{list: new([]*errdetails.BadRequest_FieldViolation)}
+    violations.validate(msg)
+    return violations.Err()
+}
+
+// FieldViolations 收集校验过程中发现的不合法字段，字段路径使用 proto 字段名，例如 laptop.cpu.max_ghz
+type FieldViolations struct {
+    path string
+    list *[]*errdetails.BadRequest_FieldViolation
+}
+
+// Add 记录一个不合法的字段
+func (violations *FieldViolations) Add(field string, description string) {
+    *violations.list = append(*violations.list, &errdetails.BadRequest_FieldViolation{
+        Field:       violations.fieldPath(field),
+        Description: description,
+    })
+}
+
+// Message 按照注册的规则校验嵌套的消息字段，required 为 true 时字段不能为空
+func (violations *FieldViolations) Message(field string, msg proto.Message, required bool) {
+    if msg == nil || !msg.ProtoReflect().IsValid() {
+        if required {
+            violations.Add(field, "is required")
+        }
+        return
+    }
+
+    nested := &FieldViolations{path: violations.fieldPath(field), list: violations.list}
+    nested.validate(msg)
+}
+
+// Enum 检查枚举字段是已经定义的值，allowUnknown 为 false 时也不能是 0 值
+func (violations *FieldViolations) Enum(field string, value protoreflect.Enum, allowUnknown bool) {
+    number := value.Number()
+    if value.Descriptor().Values().ByNumber(number) == nil {
+        violations.Add(field, fmt.Sprintf("unknown value %d", number))
+        return
+    }
+    if number == 0 && !allowUnknown {
+        violations.Add(field, "is required")
+    }
+}
+
+// Err 没有不合法字段时返回 nil，否则返回带有 BadRequest 详情的 InvalidArgument 错误
+func (violations *FieldViolations) Err() error {
+    list := *violations.list
+    if len(list) == 0 {
+        return nil
+    }
+
+    descriptions := make([]string, 0, len(list))
+    for _, violation := range list {
+        descriptions = append(descriptions, violation.GetField()+" "+violation.GetDescription())
+    }
+    st := status.New(codes.InvalidArgument, "invalid request: "+strings.Join(descriptions, "; "))
+    detailed, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: list})
+    if err != nil {
+        return st.Err()
+    }
+    return detailed.Err()
+}
+
+func (violations *FieldViolations) validate(msg proto.Message) {
+    if validator, ok := validators[msg.ProtoReflect().Descriptor().FullName()]; ok {
+        validator(msg, violations)
+    }
+}
+
+func (violations *FieldViolations) fieldPath(field string) string {
+    if violations.path == "" {
+        return field
+    }
+    return violations.path + "." + field
+}
+
+// ValidationInterceptor 按照注册的规则校验请求的拦截器，流式 RPC 中收到的每一条消息都会被校验
+type ValidationInterceptor struct{}
+
+// NewValidationInterceptor 新建一个请求校验拦截器，需要放在授权拦截器之后，未授权的调用方拿不到校验详情
+func NewValidationInterceptor() *ValidationInterceptor {
+    return &ValidationInterceptor{}
+}
+
+// Unary 一元 RPC 请求校验拦截器
+func (interceptor *ValidationInterceptor) Unary() grpc.UnaryServerInterceptor {
+    return func(
+        ctx context.Context,
+        req interface{},
+        info *grpc.UnaryServerInfo,
+        handler grpc.UnaryHandler,
+    ) (interface{}, error) {
+        if msg, ok := req.(proto.Message); ok {
+            if err := Validate(msg); err != nil {
+                return nil, err
+            }
+        }
+        return handler(ctx, req)
+    }
+}
+
+// Stream 流式 RPC 请求校验拦截器
+func (interceptor *ValidationInterceptor) Stream() grpc.StreamServerInterceptor {
+    return func(
+        srv interface{},
+        ss grpc.ServerStream,
+        info *grpc.StreamServerInfo,
+        handler grpc.StreamHandler,
+    ) error {
+        stream := &validatingServerStream{ServerStream: ss}
+        err := handler(srv, stream)
+        // 处理函数会把接收错误包装成其他状态码，这里返回原始的校验错误
+        if stream.err != nil {
+            return stream.err
+        }
+        return err
+    }
+}
+
+// validatingServerStream 校验每一条收到的消息的服务端流
+type validatingServerStream struct {
+    grpc.ServerStream
+    err error
+}
+
+func (stream *validatingServerStream) RecvMsg(m interface{}) error {
+    if err := stream.ServerStream.RecvMsg(m); err != nil {
+        return err
+    }
+    if msg, ok := m.(proto.Message); ok {
+        if err := Validate(msg); err != nil {
+            stream.err = err
+            return err
+        }
+    }
+    return nil
+}
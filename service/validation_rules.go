@@ -0,0 +1,382 @@
+package service
+
+import (
+    "fmt"
+    "math"
+    "net/url"
+
+    "github.com/google/uuid"
+    "github.com/xiusl/pcbook/pb"
+    "google.golang.org/protobuf/proto"
+    "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+    // minLaptopScore 和 maxLaptopScore laptop 评分的范围
+    minLaptopScore = 1
+    maxLaptopScore = 10
+    // maxImageTypeLength 图片类型（扩展名）的最大长度
+    maxImageTypeLength = 16
+    // maxImportBatchSize 导入时每条消息最多包含的便携电脑数
+    maxImportBatchSize = 500
+)
+
+func init() {
+    RegisterValidator(&pb.Laptop{}, validateLaptop)
+    RegisterValidator(&pb.CPU{}, validateCPU)
+    RegisterValidator(&pb.GPU{}, validateGPU)
+    RegisterValidator(&pb.Memory{}, validateMemory)
+    RegisterValidator(&pb.Storage{}, validateStorage)
+    RegisterValidator(&pb.Screen{}, validateScreen)
+    RegisterValidator(&pb.Screen_Resolution{}, validateResolution)
+    RegisterValidator(&pb.Keyboard{}, validateKeyboard)
+    RegisterValidator(&pb.Filter{}, validateFilter)
+
+    RegisterValidator(&pb.CreateLaptopRequest{}, validateCreateLaptopRequest)
+    RegisterValidator(&pb.UpdateLaptopRequest{}, validateUpdateLaptopRequest)
+    RegisterValidator(&pb.SearchLaptopRequest{}, validateSearchLaptopRequest)
+    RegisterValidator(&pb.UploadImageRequest{}, validateUploadImageRequest)
+    RegisterValidator(&pb.RateLaptopRequest{}, validateRateLaptopRequest)
+    RegisterValidator(&pb.WatchLaptopsRequest{}, validateWatchLaptopsRequest)
+    RegisterValidator(&pb.ImportLaptopsRequest{}, validateImportLaptopsRequest)
+    RegisterValidator(&pb.ExportLaptopsRequest{}, validateExportLaptopsRequest)
+
+    RegisterValidator(&pb.LoginRequest{}, validateLoginRequest)
+    RegisterValidator(&pb.VerifyLoginRequest{}, validateVerifyLoginRequest)
+    RegisterValidator(&pb.ConfirmTOTPRequest{}, validateConfirmTOTPRequest)
+    RegisterValidator(&pb.UnlockAccountRequest{}, validateUnlockAccountRequest)
+    RegisterValidator(&pb.ChangePasswordRequest{}, validateChangePasswordRequest)
+    RegisterValidator(&pb.CreateAPIKeyRequest{}, validateCreateAPIKeyRequest)
+    RegisterValidator(&pb.RevokeAPIKeyRequest{}, validateRevokeAPIKeyRequest)
+    RegisterValidator(&pb.QueryAuditLogRequest{}, validateQueryAuditLogRequest)
+    RegisterValidator(&pb.CreateAlertRequest{}, validateCreateAlertRequest)
+    RegisterValidator(&pb.DeleteAlertRequest{}, validateDeleteAlertRequest)
+    RegisterValidator(&pb.CreateWebhookRequest{}, validateCreateWebhookRequest)
+    RegisterValidator(&pb.DeleteWebhookRequest{}, validateDeleteWebhookRequest)
+    RegisterValidator(&pb.ListDeadLettersRequest{}, validateListDeadLettersRequest)
+    RegisterValidator(&pb.ReplayDeadLettersRequest{}, validateReplayDeadLettersRequest)
+}
+
+func validateLaptop(msg proto.Message, v *FieldViolations) {
+    laptop := msg.(*pb.Laptop)
+    if laptop.GetId() != "" {
+        checkUUID(v, "id", laptop.GetId())
+    }
+    checkRequired(v, "brand", laptop.GetBrand())
+    checkRequired(v, "name", laptop.GetName())
+    v.Message("cpu", laptop.GetCpu(), true)
+    v.Message("ram", laptop.GetRam(), true)
+    for i, gpu := range laptop.GetGpus() {
+        v.Message(fmt.Sprintf("gpus[%d]", i), gpu, true)
+    }
+    for i, storage := range laptop.GetStorages() {
+        v.Message(fmt.Sprintf("storages[%d]", i), storage, true)
+    }
+    v.Message("screen", laptop.GetScreen(), true)
+    v.Message("keyboard", laptop.GetKeyboard(), false)
+
+    switch weight := laptop.GetWeight().(type) {
+    case *pb.Laptop_WeightKg:
+        checkPositive(v, "weight_kg", weight.WeightKg)
+    case *pb.Laptop_WeightLb:
+        checkPositive(v, "weight_lb", weight.WeightLb)
+    }
+    checkNonNegative(v, "price_usd", laptop.GetPriceUsd())
+    if laptop.GetUpdatedYear() != nil {
+        checkTimestamp(v, "updated_year", laptop.GetUpdatedYear())
+    }
+}
+
+func validateCPU(msg proto.Message, v *FieldViolations) {
+    cpu := msg.(*pb.CPU)
+    checkRequired(v, "brand", cpu.GetBrand())
+    checkRequired(v, "name", cpu.GetName())
+    if cpu.GetNumberCores() == 0 {
+        v.Add("number_cores", "must be greater than 0")
+    }
+    if cpu.GetNumberThreads() < cpu.GetNumberCores() {
+        v.Add("number_threads", "must not be less than number_cores")
+    }
+    checkFrequency(v, cpu.GetMinGhz(), cpu.GetMaxGhz())
+}
+
+func validateGPU(msg proto.Message, v *FieldViolations) {
+    gpu := msg.(*pb.GPU)
+    checkRequired(v, "brand", gpu.GetBrand())
+    checkRequired(v, "name", gpu.GetName())
+    checkFrequency(v, gpu.GetMinGhz(), gpu.GetMaxGhz())
+    v.Message("memory", gpu.GetMemory(), true)
+}
+
+func validateMemory(msg proto.Message, v *FieldViolations) {
+    memory := msg.(*pb.Memory)
+    if memory.GetValue() == 0 {
+        v.Add("value", "must be greater than 0")
+    }
+    v.Enum("unit", memory.GetUnit(), false)
+}
+
+func validateStorage(msg proto.Message, v *FieldViolations) {
+    storage := msg.(*pb.Storage)
+    v.Enum("driver", storage.GetDriver(), false)
+    v.Message("memory", storage.GetMemory(), true)
+}
+
+func validateScreen(msg proto.Message, v *FieldViolations) {
+    screen := msg.(*pb.Screen)
+    checkPositive(v, "size_inch", float64(screen.GetSizeInch()))
+    v.Message("resolution", screen.GetResolution(), true)
+    v.Enum("panel", screen.GetPanel(), false)
+}
+
+func validateResolution(msg proto.Message, v *FieldViolations) {
+    resolution := msg.(*pb.Screen_Resolution)
+    if resolution.GetWidth() == 0 {
+        v.Add("width", "must be greater than 0")
+    }
+    if resolution.GetHeight() == 0 {
+        v.Add("height", "must be greater than 0")
+    }
+}
+
+func validateKeyboard(msg proto.Message, v *FieldViolations) {
+    keyboard := msg.(*pb.Keyboard)
+    v.Enum("layout", keyboard.GetLayout(), true)
+}
+
+func validateFilter(msg proto.Message, v *FieldViolations) {
+    filter := msg.(*pb.Filter)
+    checkNonNegative(v, "max_price_usd", filter.GetMaxPriceUsd())
+    checkNonNegative(v, "min_cpu_ghz", filter.GetMinCpuGhz())
+    v.Message("min_ram", filter.GetMinRam(), false)
+}
+
+func validateCreateLaptopRequest(msg proto.Message, v *FieldViolations) {
+    v.Message("laptop", msg.(*pb.CreateLaptopRequest).GetLaptop(), true)
+}
+
+func validateUpdateLaptopRequest(msg proto.Message, v *FieldViolations) {
+    laptop := msg.(*pb.UpdateLaptopRequest).GetLaptop()
+    if laptop != nil && laptop.GetId() == "" {
+        v.Add("laptop.id", "is required")
+    }
+    v.Message("laptop", laptop, true)
+}
+
+func validateSearchLaptopRequest(msg proto.Message, v *FieldViolations) {
+    v.Message("filter", msg.(*pb.SearchLaptopRequest).GetFilter(), true)
+}
+
+func validateWatchLaptopsRequest(msg proto.Message, v *FieldViolations) {
+    v.Message("filter", msg.(*pb.WatchLaptopsRequest).GetFilter(), false)
+}
+
+// validateImportLaptopsRequest 只检查批次的大小，每个便携电脑由服务单独检查并报告结果
+func validateImportLaptopsRequest(msg proto.Message, v *FieldViolations) {
+    req := msg.(*pb.ImportLaptopsRequest)
+    if req.GetData() == nil {
+        v.Add("data", "is required")
+    }
+    if len(req.GetBatch().GetLaptops()) > maxImportBatchSize {
+        v.Add("batch.laptops", fmt.Sprintf("must contain at most %d laptops", maxImportBatchSize))
+    }
+}
+
+func validateExportLaptopsRequest(msg proto.Message, v *FieldViolations) {
+    v.Message("filter", msg.(*pb.ExportLaptopsRequest).GetFilter(), false)
+}
+
+func validateUploadImageRequest(msg proto.Message, v *FieldViolations) {
+    switch data := msg.(*pb.UploadImageRequest).GetData().(type) {
+    case *pb.UploadImageRequest_Info:
+        checkUUID(v, "info.laptop_id", data.Info.GetLaptopId())
+        imageType := data.Info.GetImageType()
+        checkRequired(v, "info.image_type", imageType)
+        if len(imageType) > maxImageTypeLength {
+            v.Add("info.image_type", fmt.Sprintf("must be at most %d characters", maxImageTypeLength))
+        }
+    case *pb.UploadImageRequest_ChunkData:
+        if len(data.ChunkData) == 0 {
+            v.Add("chunk_data", "must not be empty")
+        }
+    default:
+        v.Add("data", "one of info or chunk_data is required")
+    }
+}
+
+func validateRateLaptopRequest(msg proto.Message, v *FieldViolations) {
+    req := msg.(*pb.RateLaptopRequest)
+    checkUUID(v, "laptop_id", req.GetLaptopId())
+    if score := req.GetScore(); !(score >= minLaptopScore && score <= maxLaptopScore) {
+        v.Add("score", fmt.Sprintf("must be between %d and %d", minLaptopScore, maxLaptopScore))
+    }
+}
+
+func validateLoginRequest(msg proto.Message, v *FieldViolations) {
+    req := msg.(*pb.LoginRequest)
+    checkRequired(v, "username", req.GetUsername())
+    checkRequired(v, "password", req.GetPassword())
+}
+
+func validateVerifyLoginRequest(msg proto.Message, v *FieldViolations) {
+    req := msg.(*pb.VerifyLoginRequest)
+    checkRequired(v, "mfa_challenge", req.GetMfaChallenge())
+    switch factor := req.GetFactor().(type) {
+    case *pb.VerifyLoginRequest_TotpCode:
+        checkRequired(v, "totp_code", factor.TotpCode)
+    case *pb.VerifyLoginRequest_RecoveryCode:
+        checkRequired(v, "recovery_code", factor.RecoveryCode)
+    default:
+        v.Add("factor", "one of totp_code or recovery_code is required")
+    }
+}
+
+func validateConfirmTOTPRequest(msg proto.Message, v *FieldViolations) {
+    checkRequired(v, "totp_code", msg.(*pb.ConfirmTOTPRequest).GetTotpCode())
+}
+
+func validateUnlockAccountRequest(msg proto.Message, v *FieldViolations) {
+    checkRequired(v, "username", msg.(*pb.UnlockAccountRequest).GetUsername())
+}
+
+func validateChangePasswordRequest(msg proto.Message, v *FieldViolations) {
+    req := msg.(*pb.ChangePasswordRequest)
+    checkRequired(v, "current_password", req.GetCurrentPassword())
+    checkRequired(v, "new_password", req.GetNewPassword())
+}
+
+func validateCreateAPIKeyRequest(msg proto.Message, v *FieldViolations) {
+    req := msg.(*pb.CreateAPIKeyRequest)
+    checkRequired(v, "name", req.GetName())
+    if len(req.GetRoles()) == 0 {
+        v.Add("roles", "must have at least one role")
+    }
+    if req.GetExpiresAt() != nil {
+        checkTimestamp(v, "expires_at", req.GetExpiresAt())
+    }
+}
+
+func validateRevokeAPIKeyRequest(msg proto.Message, v *FieldViolations) {
+    checkRequired(v, "id", msg.(*pb.RevokeAPIKeyRequest).GetId())
+}
+
+func validateQueryAuditLogRequest(msg proto.Message, v *FieldViolations) {
+    req := msg.(*pb.QueryAuditLogRequest)
+    start, end := req.GetStartTime(), req.GetEndTime()
+    if start != nil {
+        checkTimestamp(v, "start_time", start)
+    }
+    if end != nil {
+        checkTimestamp(v, "end_time", end)
+    }
+    if start != nil && end != nil && end.AsTime().Before(start.AsTime()) {
+        v.Add("end_time", "must not be before start_time")
+    }
+}
+
+func validateCreateAlertRequest(msg proto.Message, v *FieldViolations) {
+    req := msg.(*pb.CreateAlertRequest)
+    checkRequired(v, "name", req.GetName())
+    v.Message("filter", req.GetFilter(), false)
+    if req.GetFilter().GetMaxPriceUsd() != 0 {
+        v.Add("filter.max_price_usd", "is not used by alerts, set target_price_usd instead")
+    }
+    checkNonNegative(v, "target_price_usd", req.GetTargetPriceUsd())
+    if req.GetWebhookUrl() != "" {
+        checkWebhookURL(v, "webhook_url", req.GetWebhookUrl())
+    }
+}
+
+func validateDeleteAlertRequest(msg proto.Message, v *FieldViolations) {
+    checkUUID(v, "id", msg.(*pb.DeleteAlertRequest).GetId())
+}
+
+func validateCreateWebhookRequest(msg proto.Message, v *FieldViolations) {
+    req := msg.(*pb.CreateWebhookRequest)
+    checkWebhookURL(v, "url", req.GetUrl())
+    for i, eventType := range req.GetEventTypes() {
+        if _, ok := pb.LaptopEvent_Type_name[int32(eventType)]; !ok || eventType == pb.LaptopEvent_UNKNOWN {
+            v.Add(fmt.Sprintf("event_types[%d]", i), "must be a known event type")
+        }
+    }
+}
+
+func validateDeleteWebhookRequest(msg proto.Message, v *FieldViolations) {
+    checkUUID(v, "id", msg.(*pb.DeleteWebhookRequest).GetId())
+}
+
+func validateListDeadLettersRequest(msg proto.Message, v *FieldViolations) {
+    if webhookID := msg.(*pb.ListDeadLettersRequest).GetWebhookId(); webhookID != "" {
+        checkUUID(v, "webhook_id", webhookID)
+    }
+}
+
+func validateReplayDeadLettersRequest(msg proto.Message, v *FieldViolations) {
+    req := msg.(*pb.ReplayDeadLettersRequest)
+    if len(req.GetIds()) == 0 && req.GetWebhookId() == "" {
+        v.Add("ids", "is required when webhook_id is not set")
+    }
+    for i, id := range req.GetIds() {
+        checkUUID(v, fmt.Sprintf("ids[%d]", i), id)
+    }
+    if req.GetWebhookId() != "" {
+        checkUUID(v, "webhook_id", req.GetWebhookId())
+    }
+}
+
+func checkRequired(v *FieldViolations, field string, value string) {
+    if value == "" {
+        v.Add(field, "is required")
+    }
+}
+
+func checkUUID(v *FieldViolations, field string, value string) {
+    if value == "" {
+        v.Add(field, "is required")
+        return
+    }
+    if _, err := uuid.Parse(value); err != nil {
+        v.Add(field, "must be a UUID")
+    }
+}
+
+// checkWebhookURL 检查 webhook 地址是绝对的 http 或者 https 地址，并且不指向本机、链路本地或者内网地址
+func checkWebhookURL(v *FieldViolations, field string, value string) {
+    u, err := url.Parse(value)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        v.Add(field, "must be an absolute http or https URL")
+        return
+    }
+    if isBlockedWebhookHost(u.Hostname()) {
+        v.Add(field, "must not point to a loopback, link-local or private address")
+    }
+}
+
+// checkPositive 检查数值大于 0，NaN 和无穷大都不合法
+func checkPositive(v *FieldViolations, field string, value float64) {
+    if !(value > 0) || math.IsInf(value, 0) {
+        v.Add(field, "must be greater than 0")
+    }
+}
+
+// checkNonNegative 检查数值不小于 0，NaN 和无穷大都不合法
+func checkNonNegative(v *FieldViolations, field string, value float64) {
+    if !(value >= 0) || math.IsInf(value, 0) {
+        v.Add(field, "must not be negative")
+    }
+}
+
+// checkFrequency 检查主频的范围，最高主频不能低于最低主频
+func checkFrequency(v *FieldViolations, minGhz float64, maxGhz float64) {
+    checkPositive(v, "min_ghz", minGhz)
+    checkPositive(v, "max_ghz", maxGhz)
+    if maxGhz < minGhz {
+        v.Add("max_ghz", "must not be less than min_ghz")
+    }
+}
+
+func checkTimestamp(v *FieldViolations, field string, value *timestamppb.Timestamp) {
+    if err := value.CheckValid(); err != nil {
+        v.Add(field, "is not a valid timestamp")
+    }
+}
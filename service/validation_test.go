@@ -0,0 +1,240 @@
+package service_test
+
+import (
+    "context"
+    "io"
+    "math"
+    "net"
+    "testing"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/sample"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/genproto/googleapis/rpc/errdetails"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+)
+
+// fieldViolations 取出错误详情中的不合法字段
+func fieldViolations(t *testing.T, err error) map[string]string {
+    st, ok := status.FromError(err)
+    require.True(t, ok)
+    require.Equal(t, codes.InvalidArgument, st.Code(), st.Message())
+
+    violations := make(map[string]string)
+    for _, detail := range st.Details() {
+        if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+            for _, violation := range badRequest.GetFieldViolations() {
+                violations[violation.GetField()] = violation.GetDescription()
+            }
+        }
+    }
+    require.NotEmpty(t, violations)
+    return violations
+}
+
+func TestValidateLaptop(t *testing.T) {
+    testCases := []struct {
+        name   string
+        modify func(laptop *pb.Laptop)
+        // fields 为空表示合法
+        fields []string
+    }{
+        {
+            name:   "valid",
+            modify: func(laptop *pb.Laptop) {},
+        },
+        {
+            name:   "no id",
+            modify: func(laptop *pb.Laptop) { laptop.Id = "" },
+        },
+        {
+            name: "invalid id and empty brand",
+            modify: func(laptop *pb.Laptop) {
+                laptop.Id = "invalid-id"
+                laptop.Brand = ""
+            },
+            fields: []string{"laptop.id", "laptop.brand"},
+        },
+        {
+            name:   "negative price",
+            modify: func(laptop *pb.Laptop) { laptop.PriceUsd = -1 },
+            fields: []string{"laptop.price_usd"},
+        },
+        {
+            name:   "NaN price",
+            modify: func(laptop *pb.Laptop) { laptop.PriceUsd = math.NaN() },
+            fields: []string{"laptop.price_usd"},
+        },
+        {
+            name: "max ghz less than min ghz",
+            modify: func(laptop *pb.Laptop) {
+                laptop.Cpu.MinGhz = 3.5
+                laptop.Cpu.MaxGhz = 2.0
+            },
+            fields: []string{"laptop.cpu.max_ghz"},
+        },
+        {
+            name: "fewer threads than cores",
+            modify: func(laptop *pb.Laptop) {
+                laptop.Cpu.NumberCores = 8
+                laptop.Cpu.NumberThreads = 4
+            },
+            fields: []string{"laptop.cpu.number_threads"},
+        },
+        {
+            name:   "zero size screen",
+            modify: func(laptop *pb.Laptop) { laptop.Screen.SizeInch = 0 },
+            fields: []string{"laptop.screen.size_inch"},
+        },
+        {
+            name: "unknown enum values",
+            modify: func(laptop *pb.Laptop) {
+                laptop.Ram.Unit = pb.Memory_Unit(42)
+                laptop.Storages[1].Driver = pb.Storage_UNKNOWN
+                laptop.Keyboard.Layout = pb.Keyboard_Layout(9)
+            },
+            fields: []string{"laptop.ram.unit", "laptop.storages[1].driver", "laptop.keyboard.layout"},
+        },
+        {
+            name: "missing nested messages",
+            modify: func(laptop *pb.Laptop) {
+                laptop.Cpu = nil
+                laptop.Gpus[0].Memory = nil
+                laptop.Screen.Resolution = nil
+            },
+            fields: []string{"laptop.cpu", "laptop.gpus[0].memory", "laptop.screen.resolution"},
+        },
+        {
+            name:   "negative weight",
+            modify: func(laptop *pb.Laptop) { laptop.Weight = &pb.Laptop_WeightLb{WeightLb: -2} },
+            fields: []string{"laptop.weight_lb"},
+        },
+    }
+
+    for _, tc := range testCases {
+        tc := tc
+        t.Run(tc.name, func(t *testing.T) {
+            laptop := sample.NewLaptop()
+            tc.modify(laptop)
+
+            err := service.Validate(&pb.CreateLaptopRequest{Laptop: laptop})
+            if len(tc.fields) == 0 {
+                require.NoError(t, err)
+                return
+            }
+
+            violations := fieldViolations(t, err)
+            require.Len(t, violations, len(tc.fields), violations)
+            for _, field := range tc.fields {
+                require.Contains(t, violations, field)
+            }
+        })
+    }
+}
+
+func TestValidateRequests(t *testing.T) {
+    laptopNoID := sample.NewLaptop()
+    laptopNoID.Id = ""
+
+    testCases := []struct {
+        name   string
+        req    proto.Message
+        fields []string
+    }{
+        {"create without laptop", &pb.CreateLaptopRequest{}, []string{"laptop"}},
+        {"update without id", &pb.UpdateLaptopRequest{Laptop: laptopNoID}, []string{"laptop.id"}},
+        {"search without filter", &pb.SearchLaptopRequest{}, []string{"filter"}},
+        {"search with negative price", &pb.SearchLaptopRequest{Filter: &pb.Filter{MaxPriceUsd: -1}}, []string{"filter.max_price_usd"}},
+        {"search", &pb.SearchLaptopRequest{Filter: &pb.Filter{MaxPriceUsd: 2000}}, nil},
+        {"upload without data", &pb.UploadImageRequest{}, []string{"data"}},
+        {
+            "upload info",
+            &pb.UploadImageRequest{Data: &pb.UploadImageRequest_Info{Info: &pb.ImageInfo{LaptopId: "laptop"}}},
+            []string{"info.laptop_id", "info.image_type"},
+        },
+        {"rate out of range", &pb.RateLaptopRequest{LaptopId: sample.NewLaptop().Id, Score: 11}, []string{"score"}},
+        {"rate", &pb.RateLaptopRequest{LaptopId: sample.NewLaptop().Id, Score: 7}, nil},
+        {"login", &pb.LoginRequest{Username: "alice"}, []string{"password"}},
+        {"verify login", &pb.VerifyLoginRequest{MfaChallenge: "challenge"}, []string{"factor"}},
+        {"create api key", &pb.CreateAPIKeyRequest{}, []string{"name", "roles"}},
+        {"create webhook", &pb.CreateWebhookRequest{Url: "https://partner.example.com/hooks"}, nil},
+        {"create webhook to loopback", &pb.CreateWebhookRequest{Url: "http://127.0.0.1:8080/hooks"}, []string{"url"}},
+        {"create webhook to localhost", &pb.CreateWebhookRequest{Url: "http://localhost/hooks"}, []string{"url"}},
+        {"create webhook to ipv6 loopback", &pb.CreateWebhookRequest{Url: "http://[::1]/hooks"}, []string{"url"}},
+        {"create webhook to private address", &pb.CreateWebhookRequest{Url: "https://10.0.0.5/hooks"}, []string{"url"}},
+        {"create alert to link-local address", &pb.CreateAlertRequest{
+            Name:       "metadata",
+            Filter:     &pb.Filter{},
+            WebhookUrl: "http://169.254.169.254/latest/meta-data",
+        }, []string{"webhook_url"}},
+    }
+
+    for _, tc := range testCases {
+        tc := tc
+        t.Run(tc.name, func(t *testing.T) {
+            err := service.Validate(tc.req)
+            if len(tc.fields) == 0 {
+                require.NoError(t, err)
+                return
+            }
+
+            violations := fieldViolations(t, err)
+            require.Len(t, violations, len(tc.fields), violations)
+            for _, field := range tc.fields {
+                require.Contains(t, violations, field)
+            }
+        })
+    }
+}
+
+func TestValidationInterceptor(t *testing.T) {
+    validation := service.NewValidationInterceptor()
+    grpcServer := grpc.NewServer(
+        grpc.UnaryInterceptor(validation.Unary()),
+        grpc.StreamInterceptor(validation.Stream()),
+    )
+    laptopStore := service.NewInMemoryLaptopStore()
+    laptopServer := service.NewLaptopServer(laptopStore, nil, service.NewInMemoryRatingStore())
+    pb.RegisterLaptopServicesServer(grpcServer, laptopServer)
+
+    listener, err := net.Listen("tcp", ":0")
+    require.NoError(t, err)
+    go grpcServer.Serve(listener)
+    defer grpcServer.Stop()
+
+    conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+    require.NoError(t, err)
+    defer conn.Close()
+    laptopClient := pb.NewLaptopServicesClient(conn)
+
+    // 一元 RPC 中不合法的请求不会到达处理函数
+    laptop := sample.NewLaptop()
+    laptop.Cpu.NumberThreads = 0
+    _, err = laptopClient.CreateLaptop(context.Background(), &pb.CreateLaptopRequest{Laptop: laptop})
+    require.Contains(t, fieldViolations(t, err), "laptop.cpu.number_threads")
+
+    stored, err := laptopStore.FindByID(laptop.Id)
+    require.NoError(t, err)
+    require.Nil(t, stored)
+
+    // 流式 RPC 中的每一条消息都会被校验，处理函数包装的接收错误不会覆盖校验错误
+    laptop = sample.NewLaptop()
+    _, err = laptopClient.CreateLaptop(context.Background(), &pb.CreateLaptopRequest{Laptop: laptop})
+    require.NoError(t, err)
+
+    stream, err := laptopClient.RateLaptop(context.Background())
+    require.NoError(t, err)
+    require.NoError(t, stream.Send(&pb.RateLaptopRequest{LaptopId: laptop.Id, Score: 8}))
+    res, err := stream.Recv()
+    require.NoError(t, err)
+    require.Equal(t, uint32(1), res.GetRatedCount())
+
+    require.NoError(t, stream.Send(&pb.RateLaptopRequest{LaptopId: laptop.Id, Score: 0}))
+    _, err = stream.Recv()
+    require.NotEqual(t, io.EOF, err)
+    require.Contains(t, fieldViolations(t, err), "score")
+}
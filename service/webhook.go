@@ -0,0 +1,509 @@
+package service
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/xiusl/pcbook/logging"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/serializer"
+)
+
+// webhookLog webhook 发送相关的日志
+var webhookLog = logging.New("webhook")
+
+// 发送 webhook 时的请求头
+const (
+    // WebhookSignatureHeader 请求内容的签名，格式为 sha256=<hex>
+    WebhookSignatureHeader = "X-Pcbook-Signature"
+    // WebhookTimestampHeader 签名时的 Unix 时间戳（秒），接收方可以据此拒绝重放的旧请求
+    WebhookTimestampHeader = "X-Pcbook-Timestamp"
+    // WebhookDeliveryHeader 发送的 ID，重试和重放时不变
+    WebhookDeliveryHeader = "X-Pcbook-Delivery"
+    // WebhookEventHeader 事件类型
+    WebhookEventHeader = "X-Pcbook-Event"
+)
+
+// WebhookConfig webhook 发送配置
+type WebhookConfig struct {
+    // Workers 并发发送的数量
+    Workers int `yaml:"workers"`
+    // QueueSize 等待发送的队列长度，队列满时直接进入死信队列
+    QueueSize int `yaml:"queue_size"`
+    // Timeout 发送一次的超时时间
+    Timeout time.Duration `yaml:"timeout"`
+    // MaxAttempts 每个事件最多发送的次数，包括第一次
+    MaxAttempts int `yaml:"max_attempts"`
+    // InitialBackoff 第一次重试前的等待时间，之后每次翻倍
+    InitialBackoff time.Duration `yaml:"initial_backoff"`
+    // MaxBackoff 重试前最长的等待时间
+    MaxBackoff time.Duration `yaml:"max_backoff"`
+    // MaxDeadLetters 死信队列最多保存的数量，超出时丢弃最早的死信
+    MaxDeadLetters int `yaml:"max_dead_letters"`
+    // DeadLetterFile 保存死信的文件，为空时只保存在内存中，重启后丢失
+    DeadLetterFile string `yaml:"dead_letter_file"`
+    // AllowPrivateAddresses 允许发送到本机和内网地址，只用于测试
+    AllowPrivateAddresses bool `yaml:"-"`
+}
+
+// DefaultWebhookConfig 默认的 webhook 发送配置
+func DefaultWebhookConfig() WebhookConfig {
+    return WebhookConfig{
+        Workers:        4,
+        QueueSize:      1000,
+        Timeout:        5 * time.Second,
+        MaxAttempts:    5,
+        InitialBackoff: time.Second,
+        MaxBackoff:     time.Minute,
+        MaxDeadLetters: 10000,
+        DeadLetterFile: "dead_letters.jsonl",
+    }
+}
+
+// Validate 检查 webhook 发送配置
+func (config WebhookConfig) Validate() error {
+    if config.Workers < 1 {
+        return fmt.Errorf("workers must be at least 1")
+    }
+    if config.QueueSize < 1 {
+        return fmt.Errorf("queue_size must be at least 1")
+    }
+    if config.Timeout <= 0 {
+        return fmt.Errorf("timeout must be positive")
+    }
+    if config.MaxAttempts < 1 {
+        return fmt.Errorf("max_attempts must be at least 1")
+    }
+    if config.InitialBackoff <= 0 {
+        return fmt.Errorf("initial_backoff must be positive")
+    }
+    if config.MaxBackoff < config.InitialBackoff {
+        return fmt.Errorf("max_backoff must not be less than initial_backoff")
+    }
+    if config.MaxDeadLetters < 1 {
+        return fmt.Errorf("max_dead_letters must be at least 1")
+    }
+    return nil
+}
+
+// Webhook 接收便携电脑事件的外部地址，密钥用于给请求签名，需要保存明文
+type Webhook struct {
+    ID         string
+    URL        string
+    EventTypes []pb.LaptopEvent_Type
+    Secret     string
+    CreatedBy  string
+    CreatedAt  time.Time
+}
+
+// NewWebhook 创建一个 webhook 并生成签名密钥，eventTypes 为空时接收所有事件
+func NewWebhook(url string, eventTypes []pb.LaptopEvent_Type, createdBy string) (*Webhook, error) {
+    id, err := uuid.NewRandom()
+    if err != nil {
+        return nil, fmt.Errorf("cannot generate webhook id: %w", err)
+    }
+
+    secret := make([]byte, 32)
+    if _, err := rand.Read(secret); err != nil {
+        return nil, fmt.Errorf("cannot generate webhook secret: %w", err)
+    }
+
+    webhook := &Webhook{
+        ID:         id.String(),
+        URL:        url,
+        EventTypes: append([]pb.LaptopEvent_Type(nil), eventTypes...),
+        Secret:     hex.EncodeToString(secret),
+        CreatedBy:  createdBy,
+        CreatedAt:  time.Now(),
+    }
+    return webhook, nil
+}
+
+// Accepts 判断 webhook 是否接收该类型的事件
+func (webhook *Webhook) Accepts(eventType pb.LaptopEvent_Type) bool {
+    if len(webhook.EventTypes) == 0 {
+        return true
+    }
+    for _, accepted := range webhook.EventTypes {
+        if accepted == eventType {
+            return true
+        }
+    }
+    return false
+}
+
+// Clone 返回一个克隆的 Webhook
+func (webhook *Webhook) Clone() *Webhook {
+    other := *webhook
+    other.EventTypes = append([]pb.LaptopEvent_Type(nil), webhook.EventTypes...)
+    return &other
+}
+
+// WebhookSignature 计算请求内容的签名，内容为 HMAC-SHA256(secret, timestamp + "." + body)
+func WebhookSignature(secret string, timestamp int64, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+    mac.Write([]byte("."))
+    mac.Write(body)
+    return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDelivery 一个事件向一个 webhook 的发送
+type webhookDelivery struct {
+    id        string
+    webhookID string
+    event     *pb.LaptopEvent
+    // attempts 已经发送的次数，backoff 下一次重试前的等待时间
+    attempts int
+    backoff  time.Duration
+}
+
+// errWebhookDeleted 重试时 webhook 已经被删除
+var errWebhookDeleted = errors.New("webhook is deleted")
+
+// WebhookDispatcher 订阅便携电脑事件，签名后发送到所有接收该事件的 webhook
+// 发送失败时按指数退避重试，重试多次仍然失败或者不能重试的事件保存到死信队列，可以重放
+// 等待重试的发送由定时器重新加入队列，不占用发送的 goroutine
+type WebhookDispatcher struct {
+    webhookStore    WebhookStore
+    deadLetterStore DeadLetterStore
+    laptopStore     LaptopStore
+    config          WebhookConfig
+    client          *http.Client
+    queue           chan *webhookDelivery
+    // overflow 发送队列满时等待保存到死信队列的发送，不在订阅事件的回调中写入死信存储
+    overflow chan *webhookDelivery
+
+    mutex   sync.Mutex
+    retries map[*webhookDelivery]*time.Timer
+    stopped bool
+}
+
+// NewWebhookDispatcher 新建一个 webhook 发送器，需要调用 Run 开始发送
+func NewWebhookDispatcher(webhookStore WebhookStore, deadLetterStore DeadLetterStore, laptopStore LaptopStore, config WebhookConfig) *WebhookDispatcher {
+    return &WebhookDispatcher{
+        webhookStore:    webhookStore,
+        deadLetterStore: deadLetterStore,
+        laptopStore:     laptopStore,
+        config:          config,
+        client:          newWebhookClient(config.Timeout, config.AllowPrivateAddresses),
+        queue:           make(chan *webhookDelivery, config.QueueSize),
+        overflow:        make(chan *webhookDelivery, config.QueueSize),
+        retries:         make(map[*webhookDelivery]*time.Timer),
+    }
+}
+
+// Run 发送之后发生的便携电脑事件，直到 ctx 结束或者便携电脑存储不再接受订阅
+// 结束时正在等待重试和还在队列中的事件都保存到死信队列，使用 FileDeadLetterStore 时重启后可以重放
+func (dispatcher *WebhookDispatcher) Run(ctx context.Context) error {
+    workerCtx, cancel := context.WithCancel(ctx)
+    var wg sync.WaitGroup
+    for i := 0; i < dispatcher.config.Workers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            dispatcher.work(workerCtx)
+        }()
+    }
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        dispatcher.saveOverflow(workerCtx)
+    }()
+    defer func() {
+        cancel()
+        wg.Wait()
+        dispatcher.stopRetries()
+        dispatcher.drain()
+    }()
+
+    var next uint64
+    for {
+        err := dispatcher.laptopStore.Watch(ctx, nil, next, func(event *pb.LaptopEvent) error {
+            next = event.GetRevision() + 1
+            dispatcher.Dispatch(ctx, event)
+            return nil
+        })
+        if !errors.Is(err, ErrCompacted) {
+            return err
+        }
+        // 入队不会阻塞，只有在事件非常多的时候才会落后，跳过落后的事件继续发送
+        webhookLog.Error(ctx, "webhook dispatcher fell behind, skipping laptop events", "error", err)
+        next = 0
+    }
+}
+
+// Dispatch 把事件加入所有接收该事件的 webhook 的发送队列，队列满时交给后台保存到死信队列，不会阻塞
+func (dispatcher *WebhookDispatcher) Dispatch(ctx context.Context, event *pb.LaptopEvent) {
+    webhooks, err := dispatcher.webhookStore.List()
+    if err != nil {
+        webhookLog.Error(ctx, "cannot load webhooks", "error", err)
+        return
+    }
+
+    for _, webhook := range webhooks {
+        if !webhook.Accepts(event.GetType()) {
+            continue
+        }
+        delivery := &webhookDelivery{
+            id:        uuid.New().String(),
+            webhookID: webhook.ID,
+            event:     event,
+        }
+        if dispatcher.enqueue(delivery) {
+            continue
+        }
+        select {
+        case dispatcher.overflow <- delivery:
+        default:
+            // 死信存储也跟不上时丢弃事件
+            webhookDeliveries.WithLabelValues("dropped").Inc()
+            webhookLog.Error(ctx, "webhook delivery and dead letter queues are full, dropping event",
+                "webhook_id", delivery.webhookID, "delivery_id", delivery.id, "revision", event.GetRevision())
+        }
+    }
+}
+
+// Replay 把死信重新加入发送队列，ids 为空时重放 webhookID 的所有死信
+// 返回重新加入队列的数量和因为 webhook 已经删除或者队列已满而跳过的数量
+func (dispatcher *WebhookDispatcher) Replay(ctx context.Context, ids []string, webhookID string) (int, int, error) {
+    var letters []*DeadLetter
+    if len(ids) > 0 {
+        for _, id := range ids {
+            letter, err := dispatcher.deadLetterStore.Find(id)
+            if err != nil {
+                return 0, 0, err
+            }
+            if letter == nil {
+                return 0, 0, fmt.Errorf("dead letter %s: %w", id, ErrNotFound)
+            }
+            letters = append(letters, letter)
+        }
+    } else {
+        var err error
+        letters, err = dispatcher.deadLetterStore.List(webhookID, 0)
+        if err != nil {
+            return 0, 0, err
+        }
+    }
+
+    replayed, skipped := 0, 0
+    for _, letter := range letters {
+        webhook, err := dispatcher.webhookStore.Find(letter.WebhookID)
+        if err != nil {
+            return replayed, skipped, err
+        }
+        delivery := &webhookDelivery{
+            id:        letter.DeliveryID,
+            webhookID: letter.WebhookID,
+            event:     letter.Event,
+        }
+        if webhook == nil || !dispatcher.enqueue(delivery) {
+            skipped++
+            continue
+        }
+        // 重放再次失败时会以新的 ID 进入死信队列，先入队再删除不会冲突
+        if err := dispatcher.deadLetterStore.Remove(letter.ID); err != nil && !errors.Is(err, ErrNotFound) {
+            return replayed, skipped, err
+        }
+        replayed++
+        webhookLog.Info(ctx, "dead letter replayed", "letter_id", letter.ID, "webhook_id", letter.WebhookID, "delivery_id", letter.DeliveryID)
+    }
+    return replayed, skipped, nil
+}
+
+// enqueue 不阻塞地把发送加入队列，队列已满时返回 false
+func (dispatcher *WebhookDispatcher) enqueue(delivery *webhookDelivery) bool {
+    select {
+    case dispatcher.queue <- delivery:
+        return true
+    default:
+        return false
+    }
+}
+
+// work 从队列中取出发送并发送，直到 ctx 结束
+func (dispatcher *WebhookDispatcher) work(ctx context.Context) {
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case delivery := <-dispatcher.queue:
+            dispatcher.deliver(ctx, delivery)
+        }
+    }
+}
+
+// saveOverflow 把队列满时没有加入队列的发送保存到死信队列，直到 ctx 结束
+func (dispatcher *WebhookDispatcher) saveOverflow(ctx context.Context) {
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case delivery := <-dispatcher.overflow:
+            dispatcher.deadLetter(ctx, delivery, 0, errors.New("delivery queue is full"))
+        }
+    }
+}
+
+// deliver 发送一次事件，可以重试的失败安排在退避时间之后重试，最终失败时保存到死信队列
+func (dispatcher *WebhookDispatcher) deliver(ctx context.Context, delivery *webhookDelivery) {
+    delivery.attempts++
+    retry, err := dispatcher.send(ctx, delivery)
+    if err == nil {
+        webhookDeliveries.WithLabelValues("delivered").Inc()
+        webhookLog.Debug(ctx, "webhook delivered", "webhook_id", delivery.webhookID, "delivery_id", delivery.id, "attempts", delivery.attempts)
+        return
+    }
+    if errors.Is(err, errWebhookDeleted) {
+        webhookDeliveries.WithLabelValues("discarded").Inc()
+        return
+    }
+    if !retry || delivery.attempts >= dispatcher.config.MaxAttempts {
+        dispatcher.deadLetter(ctx, delivery, delivery.attempts, err)
+        return
+    }
+
+    if delivery.backoff == 0 {
+        delivery.backoff = dispatcher.config.InitialBackoff
+    }
+    webhookDeliveries.WithLabelValues("retried").Inc()
+    webhookLog.Warn(ctx, "webhook delivery failed, retrying", "webhook_id", delivery.webhookID,
+        "delivery_id", delivery.id, "attempt", delivery.attempts, "backoff", delivery.backoff, "error", err)
+    dispatcher.scheduleRetry(delivery, err)
+}
+
+// scheduleRetry 在退避时间之后把发送重新加入队列，队列已满时保存到死信队列
+func (dispatcher *WebhookDispatcher) scheduleRetry(delivery *webhookDelivery, cause error) {
+    backoff := delivery.backoff
+    delivery.backoff *= 2
+    if delivery.backoff > dispatcher.config.MaxBackoff {
+        delivery.backoff = dispatcher.config.MaxBackoff
+    }
+
+    dispatcher.mutex.Lock()
+    defer dispatcher.mutex.Unlock()
+    if dispatcher.stopped {
+        dispatcher.deadLetter(context.Background(), delivery, delivery.attempts, fmt.Errorf("server is shutting down, last error: %w", cause))
+        return
+    }
+    dispatcher.retries[delivery] = time.AfterFunc(backoff, func() {
+        // 在锁内入队，stopRetries 之后不会再有发送加入队列
+        dispatcher.mutex.Lock()
+        _, pending := dispatcher.retries[delivery]
+        delete(dispatcher.retries, delivery)
+        queued := pending && dispatcher.enqueue(delivery)
+        dispatcher.mutex.Unlock()
+
+        if pending && !queued {
+            dispatcher.deadLetter(context.Background(), delivery, delivery.attempts, fmt.Errorf("delivery queue is full, last error: %w", cause))
+        }
+    })
+}
+
+// stopRetries 停止所有等待重试的定时器，把这些发送保存到死信队列
+func (dispatcher *WebhookDispatcher) stopRetries() {
+    dispatcher.mutex.Lock()
+    retries := dispatcher.retries
+    dispatcher.retries = make(map[*webhookDelivery]*time.Timer)
+    dispatcher.stopped = true
+    dispatcher.mutex.Unlock()
+
+    for delivery, timer := range retries {
+        timer.Stop()
+        dispatcher.deadLetter(context.Background(), delivery, delivery.attempts, errors.New("server is shutting down while waiting to retry"))
+    }
+}
+
+// send 签名后发送一次事件，返回的 retry 表示失败是否可以重试
+// 网络错误、超时、限流和 5xx 可以重试，其他 4xx 说明接收方拒绝了请求，不允许连接的地址也不重试
+func (dispatcher *WebhookDispatcher) send(ctx context.Context, delivery *webhookDelivery) (bool, error) {
+    webhook, err := dispatcher.webhookStore.Find(delivery.webhookID)
+    if err != nil {
+        return true, fmt.Errorf("cannot find webhook: %w", err)
+    }
+    if webhook == nil {
+        return false, errWebhookDeleted
+    }
+
+    payload := &pb.WebhookPayload{
+        DeliveryId: delivery.id,
+        WebhookId:  webhook.ID,
+        Event:      delivery.event,
+    }
+    body, err := serializer.ConvertProtobufToJSON(payload)
+    if err != nil {
+        return false, fmt.Errorf("cannot marshal payload: %w", err)
+    }
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewBufferString(body))
+    if err != nil {
+        return false, fmt.Errorf("cannot create request: %w", err)
+    }
+    timestamp := time.Now().Unix()
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set(WebhookSignatureHeader, WebhookSignature(webhook.Secret, timestamp, []byte(body)))
+    req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+    req.Header.Set(WebhookDeliveryHeader, delivery.id)
+    req.Header.Set(WebhookEventHeader, delivery.event.GetType().String())
+
+    res, err := dispatcher.client.Do(req)
+    if err != nil {
+        return !errors.Is(err, errWebhookAddressNotAllowed), err
+    }
+    res.Body.Close()
+
+    switch {
+    case res.StatusCode >= 200 && res.StatusCode < 300:
+        return false, nil
+    case res.StatusCode == http.StatusRequestTimeout, res.StatusCode == http.StatusTooManyRequests, res.StatusCode >= 500:
+        return true, fmt.Errorf("unexpected status %s", res.Status)
+    default:
+        return false, fmt.Errorf("unexpected status %s", res.Status)
+    }
+}
+
+// deadLetter 把没有送达的事件保存到死信队列
+func (dispatcher *WebhookDispatcher) deadLetter(ctx context.Context, delivery *webhookDelivery, attempts int, cause error) {
+    webhookDeliveries.WithLabelValues("dead_lettered").Inc()
+    webhookLog.Error(ctx, "webhook delivery failed, moving to dead letter queue", "webhook_id", delivery.webhookID,
+        "delivery_id", delivery.id, "attempts", attempts, "error", cause)
+
+    letter := &DeadLetter{
+        ID:         uuid.New().String(),
+        WebhookID:  delivery.webhookID,
+        DeliveryID: delivery.id,
+        Event:      delivery.event,
+        Attempts:   attempts,
+        LastError:  cause.Error(),
+        FailedAt:   time.Now(),
+    }
+    if err := dispatcher.deadLetterStore.Save(letter); err != nil {
+        webhookLog.Error(ctx, "cannot save dead letter", "delivery_id", delivery.id, "error", err)
+    }
+}
+
+// drain 把队列中还没有发送的事件和还没有保存的发送保存到死信队列
+func (dispatcher *WebhookDispatcher) drain() {
+    for {
+        select {
+        case delivery := <-dispatcher.queue:
+            dispatcher.deadLetter(context.Background(), delivery, 0, errors.New("server is shutting down"))
+        case delivery := <-dispatcher.overflow:
+            dispatcher.deadLetter(context.Background(), delivery, 0, errors.New("delivery queue is full"))
+        default:
+            return
+        }
+    }
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// errWebhookAddressNotAllowed 连接前发现 webhook 的地址是本机或者内网地址，重试也不会成功
+var errWebhookAddressNotAllowed = errors.New("webhook address is not allowed")
+
+// blockedWebhookNetworks webhook 不能访问的地址段：本机、链路本地、内网和其他保留地址
+var blockedWebhookNetworks = func() []*net.IPNet {
+    cidrs := []string{
+        "0.0.0.0/8",
+        "10.0.0.0/8",
+        "100.64.0.0/10",
+        "127.0.0.0/8",
+        "169.254.0.0/16",
+        "172.16.0.0/12",
+        "192.0.0.0/24",
+        "192.168.0.0/16",
+        "198.18.0.0/15",
+        "224.0.0.0/4",
+        "240.0.0.0/4",
+        "::/128",
+        "::1/128",
+        "fc00::/7",
+        "fe80::/10",
+        "ff00::/8",
+    }
+    networks := make([]*net.IPNet, len(cidrs))
+    for i, cidr := range cidrs {
+        _, network, err := net.ParseCIDR(cidr)
+        if err != nil {
+            panic(err)
+        }
+        networks[i] = network
+    }
+    return networks
+}()
+
+// isPublicIP 判断 webhook 是否可以访问这个地址，IPv4 映射的 IPv6 地址按 IPv4 地址判断
+func isPublicIP(ip net.IP) bool {
+    if ip4 := ip.To4(); ip4 != nil {
+        ip = ip4
+    }
+    for _, network := range blockedWebhookNetworks {
+        if network.Contains(ip) {
+            return false
+        }
+    }
+    return true
+}
+
+// isBlockedWebhookHost 判断 webhook 地址的主机名是否明显指向本机或者内网，域名在连接时再检查解析后的地址
+func isBlockedWebhookHost(host string) bool {
+    host = strings.TrimSuffix(strings.ToLower(host), ".")
+    if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+        return true
+    }
+    if ip := net.ParseIP(host); ip != nil {
+        return !isPublicIP(ip)
+    }
+    return false
+}
+
+// newWebhookClient 新建发送 webhook 的 HTTP 客户端，不跟随重定向
+// allowPrivate 为 false 时在连接前检查解析后的地址，拒绝连接本机和内网，避免通过 DNS 解析绕过创建时的检查
+func newWebhookClient(timeout time.Duration, allowPrivate bool) *http.Client {
+    dialer := &net.Dialer{Timeout: timeout}
+    if !allowPrivate {
+        dialer.Control = func(network, address string, c syscall.RawConn) error {
+            host, _, err := net.SplitHostPort(address)
+            if err != nil {
+                return err
+            }
+            if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+                return fmt.Errorf("%w: %s", errWebhookAddressNotAllowed, host)
+            }
+            return nil
+        }
+    }
+
+    // 经过代理时连接的是代理的地址，无法检查目标地址，所以不使用环境变量中的代理
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.Proxy = nil
+    transport.DialContext = dialer.DialContext
+
+    return &http.Client{
+        Timeout:   timeout,
+        Transport: transport,
+        // 重定向可能指向内网地址，3xx 响应按发送失败处理
+        CheckRedirect: func(req *http.Request, via []*http.Request) error {
+            return http.ErrUseLastResponse
+        },
+    }
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+    "context"
+    "errors"
+
+    "github.com/xiusl/pcbook/pb"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+    // defaultDeadLetterLimit 请求没有指定数量时最多返回的死信数
+    defaultDeadLetterLimit = 100
+    // maxDeadLetterLimit 单次查询最多返回的死信数
+    maxDeadLetterLimit = 1000
+)
+
+// WebhookServer 管理 webhook 和死信队列的服务
+type WebhookServer struct {
+    webhookStore    WebhookStore
+    deadLetterStore DeadLetterStore
+    dispatcher      *WebhookDispatcher
+}
+
+// NewWebhookServer 创建一个 webhook 服务
+func NewWebhookServer(webhookStore WebhookStore, deadLetterStore DeadLetterStore, dispatcher *WebhookDispatcher) *WebhookServer {
+    return &WebhookServer{
+        webhookStore:    webhookStore,
+        deadLetterStore: deadLetterStore,
+        dispatcher:      dispatcher,
+    }
+}
+
+// CreateWebhook 注册一个 webhook，签名密钥只在响应中返回一次
+func (server *WebhookServer) CreateWebhook(ctx context.Context, req *pb.CreateWebhookRequest) (*pb.CreateWebhookResponse, error) {
+    var createdBy string
+    if principal, ok := PrincipalFromContext(ctx); ok {
+        createdBy = principal.Username
+    }
+
+    webhook, err := NewWebhook(req.GetUrl(), req.GetEventTypes(), createdBy)
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot generate webhook: %v", err)
+    }
+    if err := server.webhookStore.Save(webhook); err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot save webhook: %v", err)
+    }
+    webhookLog.Info(ctx, "webhook created", "webhook_id", webhook.ID, "url", webhook.URL, "event_types", webhook.EventTypes)
+
+    res := &pb.CreateWebhookResponse{
+        Webhook: webhookToProto(webhook),
+        Secret:  webhook.Secret,
+    }
+    return res, nil
+}
+
+// ListWebhooks 列出所有的 webhook，不包含签名密钥
+func (server *WebhookServer) ListWebhooks(ctx context.Context, req *pb.ListWebhooksRequest) (*pb.ListWebhooksResponse, error) {
+    webhooks, err := server.webhookStore.List()
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot list webhooks: %v", err)
+    }
+
+    res := &pb.ListWebhooksResponse{}
+    for _, webhook := range webhooks {
+        res.Webhooks = append(res.Webhooks, webhookToProto(webhook))
+    }
+    return res, nil
+}
+
+// DeleteWebhook 删除 webhook，正在重试的事件不再发送，死信保留到被清理
+func (server *WebhookServer) DeleteWebhook(ctx context.Context, req *pb.DeleteWebhookRequest) (*pb.DeleteWebhookResponse, error) {
+    err := server.webhookStore.Delete(req.GetId())
+    if err != nil {
+        code := codes.Internal
+        if errors.Is(err, ErrNotFound) {
+            code = codes.NotFound
+        }
+        return nil, status.Errorf(code, "cannot delete webhook: %v", err)
+    }
+    webhookLog.Info(ctx, "webhook deleted", "webhook_id", req.GetId())
+
+    return &pb.DeleteWebhookResponse{}, nil
+}
+
+// ListDeadLetters 按失败时间列出死信
+func (server *WebhookServer) ListDeadLetters(ctx context.Context, req *pb.ListDeadLettersRequest) (*pb.ListDeadLettersResponse, error) {
+    limit := int(req.GetLimit())
+    if limit == 0 {
+        limit = defaultDeadLetterLimit
+    }
+    if limit > maxDeadLetterLimit {
+        limit = maxDeadLetterLimit
+    }
+
+    letters, err := server.deadLetterStore.List(req.GetWebhookId(), limit)
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot list dead letters: %v", err)
+    }
+
+    res := &pb.ListDeadLettersResponse{}
+    for _, letter := range letters {
+        res.DeadLetters = append(res.DeadLetters, deadLetterToProto(letter))
+    }
+    return res, nil
+}
+
+// ReplayDeadLetters 把死信重新加入发送队列
+func (server *WebhookServer) ReplayDeadLetters(ctx context.Context, req *pb.ReplayDeadLettersRequest) (*pb.ReplayDeadLettersResponse, error) {
+    replayed, skipped, err := server.dispatcher.Replay(ctx, req.GetIds(), req.GetWebhookId())
+    if err != nil {
+        code := codes.Internal
+        if errors.Is(err, ErrNotFound) {
+            code = codes.NotFound
+        }
+        return nil, status.Errorf(code, "cannot replay dead letters: %v", err)
+    }
+
+    res := &pb.ReplayDeadLettersResponse{
+        Replayed: uint32(replayed),
+        Skipped:  uint32(skipped),
+    }
+    return res, nil
+}
+
+func webhookToProto(webhook *Webhook) *pb.Webhook {
+    return &pb.Webhook{
+        Id:         webhook.ID,
+        Url:        webhook.URL,
+        EventTypes: webhook.EventTypes,
+        CreatedBy:  webhook.CreatedBy,
+        CreatedAt:  timestamppb.New(webhook.CreatedAt),
+    }
+}
+
+func deadLetterToProto(letter *DeadLetter) *pb.DeadLetter {
+    return &pb.DeadLetter{
+        Id:         letter.ID,
+        WebhookId:  letter.WebhookID,
+        DeliveryId: letter.DeliveryID,
+        Event:      letter.Event,
+        Attempts:   uint32(letter.Attempts),
+        LastError:  letter.LastError,
+        FailedAt:   timestamppb.New(letter.FailedAt),
+    }
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+    "context"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/xiusl/pcbook/pb"
+    "google.golang.org/protobuf/proto"
+)
+
+// WebhookStore 存储 webhook 的接口
+type WebhookStore interface {
+    Save(webhook *Webhook) error
+    Find(id string) (*Webhook, error)
+    // List 按创建时间返回所有的 webhook
+    List() ([]*Webhook, error)
+    Delete(id string) error
+}
+
+// DeadLetter 重试多次仍然没有送达的事件
+type DeadLetter struct {
+    ID         string
+    WebhookID  string
+    DeliveryID string
+    Event      *pb.LaptopEvent
+    Attempts   int
+    LastError  string
+    FailedAt   time.Time
+}
+
+// DeadLetterStore 存储死信的接口
+type DeadLetterStore interface {
+    Save(letter *DeadLetter) error
+    Find(id string) (*DeadLetter, error)
+    // List 按失败时间返回 webhookID 的死信，webhookID 为空时返回所有的死信，limit 为 0 时不限制数量
+    List(webhookID string, limit int) ([]*DeadLetter, error)
+    Remove(id string) error
+}
+
+// InMemoryWebhookStore 在内存中存储 webhook
+type InMemoryWebhookStore struct {
+    mutex    sync.RWMutex
+    webhooks map[string]*Webhook
+}
+
+// NewInMemoryWebhookStore 新建一个 webhook 内存存储实例
+func NewInMemoryWebhookStore() *InMemoryWebhookStore {
+    return &InMemoryWebhookStore{
+        webhooks: make(map[string]*Webhook),
+    }
+}
+
+// Save 存储 webhook 到内存中
+func (store *InMemoryWebhookStore) Save(webhook *Webhook) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    if store.webhooks[webhook.ID] != nil {
+        return ErrAlreadyExists
+    }
+    store.webhooks[webhook.ID] = webhook.Clone()
+    return nil
+}
+
+// Find 根据 id 查询 webhook
+func (store *InMemoryWebhookStore) Find(id string) (*Webhook, error) {
+    store.mutex.RLock()
+    defer store.mutex.RUnlock()
+
+    webhook := store.webhooks[id]
+    if webhook != nil {
+        return webhook.Clone(), nil
+    }
+    return nil, nil
+}
+
+// List 按创建时间返回所有的 webhook
+func (store *InMemoryWebhookStore) List() ([]*Webhook, error) {
+    store.mutex.RLock()
+    defer store.mutex.RUnlock()
+
+    webhooks := make([]*Webhook, 0, len(store.webhooks))
+    for _, webhook := range store.webhooks {
+        webhooks = append(webhooks, webhook.Clone())
+    }
+    sort.Slice(webhooks, func(i, j int) bool {
+        return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt)
+    })
+    return webhooks, nil
+}
+
+// Delete 删除 webhook
+func (store *InMemoryWebhookStore) Delete(id string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    if store.webhooks[id] == nil {
+        return ErrNotFound
+    }
+    delete(store.webhooks, id)
+    return nil
+}
+
+// InMemoryDeadLetterStore 在内存中按失败时间保存死信，超过上限时丢弃最早的死信
+type InMemoryDeadLetterStore struct {
+    mutex   sync.RWMutex
+    letters []*DeadLetter
+    max     int
+}
+
+// NewInMemoryDeadLetterStore 新建一个最多保存 max 条死信的内存存储实例
+func NewInMemoryDeadLetterStore(max int) *InMemoryDeadLetterStore {
+    return &InMemoryDeadLetterStore{max: max}
+}
+
+// Save 保存一条死信
+func (store *InMemoryDeadLetterStore) Save(letter *DeadLetter) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    for _, existing := range store.letters {
+        if existing.ID == letter.ID {
+            return ErrAlreadyExists
+        }
+    }
+    if store.max > 0 && len(store.letters) >= store.max {
+        webhookLog.Warn(context.Background(), "dead letter queue is full, dropping the oldest letter", "letter_id", store.letters[0].ID)
+        store.letters = store.letters[1:]
+    }
+    store.letters = append(store.letters, letter.Clone())
+    return nil
+}
+
+// Find 根据 id 查询死信
+func (store *InMemoryDeadLetterStore) Find(id string) (*DeadLetter, error) {
+    store.mutex.RLock()
+    defer store.mutex.RUnlock()
+
+    for _, letter := range store.letters {
+        if letter.ID == id {
+            return letter.Clone(), nil
+        }
+    }
+    return nil, nil
+}
+
+// List 按失败时间返回 webhookID 的死信
+func (store *InMemoryDeadLetterStore) List(webhookID string, limit int) ([]*DeadLetter, error) {
+    store.mutex.RLock()
+    defer store.mutex.RUnlock()
+
+    var letters []*DeadLetter
+    for _, letter := range store.letters {
+        if limit > 0 && len(letters) >= limit {
+            break
+        }
+        if webhookID == "" || letter.WebhookID == webhookID {
+            letters = append(letters, letter.Clone())
+        }
+    }
+    return letters, nil
+}
+
+// Remove 删除一条死信
+func (store *InMemoryDeadLetterStore) Remove(id string) error {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    for i, letter := range store.letters {
+        if letter.ID == id {
+            store.letters = append(store.letters[:i], store.letters[i+1:]...)
+            return nil
+        }
+    }
+    return ErrNotFound
+}
+
+// count 返回保存的死信数量
+func (store *InMemoryDeadLetterStore) count() int {
+    store.mutex.RLock()
+    defer store.mutex.RUnlock()
+    return len(store.letters)
+}
+
+// Clone 返回一个克隆的 DeadLetter
+func (letter *DeadLetter) Clone() *DeadLetter {
+    other := *letter
+    other.Event = proto.Clone(letter.Event).(*pb.LaptopEvent)
+    return &other
+}
@@ -0,0 +1,490 @@
+package service_test
+
+import (
+    "context"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+    "github.com/xiusl/pcbook/pb"
+    "github.com/xiusl/pcbook/sample"
+    "github.com/xiusl/pcbook/serializer"
+    "github.com/xiusl/pcbook/service"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+)
+
+// testWebhookConfig 测试使用的 webhook 配置，重试间隔很短
+func testWebhookConfig() service.WebhookConfig {
+    config := service.DefaultWebhookConfig()
+    config.Workers = 2
+    config.MaxAttempts = 3
+    config.InitialBackoff = 10 * time.Millisecond
+    config.MaxBackoff = 20 * time.Millisecond
+    config.AllowPrivateAddresses = true
+    return config
+}
+
+// webhookReceiver 验证签名并记录成功接收的事件，status 为 0 时返回 200
+type webhookReceiver struct {
+    *httptest.Server
+    secret   string
+    status   int32
+    received chan *pb.WebhookPayload
+
+    mutex    sync.Mutex
+    attempts map[string]int
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+    receiver := &webhookReceiver{
+        received: make(chan *pb.WebhookPayload, 10),
+        attempts: make(map[string]int),
+    }
+    receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, err := ioutil.ReadAll(r.Body)
+        require.NoError(t, err)
+        timestamp, err := strconv.ParseInt(r.Header.Get(service.WebhookTimestampHeader), 10, 64)
+        require.NoError(t, err)
+        require.Equal(t, service.WebhookSignature(receiver.secret, timestamp, body), r.Header.Get(service.WebhookSignatureHeader))
+
+        payload := &pb.WebhookPayload{}
+        require.NoError(t, serializer.ConvertJSONToProtobuf(string(body), payload))
+        require.Equal(t, payload.GetDeliveryId(), r.Header.Get(service.WebhookDeliveryHeader))
+        require.Equal(t, payload.GetEvent().GetType().String(), r.Header.Get(service.WebhookEventHeader))
+
+        receiver.mutex.Lock()
+        receiver.attempts[payload.GetDeliveryId()]++
+        receiver.mutex.Unlock()
+
+        if code := atomic.LoadInt32(&receiver.status); code != 0 {
+            w.WriteHeader(int(code))
+            return
+        }
+        receiver.received <- payload
+    }))
+    return receiver
+}
+
+func (receiver *webhookReceiver) attemptsOf(deliveryID string) int {
+    receiver.mutex.Lock()
+    defer receiver.mutex.Unlock()
+    return receiver.attempts[deliveryID]
+}
+
+// nextPayload 等待下一个成功接收的事件，超时返回 nil
+func (receiver *webhookReceiver) nextPayload() *pb.WebhookPayload {
+    select {
+    case payload := <-receiver.received:
+        return payload
+    case <-time.After(time.Second):
+        return nil
+    }
+}
+
+func TestWebhookSignature(t *testing.T) {
+    signature := service.WebhookSignature("secret", 1700000000, []byte(`{"deliveryId":"1"}`))
+    require.Equal(t, "sha256=", signature[:7])
+    require.Len(t, signature, 7+64)
+    require.Equal(t, signature, service.WebhookSignature("secret", 1700000000, []byte(`{"deliveryId":"1"}`)))
+
+    require.NotEqual(t, signature, service.WebhookSignature("other", 1700000000, []byte(`{"deliveryId":"1"}`)))
+    require.NotEqual(t, signature, service.WebhookSignature("secret", 1700000001, []byte(`{"deliveryId":"1"}`)))
+    require.NotEqual(t, signature, service.WebhookSignature("secret", 1700000000, []byte(`{"deliveryId":"2"}`)))
+}
+
+func TestWebhookDispatcherRun(t *testing.T) {
+    receiver := newWebhookReceiver(t)
+    defer receiver.Close()
+
+    webhookStore := service.NewInMemoryWebhookStore()
+    laptopStore := service.NewInMemoryLaptopStore()
+    dispatcher := service.NewWebhookDispatcher(webhookStore, service.NewInMemoryDeadLetterStore(10), laptopStore, testWebhookConfig())
+
+    webhook, err := service.NewWebhook(receiver.URL, []pb.LaptopEvent_Type{pb.LaptopEvent_CREATED}, "admin")
+    require.NoError(t, err)
+    require.NoError(t, webhookStore.Save(webhook))
+    receiver.secret = webhook.Secret
+
+    // 第一次发送失败，重试后成功
+    atomic.StoreInt32(&receiver.status, http.StatusServiceUnavailable)
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan error)
+    go func() {
+        done <- dispatcher.Run(ctx)
+    }()
+
+    // 发送器只处理开始之后的事件，持续保存直到有事件发送
+    laptop := sample.NewLaptop()
+    require.NoError(t, laptopStore.Save(laptop))
+    require.Eventually(t, func() bool {
+        receiver.mutex.Lock()
+        defer receiver.mutex.Unlock()
+        if len(receiver.attempts) > 0 {
+            return true
+        }
+        laptop = sample.NewLaptop()
+        require.NoError(t, laptopStore.Save(laptop))
+        return false
+    }, time.Second, 10*time.Millisecond)
+    atomic.StoreInt32(&receiver.status, 0)
+
+    payload := receiver.nextPayload()
+    require.NotNil(t, payload)
+    require.Equal(t, webhook.ID, payload.GetWebhookId())
+    require.Equal(t, pb.LaptopEvent_CREATED, payload.GetEvent().GetType())
+    require.Equal(t, 2, receiver.attemptsOf(payload.GetDeliveryId()))
+
+    // 不接收的事件类型不会发送
+    require.NoError(t, laptopStore.Publish(laptop.Id, pb.LaptopEvent_RATED, &pb.LaptopEvent{}))
+    other := sample.NewLaptop()
+    require.NoError(t, laptopStore.Save(other))
+    for payload.GetEvent().GetLaptop().GetId() != other.Id {
+        payload = receiver.nextPayload()
+        require.NotNil(t, payload)
+        require.Equal(t, pb.LaptopEvent_CREATED, payload.GetEvent().GetType())
+    }
+
+    cancel()
+    require.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestWebhookDeadLetters(t *testing.T) {
+    receiver := newWebhookReceiver(t)
+    defer receiver.Close()
+
+    webhookStore := service.NewInMemoryWebhookStore()
+    deadLetterStore := service.NewInMemoryDeadLetterStore(10)
+    dispatcher := service.NewWebhookDispatcher(webhookStore, deadLetterStore, service.NewInMemoryLaptopStore(), testWebhookConfig())
+
+    webhook, err := service.NewWebhook(receiver.URL, nil, "admin")
+    require.NoError(t, err)
+    require.NoError(t, webhookStore.Save(webhook))
+    receiver.secret = webhook.Secret
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go dispatcher.Run(ctx)
+
+    waitDeadLetters := func(count int) []*service.DeadLetter {
+        var letters []*service.DeadLetter
+        require.Eventually(t, func() bool {
+            letters, err = deadLetterStore.List(webhook.ID, 0)
+            require.NoError(t, err)
+            return len(letters) == count
+        }, time.Second, 10*time.Millisecond)
+        return letters
+    }
+
+    // 5xx 重试到最大次数后进入死信队列
+    atomic.StoreInt32(&receiver.status, http.StatusInternalServerError)
+    dispatcher.Dispatch(ctx, &pb.LaptopEvent{Revision: 1, Type: pb.LaptopEvent_CREATED, Laptop: sample.NewLaptop()})
+    letters := waitDeadLetters(1)
+    require.Equal(t, 3, letters[0].Attempts)
+    require.Equal(t, 3, receiver.attemptsOf(letters[0].DeliveryID))
+    require.Contains(t, letters[0].LastError, "500")
+
+    // 其他 4xx 不重试
+    atomic.StoreInt32(&receiver.status, http.StatusBadRequest)
+    dispatcher.Dispatch(ctx, &pb.LaptopEvent{Revision: 2, Type: pb.LaptopEvent_UPDATED, Laptop: sample.NewLaptop()})
+    letters = waitDeadLetters(2)
+    require.Equal(t, 1, letters[1].Attempts)
+    require.Equal(t, uint64(2), letters[1].Event.GetRevision())
+
+    _, _, err = dispatcher.Replay(ctx, []string{"unknown"}, "")
+    require.ErrorIs(t, err, service.ErrNotFound)
+
+    // 接收方恢复后重放，重放使用原来的发送 ID
+    atomic.StoreInt32(&receiver.status, 0)
+    replayed, skipped, err := dispatcher.Replay(ctx, nil, webhook.ID)
+    require.NoError(t, err)
+    require.Equal(t, 2, replayed)
+    require.Equal(t, 0, skipped)
+
+    delivered := make(map[string]bool)
+    for i := 0; i < 2; i++ {
+        payload := receiver.nextPayload()
+        require.NotNil(t, payload)
+        delivered[payload.GetDeliveryId()] = true
+    }
+    require.True(t, delivered[letters[0].DeliveryID])
+    require.True(t, delivered[letters[1].DeliveryID])
+    waitDeadLetters(0)
+
+    // webhook 删除后死信不会重放
+    atomic.StoreInt32(&receiver.status, http.StatusBadRequest)
+    dispatcher.Dispatch(ctx, &pb.LaptopEvent{Revision: 3, Type: pb.LaptopEvent_CREATED, Laptop: sample.NewLaptop()})
+    letters = waitDeadLetters(1)
+    require.NoError(t, webhookStore.Delete(webhook.ID))
+    replayed, skipped, err = dispatcher.Replay(ctx, []string{letters[0].ID}, "")
+    require.NoError(t, err)
+    require.Equal(t, 0, replayed)
+    require.Equal(t, 1, skipped)
+    waitDeadLetters(1)
+}
+
+func TestWebhookRetryDoesNotBlockWorkers(t *testing.T) {
+    failing := newWebhookReceiver(t)
+    defer failing.Close()
+    atomic.StoreInt32(&failing.status, http.StatusServiceUnavailable)
+    healthy := newWebhookReceiver(t)
+    defer healthy.Close()
+
+    // 只有一个发送的 goroutine，重试间隔远大于测试时间
+    config := testWebhookConfig()
+    config.Workers = 1
+    config.InitialBackoff = time.Hour
+    config.MaxBackoff = time.Hour
+    webhookStore := service.NewInMemoryWebhookStore()
+    deadLetterStore := service.NewInMemoryDeadLetterStore(10)
+    dispatcher := service.NewWebhookDispatcher(webhookStore, deadLetterStore, service.NewInMemoryLaptopStore(), config)
+
+    failingWebhook, err := service.NewWebhook(failing.URL, nil, "admin")
+    require.NoError(t, err)
+    require.NoError(t, webhookStore.Save(failingWebhook))
+    failing.secret = failingWebhook.Secret
+    time.Sleep(time.Millisecond)
+    healthyWebhook, err := service.NewWebhook(healthy.URL, nil, "admin")
+    require.NoError(t, err)
+    require.NoError(t, webhookStore.Save(healthyWebhook))
+    healthy.secret = healthyWebhook.Secret
+
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan error)
+    go func() {
+        done <- dispatcher.Run(ctx)
+    }()
+
+    // 等待重试的发送不占用发送的 goroutine，其他 webhook 照常送达
+    for revision := uint64(1); revision <= 3; revision++ {
+        dispatcher.Dispatch(ctx, &pb.LaptopEvent{Revision: revision, Type: pb.LaptopEvent_CREATED, Laptop: sample.NewLaptop()})
+        payload := healthy.nextPayload()
+        require.NotNil(t, payload)
+        require.Equal(t, revision, payload.GetEvent().GetRevision())
+    }
+
+    // 结束时等待重试的发送保存到死信队列
+    cancel()
+    <-done
+    letters, err := deadLetterStore.List(failingWebhook.ID, 0)
+    require.NoError(t, err)
+    require.Len(t, letters, 3)
+    for _, letter := range letters {
+        require.Equal(t, 1, letter.Attempts)
+        require.Equal(t, 1, failing.attemptsOf(letter.DeliveryID))
+        require.Contains(t, letter.LastError, "shutting down")
+    }
+}
+
+func TestFileDeadLetterStore(t *testing.T) {
+    filename := filepath.Join(t.TempDir(), "dead_letters.jsonl")
+    store, err := service.NewFileDeadLetterStore(filename, 2)
+    require.NoError(t, err)
+
+    var letters []*service.DeadLetter
+    for i := 1; i <= 3; i++ {
+        letter := &service.DeadLetter{
+            ID:         strconv.Itoa(i),
+            WebhookID:  "webhook",
+            DeliveryID: "delivery-" + strconv.Itoa(i),
+            Event:      &pb.LaptopEvent{Revision: uint64(i), Type: pb.LaptopEvent_CREATED, Laptop: sample.NewLaptop()},
+            Attempts:   i,
+            LastError:  "unexpected status 500",
+            FailedAt:   time.Now().UTC().Round(0),
+        }
+        require.NoError(t, store.Save(letter))
+        letters = append(letters, letter)
+    }
+    require.ErrorIs(t, store.Save(letters[2]), service.ErrAlreadyExists)
+    require.ErrorIs(t, store.Remove("unknown"), service.ErrNotFound)
+    require.NoError(t, store.Remove("2"))
+    require.NoError(t, store.Close())
+
+    // 重新打开后恢复超过上限后保留的、没有删除的死信
+    store, err = service.NewFileDeadLetterStore(filename, 2)
+    require.NoError(t, err)
+    loaded, err := store.List("", 0)
+    require.NoError(t, err)
+    require.Len(t, loaded, 1)
+    require.Equal(t, letters[2].ID, loaded[0].ID)
+    require.Equal(t, letters[2].DeliveryID, loaded[0].DeliveryID)
+    require.Equal(t, letters[2].Attempts, loaded[0].Attempts)
+    require.Equal(t, letters[2].LastError, loaded[0].LastError)
+    require.True(t, letters[2].FailedAt.Equal(loaded[0].FailedAt))
+    require.True(t, proto.Equal(letters[2].Event, loaded[0].Event))
+
+    // 删除的记录过多时压缩文件，文件中只剩下现有的死信
+    for i := 0; i < 600; i++ {
+        letter := letters[0].Clone()
+        letter.ID = "compact-" + strconv.Itoa(i)
+        require.NoError(t, store.Save(letter))
+        require.NoError(t, store.Remove(letter.ID))
+    }
+    content, err := ioutil.ReadFile(filename)
+    require.NoError(t, err)
+    require.Less(t, strings.Count(string(content), "\n"), 1000)
+    require.NoError(t, store.Close())
+
+    store, err = service.NewFileDeadLetterStore(filename, 2)
+    require.NoError(t, err)
+    loaded, err = store.List("", 0)
+    require.NoError(t, err)
+    require.Len(t, loaded, 1)
+    require.Equal(t, letters[2].ID, loaded[0].ID)
+    require.NoError(t, store.Close())
+
+    // 文件损坏时不能打开
+    require.NoError(t, ioutil.WriteFile(filename, []byte("{"), 0600))
+    _, err = service.NewFileDeadLetterStore(filename, 2)
+    require.Error(t, err)
+}
+
+// blockingDeadLetterStore 在 release 关闭之前阻塞保存死信
+type blockingDeadLetterStore struct {
+    service.DeadLetterStore
+    release chan struct{}
+}
+
+func (store *blockingDeadLetterStore) Save(letter *service.DeadLetter) error {
+    <-store.release
+    return store.DeadLetterStore.Save(letter)
+}
+
+func TestWebhookDispatchQueueFull(t *testing.T) {
+    release := make(chan struct{})
+    receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        <-release
+    }))
+    defer receiver.Close()
+    defer close(release)
+
+    config := testWebhookConfig()
+    config.Workers = 1
+    config.QueueSize = 1
+    webhookStore := service.NewInMemoryWebhookStore()
+    deadLetterStore := &blockingDeadLetterStore{service.NewInMemoryDeadLetterStore(10), release}
+    dispatcher := service.NewWebhookDispatcher(webhookStore, deadLetterStore, service.NewInMemoryLaptopStore(), config)
+
+    webhook, err := service.NewWebhook(receiver.URL, nil, "admin")
+    require.NoError(t, err)
+    require.NoError(t, webhookStore.Save(webhook))
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go dispatcher.Run(ctx)
+
+    // 接收方和死信存储都没有响应时，分发事件也不会阻塞
+    dispatched := make(chan struct{})
+    go func() {
+        defer close(dispatched)
+        for revision := uint64(1); revision <= 10; revision++ {
+            dispatcher.Dispatch(ctx, &pb.LaptopEvent{Revision: revision, Type: pb.LaptopEvent_CREATED, Laptop: sample.NewLaptop()})
+        }
+    }()
+    select {
+    case <-dispatched:
+    case <-time.After(time.Second):
+        require.FailNow(t, "dispatch is blocked")
+    }
+}
+
+func TestWebhookAddressGuard(t *testing.T) {
+    receiver := newWebhookReceiver(t)
+    defer receiver.Close()
+    redirect := httptest.NewServer(http.RedirectHandler(receiver.URL, http.StatusTemporaryRedirect))
+    defer redirect.Close()
+
+    testCases := []struct {
+        name         string
+        url          string
+        allowPrivate bool
+        lastError    string
+    }{
+        {"private address", receiver.URL, false, "is not allowed"},
+        {"redirect", redirect.URL, true, "307"},
+    }
+
+    for _, tc := range testCases {
+        tc := tc
+        t.Run(tc.name, func(t *testing.T) {
+            config := testWebhookConfig()
+            config.AllowPrivateAddresses = tc.allowPrivate
+            webhookStore := service.NewInMemoryWebhookStore()
+            deadLetterStore := service.NewInMemoryDeadLetterStore(10)
+            dispatcher := service.NewWebhookDispatcher(webhookStore, deadLetterStore, service.NewInMemoryLaptopStore(), config)
+
+            webhook, err := service.NewWebhook(tc.url, nil, "admin")
+            require.NoError(t, err)
+            require.NoError(t, webhookStore.Save(webhook))
+
+            ctx, cancel := context.WithCancel(context.Background())
+            defer cancel()
+            go dispatcher.Run(ctx)
+
+            // 连接内网地址和跟随重定向都按不能重试的发送失败处理，接收方收不到请求
+            dispatcher.Dispatch(ctx, &pb.LaptopEvent{Revision: 1, Type: pb.LaptopEvent_CREATED, Laptop: sample.NewLaptop()})
+            var letters []*service.DeadLetter
+            require.Eventually(t, func() bool {
+                letters, err = deadLetterStore.List(webhook.ID, 0)
+                require.NoError(t, err)
+                return len(letters) == 1
+            }, time.Second, 10*time.Millisecond)
+            require.Contains(t, letters[0].LastError, tc.lastError)
+            require.Equal(t, 1, letters[0].Attempts)
+            require.Zero(t, receiver.attemptsOf(letters[0].DeliveryID))
+        })
+    }
+}
+
+func TestWebhookServer(t *testing.T) {
+    webhookStore := service.NewInMemoryWebhookStore()
+    deadLetterStore := service.NewInMemoryDeadLetterStore(10)
+    dispatcher := service.NewWebhookDispatcher(webhookStore, deadLetterStore, service.NewInMemoryLaptopStore(), testWebhookConfig())
+    server := service.NewWebhookServer(webhookStore, deadLetterStore, dispatcher)
+    ctx := service.ContextWithPrincipal(context.Background(), &service.Principal{Username: "admin", Roles: []string{"admin"}})
+
+    created, err := server.CreateWebhook(ctx, &pb.CreateWebhookRequest{
+        Url:        "https://partner.example.com/hooks",
+        EventTypes: []pb.LaptopEvent_Type{pb.LaptopEvent_RATED},
+    })
+    require.NoError(t, err)
+    require.Len(t, created.GetSecret(), 64)
+    require.Equal(t, "admin", created.GetWebhook().GetCreatedBy())
+
+    list, err := server.ListWebhooks(ctx, &pb.ListWebhooksRequest{})
+    require.NoError(t, err)
+    require.Len(t, list.GetWebhooks(), 1)
+    require.Equal(t, []pb.LaptopEvent_Type{pb.LaptopEvent_RATED}, list.GetWebhooks()[0].GetEventTypes())
+
+    require.NoError(t, deadLetterStore.Save(&service.DeadLetter{
+        ID:        "letter-1",
+        WebhookID: created.GetWebhook().GetId(),
+        Event:     &pb.LaptopEvent{Type: pb.LaptopEvent_RATED},
+        Attempts:  5,
+        FailedAt:  time.Now(),
+    }))
+    letters, err := server.ListDeadLetters(ctx, &pb.ListDeadLettersRequest{WebhookId: created.GetWebhook().GetId()})
+    require.NoError(t, err)
+    require.Len(t, letters.GetDeadLetters(), 1)
+    require.Equal(t, uint32(5), letters.GetDeadLetters()[0].GetAttempts())
+
+    _, err = server.ReplayDeadLetters(ctx, &pb.ReplayDeadLettersRequest{Ids: []string{"unknown"}})
+    require.Equal(t, codes.NotFound, status.Code(err))
+    replay, err := server.ReplayDeadLetters(ctx, &pb.ReplayDeadLettersRequest{Ids: []string{"letter-1"}})
+    require.NoError(t, err)
+    require.Equal(t, uint32(1), replay.GetReplayed())
+
+    _, err = server.DeleteWebhook(ctx, &pb.DeleteWebhookRequest{Id: created.GetWebhook().GetId()})
+    require.NoError(t, err)
+    _, err = server.DeleteWebhook(ctx, &pb.DeleteWebhookRequest{Id: created.GetWebhook().GetId()})
+    require.Equal(t, codes.NotFound, status.Code(err))
+}